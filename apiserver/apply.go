@@ -0,0 +1,56 @@
+package apiserver
+
+import (
+	"fmt"
+	"net/http"
+
+	"github.com/laincloud/deployd/engine"
+	"github.com/mijia/sweb/form"
+	"github.com/mijia/sweb/server"
+	"golang.org/x/net/context"
+)
+
+type RestfulApply struct {
+	server.BaseResource
+}
+
+// Put reconciles the pod group to the PodGroupSpec in the body, the pod group is created if not exists,
+// returns the diff and the plan, nothing is changed with dry_run.
+func (ra RestfulApply) Put(ctx context.Context, r *http.Request) (int, interface{}) {
+	var pgSpec engine.PodGroupSpec
+	if err := form.ParamBodyJson(r, &pgSpec); err != nil {
+		return http.StatusBadRequest, fmt.Sprintf("Invalid PodGroupSpec params format: %s", err)
+	}
+	if ok := pgSpec.VerifyParams(); !ok {
+		return http.StatusBadRequest, fmt.Sprintf("Missing paremeters for PodGroupSpec")
+	}
+	dryRun := form.ParamBoolean(r, "dry_run", false)
+
+	pgSpec.Pod.UpdatedBy = requester(r)
+	plan, err := getEngine(ctx).ApplyPodGroup(pgSpec, dryRun)
+	if err != nil {
+		if _, ok := err.(engine.OperLockedError); ok {
+			return http.StatusLocked, err.Error()
+		}
+		switch err {
+		case engine.ErrNotEnoughResources, engine.ErrDependencyPodNotExists, engine.ErrPodGroupCleaning,
+			engine.ErrCanaryInProgress, engine.ErrBlueGreenInProgress, engine.ErrJobNotUpdatable,
+			engine.ErrDaemonNotScalable:
+			return http.StatusMethodNotAllowed, err.Error()
+		default:
+			return http.StatusInternalServerError, err.Error()
+		}
+	}
+	if plan.OperationId == "" {
+		return http.StatusOK, plan
+	}
+
+	urlReverser := getUrlReverser(ctx)
+	return http.StatusAccepted, map[string]interface{}{
+		"message":       "PodGroupSpec will be applied by the plan.",
+		"check_url":     urlReverser.Reverse("Get_RestfulPodGroups") + "?name=" + pgSpec.Name,
+		"operation_id":  plan.OperationId,
+		"operation_url": urlReverser.Reverse("Get_RestfulOperations") + "?id=" + plan.OperationId,
+		"plan":          plan,
+	}
+}
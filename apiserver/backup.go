@@ -0,0 +1,40 @@
+package apiserver
+
+import (
+	"fmt"
+	"net/http"
+
+	"github.com/laincloud/deployd/engine"
+	"github.com/mijia/sweb/form"
+	"github.com/mijia/sweb/log"
+	"github.com/mijia/sweb/server"
+	"golang.org/x/net/context"
+)
+
+type RestfulBackup struct {
+	server.BaseResource
+}
+
+func (rb RestfulBackup) Get(ctx context.Context, r *http.Request) (int, interface{}) {
+	orcEngine := getEngine(ctx)
+	archive, err := orcEngine.Backup()
+	if err != nil {
+		return http.StatusInternalServerError, fmt.Sprintf("Failed to backup the deployd data: %s", err)
+	}
+	return http.StatusOK, archive
+}
+
+func (rb RestfulBackup) Post(ctx context.Context, r *http.Request) (int, interface{}) {
+	var archive engine.BackupArchive
+	if err := form.ParamBodyJson(r, &archive); err != nil {
+		log.Warnf("Failed to decode backup archive, %s", err)
+		return http.StatusBadRequest, fmt.Sprintf("Invalid backup archive format: %s", err)
+	}
+	dryRun := form.ParamBoolean(r, "dry_run", false)
+	orcEngine := getEngine(ctx)
+	result, err := orcEngine.Restore(&archive, dryRun)
+	if err != nil {
+		return http.StatusBadRequest, fmt.Sprintf("Failed to restore the backup: %s", err)
+	}
+	return http.StatusOK, result
+}
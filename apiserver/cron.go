@@ -0,0 +1,117 @@
+package apiserver
+
+import (
+	"fmt"
+	"net/http"
+
+	"github.com/laincloud/deployd/engine"
+	"github.com/mijia/sweb/form"
+	"github.com/mijia/sweb/log"
+	"github.com/mijia/sweb/server"
+	"golang.org/x/net/context"
+)
+
+type RestfulCrons struct {
+	server.BaseResource
+}
+
+// Post adds the CronSpec in the body, the job pod groups are launched at the ticks of its schedule
+func (rc RestfulCrons) Post(ctx context.Context, r *http.Request) (int, interface{}) {
+	var spec engine.CronSpec
+	if err := form.ParamBodyJson(r, &spec); err != nil {
+		log.Warnf("Failed to decode CronSpec, %s", err)
+		return http.StatusBadRequest, fmt.Sprintf("Invalid CronSpec params format: %s", err)
+	}
+	if ok := spec.VerifyParams(); !ok {
+		return http.StatusBadRequest, fmt.Sprintf("Missing or invalid paremeters for CronSpec, " +
+			"the Schedule should be a cron expression and the ConcurrencyPolicy should be one of allow, forbid and replace")
+	}
+
+	spec.Pod.UpdatedBy = requester(r)
+	if err := getEngine(ctx).NewCron(spec); err != nil {
+		if err == engine.ErrCronExists {
+			return http.StatusMethodNotAllowed, err.Error()
+		}
+		return http.StatusInternalServerError, err.Error()
+	}
+
+	urlReverser := getUrlReverser(ctx)
+	return http.StatusAccepted, map[string]string{
+		"message":   "Cron added into the orc engine.",
+		"check_url": urlReverser.Reverse("Get_RestfulCrons") + "?name=" + spec.Name,
+	}
+}
+
+// Get returns the cron with its runs by the name, or all the crons without the name
+func (rc RestfulCrons) Get(ctx context.Context, r *http.Request) (int, interface{}) {
+	orcEngine := getEngine(ctx)
+	name := form.ParamString(r, "name", "")
+	if name == "" {
+		return http.StatusOK, orcEngine.ListCrons()
+	}
+	c, err := orcEngine.InspectCron(name)
+	if err != nil {
+		return http.StatusNotFound, err.Error()
+	}
+	return http.StatusOK, c
+}
+
+// Delete removes the cron with the job pod groups of its runs
+func (rc RestfulCrons) Delete(ctx context.Context, r *http.Request) (int, interface{}) {
+	name := form.ParamString(r, "name", "")
+	if name == "" {
+		return http.StatusBadRequest, fmt.Sprintf("No cron name provided.")
+	}
+	if err := getEngine(ctx).RemoveCron(name); err != nil {
+		if err == engine.ErrCronNotExists {
+			return http.StatusNotFound, err.Error()
+		}
+		return http.StatusInternalServerError, err.Error()
+	}
+	return http.StatusAccepted, map[string]string{
+		"message": "Cron deleted from the orc engine.",
+	}
+}
+
+type RestfulCronRuns struct {
+	server.BaseResource
+}
+
+// Get returns the runs of the cron from the oldest
+func (rcr RestfulCronRuns) Get(ctx context.Context, r *http.Request) (int, interface{}) {
+	name := form.ParamString(r, "name", "")
+	if name == "" {
+		return http.StatusBadRequest, fmt.Sprintf("No cron name provided.")
+	}
+	c, err := getEngine(ctx).InspectCron(name)
+	if err != nil {
+		return http.StatusNotFound, err.Error()
+	}
+	return http.StatusOK, c.Runs
+}
+
+// Post triggers a run of the cron now, whatever the concurrency policy is
+func (rcr RestfulCronRuns) Post(ctx context.Context, r *http.Request) (int, interface{}) {
+	name := form.ParamString(r, "name", "")
+	if name == "" {
+		return http.StatusBadRequest, fmt.Sprintf("No cron name provided.")
+	}
+	run, err := getEngine(ctx).TriggerCron(name)
+	if err != nil {
+		switch err {
+		case engine.ErrCronNotExists:
+			return http.StatusNotFound, err.Error()
+		case engine.ErrNotEnoughResources, engine.ErrPodGroupExists, engine.ErrPodGroupCleaning:
+			return http.StatusMethodNotAllowed, err.Error()
+		default:
+			return http.StatusInternalServerError, err.Error()
+		}
+	}
+
+	urlReverser := getUrlReverser(ctx)
+	return http.StatusAccepted, map[string]interface{}{
+		"message":   "Cron run triggered.",
+		"run":       run,
+		"check_url": urlReverser.Reverse("Get_RestfulJobs") + "?name=" + run.Name,
+	}
+}
@@ -0,0 +1,138 @@
+package apiserver
+
+import (
+	"fmt"
+	"net/http"
+
+	"github.com/laincloud/deployd/engine"
+	"github.com/mijia/sweb/form"
+	"github.com/mijia/sweb/log"
+	"github.com/mijia/sweb/server"
+	"golang.org/x/net/context"
+)
+
+type RestfulDaemons struct {
+	server.BaseResource
+}
+
+// Post submits the daemon PodGroupSpec in the body, an instance is deployed on each node matching the selector
+func (rd RestfulDaemons) Post(ctx context.Context, r *http.Request) (int, interface{}) {
+	var pgSpec engine.PodGroupSpec
+	if err := form.ParamBodyJson(r, &pgSpec); err != nil {
+		log.Warnf("Failed to decode PodGroupSpec, %s", err)
+		return http.StatusBadRequest, fmt.Sprintf("Invalid PodGroupSpec params format: %s", err)
+	}
+	if pgSpec.Daemon == nil {
+		return http.StatusBadRequest, engine.ErrDaemonSpecNotExists.Error()
+	}
+	if ok := pgSpec.VerifyParams(); !ok {
+		return http.StatusBadRequest, fmt.Sprintf("Missing paremeters for PodGroupSpec, " +
+			"the NodeSelector of the DaemonSpec should not have empty keys and the MaxUnavailable should be >= 0")
+	}
+
+	pgSpec.Pod.UpdatedBy = requester(r)
+	operationId, err := getEngine(ctx).NewPodGroup(pgSpec)
+	if err != nil {
+		switch err {
+		case engine.ErrNotEnoughResources, engine.ErrPodGroupExists, engine.ErrPodGroupCleaning:
+			return http.StatusMethodNotAllowed, err.Error()
+		default:
+			return http.StatusInternalServerError, err.Error()
+		}
+	}
+
+	urlReverser := getUrlReverser(ctx)
+	return http.StatusAccepted, map[string]string{
+		"message":       "Daemon added into the orc engine.",
+		"check_url":     urlReverser.Reverse("Get_RestfulDaemons") + "?name=" + pgSpec.Name,
+		"operation_id":  operationId,
+		"operation_url": urlReverser.Reverse("Get_RestfulOperations") + "?id=" + operationId,
+	}
+}
+
+// Get returns the daemon with the status of its instance on each node by the name, or all the daemons without the name
+func (rd RestfulDaemons) Get(ctx context.Context, r *http.Request) (int, interface{}) {
+	orcEngine := getEngine(ctx)
+	name := form.ParamString(r, "name", "")
+	if name == "" {
+		return http.StatusOK, orcEngine.ListDaemons()
+	}
+	daemon, err := orcEngine.InspectDaemon(name)
+	if err != nil {
+		return http.StatusNotFound, err.Error()
+	}
+	return http.StatusOK, daemon
+}
+
+// Patch rolls the PodSpec in the body out node by node, at most MaxUnavailable nodes are updated at the same time
+func (rd RestfulDaemons) Patch(ctx context.Context, r *http.Request) (int, interface{}) {
+	name := form.ParamString(r, "name", "")
+	if name == "" {
+		return http.StatusBadRequest, fmt.Sprintf("No daemon name provided.")
+	}
+	var podSpec engine.PodSpec
+	if err := form.ParamBodyJson(r, &podSpec); err != nil {
+		return http.StatusBadRequest, fmt.Sprintf("Bad parameter format for PodSpec, %s", err)
+	}
+	if !podSpec.VerifyParams() {
+		return http.StatusBadRequest, fmt.Sprintf("Missing parameter for PodSpec")
+	}
+
+	orcEngine := getEngine(ctx)
+	if _, err := orcEngine.InspectDaemon(name); err != nil {
+		return http.StatusNotFound, err.Error()
+	}
+	podSpec.UpdatedBy = requester(r)
+	operationId, err := orcEngine.RescheduleSpec(name, podSpec)
+	if err != nil {
+		if _, ok := err.(engine.OperLockedError); ok {
+			return http.StatusLocked, err.Error()
+		}
+		switch err {
+		case engine.ErrPodGroupNotExists:
+			return http.StatusNotFound, err.Error()
+		case engine.ErrNotEnoughResources, engine.ErrDependencyPodNotExists:
+			return http.StatusMethodNotAllowed, err.Error()
+		default:
+			return http.StatusInternalServerError, err.Error()
+		}
+	}
+
+	urlReverser := getUrlReverser(ctx)
+	return http.StatusAccepted, map[string]string{
+		"message":       "Daemon will be updated node by node.",
+		"check_url":     urlReverser.Reverse("Get_RestfulDaemons") + "?name=" + name,
+		"operation_id":  operationId,
+		"operation_url": urlReverser.Reverse("Get_RestfulOperations") + "?id=" + operationId,
+	}
+}
+
+// Delete removes the daemon with its instances on all the nodes
+func (rd RestfulDaemons) Delete(ctx context.Context, r *http.Request) (int, interface{}) {
+	name := form.ParamString(r, "name", "")
+	if name == "" {
+		return http.StatusBadRequest, fmt.Sprintf("No daemon name provided.")
+	}
+	orcEngine := getEngine(ctx)
+	if _, err := orcEngine.InspectDaemon(name); err != nil {
+		return http.StatusNotFound, err.Error()
+	}
+	operationId, err := orcEngine.RemovePodGroup(name)
+	if err != nil {
+		if err == engine.ErrPodGroupNotExists {
+			return http.StatusNotFound, err.Error()
+		}
+		if _, ok := err.(engine.OperLockedError); ok {
+			return http.StatusLocked, err.Error()
+		}
+		return http.StatusInternalServerError, err.Error()
+	}
+
+	urlReverser := getUrlReverser(ctx)
+	return http.StatusAccepted, map[string]string{
+		"message":       "Daemon will be deleted from the orc engine.",
+		"check_url":     urlReverser.Reverse("Get_RestfulDaemons") + "?name=" + name,
+		"operation_id":  operationId,
+		"operation_url": urlReverser.Reverse("Get_RestfulOperations") + "?id=" + operationId,
+	}
+}
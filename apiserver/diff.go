@@ -0,0 +1,39 @@
+package apiserver
+
+import (
+	"fmt"
+	"net/http"
+
+	"github.com/laincloud/deployd/engine"
+	"github.com/mijia/sweb/form"
+	"github.com/mijia/sweb/server"
+	"golang.org/x/net/context"
+)
+
+type RestfulDiff struct {
+	server.BaseResource
+}
+
+// Post diffs the PodSpec in the body against the current one of the pod group, nothing is changed
+func (rd RestfulDiff) Post(ctx context.Context, r *http.Request) (int, interface{}) {
+	pgName := form.ParamString(r, "name", "")
+	if pgName == "" {
+		return http.StatusBadRequest, fmt.Sprintf("No pod group name provided.")
+	}
+	var podSpec engine.PodSpec
+	if err := form.ParamBodyJson(r, &podSpec); err != nil {
+		return http.StatusBadRequest, fmt.Sprintf("Bad parameter format for PodSpec, %s", err)
+	}
+	if !podSpec.VerifyParams() {
+		return http.StatusBadRequest, fmt.Sprintf("Missing parameter for PodSpec")
+	}
+
+	diff, err := getEngine(ctx).DiffPodGroup(pgName, podSpec)
+	if err != nil {
+		if err == engine.ErrPodGroupNotExists {
+			return http.StatusNotFound, err.Error()
+		}
+		return http.StatusInternalServerError, err.Error()
+	}
+	return http.StatusOK, diff
+}
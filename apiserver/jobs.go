@@ -0,0 +1,94 @@
+package apiserver
+
+import (
+	"fmt"
+	"net/http"
+
+	"github.com/laincloud/deployd/engine"
+	"github.com/mijia/sweb/form"
+	"github.com/mijia/sweb/log"
+	"github.com/mijia/sweb/server"
+	"golang.org/x/net/context"
+)
+
+type RestfulJobs struct {
+	server.BaseResource
+}
+
+// Post submits the job PodGroupSpec in the body, the pods are deployed and run to completion
+func (rj RestfulJobs) Post(ctx context.Context, r *http.Request) (int, interface{}) {
+	var pgSpec engine.PodGroupSpec
+	if err := form.ParamBodyJson(r, &pgSpec); err != nil {
+		log.Warnf("Failed to decode PodGroupSpec, %s", err)
+		return http.StatusBadRequest, fmt.Sprintf("Invalid PodGroupSpec params format: %s", err)
+	}
+	if pgSpec.Job == nil {
+		return http.StatusBadRequest, engine.ErrJobSpecNotExists.Error()
+	}
+	if ok := pgSpec.VerifyParams(); !ok {
+		return http.StatusBadRequest, fmt.Sprintf("Missing paremeters for PodGroupSpec, Completions of the JobSpec should be > 0")
+	}
+
+	pgSpec.Pod.UpdatedBy = requester(r)
+	operationId, err := getEngine(ctx).NewPodGroup(pgSpec)
+	if err != nil {
+		switch err {
+		case engine.ErrNotEnoughResources, engine.ErrPodGroupExists, engine.ErrPodGroupCleaning:
+			return http.StatusMethodNotAllowed, err.Error()
+		default:
+			return http.StatusInternalServerError, err.Error()
+		}
+	}
+
+	urlReverser := getUrlReverser(ctx)
+	return http.StatusAccepted, map[string]string{
+		"message":       "Job added into the orc engine.",
+		"check_url":     urlReverser.Reverse("Get_RestfulJobs") + "?name=" + pgSpec.Name,
+		"operation_id":  operationId,
+		"operation_url": urlReverser.Reverse("Get_RestfulOperations") + "?id=" + operationId,
+	}
+}
+
+// Get returns the job by the name, or all the jobs without the name
+func (rj RestfulJobs) Get(ctx context.Context, r *http.Request) (int, interface{}) {
+	orcEngine := getEngine(ctx)
+	name := form.ParamString(r, "name", "")
+	if name == "" {
+		return http.StatusOK, orcEngine.ListJobs()
+	}
+	job, err := orcEngine.InspectJob(name)
+	if err != nil {
+		return http.StatusNotFound, err.Error()
+	}
+	return http.StatusOK, job
+}
+
+// Delete removes the job with its containers, the running pods are stopped
+func (rj RestfulJobs) Delete(ctx context.Context, r *http.Request) (int, interface{}) {
+	name := form.ParamString(r, "name", "")
+	if name == "" {
+		return http.StatusBadRequest, fmt.Sprintf("No job name provided.")
+	}
+	orcEngine := getEngine(ctx)
+	if _, err := orcEngine.InspectJob(name); err != nil {
+		return http.StatusNotFound, err.Error()
+	}
+	operationId, err := orcEngine.RemovePodGroup(name)
+	if err != nil {
+		if err == engine.ErrPodGroupNotExists {
+			return http.StatusNotFound, err.Error()
+		}
+		if _, ok := err.(engine.OperLockedError); ok {
+			return http.StatusLocked, err.Error()
+		}
+		return http.StatusInternalServerError, err.Error()
+	}
+
+	urlReverser := getUrlReverser(ctx)
+	return http.StatusAccepted, map[string]string{
+		"message":       "Job will be deleted from the orc engine.",
+		"check_url":     urlReverser.Reverse("Get_RestfulJobs") + "?name=" + name,
+		"operation_id":  operationId,
+		"operation_url": urlReverser.Reverse("Get_RestfulOperations") + "?id=" + operationId,
+	}
+}
@@ -0,0 +1,35 @@
+package apiserver
+
+import (
+	"fmt"
+	"net/http"
+
+	"github.com/laincloud/deployd/engine"
+	"github.com/mijia/sweb/form"
+	"github.com/mijia/sweb/server"
+	"golang.org/x/net/context"
+)
+
+type RestfulOperations struct {
+	server.BaseResource
+}
+
+// Get polls the operation by id, or lists the recent operations of the pod group from the latest
+func (ro RestfulOperations) Get(ctx context.Context, r *http.Request) (int, interface{}) {
+	orcEngine := getEngine(ctx)
+	if id := form.ParamString(r, "id", ""); id != "" {
+		operation, err := orcEngine.GetOperation(id)
+		if err != nil {
+			if err == engine.ErrOperationNotExists {
+				return http.StatusNotFound, err.Error()
+			}
+			return http.StatusInternalServerError, err.Error()
+		}
+		return http.StatusOK, operation
+	}
+	pgName := form.ParamString(r, "name", "")
+	if pgName == "" {
+		return http.StatusBadRequest, fmt.Sprintf("No operation id or pod group name provided.")
+	}
+	return http.StatusOK, orcEngine.ListOperations(pgName)
+}
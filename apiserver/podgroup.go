@@ -25,8 +25,10 @@ func (rpg RestfulPodGroups) Post(ctx context.Context, r *http.Request) (int, int
 		return http.StatusBadRequest, fmt.Sprintf("Missing paremeters for PodGroupSpec")
 	}
 
+	pgSpec.Pod.UpdatedBy = requester(r)
 	orcEngine := getEngine(ctx)
-	if err := orcEngine.NewPodGroup(pgSpec); err != nil {
+	operationId, err := orcEngine.NewPodGroup(pgSpec)
+	if err != nil {
 		switch err {
 		case engine.ErrNotEnoughResources, engine.ErrPodGroupExists, engine.ErrDependencyPodNotExists:
 			return http.StatusMethodNotAllowed, err.Error()
@@ -37,8 +39,10 @@ func (rpg RestfulPodGroups) Post(ctx context.Context, r *http.Request) (int, int
 
 	urlReverser := getUrlReverser(ctx)
 	return http.StatusAccepted, map[string]string{
-		"message":   "PodGroupSpec added into the orc engine.",
-		"check_url": urlReverser.Reverse("Get_RestfulPodGroups") + "?name=" + pgSpec.Name,
+		"message":       "PodGroupSpec added into the orc engine.",
+		"check_url":     urlReverser.Reverse("Get_RestfulPodGroups") + "?name=" + pgSpec.Name,
+		"operation_id":  operationId,
+		"operation_url": urlReverser.Reverse("Get_RestfulOperations") + "?id=" + operationId,
 	}
 }
 
@@ -48,7 +52,8 @@ func (rpg RestfulPodGroups) Delete(ctx context.Context, r *http.Request) (int, i
 		return http.StatusBadRequest, fmt.Sprintf("No pod group name provided.")
 	}
 	orcEngine := getEngine(ctx)
-	if err := orcEngine.RemovePodGroup(pgName); err != nil {
+	operationId, err := orcEngine.RemovePodGroup(pgName)
+	if err != nil {
 		if err == engine.ErrPodGroupNotExists {
 			return http.StatusNotFound, err.Error()
 		}
@@ -60,8 +65,10 @@ func (rpg RestfulPodGroups) Delete(ctx context.Context, r *http.Request) (int, i
 
 	urlReverser := getUrlReverser(ctx)
 	return http.StatusAccepted, map[string]string{
-		"message":   "PodGroupSpec will be deleted from the orc engine.",
-		"check_url": urlReverser.Reverse("Get_RestfulPodGroups") + "?name=" + pgName,
+		"message":       "PodGroupSpec will be deleted from the orc engine.",
+		"check_url":     urlReverser.Reverse("Get_RestfulPodGroups") + "?name=" + pgName,
+		"operation_id":  operationId,
+		"operation_url": urlReverser.Reverse("Get_RestfulOperations") + "?id=" + operationId,
 	}
 }
 
@@ -95,9 +102,13 @@ func (rpg RestfulPodGroups) Patch(ctx context.Context, r *http.Request) (int, in
 	}
 
 	orcEngine := getEngine(ctx)
-	options := []string{"replica", "spec", "operation"}
+	options := []string{"replica", "spec", "rollback", "strategy", "failure", "canary", "promote", "abort",
+		"bluegreen", "switch", "discard", "pause", "resume", "cancel", "operation"}
 	cmd := form.ParamStringOptions(r, "cmd", options, "noop")
-	var err error
+	var (
+		operationId string
+		err         error
+	)
 	switch cmd {
 	case "replica":
 		numInstance := form.ParamInt(r, "num_instances", -1)
@@ -115,9 +126,9 @@ func (rpg RestfulPodGroups) Patch(ctx context.Context, r *http.Request) (int, in
 			return http.StatusBadRequest, fmt.Sprintf("Bad parameter for num_instances, should be > 0 but %d", numInstance)
 		}
 		if restartPolicy != -1 {
-			err = orcEngine.RescheduleInstance(pgName, numInstance, engine.RestartPolicy(restartPolicy))
+			operationId, err = orcEngine.RescheduleInstance(pgName, numInstance, engine.RestartPolicy(restartPolicy))
 		} else {
-			err = orcEngine.RescheduleInstance(pgName, numInstance)
+			operationId, err = orcEngine.RescheduleInstance(pgName, numInstance)
 		}
 	case "spec":
 		var podSpec engine.PodSpec
@@ -127,12 +138,79 @@ func (rpg RestfulPodGroups) Patch(ctx context.Context, r *http.Request) (int, in
 		if !podSpec.VerifyParams() {
 			return http.StatusBadRequest, fmt.Sprintf("Missing parameter for PodSpec")
 		}
-		err = orcEngine.RescheduleSpec(pgName, podSpec)
+		podSpec.UpdatedBy = requester(r)
+		operationId, err = orcEngine.RescheduleSpec(pgName, podSpec)
+	case "rollback":
+		revision := form.ParamInt(r, "revision", 0)
+		if revision <= 0 {
+			return http.StatusBadRequest, fmt.Sprintf("Bad parameter for revision, should be > 0 but %d", revision)
+		}
+		operationId, err = orcEngine.RollbackRevision(pgName, revision, requester(r))
+	case "canary":
+		instances := form.ParamInt(r, "instances", 1)
+		if instances <= 0 {
+			return http.StatusBadRequest, fmt.Sprintf("Bad parameter for instances, should be > 0 but %d", instances)
+		}
+		var podSpec engine.PodSpec
+		if bodyErr := form.ParamBodyJson(r, &podSpec); bodyErr != nil {
+			return http.StatusBadRequest, fmt.Sprintf("Bad parameter format for PodSpec, %s", bodyErr)
+		}
+		if !podSpec.VerifyParams() {
+			return http.StatusBadRequest, fmt.Sprintf("Missing parameter for PodSpec")
+		}
+		podSpec.UpdatedBy = requester(r)
+		operationId, err = orcEngine.RescheduleCanary(pgName, podSpec, instances)
+	case "promote":
+		operationId, err = orcEngine.PromoteCanary(pgName)
+	case "abort":
+		operationId, err = orcEngine.AbortCanary(pgName)
+	case "bluegreen":
+		removeDelay := form.ParamInt(r, "remove_delay", engine.DefaultBlueGreenRemoveDelay)
+		if removeDelay < 0 {
+			return http.StatusBadRequest, fmt.Sprintf("Bad parameter for remove_delay, should be >= 0 but %d", removeDelay)
+		}
+		var podSpec engine.PodSpec
+		if bodyErr := form.ParamBodyJson(r, &podSpec); bodyErr != nil {
+			return http.StatusBadRequest, fmt.Sprintf("Bad parameter format for PodSpec, %s", bodyErr)
+		}
+		if !podSpec.VerifyParams() {
+			return http.StatusBadRequest, fmt.Sprintf("Missing parameter for PodSpec")
+		}
+		podSpec.UpdatedBy = requester(r)
+		operationId, err = orcEngine.RescheduleBlueGreen(pgName, podSpec, removeDelay)
+	case "switch":
+		operationId, err = orcEngine.SwitchBlueGreen(pgName)
+	case "discard":
+		operationId, err = orcEngine.DiscardBlueGreen(pgName)
+	case "pause":
+		err = orcEngine.PauseOperation(pgName)
+	case "resume":
+		err = orcEngine.ResumeOperation(pgName)
+	case "cancel":
+		err = orcEngine.CancelOperation(pgName)
+	case "strategy":
+		var strategy engine.UpdateStrategy
+		if bodyErr := form.ParamBodyJson(r, &strategy); bodyErr != nil {
+			return http.StatusBadRequest, fmt.Sprintf("Bad parameter format for UpdateStrategy, %s", bodyErr)
+		}
+		if !strategy.VerifyParams() {
+			return http.StatusBadRequest, fmt.Sprintf("Bad parameter for UpdateStrategy, should not be negative")
+		}
+		err = orcEngine.ChangeUpdateStrategy(pgName, strategy)
+	case "failure":
+		var policy engine.FailurePolicy
+		if bodyErr := form.ParamBodyJson(r, &policy); bodyErr != nil {
+			return http.StatusBadRequest, fmt.Sprintf("Bad parameter format for FailurePolicy, %s", bodyErr)
+		}
+		if !policy.VerifyParams() {
+			return http.StatusBadRequest, fmt.Sprintf("Bad parameter for FailurePolicy, should not be negative and the action should be rollback, pause or continue")
+		}
+		err = orcEngine.ChangeFailurePolicy(pgName, policy)
 	case "operation":
 		instance := form.ParamInt(r, "instance", 0)
 		opTypeOptions := []string{"start", "stop", "restart"}
 		opType := form.ParamStringOptions(r, "optype", opTypeOptions, "noop")
-		err = orcEngine.ChangeState(pgName, opType, instance)
+		operationId, err = orcEngine.ChangeState(pgName, opType, instance)
 	}
 
 	if err != nil {
@@ -140,9 +218,14 @@ func (rpg RestfulPodGroups) Patch(ctx context.Context, r *http.Request) (int, in
 			return http.StatusLocked, err.Error()
 		}
 		switch err {
-		case engine.ErrPodGroupNotExists:
+		case engine.ErrPodGroupNotExists, engine.ErrRevisionNotExists:
 			return http.StatusNotFound, err.Error()
-		case engine.ErrNotEnoughResources, engine.ErrDependencyPodNotExists:
+		case engine.ErrNotEnoughResources, engine.ErrDependencyPodNotExists,
+			engine.ErrCanaryInProgress, engine.ErrCanaryNotExists,
+			engine.ErrBlueGreenInProgress, engine.ErrBlueGreenNotExists,
+			engine.ErrBlueGreenNotReady, engine.ErrBlueGreenStateful,
+			engine.ErrPodGroupNotOperating, engine.ErrPodGroupNotPaused, engine.ErrJobNotUpdatable,
+			engine.ErrDaemonNotScalable:
 			return http.StatusMethodNotAllowed, err.Error()
 		default:
 			return http.StatusInternalServerError, err.Error()
@@ -150,8 +233,13 @@ func (rpg RestfulPodGroups) Patch(ctx context.Context, r *http.Request) (int, in
 	}
 
 	urlReverser := getUrlReverser(ctx)
-	return http.StatusAccepted, map[string]string{
+	result := map[string]string{
 		"message":   "PodGroupSpec will be patched and rescheduled.",
 		"check_url": urlReverser.Reverse("Get_RestfulPodGroups") + "?name=" + pgName,
 	}
+	if operationId != "" {
+		result["operation_id"] = operationId
+		result["operation_url"] = urlReverser.Reverse("Get_RestfulOperations") + "?id=" + operationId
+	}
+	return http.StatusAccepted, result
 }
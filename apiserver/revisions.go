@@ -0,0 +1,36 @@
+package apiserver
+
+import (
+	"fmt"
+	"net/http"
+
+	"github.com/laincloud/deployd/engine"
+	"github.com/mijia/sweb/form"
+	"github.com/mijia/sweb/server"
+	"golang.org/x/net/context"
+)
+
+type RestfulRevisions struct {
+	server.BaseResource
+}
+
+// Get lists the spec revisions of the pod group from the oldest to the latest
+func (rr RestfulRevisions) Get(ctx context.Context, r *http.Request) (int, interface{}) {
+	pgName := form.ParamString(r, "name", "")
+	if pgName == "" {
+		return http.StatusBadRequest, fmt.Sprintf("No pod group name provided.")
+	}
+	revisions, err := getEngine(ctx).ListRevisions(pgName)
+	if err != nil {
+		if err == engine.ErrPodGroupNotExists {
+			return http.StatusNotFound, err.Error()
+		}
+		return http.StatusInternalServerError, err.Error()
+	}
+	return http.StatusOK, revisions
+}
+
+// requester tells who sends the request by the requester parameter, the remote address by default
+func requester(r *http.Request) string {
+	return form.ParamString(r, "requester", r.RemoteAddr)
+}
@@ -0,0 +1,73 @@
+package apiserver
+
+import (
+	"fmt"
+	"net/http"
+
+	"github.com/laincloud/deployd/engine"
+	"github.com/mijia/sweb/form"
+	"github.com/mijia/sweb/server"
+	"golang.org/x/net/context"
+)
+
+type RestfulScheduleSimulate struct {
+	server.BaseResource
+}
+
+// Post simulates the scheduling of a new pod group, or the replica and spec patch of a pod group,
+// nothing will be created or changed.
+func (rss RestfulScheduleSimulate) Post(ctx context.Context, r *http.Request) (int, interface{}) {
+	orcEngine := getEngine(ctx)
+	options := []string{"podgroup", "replica", "spec"}
+	cmd := form.ParamStringOptions(r, "cmd", options, "podgroup")
+	var (
+		sim *engine.ScheduleSimulation
+		err error
+	)
+	switch cmd {
+	case "podgroup":
+		var pgSpec engine.PodGroupSpec
+		if bodyErr := form.ParamBodyJson(r, &pgSpec); bodyErr != nil {
+			return http.StatusBadRequest, fmt.Sprintf("Invalid PodGroupSpec params format: %s", bodyErr)
+		}
+		if ok := pgSpec.VerifyParams(); !ok {
+			return http.StatusBadRequest, fmt.Sprintf("Missing paremeters for PodGroupSpec")
+		}
+		sim, err = orcEngine.SimulateNewPodGroup(pgSpec)
+	case "replica":
+		pgName := form.ParamString(r, "name", "")
+		if pgName == "" {
+			return http.StatusBadRequest, fmt.Sprintf("No pod group name provided.")
+		}
+		numInstance := form.ParamInt(r, "num_instances", -1)
+		if numInstance < 0 {
+			return http.StatusBadRequest, fmt.Sprintf("Bad parameter for num_instances, should be > 0 but %d", numInstance)
+		}
+		sim, err = orcEngine.SimulateRescheduleInstance(pgName, numInstance)
+	case "spec":
+		pgName := form.ParamString(r, "name", "")
+		if pgName == "" {
+			return http.StatusBadRequest, fmt.Sprintf("No pod group name provided.")
+		}
+		var podSpec engine.PodSpec
+		if bodyErr := form.ParamBodyJson(r, &podSpec); bodyErr != nil {
+			return http.StatusBadRequest, fmt.Sprintf("Bad parameter format for PodSpec, %s", bodyErr)
+		}
+		if !podSpec.VerifyParams() {
+			return http.StatusBadRequest, fmt.Sprintf("Missing parameter for PodSpec")
+		}
+		sim, err = orcEngine.SimulateRescheduleSpec(pgName, podSpec)
+	}
+
+	if err != nil {
+		switch err {
+		case engine.ErrPodGroupNotExists:
+			return http.StatusNotFound, err.Error()
+		case engine.ErrPodGroupExists:
+			return http.StatusMethodNotAllowed, err.Error()
+		default:
+			return http.StatusInternalServerError, err.Error()
+		}
+	}
+	return http.StatusOK, sim
+}
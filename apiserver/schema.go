@@ -0,0 +1,22 @@
+package apiserver
+
+import (
+	"fmt"
+	"net/http"
+
+	"github.com/mijia/sweb/server"
+	"golang.org/x/net/context"
+)
+
+type RestfulSchema struct {
+	server.BaseResource
+}
+
+func (rs RestfulSchema) Get(ctx context.Context, r *http.Request) (int, interface{}) {
+	orcEngine := getEngine(ctx)
+	report, err := orcEngine.SchemaReport()
+	if err != nil {
+		return http.StatusInternalServerError, fmt.Sprintf("Failed to report the record schemas: %s", err)
+	}
+	return http.StatusOK, report
+}
@@ -4,12 +4,17 @@ import (
 	"encoding/json"
 	"fmt"
 	"net/http"
+	"strings"
 	"time"
 
+	"github.com/laincloud/deployd/cluster"
+	"github.com/laincloud/deployd/cluster/docker"
 	"github.com/laincloud/deployd/cluster/swarm"
 	"github.com/laincloud/deployd/engine"
 	"github.com/laincloud/deployd/network"
+	"github.com/laincloud/deployd/storage"
 	setcd "github.com/laincloud/deployd/storage/etcd"
+	"github.com/laincloud/deployd/storage/etcdv3"
 	"github.com/mijia/sweb/log"
 	"github.com/mijia/sweb/server"
 	"golang.org/x/net/context"
@@ -23,16 +28,18 @@ type UrlReverser interface {
 type Server struct {
 	*server.Server
 
-	swarmAddress string
-	etcdAddress  string
-	isDebug      bool
-	started      bool
-	engine       *engine.OrcEngine
-	runtime      *server.RuntimeWare
+	swarmAddress  string
+	dockerEngines string
+	etcdAddress   string
+	etcdApi       string
+	isDebug       bool
+	started       bool
+	engine        *engine.OrcEngine
+	runtime       *server.RuntimeWare
 }
 
 func (s *Server) ListenAndServe(addr string) error {
-	orcEngine, err := initOrcEngine(s.swarmAddress, s.etcdAddress, s.isDebug)
+	orcEngine, err := initOrcEngine(s.swarmAddress, s.dockerEngines, s.etcdAddress, s.etcdApi, s.isDebug)
 	if err != nil {
 		return err
 	}
@@ -57,6 +64,14 @@ func (s *Server) ListenAndServe(addr string) error {
 
 	s.RestfulHandlerAdapter(s.adaptResourceHandler)
 	s.AddRestfulResource("/api/podgroups", "RestfulPodGroups", RestfulPodGroups{})
+	s.AddRestfulResource("/api/podgroups/revisions", "RestfulRevisions", RestfulRevisions{})
+	s.AddRestfulResource("/api/podgroups/apply", "RestfulApply", RestfulApply{})
+	s.AddRestfulResource("/api/podgroups/diff", "RestfulDiff", RestfulDiff{})
+	s.AddRestfulResource("/api/jobs", "RestfulJobs", RestfulJobs{})
+	s.AddRestfulResource("/api/crons", "RestfulCrons", RestfulCrons{})
+	s.AddRestfulResource("/api/crons/runs", "RestfulCronRuns", RestfulCronRuns{})
+	s.AddRestfulResource("/api/daemons", "RestfulDaemons", RestfulDaemons{})
+	s.AddRestfulResource("/api/operations", "RestfulOperations", RestfulOperations{})
 	s.AddRestfulResource("/api/depends", "RestfulDependPods", RestfulDependPods{})
 	s.AddRestfulResource("/api/nodes", "RestfulNodes", RestfulNodes{})
 	s.AddRestfulResource("/api/engine/config", "EngineConfig", EngineConfigApi{})
@@ -67,6 +82,9 @@ func (s *Server) ListenAndServe(addr string) error {
 	s.AddRestfulResource("/api/ports", "RestfulPorts", RestfulPorts{})
 	s.AddRestfulResource("/api/guard", "RestfulGuard", RestfulGuard{})
 	s.AddRestfulResource("/api/cntstatushistory", "RestfulCntStatusHstry", RestfulCntStatusHstry{})
+	s.AddRestfulResource("/api/backup", "RestfulBackup", RestfulBackup{})
+	s.AddRestfulResource("/api/schema", "RestfulSchema", RestfulSchema{})
+	s.AddRestfulResource("/api/schedule/simulate", "RestfulScheduleSimulate", RestfulScheduleSimulate{})
 
 	s.Get("/debug/vars", "RuntimeStat", s.getRuntimeStat)
 	s.NotFound(func(ctx context.Context, w http.ResponseWriter, r *http.Request) context.Context {
@@ -165,7 +183,7 @@ func (s *Server) Shutdown() {
 		s.Stop(time.Second)
 	}
 	if s.engine != nil {
-		s.engine.Stop()
+		s.engine.Close()
 		s.engine = nil
 	}
 }
@@ -175,32 +193,53 @@ type ApiError struct {
 	Data    interface{} `json:"data"`
 }
 
-func initOrcEngine(swarmAddr string, etcdAddr string, isDebug bool) (*engine.OrcEngine, error) {
-	store, err := setcd.NewStore(etcdAddr, isDebug)
+// NewStore creates the storage on the etcd api version, v2 or v3
+func NewStore(etcdApi, etcdAddr string, isDebug bool) (storage.Store, error) {
+	switch etcdApi {
+	case "v3":
+		return etcdv3.NewStore(etcdAddr, isDebug)
+	case "v2", "":
+		return setcd.NewStore(etcdAddr, isDebug)
+	}
+	return nil, fmt.Errorf("Unknown etcd api version %q", etcdApi)
+}
+
+// NewCluster creates the cluster on the swarm master, or on the docker engines directly if they are given
+func NewCluster(swarmAddr, dockerEngines string) (cluster.Cluster, error) {
+	if dockerEngines != "" {
+		return docker.NewCluster(strings.Split(dockerEngines, ","), 10*time.Second, 20*time.Second)
+	}
+	return swarm.NewCluster(swarmAddr, 10*time.Second, 20*time.Second)
+}
+
+func initOrcEngine(swarmAddr, dockerEngines, etcdAddr, etcdApi string, isDebug bool) (*engine.OrcEngine, error) {
+	store, err := NewStore(etcdApi, etcdAddr, isDebug)
 	if err != nil {
 		return nil, err
 	}
 
-	cluster, err := swarm.NewCluster(swarmAddr, 10*time.Second, 20*time.Second)
+	c, err := NewCluster(swarmAddr, dockerEngines)
 	if err != nil {
 		return nil, err
 	}
 
-	return engine.New(cluster, store)
+	return engine.New(c, store)
 }
 
 func initNetwWorkMgr(endpoint string) {
 	network.InitNetWorkManager("calico", endpoint)
 }
 
-func New(swarmAddr, etcdAddr string, isDebug bool) *Server {
+func New(swarmAddr, dockerEngines, etcdAddr, etcdApi string, isDebug bool) *Server {
 	srv := &Server{
-		swarmAddress: swarmAddr,
-		etcdAddress:  etcdAddr,
-		isDebug:      isDebug,
-		started:      false,
-		engine:       nil,
-		runtime:      nil,
+		swarmAddress:  swarmAddr,
+		dockerEngines: dockerEngines,
+		etcdAddress:   etcdAddr,
+		etcdApi:       etcdApi,
+		isDebug:       isDebug,
+		started:       false,
+		engine:        nil,
+		runtime:       nil,
 	}
 	return srv
 }
@@ -10,6 +10,7 @@ type Node struct {
 	UsedCPUs   int
 	Memory     int64
 	UsedMemory int64
+	Labels     map[string]string
 }
 
 func (n Node) SpareCPUs() int {
@@ -34,6 +35,7 @@ type Cluster interface {
 	RemoveContainer(id string, force bool, volumes bool) error
 	RenameContainer(id string, name string) error
 	UpdateContainer(id string, config interface{}) error 
+	ContainerLogs(id string, tail int) (string, error)
 
 	MonitorEvents(filter string, callback adoc.EventCallback) int64
 	StopMonitor(monitorId int64)
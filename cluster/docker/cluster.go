@@ -0,0 +1,836 @@
+package docker
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"net/url"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/laincloud/deployd/cluster"
+	"github.com/mijia/adoc"
+	"github.com/mijia/sweb/log"
+)
+
+const (
+	// the engine lists its containers by this label, swarm used to set it on every container it created
+	kSwarmIdLabel = "com.docker.swarm.id"
+
+	// the engine recognizes the node events coming from swarm
+	kNodeEventFrom       = "swarm"
+	kNodeEventType       = "engine"
+	kNodeEventConnect    = "engine_connect"
+	kNodeEventDisconnect = "engine_disconnect"
+
+	kRewatchInterval = time.Second
+	kLogsTimeout     = 10 * time.Second
+)
+
+var (
+	ErrNoNodeAvailable = errors.New("No healthy node available in the cluster")
+	ErrNoResources     = errors.New("no resources available to schedule container")
+
+	// HeartbeatInterval is how often the docker engines are checked, a node is disconnected once it fails
+	HeartbeatInterval = 10 * time.Second
+)
+
+type node struct {
+	name    string
+	address string
+	client  *adoc.DockerClient
+
+	// following fields are guarded by the cluster lock
+	connected bool
+	cpus      int
+	memory    int64
+	labels    map[string]string
+}
+
+func (n *node) swarmNode() adoc.SwarmNode {
+	ip := n.address
+	if host, _, err := net.SplitHostPort(n.address); err == nil {
+		ip = host
+	}
+	return adoc.SwarmNode{ID: n.name, IP: ip, Addr: n.address, Name: n.name}
+}
+
+// reservation is the resources reserved by a container, which would never change unless it is updated
+type reservation struct {
+	cpus   int
+	memory int64
+}
+
+func newReservation(hc *adoc.HostConfig) reservation {
+	if hc == nil {
+		return reservation{}
+	}
+	r := reservation{memory: hc.Memory}
+	if hc.CPUPeriod > 0 && hc.CPUQuota > 0 {
+		r.cpus = int((hc.CPUQuota + hc.CPUPeriod - 1) / hc.CPUPeriod)
+	}
+	return r
+}
+
+// DockerCluster talks to a list of docker engines directly instead of the swarm master. It schedules the containers
+// by the swarm filters in the env itself, aggregates the events of all the engines and synthesizes the node
+// connect and disconnect events from the engine heartbeats, so that the engine can work as it is on swarm.
+type DockerCluster struct {
+	sync.RWMutex
+	nodes        []*node
+	locations    map[string]*node // container id -> node
+	reservations map[string]reservation
+	monitorSeq   int64
+	monitors     map[int64]*monitor
+	interval     time.Duration
+
+	// scheduleLock serializes the scheduling with the creation of the containers, so that the containers
+	// created at the same time by the pod groups won't be scheduled onto the same node without its resources
+	scheduleLock sync.Mutex
+	stop         chan struct{}
+	stopOnce     sync.Once
+}
+
+// GetResources reports the connected nodes, the node failed to tell its usage is left out as it cannot be
+// scheduled onto, so that one node won't fail the others.
+func (c *DockerCluster) GetResources() ([]cluster.Node, error) {
+	connected := c.connectedNodes()
+	nodes := make([]cluster.Node, 0, len(connected))
+	for _, n := range connected {
+		count, cpus, memory, err := c.usage(n)
+		if err != nil {
+			log.Warnf("<DockerCluster> Failed to get the resources usage of node %s, %s", n.name, err)
+			continue
+		}
+		c.RLock()
+		nodes = append(nodes, cluster.Node{
+			Name:       n.name,
+			Address:    n.address,
+			Containers: int64(count),
+			CPUs:       n.cpus,
+			UsedCPUs:   cpus,
+			Memory:     n.memory,
+			UsedMemory: memory,
+			Labels:     n.labels,
+		})
+		c.RUnlock()
+	}
+	return nodes, nil
+}
+
+// ListContainers lists the containers on all the nodes with the names prefixed by the node as swarm does,
+// the swarm only `node` filter picks the nodes and the other filters are passed to the engines.
+func (c *DockerCluster) ListContainers(showAll bool, showSize bool, filters ...string) ([]adoc.Container, error) {
+	nodes := c.connectedNodes()
+	filter := ""
+	if len(filters) > 0 && filters[0] != "" {
+		filterMap := make(map[string][]string)
+		if err := json.Unmarshal([]byte(filters[0]), &filterMap); err != nil {
+			return nil, fmt.Errorf("Invalid filter %q, %s", filters[0], err)
+		}
+		if names, ok := filterMap["node"]; ok {
+			nodes = pickNodes(nodes, names)
+			delete(filterMap, "node")
+		}
+		if len(filterMap) > 0 {
+			data, err := json.Marshal(filterMap)
+			if err != nil {
+				return nil, err
+			}
+			filter = string(data)
+		}
+	}
+
+	type result struct {
+		node       *node
+		containers []adoc.Container
+		err        error
+	}
+	results := make(chan result, len(nodes))
+	for _, n := range nodes {
+		go func(n *node) {
+			containers, err := n.client.ListContainers(showAll, showSize, filter)
+			results <- result{n, containers, err}
+		}(n)
+	}
+	all := make([]adoc.Container, 0)
+	var lastErr error
+	for range nodes {
+		r := <-results
+		if r.err != nil {
+			// a partial list would make the engine think the containers are gone
+			log.Warnf("<DockerCluster> Failed to list containers on node %s, %s", r.node.name, r.err)
+			lastErr = fmt.Errorf("Failed to list containers on node %s, %s", r.node.name, r.err)
+			continue
+		}
+		c.Lock()
+		for i, container := range r.containers {
+			c.locations[container.Id] = r.node
+			names := make([]string, len(container.Names))
+			for j, name := range container.Names {
+				names[j] = "/" + r.node.name + "/" + strings.TrimPrefix(name, "/")
+			}
+			r.containers[i].Names = names
+		}
+		c.Unlock()
+		all = append(all, r.containers...)
+	}
+	if lastErr != nil {
+		return nil, lastErr
+	}
+	// the newest one comes first, the same as docker
+	sort.Sort(byCreated(all))
+	return all, nil
+}
+
+func (c *DockerCluster) CreateContainer(cc adoc.ContainerConfig, hc adoc.HostConfig, nc adoc.NetworkingConfig, name ...string) (string, error) {
+	filters, env, err := cluster.ParseFilters(cc.Env)
+	if err != nil {
+		return "", err
+	}
+	cc.Env = env
+	labels := make(map[string]string, len(cc.Labels)+1)
+	for key, value := range cc.Labels {
+		labels[key] = value
+	}
+	labels[kSwarmIdLabel] = newSwarmId()
+	cc.Labels = labels
+
+	c.scheduleLock.Lock()
+	defer c.scheduleLock.Unlock()
+	n, err := c.schedule(filters, newReservation(&hc))
+	if err != nil {
+		return "", err
+	}
+	id, err := n.client.CreateContainer(cc, hc, nc, name...)
+	if err != nil {
+		return "", err
+	}
+	c.Lock()
+	c.locations[id] = n
+	c.reservations[id] = newReservation(&hc)
+	c.Unlock()
+	log.Debugf("<DockerCluster> Container %s created on node %s", id, n.name)
+	return id, nil
+}
+
+func (c *DockerCluster) ConnectContainer(networkName string, id string, ipAddr string) error {
+	n, err := c.locate(id)
+	if err != nil {
+		return err
+	}
+	return n.client.ConnectContainer(networkName, id, ipAddr)
+}
+
+func (c *DockerCluster) DisconnectContainer(networkName string, id string, force bool) error {
+	n, err := c.locate(id)
+	if err != nil {
+		return err
+	}
+	return n.client.DisconnectContainer(networkName, id, force)
+}
+
+func (c *DockerCluster) StartContainer(id string) error {
+	n, err := c.locate(id)
+	if err != nil {
+		return err
+	}
+	return n.client.StartContainer(id)
+}
+
+func (c *DockerCluster) StopContainer(id string, timeout ...int) error {
+	n, err := c.locate(id)
+	if err != nil {
+		return err
+	}
+	return n.client.StopContainer(id, timeout...)
+}
+
+func (c *DockerCluster) RestartContainer(id string, timeout ...int) error {
+	n, err := c.locate(id)
+	if err != nil {
+		return err
+	}
+	return n.client.RestartContainer(id, timeout...)
+}
+
+func (c *DockerCluster) InspectContainer(id string) (adoc.ContainerDetail, error) {
+	n, err := c.locate(id)
+	if err != nil {
+		return adoc.ContainerDetail{}, err
+	}
+	detail, err := n.client.InspectContainer(id)
+	if err != nil {
+		return detail, err
+	}
+	detail.Node = n.swarmNode()
+	return detail, nil
+}
+
+func (c *DockerCluster) RemoveContainer(id string, force bool, volumes bool) error {
+	n, err := c.locate(id)
+	if err != nil {
+		return err
+	}
+	if err := n.client.RemoveContainer(id, force, volumes); err != nil {
+		return err
+	}
+	c.forget(id)
+	return nil
+}
+
+func (c *DockerCluster) RenameContainer(id string, name string) error {
+	n, err := c.locate(id)
+	if err != nil {
+		return err
+	}
+	return n.client.RenameContainer(id, name)
+}
+
+func (c *DockerCluster) UpdateContainer(id string, config interface{}) error {
+	n, err := c.locate(id)
+	if err != nil {
+		return err
+	}
+	if err := n.client.UpdateContainer(id, config); err != nil {
+		return err
+	}
+	c.Lock()
+	delete(c.reservations, id) // reload the resources on next usage
+	c.Unlock()
+	return nil
+}
+
+// ContainerLogs reads the last lines of the logs of the container from the engine it runs on
+func (c *DockerCluster) ContainerLogs(id string, tail int) (string, error) {
+	n, err := c.locate(id)
+	if err != nil {
+		return "", err
+	}
+	return cluster.ReadLogs(n.address, id, tail, kLogsTimeout)
+}
+
+// MonitorEvents watches the events of all the connected engines, and the node events synthesized by the cluster
+func (c *DockerCluster) MonitorEvents(filter string, callback adoc.EventCallback) int64 {
+	c.Lock()
+	c.monitorSeq += 1
+	m := &monitor{
+		id:       c.monitorSeq,
+		filter:   filter,
+		callback: callback,
+		streams:  make(map[*node]*stream),
+	}
+	c.monitors[m.id] = m
+	nodes := make([]*node, 0, len(c.nodes))
+	for _, n := range c.nodes {
+		if n.connected {
+			nodes = append(nodes, n)
+		}
+	}
+	c.Unlock()
+	for _, n := range nodes {
+		c.watch(m, n)
+	}
+	return m.id
+}
+
+func (c *DockerCluster) StopMonitor(monitorId int64) {
+	c.Lock()
+	m, ok := c.monitors[monitorId]
+	delete(c.monitors, monitorId)
+	c.Unlock()
+	if ok {
+		m.stop()
+	}
+}
+
+// watch starts the event stream of the node for the monitor
+func (c *DockerCluster) watch(m *monitor, n *node) {
+	s := &stream{}
+	if !m.add(n, s) {
+		return
+	}
+	id := n.client.MonitorEvents(m.filter, func(event adoc.Event, err error) {
+		if !m.current(n, s) {
+			return
+		}
+		if err != nil {
+			m.detach(n, s)
+			log.Warnf("<DockerCluster> Event stream of node %s broken, %s", n.name, err)
+			go c.rewatch(m, n)
+			return
+		}
+		event.Node = n.swarmNode()
+		m.deliver(event)
+	})
+	m.started(n, s, id)
+}
+
+// rewatch checks the node after its event stream broken, watches it again if the node is still fine
+// or disconnects it which will stop all its streams
+func (c *DockerCluster) rewatch(m *monitor, n *node) {
+	time.Sleep(kRewatchInterval)
+	if !c.probe(n) {
+		return
+	}
+	c.RLock()
+	_, running := c.monitors[m.id]
+	c.RUnlock()
+	if running {
+		c.watch(m, n)
+	}
+}
+
+// heartbeat checks all the engines periodically until the cluster is stopped, the connect and disconnect
+// events are emitted on the changes
+func (c *DockerCluster) heartbeat() {
+	ticker := time.NewTicker(c.interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			for _, n := range c.nodes {
+				go c.probe(n)
+			}
+		case <-c.stop:
+			return
+		}
+	}
+}
+
+// Stop stops the heartbeat of the engines and all the event monitors
+func (c *DockerCluster) Stop() {
+	c.stopOnce.Do(func() {
+		close(c.stop)
+	})
+	c.Lock()
+	monitors := make([]*monitor, 0, len(c.monitors))
+	for id, m := range c.monitors {
+		monitors = append(monitors, m)
+		delete(c.monitors, id)
+	}
+	c.Unlock()
+	for _, m := range monitors {
+		m.stop()
+	}
+}
+
+// probe refreshes the engine info and updates the node state, returns if the node is connected
+func (c *DockerCluster) probe(n *node) bool {
+	info, err := n.client.Info()
+	c.Lock()
+	wasConnected := n.connected
+	n.connected = err == nil
+	if err == nil {
+		n.cpus = info.NCPU
+		n.memory = info.MemTotal
+		n.labels = parseLabels(info.Labels)
+	}
+	monitors := make([]*monitor, 0, len(c.monitors))
+	for _, m := range c.monitors {
+		monitors = append(monitors, m)
+	}
+	c.Unlock()
+
+	switch {
+	case err == nil && !wasConnected:
+		log.Infof("<DockerCluster> Node %s connected", n.name)
+		event := c.nodeEvent(n, kNodeEventConnect)
+		for _, m := range monitors {
+			m.deliver(event)
+			c.watch(m, n)
+		}
+	case err != nil && wasConnected:
+		log.Warnf("<DockerCluster> Node %s disconnected, %s", n.name, err)
+		event := c.nodeEvent(n, kNodeEventDisconnect)
+		for _, m := range monitors {
+			m.detach(n, nil)
+			m.deliver(event)
+		}
+	}
+	return err == nil
+}
+
+func (c *DockerCluster) nodeEvent(n *node, status string) adoc.Event {
+	return adoc.Event{
+		Status: status,
+		ID:     n.name,
+		From:   kNodeEventFrom,
+		Time:   time.Now().Unix(),
+		Type:   kNodeEventType,
+		Action: status,
+		Actor: adoc.EventActor{
+			ID:         n.name,
+			Attributes: map[string]string{"name": n.name, "addr": n.address},
+		},
+		Node: n.swarmNode(),
+	}
+}
+
+// schedule picks the node for the container, hard filters must be satisfied and soft filters are ignored
+// if no node can satisfy them, then the node with the least containers and enough resources wins.
+func (c *DockerCluster) schedule(filters []cluster.FilterExpr, r reservation) (*node, error) {
+	nodes := c.connectedNodes()
+	if len(nodes) == 0 {
+		return nil, ErrNoNodeAvailable
+	}
+	containers := make(map[*node][]adoc.Container, len(nodes))
+	for _, n := range nodes {
+		list, err := n.client.ListContainers(true, false)
+		if err != nil {
+			return nil, fmt.Errorf("Failed to list containers on node %s, %s", n.name, err)
+		}
+		containers[n] = list
+	}
+
+	candidates := nodes
+	for _, filter := range filters {
+		if filter.Soft {
+			continue
+		}
+		candidates = c.filterNodes(candidates, containers, filter)
+		if len(candidates) == 0 {
+			return nil, fmt.Errorf("Unable to find a node that satisfies the following conditions [%s]", filter)
+		}
+	}
+	for _, filter := range filters {
+		if !filter.Soft {
+			continue
+		}
+		if filtered := c.filterNodes(candidates, containers, filter); len(filtered) > 0 {
+			candidates = filtered
+		}
+	}
+
+	var picked *node
+	pickedCount := 0
+	for _, n := range candidates {
+		count, usedCPUs, usedMemory, err := c.usage(n)
+		if err != nil {
+			log.Warnf("<DockerCluster> Failed to get the resources usage of node %s, %s", n.name, err)
+			continue
+		}
+		c.RLock()
+		cpus, memory := n.cpus, n.memory
+		c.RUnlock()
+		if memory > 0 && usedMemory+r.memory > memory {
+			continue
+		}
+		if cpus > 0 && usedCPUs+r.cpus > cpus {
+			continue
+		}
+		if picked == nil || count < pickedCount {
+			picked, pickedCount = n, count
+		}
+	}
+	if picked == nil {
+		return nil, ErrNoResources
+	}
+	return picked, nil
+}
+
+func (c *DockerCluster) filterNodes(nodes []*node, containers map[*node][]adoc.Container, filter cluster.FilterExpr) []*node {
+	filtered := make([]*node, 0, len(nodes))
+	for _, n := range nodes {
+		matched := false
+		if filter.Kind == cluster.FilterConstraint {
+			c.RLock()
+			value, ok := n.labels[filter.Key]
+			c.RUnlock()
+			if filter.Key == "node" {
+				matched = filter.Match(n.name)
+			} else if ok {
+				matched = filter.Match(value)
+			}
+		} else {
+			for _, container := range containers[n] {
+				switch filter.Key {
+				case "container":
+					matched = filter.Match(container.Id)
+					for _, name := range container.Names {
+						matched = matched || filter.Match(strings.TrimPrefix(name, "/"))
+					}
+				case "image":
+					matched = filter.Match(container.Image)
+				default:
+					value, ok := container.Labels[filter.Key]
+					matched = ok && filter.Match(value)
+				}
+				if matched {
+					break
+				}
+			}
+		}
+		if matched == filter.Equal {
+			filtered = append(filtered, n)
+		}
+	}
+	return filtered
+}
+
+// usage sums up the resources reserved by all the containers on the node, the same as swarm does
+func (c *DockerCluster) usage(n *node) (count int, cpus int, memory int64, err error) {
+	containers, err := n.client.ListContainers(true, false)
+	if err != nil {
+		return 0, 0, 0, err
+	}
+	for _, container := range containers {
+		c.RLock()
+		r, ok := c.reservations[container.Id]
+		c.RUnlock()
+		if !ok {
+			detail, err := n.client.InspectContainer(container.Id)
+			if err != nil {
+				if adoc.IsNotFound(err) {
+					continue // removed in the meantime
+				}
+				return 0, 0, 0, err
+			}
+			r = newReservation(detail.HostConfig)
+			c.Lock()
+			c.reservations[container.Id] = r
+			c.locations[container.Id] = n
+			c.Unlock()
+		}
+		count += 1
+		cpus += r.cpus
+		memory += r.memory
+	}
+	return count, cpus, memory, nil
+}
+
+// locate finds the node of the container, asks all the connected nodes if it is not known yet
+func (c *DockerCluster) locate(id string) (*node, error) {
+	c.RLock()
+	n, ok := c.locations[id]
+	c.RUnlock()
+	if ok {
+		return n, nil
+	}
+	nodes := c.connectedNodes()
+	if len(nodes) == 0 {
+		return nil, ErrNoNodeAvailable
+	}
+	var lastErr error
+	for _, n := range nodes {
+		detail, err := n.client.InspectContainer(id)
+		if err != nil {
+			lastErr = err
+			continue
+		}
+		// only the ids are cached, the names could be taken by the containers on other nodes later
+		c.Lock()
+		c.locations[detail.Id] = n
+		c.Unlock()
+		return n, nil
+	}
+	// the not found error from the engines is kept, so that adoc.IsNotFound works as on swarm
+	return nil, lastErr
+}
+
+func (c *DockerCluster) forget(id string) {
+	c.Lock()
+	defer c.Unlock()
+	delete(c.locations, id)
+	delete(c.reservations, id)
+}
+
+func (c *DockerCluster) connectedNodes() []*node {
+	c.RLock()
+	defer c.RUnlock()
+	nodes := make([]*node, 0, len(c.nodes))
+	for _, n := range c.nodes {
+		if n.connected {
+			nodes = append(nodes, n)
+		}
+	}
+	return nodes
+}
+
+type stream struct {
+	id      int64
+	stopped bool
+}
+
+// monitor is one MonitorEvents caller, which has one event stream on every connected node,
+// the callback is called by one event at a time.
+type monitor struct {
+	id       int64
+	filter   string
+	callback adoc.EventCallback
+
+	deliverLock sync.Mutex
+
+	sync.Mutex
+	stopped bool
+	streams map[*node]*stream
+}
+
+func (m *monitor) add(n *node, s *stream) bool {
+	m.Lock()
+	defer m.Unlock()
+	if m.stopped {
+		return false
+	}
+	if _, ok := m.streams[n]; ok {
+		return false // already watching
+	}
+	m.streams[n] = s
+	return true
+}
+
+// started records the id of the stream, the stream may have been detached before its id is known
+func (m *monitor) started(n *node, s *stream, id int64) {
+	m.Lock()
+	s.id = id
+	stopped := s.stopped
+	m.Unlock()
+	if stopped {
+		n.client.StopMonitor(id)
+	}
+}
+
+func (m *monitor) current(n *node, s *stream) bool {
+	m.Lock()
+	defer m.Unlock()
+	return !m.stopped && m.streams[n] == s
+}
+
+// detach removes the stream of the node, s is nil for any stream, and stops it if it is running
+func (m *monitor) detach(n *node, s *stream) {
+	m.Lock()
+	current, ok := m.streams[n]
+	if !ok || (s != nil && current != s) {
+		m.Unlock()
+		return
+	}
+	delete(m.streams, n)
+	current.stopped = true
+	id := current.id
+	m.Unlock()
+	if id > 0 {
+		n.client.StopMonitor(id)
+	}
+}
+
+func (m *monitor) deliver(event adoc.Event) {
+	m.deliverLock.Lock()
+	defer m.deliverLock.Unlock()
+	m.Lock()
+	stopped := m.stopped
+	m.Unlock()
+	if !stopped {
+		m.callback(event, nil)
+	}
+}
+
+func (m *monitor) stop() {
+	m.Lock()
+	m.stopped = true
+	nodes := make([]*node, 0, len(m.streams))
+	for n := range m.streams {
+		nodes = append(nodes, n)
+	}
+	m.Unlock()
+	for _, n := range nodes {
+		m.detach(n, nil)
+	}
+}
+
+type byCreated []adoc.Container
+
+func (cs byCreated) Len() int           { return len(cs) }
+func (cs byCreated) Swap(i, j int)      { cs[i], cs[j] = cs[j], cs[i] }
+func (cs byCreated) Less(i, j int) bool { return cs[i].Created > cs[j].Created }
+
+func pickNodes(nodes []*node, names []string) []*node {
+	picked := make([]*node, 0, len(nodes))
+	for _, n := range nodes {
+		for _, name := range names {
+			if n.name == name {
+				picked = append(picked, n)
+				break
+			}
+		}
+	}
+	return picked
+}
+
+func parseLabels(labels []string) map[string]string {
+	labelMap := make(map[string]string, len(labels))
+	for _, label := range labels {
+		parts := strings.SplitN(label, "=", 2)
+		if len(parts) == 2 {
+			labelMap[parts[0]] = parts[1]
+		}
+	}
+	return labelMap
+}
+
+func newSwarmId() string {
+	b := make([]byte, 32)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+// NewCluster creates the cluster on the docker engines, the engine address can be given with the node name like
+// `node1=tcp://192.168.77.21:2375`, otherwise the name reported by the engine is used. The engines unreachable
+// now will be connected later by the heartbeat, but their names have to be given.
+func NewCluster(engines []string, timeout, rwTimeout time.Duration) (cluster.Cluster, error) {
+	if len(engines) == 0 {
+		return nil, fmt.Errorf("No docker engine is given")
+	}
+	c := &DockerCluster{
+		nodes:        make([]*node, 0, len(engines)),
+		locations:    make(map[string]*node),
+		reservations: make(map[string]reservation),
+		monitors:     make(map[int64]*monitor),
+		interval:     HeartbeatInterval,
+		stop:         make(chan struct{}),
+	}
+	names := make(map[string]struct{}, len(engines))
+	for _, engine := range engines {
+		name, addr := "", engine
+		if parts := strings.SplitN(engine, "=", 2); len(parts) == 2 {
+			name, addr = parts[0], parts[1]
+		}
+		client, err := adoc.NewDockerClientTimeout(addr, nil, timeout, rwTimeout)
+		if err != nil {
+			return nil, fmt.Errorf("Cannot connect docker engine[%s], %s", addr, err)
+		}
+		n := &node{name: name, address: hostAddress(addr), client: client}
+		if info, err := client.Info(); err != nil {
+			if name == "" {
+				return nil, fmt.Errorf("Cannot get the name of docker engine[%s], %s", addr, err)
+			}
+			log.Warnf("<DockerCluster> Docker engine %s[%s] is not connected, %s", name, addr, err)
+		} else {
+			if n.name == "" {
+				n.name = info.Name
+			}
+			n.connected = true
+			n.cpus = info.NCPU
+			n.memory = info.MemTotal
+			n.labels = parseLabels(info.Labels)
+		}
+		if _, ok := names[n.name]; ok {
+			return nil, fmt.Errorf("Duplicated docker engine name %s", n.name)
+		}
+		names[n.name] = struct{}{}
+		c.nodes = append(c.nodes, n)
+	}
+	go c.heartbeat()
+	return c, nil
+}
+
+func hostAddress(addr string) string {
+	if u, err := url.Parse(addr); err == nil && u.Host != "" {
+		return u.Host
+	}
+	return addr
+}
@@ -0,0 +1,537 @@
+package docker
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/mijia/adoc"
+)
+
+var apiVersionPattern = regexp.MustCompile("^/v[0-9.]+")
+
+type fakeContainer struct {
+	id         string
+	name       string
+	created    int64
+	config     adoc.ContainerConfig
+	hostConfig adoc.HostConfig
+	running    bool
+	logs       []string
+}
+
+// fakeEngine is a docker engine serving the remote api in memory, only the apis used by the cluster are supported
+type fakeEngine struct {
+	sync.Mutex
+	name       string
+	labels     []string
+	seq        int
+	containers map[string]*fakeContainer
+	watchers   map[chan adoc.Event]struct{}
+	down       bool
+	server     *httptest.Server
+}
+
+func newFakeEngine(name string, labels ...string) *fakeEngine {
+	e := &fakeEngine{
+		name:       name,
+		labels:     labels,
+		containers: make(map[string]*fakeContainer),
+		watchers:   make(map[chan adoc.Event]struct{}),
+	}
+	e.server = httptest.NewServer(http.HandlerFunc(e.serve))
+	return e
+}
+
+// setDown makes the engine unreachable, all the requests fail and the event streams are closed
+func (e *fakeEngine) setDown(down bool) {
+	e.Lock()
+	defer e.Unlock()
+	e.down = down
+	if down {
+		for ch := range e.watchers {
+			close(ch)
+			delete(e.watchers, ch)
+		}
+	}
+}
+
+func (e *fakeEngine) emit(ct *fakeContainer, action string) {
+	event := adoc.Event{
+		Status: action,
+		ID:     ct.id,
+		From:   ct.config.Image,
+		Time:   time.Now().Unix(),
+		Type:   adoc.ContainerEventType,
+		Action: action,
+		Actor:  adoc.EventActor{ID: ct.id, Attributes: map[string]string{"name": ct.name}},
+	}
+	for ch := range e.watchers {
+		ch <- event
+	}
+}
+
+func (e *fakeEngine) find(idOrName string) *fakeContainer {
+	for _, ct := range e.containers {
+		if ct.id == idOrName || ct.name == idOrName {
+			return ct
+		}
+	}
+	return nil
+}
+
+func (e *fakeEngine) serve(w http.ResponseWriter, r *http.Request) {
+	path := apiVersionPattern.ReplaceAllString(r.URL.Path, "")
+	e.Lock()
+	if e.down {
+		e.Unlock()
+		http.Error(w, "engine is down", http.StatusInternalServerError)
+		return
+	}
+	if path == "/events" {
+		ch := make(chan adoc.Event, 100)
+		e.watchers[ch] = struct{}{}
+		e.Unlock()
+		e.streamEvents(w, r, ch)
+		return
+	}
+	defer e.Unlock()
+
+	parts := strings.Split(strings.Trim(path, "/"), "/")
+	switch {
+	case path == "/info":
+		writeJson(w, adoc.DockerInfo{ID: e.name, Name: e.name, NCPU: 4, MemTotal: 1024 * 1024 * 1024, Labels: e.labels})
+	case path == "/containers/json":
+		e.listContainers(w, r)
+	case path == "/containers/create":
+		var body struct {
+			adoc.ContainerConfig
+			HostConfig adoc.HostConfig
+		}
+		json.NewDecoder(r.Body).Decode(&body)
+		name := r.URL.Query().Get("name")
+		if name != "" && e.find(name) != nil {
+			http.Error(w, "Conflict. The name is already in use", http.StatusConflict)
+			return
+		}
+		e.seq += 1
+		ct := &fakeContainer{
+			id:         fmt.Sprintf("%s%059d", e.name, e.seq),
+			name:       name,
+			created:    time.Now().UnixNano(),
+			config:     body.ContainerConfig,
+			hostConfig: body.HostConfig,
+		}
+		e.containers[ct.id] = ct
+		e.emit(ct, "create")
+		writeJson(w, map[string]string{"Id": ct.id})
+	case len(parts) >= 2 && parts[0] == "containers":
+		ct := e.find(parts[1])
+		if ct == nil {
+			http.Error(w, "No such container", http.StatusNotFound)
+			return
+		}
+		action := ""
+		if len(parts) > 2 {
+			action = parts[2]
+		}
+		switch {
+		case r.Method == "DELETE":
+			delete(e.containers, ct.id)
+			e.emit(ct, "destroy")
+		case action == "json":
+			writeJson(w, adoc.ContainerDetail{
+				Id:         ct.id,
+				Name:       "/" + ct.name,
+				Image:      ct.config.Image,
+				State:      adoc.ContainerState{Running: ct.running},
+				Config:     &ct.config,
+				HostConfig: &ct.hostConfig,
+			})
+		case action == "logs":
+			lines := ct.logs
+			if tail, err := strconv.Atoi(r.URL.Query().Get("tail")); err == nil && tail < len(lines) {
+				lines = lines[len(lines)-tail:]
+			}
+			// the logs of the container without tty are multiplexed with the headers of the stream frames
+			for _, line := range lines {
+				header := make([]byte, 8)
+				header[0] = 1
+				binary.BigEndian.PutUint32(header[4:], uint32(len(line)+1))
+				w.Write(append(header, line+"\n"...))
+			}
+		case action == "start":
+			ct.running = true
+			e.emit(ct, "start")
+		case action == "stop":
+			ct.running = false
+			e.emit(ct, "die")
+			e.emit(ct, "stop")
+		default:
+			http.Error(w, "not supported", http.StatusNotFound)
+		}
+	default:
+		http.Error(w, "not supported", http.StatusNotFound)
+	}
+}
+
+func (e *fakeEngine) listContainers(w http.ResponseWriter, r *http.Request) {
+	filters := make(map[string][]string)
+	if filter := r.URL.Query().Get("filters"); filter != "" {
+		json.Unmarshal([]byte(filter), &filters)
+	}
+	containers := make([]adoc.Container, 0, len(e.containers))
+	for _, ct := range e.containers {
+		if r.URL.Query().Get("all") == "" && !ct.running {
+			continue
+		}
+		matched := true
+		for _, label := range filters["label"] {
+			kv := strings.SplitN(label, "=", 2)
+			value, ok := ct.config.Labels[kv[0]]
+			matched = matched && ok && (len(kv) == 1 || value == kv[1])
+		}
+		if matched {
+			containers = append(containers, adoc.Container{
+				Id:      ct.id,
+				Names:   []string{"/" + ct.name},
+				Image:   ct.config.Image,
+				Created: ct.created,
+				Labels:  ct.config.Labels,
+			})
+		}
+	}
+	writeJson(w, containers)
+}
+
+func (e *fakeEngine) streamEvents(w http.ResponseWriter, r *http.Request, ch chan adoc.Event) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	w.(http.Flusher).Flush()
+	encoder := json.NewEncoder(w)
+	for {
+		select {
+		case event, ok := <-ch:
+			if !ok {
+				return
+			}
+			encoder.Encode(event)
+			w.(http.Flusher).Flush()
+		case <-r.Context().Done():
+			e.Lock()
+			if _, ok := e.watchers[ch]; ok {
+				delete(e.watchers, ch)
+			}
+			e.Unlock()
+			return
+		}
+	}
+}
+
+func writeJson(w http.ResponseWriter, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(v)
+}
+
+func newTestCluster(t *testing.T) (*DockerCluster, []*fakeEngine) {
+	HeartbeatInterval = 100 * time.Millisecond
+	engines := []*fakeEngine{
+		newFakeEngine("node1", "zone=a"),
+		newFakeEngine("node2", "zone=b"),
+	}
+	addrs := make([]string, len(engines))
+	for i, e := range engines {
+		addrs[i] = e.server.URL
+	}
+	c, err := NewCluster(addrs, time.Second, 5*time.Second)
+	if err != nil {
+		t.Fatalf("Should be able to create the cluster, %s", err)
+	}
+	return c.(*DockerCluster), engines
+}
+
+func closeEngines(engines []*fakeEngine) {
+	for _, e := range engines {
+		e.setDown(true)
+		e.server.Close()
+	}
+}
+
+func createTestContainer(c *DockerCluster, name string, memory int64, env ...string) (string, error) {
+	cc := adoc.ContainerConfig{
+		Image:  "busybox",
+		Env:    env,
+		Labels: map[string]string{"cc.bdp.lain.deployd.pg_name": name},
+	}
+	hc := adoc.HostConfig{}
+	hc.Memory = memory
+	return c.CreateContainer(cc, hc, adoc.NetworkingConfig{}, name)
+}
+
+func TestGetResources(t *testing.T) {
+	c, engines := newTestCluster(t)
+	defer closeEngines(engines)
+
+	if _, err := createTestContainer(c, "hello.proc.web.web.v0-i1-d0", 256*1024*1024, "constraint:node==node1"); err != nil {
+		t.Fatalf("Should be able to create the container, %s", err)
+	}
+	nodes, err := c.GetResources()
+	if err != nil || len(nodes) != 2 {
+		t.Fatalf("Should get the 2 nodes, %v, %v", nodes, err)
+	}
+	for _, n := range nodes {
+		if n.CPUs != 4 || n.Memory != 1024*1024*1024 {
+			t.Errorf("Should get the capacity of the node from the engine, %+v", n)
+		}
+		if n.Name == "node1" && (n.Containers != 1 || n.UsedMemory != 256*1024*1024) {
+			t.Errorf("Should account the container reservations on node1, %+v", n)
+		}
+		if n.Name == "node2" && n.Containers != 0 {
+			t.Errorf("Should have nothing on node2, %+v", n)
+		}
+	}
+
+	// the node failed to tell its usage is left out before it is found disconnected
+	engines[1].setDown(true)
+	if nodes, err := c.GetResources(); err != nil || len(nodes) != 1 || nodes[0].Name != "node1" {
+		t.Errorf("Should get the resources of the other nodes, %v, %v", nodes, err)
+	}
+}
+
+func TestScheduleFilters(t *testing.T) {
+	c, engines := newTestCluster(t)
+	defer closeEngines(engines)
+
+	id, err := createTestContainer(c, "hello.proc.web.web.v0-i1-d0", 0, "constraint:node==node2", "HELLO=world")
+	if err != nil {
+		t.Fatalf("Should be able to create the container, %s", err)
+	}
+	info, err := c.InspectContainer(id)
+	if err != nil || info.Node.Name != "node2" {
+		t.Fatalf("Container should be scheduled to node2, %+v, %v", info.Node, err)
+	}
+	if len(info.Config.Env) != 1 || info.Config.Env[0] != "HELLO=world" {
+		t.Errorf("Scheduling filters should be removed from env, but got %v", info.Config.Env)
+	}
+	if _, ok := info.Config.Labels[kSwarmIdLabel]; !ok {
+		t.Errorf("Container should be labeled as swarm does, %v", info.Config.Labels)
+	}
+
+	id, err = createTestContainer(c, "hello.proc.web.web.v0-i2-d0", 0, "constraint:zone==a")
+	if info, _ := c.InspectContainer(id); err != nil || info.Node.Name != "node1" {
+		t.Errorf("Container should be scheduled to the node labeled zone==a, %v", err)
+	}
+
+	id, err = createTestContainer(c, "hello.proc.web.web.v0-i3-d0", 0,
+		"affinity:cc.bdp.lain.deployd.pg_name==hello.proc.web.web.v0-i2-d0")
+	if info, _ := c.InspectContainer(id); err != nil || info.Node.Name != "node1" {
+		t.Errorf("Container should be scheduled along with the affinity container, %v", err)
+	}
+
+	if _, err := createTestContainer(c, "hello.proc.web.web.v0-i4-d0", 0, "constraint:zone==c"); err == nil {
+		t.Errorf("Should not schedule the container without any node satisfied")
+	}
+	if _, err := createTestContainer(c, "hello.proc.web.web.v0-i4-d0", 0, "constraint:zone==~c"); err != nil {
+		t.Errorf("Should ignore the soft constraint which can not be satisfied, %s", err)
+	}
+	if _, err := createTestContainer(c, "hello.proc.web.web.v0-i5-d0", 2*1024*1024*1024); err != ErrNoResources {
+		t.Errorf("Should not schedule the container without enough memory, %v", err)
+	}
+}
+
+func TestScheduleConcurrently(t *testing.T) {
+	c, engines := newTestCluster(t)
+	defer closeEngines(engines)
+	defer c.Stop()
+
+	// each node has 1G memory which fits 2 of the containers only
+	var wg sync.WaitGroup
+	errs := make(chan error, 6)
+	for i := 1; i <= 6; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			_, err := createTestContainer(c, fmt.Sprintf("hello.proc.web.web.v0-i%d-d0", i), 512*1024*1024)
+			errs <- err
+		}(i)
+	}
+	wg.Wait()
+	close(errs)
+	created := 0
+	for err := range errs {
+		if err == nil {
+			created += 1
+		} else if err != ErrNoResources {
+			t.Errorf("Should fail for the resources only, %s", err)
+		}
+	}
+	if created != 4 {
+		t.Errorf("Should create 4 containers without overcommitting the nodes, created %d", created)
+	}
+	nodes, _ := c.GetResources()
+	for _, n := range nodes {
+		if n.UsedMemory > n.Memory {
+			t.Errorf("Should not overcommit the node, %+v", n)
+		}
+	}
+}
+
+func TestListContainers(t *testing.T) {
+	c, engines := newTestCluster(t)
+	defer closeEngines(engines)
+
+	for i, node := range []string{"node1", "node2", "node2"} {
+		name := fmt.Sprintf("hello.proc.web.web.v0-i%d-d0", i+1)
+		if _, err := createTestContainer(c, name, 0, "constraint:node=="+node); err != nil {
+			t.Fatalf("Should be able to create the container, %s", err)
+		}
+	}
+
+	containers, err := c.ListContainers(true, false)
+	if err != nil || len(containers) != 3 {
+		t.Fatalf("Should list the containers on all nodes, %v, %v", containers, err)
+	}
+	if containers[0].Names[0] != "/node2/hello.proc.web.web.v0-i3-d0" {
+		t.Errorf("Should list the newest first with the names prefixed by node, %v", containers[0].Names)
+	}
+
+	filters, _ := json.Marshal(map[string][]string{"node": {"node2"}, "label": {kSwarmIdLabel}})
+	containers, err = c.ListContainers(true, false, string(filters))
+	if err != nil || len(containers) != 2 {
+		t.Errorf("Should only list the containers on node2, %v, %v", containers, err)
+	}
+	for _, container := range containers {
+		if !strings.HasPrefix(container.Names[0], "/node2/") {
+			t.Errorf("Should only list the containers on node2, %v", container.Names)
+		}
+	}
+
+	engines[0].setDown(true)
+	if _, err := c.ListContainers(true, false); err == nil {
+		t.Errorf("Should not return the partial list when a node fails")
+	}
+}
+
+func TestContainerRouting(t *testing.T) {
+	c, engines := newTestCluster(t)
+	defer closeEngines(engines)
+
+	id, err := createTestContainer(c, "hello.proc.web.web.v0-i1-d0", 0, "constraint:node==node2")
+	if err != nil {
+		t.Fatalf("Should be able to create the container, %s", err)
+	}
+
+	// a fresh cluster knows nothing about the container, it should find it on the nodes
+	fresh, err := NewCluster([]string{engines[0].server.URL, engines[1].server.URL}, time.Second, 5*time.Second)
+	if err != nil {
+		t.Fatalf("Should be able to create the cluster, %s", err)
+	}
+	if err := fresh.StartContainer(id); err != nil {
+		t.Fatalf("Should be able to start the container, %s", err)
+	}
+	if info, err := fresh.InspectContainer(id); err != nil || !info.State.Running || info.Node.Name != "node2" {
+		t.Errorf("Container should be running on node2, %+v, %v", info.Node, err)
+	}
+	engines[1].Lock()
+	engines[1].find(id).logs = []string{"starting", "migrating", "failed"}
+	engines[1].Unlock()
+	if logs, err := fresh.ContainerLogs(id, 2); err != nil || logs != "migrating\nfailed\n" {
+		t.Errorf("Should read the last lines of the logs, got %q, %v", logs, err)
+	}
+	if err := fresh.StopContainer(id); err != nil {
+		t.Errorf("Should be able to stop the container, %s", err)
+	}
+	if err := fresh.RemoveContainer(id, true, false); err != nil {
+		t.Errorf("Should be able to remove the container, %s", err)
+	}
+	if _, err := fresh.InspectContainer(id); !adoc.IsNotFound(err) {
+		t.Errorf("Should get the not found error for the removed container, %v", err)
+	}
+}
+
+type eventRecorder struct {
+	sync.Mutex
+	events []adoc.Event
+}
+
+func (r *eventRecorder) callback(event adoc.Event, err error) {
+	r.Lock()
+	defer r.Unlock()
+	if err == nil {
+		r.events = append(r.events, event)
+	}
+}
+
+func (r *eventRecorder) waitFor(t *testing.T, match func(adoc.Event) bool, msg string) adoc.Event {
+	for i := 0; i < 50; i++ {
+		r.Lock()
+		for _, event := range r.events {
+			if match(event) {
+				r.Unlock()
+				return event
+			}
+		}
+		r.Unlock()
+		time.Sleep(100 * time.Millisecond)
+	}
+	t.Fatalf("Should receive the event, %s", msg)
+	return adoc.Event{}
+}
+
+func TestMonitorEvents(t *testing.T) {
+	c, engines := newTestCluster(t)
+	defer closeEngines(engines)
+
+	var recorder eventRecorder
+	monitorId := c.MonitorEvents("", recorder.callback)
+	defer c.StopMonitor(monitorId)
+	time.Sleep(200 * time.Millisecond) // wait for the event streams connected
+
+	for _, node := range []string{"node1", "node2"} {
+		id, err := createTestContainer(c, "hello.proc.web.web.v0-i1-d0-"+node, 0, "constraint:node=="+node)
+		if err != nil {
+			t.Fatalf("Should be able to create the container, %s", err)
+		}
+		c.StartContainer(id)
+		event := recorder.waitFor(t, func(event adoc.Event) bool {
+			return event.ID == id && event.Status == "start"
+		}, "container start on "+node)
+		if event.Node.Name != node {
+			t.Errorf("Should tell the node of the container event, %+v", event.Node)
+		}
+	}
+
+	engines[1].setDown(true)
+	event := recorder.waitFor(t, func(event adoc.Event) bool {
+		return event.Status == kNodeEventDisconnect
+	}, "node2 disconnect")
+	if !strings.HasPrefix(event.From, "swarm") || event.Node.Name != "node2" {
+		t.Errorf("Should synthesize the swarm node event, %+v", event)
+	}
+	if nodes, _ := c.GetResources(); len(nodes) != 1 {
+		t.Errorf("Should not report the disconnected node, %v", nodes)
+	}
+
+	engines[1].setDown(false)
+	recorder.waitFor(t, func(event adoc.Event) bool {
+		return event.Status == kNodeEventConnect && event.Node.Name == "node2"
+	}, "node2 connect")
+
+	time.Sleep(200 * time.Millisecond) // wait for the event stream connected again
+	id, err := createTestContainer(c, "hello.proc.web.web.v0-i2-d0", 0, "constraint:node==node2")
+	if err != nil {
+		t.Fatalf("Should be able to create the container, %s", err)
+	}
+	c.StartContainer(id)
+	recorder.waitFor(t, func(event adoc.Event) bool {
+		return event.ID == id && event.Status == "start"
+	}, "container start after node2 reconnected")
+}
@@ -0,0 +1,1088 @@
+package fake
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/laincloud/deployd/cluster"
+	"github.com/mijia/adoc"
+)
+
+const (
+	kSwarmIdLabel    = "com.docker.swarm.id"
+	kDefaultNetwork  = "bridge"
+	kHostPortStart   = 32768
+	kOOMKillExitCode = 137
+)
+
+var (
+	ErrNoNodeAvailable = errors.New("No healthy node available in the cluster")
+	ErrNoResources     = errors.New("no resources available to schedule container")
+)
+
+// Clock is a manual time source for the fake cluster, so that the event times can be replayed deterministically.
+type Clock struct {
+	sync.Mutex
+	now time.Time
+}
+
+func (clock *Clock) Now() time.Time {
+	clock.Lock()
+	defer clock.Unlock()
+	return clock.now
+}
+
+func (clock *Clock) Advance(d time.Duration) time.Time {
+	clock.Lock()
+	defer clock.Unlock()
+	clock.now = clock.now.Add(d)
+	return clock.now
+}
+
+func NewClock(start time.Time) *Clock {
+	return &Clock{now: start}
+}
+
+type node struct {
+	name      string
+	address   string
+	cpus      int
+	memory    int64
+	labels    map[string]string
+	connected bool
+	nextPort  int
+}
+
+func (n *node) doc() map[string]interface{} {
+	ip := n.address
+	if host, _, err := net.SplitHostPort(n.address); err == nil {
+		ip = host
+	}
+	return map[string]interface{}{
+		"ID":     n.name,
+		"IP":     ip,
+		"Addr":   n.address,
+		"Name":   n.name,
+		"Cpus":   n.cpus,
+		"Memory": n.memory,
+		"Labels": n.labels,
+	}
+}
+
+type containerState struct {
+	running    bool
+	oomKilled  bool
+	exitCode   int
+	err        string
+	startedAt  time.Time
+	finishedAt time.Time
+	health     string
+}
+
+func (s containerState) status() string {
+	if s.running {
+		return "running"
+	} else if s.startedAt.IsZero() {
+		return "created"
+	}
+	return "exited"
+}
+
+type container struct {
+	seq        int64
+	id         string
+	name       string
+	node       *node
+	config     adoc.ContainerConfig
+	hostConfig adoc.HostConfig
+	created    time.Time
+	state      containerState
+	networks   map[string]string
+	ports      map[string]string
+	logs       []string
+}
+
+func (ct *container) hasHealthcheck() bool {
+	hc := ct.config.Healthcheck
+	return hc != nil && len(hc.Test) > 0 && hc.Test[0] != "NONE"
+}
+
+func (ct *container) cpus() int {
+	hc := ct.hostConfig
+	if hc.CPUPeriod <= 0 || hc.CPUQuota <= 0 {
+		return 0
+	}
+	return int((hc.CPUQuota + hc.CPUPeriod - 1) / hc.CPUPeriod)
+}
+
+// Cluster is an in-memory cluster.Cluster which behaves like a swarm master, it keeps the nodes and containers,
+// schedules the containers with the swarm filters and accounts the resources. Faults like node disconnect,
+// OOM kill and IP conflict can be injected, and all the events are delivered to the monitors in order.
+type Cluster struct {
+	sync.Mutex
+	now        func() time.Time
+	seq        int64
+	nodes      []*node
+	containers map[string]*container
+	networks   map[string]map[string]string // network -> ip -> container id, empty id means reserved
+	netOrder   []string
+	failures   map[string][]error
+	monitorSeq int64
+	monitors   map[int64]*monitor
+}
+
+func (c *Cluster) GetResources() ([]cluster.Node, error) {
+	c.Lock()
+	defer c.Unlock()
+	if err := c.popFailure("GetResources"); err != nil {
+		return nil, err
+	}
+	nodes := make([]cluster.Node, 0, len(c.nodes))
+	for _, n := range c.nodes {
+		if !n.connected {
+			continue
+		}
+		count, cpus, memory := c.usage(n)
+		nodes = append(nodes, cluster.Node{
+			Name:       n.name,
+			Address:    n.address,
+			Containers: int64(count),
+			CPUs:       n.cpus,
+			UsedCPUs:   cpus,
+			Memory:     n.memory,
+			UsedMemory: memory,
+			Labels:     n.labels,
+		})
+	}
+	return nodes, nil
+}
+
+func (c *Cluster) ListContainers(showAll bool, showSize bool, filters ...string) ([]adoc.Container, error) {
+	c.Lock()
+	defer c.Unlock()
+	if err := c.popFailure("ListContainers"); err != nil {
+		return nil, err
+	}
+	filterMap := make(map[string][]string)
+	if len(filters) > 0 && filters[0] != "" {
+		if err := json.Unmarshal([]byte(filters[0]), &filterMap); err != nil {
+			return nil, fmt.Errorf("Invalid filter %q, %s", filters[0], err)
+		}
+	}
+	matched := make([]*container, 0, len(c.containers))
+	for _, ct := range c.containers {
+		if !showAll && !ct.state.running {
+			continue
+		}
+		if containerMatch(ct, filterMap) {
+			matched = append(matched, ct)
+		}
+	}
+	// the newest one comes first, the same as docker
+	sort.Slice(matched, func(i, j int) bool { return matched[i].seq > matched[j].seq })
+
+	containers := make([]adoc.Container, len(matched))
+	for i, ct := range matched {
+		ports := make([]map[string]interface{}, 0, len(ct.ports))
+		for key, hostPort := range ct.ports {
+			privatePort, proto := splitPortKey(key)
+			publicPort, _ := strconv.Atoi(hostPort)
+			ports = append(ports, map[string]interface{}{
+				"IP":          "0.0.0.0",
+				"PrivatePort": privatePort,
+				"PublicPort":  publicPort,
+				"Type":        proto,
+			})
+		}
+		status := "Created"
+		if ct.state.running {
+			status = "Up"
+		} else if !ct.state.startedAt.IsZero() {
+			status = fmt.Sprintf("Exited (%d)", ct.state.exitCode)
+		}
+		decode(map[string]interface{}{
+			"Id":      ct.id,
+			"Names":   []string{"/" + ct.node.name + "/" + ct.name},
+			"Image":   ct.config.Image,
+			"Command": strings.Join(append(append([]string{}, ct.config.Entrypoint...), ct.config.Cmd...), " "),
+			"Created": ct.created.Unix(),
+			"State":   ct.state.status(),
+			"Status":  status,
+			"Ports":   ports,
+			"Labels":  ct.config.Labels,
+		}, &containers[i])
+	}
+	return containers, nil
+}
+
+func (c *Cluster) CreateContainer(cc adoc.ContainerConfig, hc adoc.HostConfig, nc adoc.NetworkingConfig, name ...string) (string, error) {
+	c.Lock()
+	defer c.Unlock()
+	if err := c.popFailure("CreateContainer"); err != nil {
+		return "", err
+	}
+	c.seq += 1
+	cname := fmt.Sprintf("fake_container_%d", c.seq)
+	if len(name) > 0 && name[0] != "" {
+		cname = strings.TrimPrefix(name[0], "/")
+	}
+	if c.findContainer(cname) != nil {
+		return "", fmt.Errorf("Conflict. The name %q is already in use by container %s", cname, c.findContainer(cname).id)
+	}
+	filters, env, err := cluster.ParseFilters(cc.Env)
+	if err != nil {
+		return "", err
+	}
+	hash := sha256.Sum256([]byte(fmt.Sprintf("%s-%d", cname, c.seq)))
+	ct := &container{
+		seq:        c.seq,
+		id:         hex.EncodeToString(hash[:]),
+		name:       cname,
+		config:     cc,
+		hostConfig: hc,
+		created:    c.now(),
+		networks:   make(map[string]string),
+		ports:      make(map[string]string),
+	}
+	ct.config.Env = env
+	ct.config.Labels = make(map[string]string)
+	for key, value := range cc.Labels {
+		ct.config.Labels[key] = value
+	}
+	ct.config.Labels[kSwarmIdLabel] = ct.id
+
+	if ct.node, err = c.schedule(filters, ct); err != nil {
+		return "", err
+	}
+	network := hc.NetworkMode
+	if network == "" {
+		network = kDefaultNetwork
+	}
+	if ip := requestedIP(nc, network); c.assignIP(network, ip, ct) != nil {
+		// the same as calico, the conflict ip is found when the container starts
+		ct.networks[network] = ip
+	}
+	c.containers[ct.id] = ct
+	c.emit(c.containerEvent(ct, "create", nil))
+	return ct.id, nil
+}
+
+func (c *Cluster) ConnectContainer(networkName string, id string, ipAddr string) error {
+	c.Lock()
+	defer c.Unlock()
+	ct, err := c.lookup("ConnectContainer", id)
+	if err != nil {
+		return err
+	}
+	if _, ok := ct.networks[networkName]; ok {
+		return fmt.Errorf("Container %s is already connected to network %s", ct.id, networkName)
+	}
+	if err := c.assignIP(networkName, ipAddr, ct); err != nil {
+		return err
+	}
+	c.emit(c.networkEvent(ct, networkName, "connect"))
+	return nil
+}
+
+func (c *Cluster) DisconnectContainer(networkName string, id string, force bool) error {
+	c.Lock()
+	defer c.Unlock()
+	ct, err := c.lookup("DisconnectContainer", id)
+	if err != nil {
+		return err
+	}
+	ip, ok := ct.networks[networkName]
+	if !ok {
+		return fmt.Errorf("Container %s is not connected to the network %s", ct.id, networkName)
+	}
+	c.releaseIP(networkName, ip, ct)
+	delete(ct.networks, networkName)
+	c.emit(c.networkEvent(ct, networkName, "disconnect"))
+	return nil
+}
+
+func (c *Cluster) StartContainer(id string) error {
+	c.Lock()
+	defer c.Unlock()
+	ct, err := c.lookup("StartContainer", id)
+	if err != nil {
+		return err
+	}
+	return c.start(ct)
+}
+
+func (c *Cluster) StopContainer(id string, timeout ...int) error {
+	c.Lock()
+	defer c.Unlock()
+	ct, err := c.lookup("StopContainer", id)
+	if err != nil {
+		return err
+	}
+	c.stop(ct)
+	return nil
+}
+
+func (c *Cluster) RestartContainer(id string, timeout ...int) error {
+	c.Lock()
+	defer c.Unlock()
+	ct, err := c.lookup("RestartContainer", id)
+	if err != nil {
+		return err
+	}
+	c.stop(ct)
+	if err := c.start(ct); err != nil {
+		return err
+	}
+	c.emit(c.containerEvent(ct, "restart", nil))
+	return nil
+}
+
+func (c *Cluster) InspectContainer(id string) (adoc.ContainerDetail, error) {
+	var detail adoc.ContainerDetail
+	c.Lock()
+	defer c.Unlock()
+	ct, err := c.lookup("InspectContainer", id)
+	if err != nil {
+		return detail, err
+	}
+	state := map[string]interface{}{
+		"Status":     ct.state.status(),
+		"Running":    ct.state.running,
+		"OOMKilled":  ct.state.oomKilled,
+		"ExitCode":   ct.state.exitCode,
+		"Error":      ct.state.err,
+		"StartedAt":  ct.state.startedAt,
+		"FinishedAt": ct.state.finishedAt,
+	}
+	if ct.state.health != "" {
+		state["Health"] = map[string]interface{}{
+			"Status": ct.state.health,
+		}
+	}
+	ports := make(map[string]interface{})
+	for key, hostPort := range ct.ports {
+		ports[key] = []map[string]string{{"HostIp": "0.0.0.0", "HostPort": hostPort}}
+	}
+	networks := make(map[string]interface{})
+	for network, ip := range ct.networks {
+		networks[network] = map[string]string{"IPAddress": ip}
+	}
+	decode(map[string]interface{}{
+		"Id":         ct.id,
+		"Created":    ct.created,
+		"Name":       "/" + ct.name,
+		"Image":      ct.config.Image,
+		"State":      state,
+		"Config":     ct.config,
+		"HostConfig": ct.hostConfig,
+		"NetworkSettings": map[string]interface{}{
+			"Ports":    ports,
+			"Networks": networks,
+		},
+		"Node": ct.node.doc(),
+	}, &detail)
+	return detail, nil
+}
+
+func (c *Cluster) RemoveContainer(id string, force bool, volumes bool) error {
+	c.Lock()
+	defer c.Unlock()
+	ct, err := c.lookup("RemoveContainer", id)
+	if err != nil {
+		return err
+	}
+	if ct.state.running {
+		if !force {
+			return fmt.Errorf("You cannot remove a running container %s. Stop the container before attempting removal or use -f", ct.id)
+		}
+		c.exit(ct, kOOMKillExitCode, "", false)
+	}
+	for network, ip := range ct.networks {
+		c.releaseIP(network, ip, ct)
+	}
+	delete(c.containers, ct.id)
+	c.emit(c.containerEvent(ct, "destroy", nil))
+	return nil
+}
+
+func (c *Cluster) RenameContainer(id string, name string) error {
+	c.Lock()
+	defer c.Unlock()
+	ct, err := c.lookup("RenameContainer", id)
+	if err != nil {
+		return err
+	}
+	name = strings.TrimPrefix(name, "/")
+	if other := c.findContainer(name); other != nil && other != ct {
+		return fmt.Errorf("Conflict. The name %q is already in use by container %s", name, other.id)
+	}
+	oldName := ct.name
+	ct.name = name
+	c.emit(c.containerEvent(ct, "rename", map[string]string{"oldName": "/" + oldName}))
+	return nil
+}
+
+func (c *Cluster) UpdateContainer(id string, config interface{}) error {
+	c.Lock()
+	defer c.Unlock()
+	ct, err := c.lookup("UpdateContainer", id)
+	if err != nil {
+		return err
+	}
+	// the update config has the same json fields as the resources in host config
+	if err := decode(config, &ct.hostConfig); err != nil {
+		return err
+	}
+	c.emit(c.containerEvent(ct, "update", nil))
+	return nil
+}
+
+func (c *Cluster) ContainerLogs(id string, tail int) (string, error) {
+	c.Lock()
+	defer c.Unlock()
+	ct, err := c.lookup("ContainerLogs", id)
+	if err != nil {
+		return "", err
+	}
+	lines := ct.logs
+	if tail >= 0 && len(lines) > tail {
+		lines = lines[len(lines)-tail:]
+	}
+	if len(lines) == 0 {
+		return "", nil
+	}
+	return strings.Join(lines, "\n") + "\n", nil
+}
+
+func (c *Cluster) MonitorEvents(filter string, callback adoc.EventCallback) int64 {
+	c.Lock()
+	defer c.Unlock()
+	c.monitorSeq += 1
+	c.monitors[c.monitorSeq] = newMonitor(filter, callback)
+	return c.monitorSeq
+}
+
+func (c *Cluster) StopMonitor(monitorId int64) {
+	c.Lock()
+	m, ok := c.monitors[monitorId]
+	delete(c.monitors, monitorId)
+	c.Unlock()
+	if ok {
+		m.stop()
+	}
+}
+
+// Monitors returns the count of the running event monitors
+func (c *Cluster) Monitors() int {
+	c.Lock()
+	defer c.Unlock()
+	return len(c.monitors)
+}
+
+// SetClock replaces the time source of the cluster, which is used for the container states and the event times
+func (c *Cluster) SetClock(now func() time.Time) {
+	c.Lock()
+	defer c.Unlock()
+	c.now = now
+}
+
+// AddNode joins a new docker engine into the cluster, the labels can be used by the constraint filters
+func (c *Cluster) AddNode(name, address string, cpus int, memory int64, labels map[string]string) error {
+	c.Lock()
+	defer c.Unlock()
+	if c.findNode(name) != nil {
+		return fmt.Errorf("Node %s already exists", name)
+	}
+	n := &node{
+		name:      name,
+		address:   address,
+		cpus:      cpus,
+		memory:    memory,
+		labels:    make(map[string]string),
+		connected: true,
+		nextPort:  kHostPortStart,
+	}
+	for key, value := range labels {
+		n.labels[key] = value
+	}
+	c.nodes = append(c.nodes, n)
+	c.emit(c.swarmEvent(n, "engine_connect"))
+	return nil
+}
+
+// DisconnectNode makes the node unreachable, the containers on it are still listed but cannot be operated,
+// and the node won't be used for scheduling until it is reconnected.
+func (c *Cluster) DisconnectNode(name string) error {
+	c.Lock()
+	defer c.Unlock()
+	n := c.findNode(name)
+	if n == nil {
+		return fmt.Errorf("Node %s not found", name)
+	}
+	if n.connected {
+		n.connected = false
+		c.emit(c.swarmEvent(n, "engine_disconnect"))
+	}
+	return nil
+}
+
+func (c *Cluster) ReconnectNode(name string) error {
+	c.Lock()
+	defer c.Unlock()
+	n := c.findNode(name)
+	if n == nil {
+		return fmt.Errorf("Node %s not found", name)
+	}
+	if !n.connected {
+		n.connected = true
+		c.emit(c.swarmEvent(n, "engine_connect"))
+	}
+	return nil
+}
+
+// OOMKill kills the running container as the kernel OOM killer does
+func (c *Cluster) OOMKill(id string) error {
+	c.Lock()
+	defer c.Unlock()
+	ct, err := c.lookup("", id)
+	if err != nil {
+		return err
+	}
+	if !ct.state.running {
+		return fmt.Errorf("Container %s is not running", ct.id)
+	}
+	c.emit(c.containerEvent(ct, "oom", nil))
+	c.exit(ct, kOOMKillExitCode, "", true)
+	return nil
+}
+
+// ExitContainer makes the running container exit by itself with the exit code and the error message
+func (c *Cluster) ExitContainer(id string, exitCode int, errMsg string) error {
+	c.Lock()
+	defer c.Unlock()
+	ct, err := c.lookup("", id)
+	if err != nil {
+		return err
+	}
+	if !ct.state.running {
+		return fmt.Errorf("Container %s is not running", ct.id)
+	}
+	c.exit(ct, exitCode, errMsg, false)
+	return nil
+}
+
+// WriteLogs appends the lines to the logs of the container
+func (c *Cluster) WriteLogs(id string, lines ...string) error {
+	c.Lock()
+	defer c.Unlock()
+	ct, err := c.lookup("", id)
+	if err != nil {
+		return err
+	}
+	ct.logs = append(ct.logs, lines...)
+	return nil
+}
+
+// SetHealth changes the health status of the container, status should be starting, healthy or unhealthy
+func (c *Cluster) SetHealth(id string, status string) error {
+	c.Lock()
+	defer c.Unlock()
+	ct, err := c.lookup("", id)
+	if err != nil {
+		return err
+	}
+	if !ct.hasHealthcheck() {
+		return fmt.Errorf("Container %s has no health check", ct.id)
+	}
+	if ct.state.health != status {
+		ct.state.health = status
+		c.emit(c.containerEvent(ct, "health_status: "+status, nil))
+	}
+	return nil
+}
+
+// ReserveIP occupies the ip in the network by someone outside the cluster, like the ip not reclaimed
+// after the node went down abnormally, the containers asking for this ip would get the conflict error.
+func (c *Cluster) ReserveIP(network, ip string) error {
+	c.Lock()
+	defer c.Unlock()
+	if owner, ok := c.ipOwners(network)[ip]; ok {
+		return ipConflictError(ip, owner)
+	}
+	c.ipOwners(network)[ip] = ""
+	return nil
+}
+
+// ReleaseIP frees the ip in the network no matter who is using it
+func (c *Cluster) ReleaseIP(network, ip string) {
+	c.Lock()
+	defer c.Unlock()
+	delete(c.ipOwners(network), ip)
+}
+
+// SetContainerIP changes the ip of the container behind the engine, like the container gets a new ip after the node rebooted
+func (c *Cluster) SetContainerIP(id, network, ip string) error {
+	c.Lock()
+	defer c.Unlock()
+	ct, err := c.lookup("", id)
+	if err != nil {
+		return err
+	}
+	oldIP, ok := ct.networks[network]
+	if !ok {
+		return fmt.Errorf("Container %s is not connected to the network %s", ct.id, network)
+	}
+	if owner, ok := c.ipOwners(network)[ip]; ok && owner != ct.id {
+		return ipConflictError(ip, owner)
+	}
+	c.releaseIP(network, oldIP, ct)
+	return c.assignIP(network, ip, ct)
+}
+
+// FailNext makes the next call of the method return the error, e.g. FailNext("StartContainer", err)
+func (c *Cluster) FailNext(method string, err error) {
+	c.Lock()
+	defer c.Unlock()
+	c.failures[method] = append(c.failures[method], err)
+}
+
+// InterruptEvents breaks all the event monitors with the error, like the connection to swarm is lost
+func (c *Cluster) InterruptEvents(err error) {
+	c.Lock()
+	defer c.Unlock()
+	for _, m := range c.monitors {
+		m.push(eventItem{err: err})
+	}
+}
+
+// Flush waits until all the emitted events have been handled by the monitor callbacks,
+// it should not be called inside the callbacks.
+func (c *Cluster) Flush() {
+	c.Lock()
+	monitors := make([]*monitor, 0, len(c.monitors))
+	for _, m := range c.monitors {
+		monitors = append(monitors, m)
+	}
+	c.Unlock()
+	for _, m := range monitors {
+		m.pending.Wait()
+	}
+}
+
+// schedule picks the node for the container, hard filters must be satisfied and soft filters are ignored
+// if no node can satisfy them, then the node with the least containers and enough resources wins.
+func (c *Cluster) schedule(filters []cluster.FilterExpr, ct *container) (*node, error) {
+	candidates := make([]*node, 0, len(c.nodes))
+	for _, n := range c.nodes {
+		if n.connected {
+			candidates = append(candidates, n)
+		}
+	}
+	if len(candidates) == 0 {
+		return nil, ErrNoNodeAvailable
+	}
+	for _, filter := range filters {
+		if filter.Soft {
+			continue
+		}
+		candidates = c.filterNodes(candidates, filter)
+		if len(candidates) == 0 {
+			return nil, fmt.Errorf("Unable to find a node that satisfies the following conditions [%s]", filter)
+		}
+	}
+	for _, filter := range filters {
+		if !filter.Soft {
+			continue
+		}
+		if filtered := c.filterNodes(candidates, filter); len(filtered) > 0 {
+			candidates = filtered
+		}
+	}
+
+	var picked *node
+	pickedCount := 0
+	cpus, memory := ct.cpus(), ct.hostConfig.Memory
+	for _, n := range candidates {
+		count, usedCPUs, usedMemory := c.usage(n)
+		if n.memory > 0 && usedMemory+memory > n.memory {
+			continue
+		}
+		if n.cpus > 0 && usedCPUs+cpus > n.cpus {
+			continue
+		}
+		if picked == nil || count < pickedCount {
+			picked, pickedCount = n, count
+		}
+	}
+	if picked == nil {
+		return nil, ErrNoResources
+	}
+	return picked, nil
+}
+
+func (c *Cluster) filterNodes(nodes []*node, filter cluster.FilterExpr) []*node {
+	filtered := make([]*node, 0, len(nodes))
+	for _, n := range nodes {
+		matched := false
+		if filter.Kind == cluster.FilterConstraint {
+			if filter.Key == "node" {
+				matched = filter.Match(n.name)
+			} else if value, ok := n.labels[filter.Key]; ok {
+				matched = filter.Match(value)
+			}
+		} else {
+			for _, ct := range c.containers {
+				if ct.node != n {
+					continue
+				}
+				switch filter.Key {
+				case "container":
+					matched = filter.Match(ct.name) || filter.Match(ct.id)
+				case "image":
+					matched = filter.Match(ct.config.Image)
+				default:
+					value, ok := ct.config.Labels[filter.Key]
+					matched = ok && filter.Match(value)
+				}
+				if matched {
+					break
+				}
+			}
+		}
+		if matched == filter.Equal {
+			filtered = append(filtered, n)
+		}
+	}
+	return filtered
+}
+
+func (c *Cluster) usage(n *node) (count int, cpus int, memory int64) {
+	for _, ct := range c.containers {
+		if ct.node == n {
+			count += 1
+			cpus += ct.cpus()
+			memory += ct.hostConfig.Memory
+		}
+	}
+	return
+}
+
+func (c *Cluster) start(ct *container) error {
+	if ct.state.running {
+		return nil
+	}
+	for network, ip := range ct.networks {
+		if err := c.assignIP(network, ip, ct); err != nil {
+			return err
+		}
+	}
+	ct.state.running = true
+	ct.state.oomKilled = false
+	ct.state.exitCode = 0
+	ct.state.err = ""
+	ct.state.startedAt = c.now()
+	if ct.hasHealthcheck() {
+		ct.state.health = "starting"
+	}
+	ct.ports = make(map[string]string)
+	for key, bindings := range ct.hostConfig.PortBindings {
+		hostPort := ""
+		if len(bindings) > 0 {
+			hostPort = bindings[0].HostPort
+		}
+		if hostPort == "" {
+			hostPort = strconv.Itoa(ct.node.nextPort)
+			ct.node.nextPort += 1
+		}
+		ct.ports[key] = hostPort
+	}
+	c.emit(c.containerEvent(ct, "start", nil))
+	return nil
+}
+
+func (c *Cluster) stop(ct *container) {
+	if !ct.state.running {
+		return
+	}
+	c.emit(c.containerEvent(ct, "kill", nil))
+	c.exit(ct, 0, "", false)
+	c.emit(c.containerEvent(ct, "stop", nil))
+}
+
+func (c *Cluster) exit(ct *container, exitCode int, errMsg string, oomKilled bool) {
+	ct.state.running = false
+	ct.state.oomKilled = oomKilled
+	ct.state.exitCode = exitCode
+	ct.state.err = errMsg
+	ct.state.finishedAt = c.now()
+	ct.ports = make(map[string]string)
+	c.emit(c.containerEvent(ct, "die", map[string]string{"exitCode": strconv.Itoa(exitCode)}))
+}
+
+func (c *Cluster) ipOwners(network string) map[string]string {
+	owners, ok := c.networks[network]
+	if !ok {
+		owners = make(map[string]string)
+		c.networks[network] = owners
+		c.netOrder = append(c.netOrder, network)
+	}
+	return owners
+}
+
+// assignIP gives the container the asked ip in the network or allocates a free one if ip is empty
+func (c *Cluster) assignIP(network, ip string, ct *container) error {
+	owners := c.ipOwners(network)
+	if ip != "" {
+		if owner, ok := owners[ip]; ok && owner != ct.id {
+			return ipConflictError(ip, owner)
+		}
+	} else {
+		netIndex := 0
+		for i, name := range c.netOrder {
+			if name == network {
+				netIndex = i
+			}
+		}
+		for n := 2; ; n++ {
+			if n%256 == 0 || n%256 == 255 {
+				continue
+			}
+			candidate := fmt.Sprintf("172.%d.%d.%d", 20+netIndex, n/256, n%256)
+			if _, ok := owners[candidate]; !ok {
+				ip = candidate
+				break
+			}
+		}
+	}
+	owners[ip] = ct.id
+	ct.networks[network] = ip
+	return nil
+}
+
+// releaseIP frees the ip only if it is owned by the container
+func (c *Cluster) releaseIP(network, ip string, ct *container) {
+	owners := c.ipOwners(network)
+	if owners[ip] == ct.id {
+		delete(owners, ip)
+	}
+}
+
+// lookup finds the container by id, id prefix or name, the injected failure of the method comes first
+func (c *Cluster) lookup(method string, id string) (*container, error) {
+	if err := c.popFailure(method); err != nil {
+		return nil, err
+	}
+	ct := c.findContainer(id)
+	if ct == nil {
+		return nil, adoc.ErrNotFound
+	}
+	if !ct.node.connected {
+		return nil, fmt.Errorf("Cannot connect to the docker engine on node %s", ct.node.name)
+	}
+	return ct, nil
+}
+
+func (c *Cluster) findContainer(idOrName string) *container {
+	idOrName = strings.TrimPrefix(idOrName, "/")
+	if idOrName == "" {
+		return nil
+	}
+	if ct, ok := c.containers[idOrName]; ok {
+		return ct
+	}
+	for _, ct := range c.containers {
+		if ct.name == idOrName || (len(idOrName) >= 12 && strings.HasPrefix(ct.id, idOrName)) {
+			return ct
+		}
+	}
+	return nil
+}
+
+func (c *Cluster) findNode(name string) *node {
+	for _, n := range c.nodes {
+		if n.name == name {
+			return n
+		}
+	}
+	return nil
+}
+
+func (c *Cluster) popFailure(method string) error {
+	errs := c.failures[method]
+	if len(errs) == 0 {
+		return nil
+	}
+	c.failures[method] = errs[1:]
+	return errs[0]
+}
+
+func (c *Cluster) containerEvent(ct *container, action string, attributes map[string]string) adoc.Event {
+	attrs := map[string]string{
+		"name":  ct.name,
+		"image": ct.config.Image,
+	}
+	for key, value := range ct.config.Labels {
+		attrs[key] = value
+	}
+	for key, value := range attributes {
+		attrs[key] = value
+	}
+	return c.newEvent(map[string]interface{}{
+		"status": action,
+		"id":     ct.id,
+		"from":   ct.config.Image + " node:" + ct.node.name,
+		"Type":   adoc.ContainerEventType,
+		"Action": action,
+		"Actor":  map[string]interface{}{"ID": ct.id, "Attributes": attrs},
+		"node":   ct.node.doc(),
+	})
+}
+
+func (c *Cluster) networkEvent(ct *container, network string, action string) adoc.Event {
+	return c.newEvent(map[string]interface{}{
+		"Type":   "network",
+		"Action": action,
+		"Actor": map[string]interface{}{
+			"ID":         network,
+			"Attributes": map[string]string{"container": ct.id, "name": network},
+		},
+		"node": ct.node.doc(),
+	})
+}
+
+func (c *Cluster) swarmEvent(n *node, action string) adoc.Event {
+	return c.newEvent(map[string]interface{}{
+		"status": action,
+		"from":   "swarm",
+		"Type":   "swarm",
+		"Action": action,
+		"Actor": map[string]interface{}{
+			"ID":         n.name,
+			"Attributes": map[string]string{"name": n.name},
+		},
+		"node": n.doc(),
+	})
+}
+
+func (c *Cluster) newEvent(doc map[string]interface{}) adoc.Event {
+	var event adoc.Event
+	now := c.now()
+	doc["time"] = now.Unix()
+	doc["timeNano"] = now.UnixNano()
+	decode(doc, &event)
+	return event
+}
+
+// emit sends the event to all the monitors, must be called with the lock held to keep the events in order
+func (c *Cluster) emit(event adoc.Event) {
+	ids := make([]int64, 0, len(c.monitors))
+	for id := range c.monitors {
+		ids = append(ids, id)
+	}
+	sort.Slice(ids, func(i, j int) bool { return ids[i] < ids[j] })
+	for _, id := range ids {
+		c.monitors[id].push(eventItem{event: event})
+	}
+}
+
+// ipConflictError has the same message as calico returns, which is recognized by the engine
+func ipConflictError(ip, owner string) error {
+	if owner == "" {
+		owner = "reserved"
+	}
+	return fmt.Errorf("IP assignment error, data: {IP:%s HandleID:%s}: Address already assigned in block", ip, owner)
+}
+
+func containerMatch(ct *container, filters map[string][]string) bool {
+	for _, label := range filters["label"] {
+		parts := strings.SplitN(label, "=", 2)
+		value, ok := ct.config.Labels[parts[0]]
+		if !ok || (len(parts) == 2 && value != parts[1]) {
+			return false
+		}
+	}
+	if names := filters["name"]; len(names) > 0 && !anyMatch(names, func(name string) bool {
+		return strings.Contains(ct.name, strings.TrimPrefix(name, "/"))
+	}) {
+		return false
+	}
+	if ids := filters["id"]; len(ids) > 0 && !anyMatch(ids, func(id string) bool {
+		return strings.HasPrefix(ct.id, id)
+	}) {
+		return false
+	}
+	if statuses := filters["status"]; len(statuses) > 0 && !anyMatch(statuses, func(status string) bool {
+		return ct.state.status() == status
+	}) {
+		return false
+	}
+	if nodes := filters["node"]; len(nodes) > 0 && !anyMatch(nodes, func(node string) bool {
+		return ct.node.name == node
+	}) {
+		return false
+	}
+	return true
+}
+
+func anyMatch(values []string, fn func(string) bool) bool {
+	for _, value := range values {
+		if fn(value) {
+			return true
+		}
+	}
+	return false
+}
+
+func requestedIP(nc adoc.NetworkingConfig, network string) string {
+	var config struct {
+		EndpointsConfig map[string]struct {
+			IPAMConfig *struct {
+				IPv4Address string
+			}
+		}
+	}
+	decode(nc, &config)
+	if endpoint, ok := config.EndpointsConfig[network]; ok && endpoint.IPAMConfig != nil {
+		return endpoint.IPAMConfig.IPv4Address
+	}
+	return ""
+}
+
+func splitPortKey(key string) (int, string) {
+	parts := strings.SplitN(key, "/", 2)
+	port, _ := strconv.Atoi(parts[0])
+	proto := "tcp"
+	if len(parts) == 2 {
+		proto = parts[1]
+	}
+	return port, proto
+}
+
+// decode converts the value into v through json, the docker api documents are built in this way
+// so that they have exactly the same shape as the ones returned by swarm.
+func decode(value interface{}, v interface{}) error {
+	data, err := json.Marshal(value)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(data, v)
+}
+
+func NewCluster() *Cluster {
+	return &Cluster{
+		now:        time.Now,
+		containers: make(map[string]*container),
+		networks:   make(map[string]map[string]string),
+		failures:   make(map[string][]error),
+		monitors:   make(map[int64]*monitor),
+	}
+}
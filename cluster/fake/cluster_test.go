@@ -0,0 +1,280 @@
+package fake
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/laincloud/deployd/utils/util"
+	"github.com/mijia/adoc"
+)
+
+func newTestCluster(t *testing.T) *Cluster {
+	c := NewCluster()
+	nodes := []struct {
+		name   string
+		labels map[string]string
+	}{
+		{"node1", map[string]string{"zone": "a"}},
+		{"node2", map[string]string{"zone": "b"}},
+		{"node3", nil},
+	}
+	for i, n := range nodes {
+		if err := c.AddNode(n.name, fmt.Sprintf("192.168.77.%d:2375", 21+i), 4, 1024*1024*1024, n.labels); err != nil {
+			t.Fatalf("Should be able to add node %s, %s", n.name, err)
+		}
+	}
+	return c
+}
+
+func createTestContainer(c *Cluster, name string, memory int64, env ...string) (string, error) {
+	cc := adoc.ContainerConfig{
+		Image:  "busybox",
+		Env:    env,
+		Labels: map[string]string{"cc.bdp.lain.deployd.pg_name": "hello.proc.web.web"},
+	}
+	hc := adoc.HostConfig{NetworkMode: "hello"}
+	hc.Memory = memory
+	return c.CreateContainer(cc, hc, adoc.NetworkingConfig{}, name)
+}
+
+func TestScheduleFilters(t *testing.T) {
+	c := newTestCluster(t)
+	id, err := createTestContainer(c, "hello.proc.web.web.v0-i1-d0", 0, "constraint:node==node2")
+	if err != nil {
+		t.Fatalf("Should be able to create the container, %s", err)
+	}
+	if info, err := c.InspectContainer(id); err != nil || info.Node.Name != "node2" {
+		t.Errorf("Container should be scheduled to node2, err=%v", err)
+	}
+	if info, _ := c.InspectContainer(id); len(info.Config.Env) != 0 {
+		t.Errorf("Scheduling filters should be removed from env, but got %v", info.Config.Env)
+	}
+
+	id, err = createTestContainer(c, "hello.proc.web.web.v0-i2-d0", 0, "constraint:zone==a")
+	if info, _ := c.InspectContainer(id); err != nil || info.Node.Name != "node1" {
+		t.Errorf("Container should be scheduled to the node labeled zone==a, err=%v", err)
+	}
+	if _, err := createTestContainer(c, "hello.proc.web.web.v0-i3-d0", 0, "constraint:zone==c"); err == nil {
+		t.Errorf("Should not be able to schedule container with unsatisfied constraint")
+	}
+
+	// node3 is the only node without the pg, soft anti affinity should pick it
+	id, err = createTestContainer(c, "hello.proc.web.web.v0-i3-d0", 0, "affinity:cc.bdp.lain.deployd.pg_name!=~hello.proc.web.web")
+	if info, _ := c.InspectContainer(id); err != nil || info.Node.Name != "node3" {
+		t.Errorf("Container should be scheduled to node3 by the anti affinity, err=%v", err)
+	}
+	// soft anti affinity can not be satisfied any more, but should be ignored
+	if _, err := createTestContainer(c, "hello.proc.web.web.v0-i4-d0", 0, "affinity:cc.bdp.lain.deployd.pg_name!=~hello.proc.web.web"); err != nil {
+		t.Errorf("Soft affinity should be ignored when no node can satisfy it, %s", err)
+	}
+	if _, err := createTestContainer(c, "hello.proc.web.web.v0-i4-d0", 0); err == nil {
+		t.Errorf("Should get the conflict error with the same container name")
+	}
+}
+
+func TestResourceAccounting(t *testing.T) {
+	c := newTestCluster(t)
+	for i := 0; i < 3; i++ {
+		if _, err := createTestContainer(c, "", 768*1024*1024); err != nil {
+			t.Fatalf("Should be able to create container with enough memory, %s", err)
+		}
+	}
+	nodes, _ := c.GetResources()
+	for _, n := range nodes {
+		if n.Containers != 1 || n.UsedMemory != 768*1024*1024 {
+			t.Errorf("Containers should be spread on the nodes, but got %+v", n)
+		}
+	}
+	if _, err := createTestContainer(c, "", 512*1024*1024); err != ErrNoResources {
+		t.Errorf("Should get the no resources error, but got %v", err)
+	}
+
+	c.DisconnectNode("node3")
+	if nodes, _ := c.GetResources(); len(nodes) != 2 {
+		t.Errorf("Disconnected node should not be listed, but got %v", nodes)
+	}
+}
+
+func TestListContainers(t *testing.T) {
+	c := newTestCluster(t)
+	id1, _ := createTestContainer(c, "hello.proc.web.web.v0-i1-d0", 0)
+	id2, _ := createTestContainer(c, "hello.proc.web.web.v0-i2-d0", 0)
+	c.StartContainer(id2)
+
+	if containers, _ := c.ListContainers(false, false); len(containers) != 1 || containers[0].Id != id2 {
+		t.Errorf("Should only list the running container, but got %v", containers)
+	}
+	containers, err := c.ListContainers(true, false, `{"label":["cc.bdp.lain.deployd.pg_name=hello.proc.web.web","com.docker.swarm.id"]}`)
+	if err != nil || len(containers) != 2 {
+		t.Fatalf("Should list all containers by the label filters, containers=%v, err=%v", containers, err)
+	}
+	if containers[0].Id != id2 || containers[1].Id != id1 {
+		t.Errorf("The newest container should come first")
+	}
+	if containers, _ := c.ListContainers(true, false, `{"label":["cc.bdp.lain.deployd.pg_name=hello.proc.web.foo"]}`); len(containers) != 0 {
+		t.Errorf("Should not list containers with other labels, but got %v", containers)
+	}
+}
+
+func TestContainerLifecycle(t *testing.T) {
+	c := newTestCluster(t)
+	if _, err := c.InspectContainer("not-exists"); !adoc.IsNotFound(err) {
+		t.Errorf("Should get the not found error, but got %v", err)
+	}
+
+	id, _ := createTestContainer(c, "hello.proc.web.web.v0-i1-d0", 0)
+	if err := c.StartContainer(id); err != nil {
+		t.Fatalf("Should be able to start the container, %s", err)
+	}
+	info, _ := c.InspectContainer(id)
+	if !info.State.Running || info.State.StartedAt.IsZero() {
+		t.Errorf("Container should be running, but got %+v", info.State)
+	}
+	ip := info.NetworkSettings.Networks["hello"].IPAddress
+	if ip == "" {
+		t.Errorf("Container should get an ip in network hello")
+	}
+	if err := c.RemoveContainer(id, false, false); err == nil {
+		t.Errorf("Should not be able to remove the running container without force")
+	}
+
+	if err := c.OOMKill(id); err != nil {
+		t.Fatalf("Should be able to OOM kill the running container, %s", err)
+	}
+	if info, _ := c.InspectContainer(id); info.State.Running || !info.State.OOMKilled || info.State.ExitCode != 137 {
+		t.Errorf("Container should be killed by OOM, but got %+v", info.State)
+	}
+
+	c.StartContainer(id)
+	c.WriteLogs(id, "starting", "serving")
+	if logs, err := c.ContainerLogs(id, 1); err != nil || logs != "serving\n" {
+		t.Errorf("Should read the last line of the logs, got %q, %v", logs, err)
+	}
+	c.UpdateContainer(id, map[string]int64{"Memory": 64 * 1024 * 1024})
+	if info, _ := c.InspectContainer(id); info.HostConfig.Memory != 64*1024*1024 || info.State.OOMKilled {
+		t.Errorf("Container should be updated and restarted, but got %+v", info)
+	}
+
+	if err := c.RemoveContainer(id, true, false); err != nil {
+		t.Errorf("Should be able to remove the container with force, %s", err)
+	}
+	if _, err := c.InspectContainer(id); !adoc.IsNotFound(err) {
+		t.Errorf("Removed container should not be found, but got %v", err)
+	}
+	if _, err := createTestContainer(c, "hello.proc.web.web.v0-i1-d0", 0); err != nil {
+		t.Errorf("Container name should be released after removed, %s", err)
+	}
+}
+
+func TestIPConflict(t *testing.T) {
+	c := newTestCluster(t)
+	c.ReserveIP("hello", "172.20.0.10")
+
+	nc := adoc.NetworkingConfig{}
+	if err := json.Unmarshal([]byte(`{"EndpointsConfig":{"hello":{"IPAMConfig":{"IPv4Address":"172.20.0.10"}}}}`), &nc); err != nil {
+		t.Fatalf("Cannot build the networking config, %s", err)
+	}
+	hc := adoc.HostConfig{NetworkMode: "hello"}
+	id, err := c.CreateContainer(adoc.ContainerConfig{Image: "busybox"}, hc, nc, "conflict")
+	if err != nil {
+		t.Fatalf("Should be able to create the container with the reserved ip, %s", err)
+	}
+	if err := c.StartContainer(id); err == nil || util.IpConflictErrorMatch(err.Error()) != "172.20.0.10" {
+		t.Errorf("Should get the ip conflict error when starting the container, but got %v", err)
+	}
+	c.ReleaseIP("hello", "172.20.0.10")
+	if err := c.StartContainer(id); err != nil {
+		t.Errorf("Should be able to start the container after the ip released, %s", err)
+	}
+
+	id, _ = createTestContainer(c, "hello.proc.web.web.v0-i1-d0", 0)
+	info, _ := c.InspectContainer(id)
+	ip := info.NetworkSettings.Networks["hello"].IPAddress
+	if err := c.SetContainerIP(id, "hello", "172.20.0.10"); err == nil {
+		t.Errorf("Should not be able to change ip to the one in use")
+	}
+	c.SetContainerIP(id, "hello", "172.20.0.11")
+	if err := c.ConnectContainer("hello", id, ip); err == nil {
+		t.Errorf("Should not be able to connect the network twice")
+	}
+	c.DisconnectContainer("hello", id, true)
+	if err := c.ConnectContainer("hello", id, ip); err != nil {
+		t.Errorf("Should be able to take the old ip back, %s", err)
+	}
+	if info, _ := c.InspectContainer(id); info.NetworkSettings.Networks["hello"].IPAddress != ip {
+		t.Errorf("Container should get the old ip %s back", ip)
+	}
+}
+
+func TestEventsAndFaults(t *testing.T) {
+	c := newTestCluster(t)
+	clock := NewClock(time.Date(2017, 6, 1, 0, 0, 0, 0, time.UTC))
+	c.SetClock(clock.Now)
+
+	var lock sync.Mutex
+	events := make([]adoc.Event, 0)
+	errs := make([]error, 0)
+	c.MonitorEvents("", func(event adoc.Event, err error) {
+		lock.Lock()
+		defer lock.Unlock()
+		if err != nil {
+			errs = append(errs, err)
+		} else {
+			events = append(events, event)
+		}
+	})
+	stopped := c.MonitorEvents(`{"type":["container"]}`, func(event adoc.Event, err error) {
+		t.Errorf("Stopped monitor should not get any event")
+	})
+	c.StopMonitor(stopped)
+
+	id, _ := createTestContainer(c, "hello.proc.web.web.v0-i1-d0", 0, "constraint:node==node1")
+	c.StartContainer(id)
+	clock.Advance(time.Minute)
+	c.DisconnectNode("node1")
+	if err := c.StartContainer(id); err == nil || adoc.IsNotFound(err) {
+		t.Errorf("Container on the disconnected node should not be operated, but got %v", err)
+	}
+	clock.Advance(time.Minute)
+	c.ReconnectNode("node1")
+	c.FailNext("StopContainer", errors.New("injected"))
+	if err := c.StopContainer(id); err == nil || err.Error() != "injected" {
+		t.Errorf("Should get the injected error, but got %v", err)
+	}
+	c.ExitContainer(id, 1, "exited")
+	c.InterruptEvents(errors.New("broken"))
+	c.Flush()
+
+	lock.Lock()
+	defer lock.Unlock()
+	expects := []struct {
+		status string
+		node   string
+		time   int64
+	}{
+		{"create", "node1", clock.Now().Add(-2 * time.Minute).Unix()},
+		{"start", "node1", clock.Now().Add(-2 * time.Minute).Unix()},
+		{"engine_disconnect", "node1", clock.Now().Add(-time.Minute).Unix()},
+		{"engine_connect", "node1", clock.Now().Unix()},
+		{"die", "node1", clock.Now().Unix()},
+	}
+	if len(events) != len(expects) {
+		t.Fatalf("Should get %d events, but got %d, %v", len(expects), len(events), events)
+	}
+	for i, expect := range expects {
+		event := events[i]
+		if event.Status != expect.status || event.Node.Name != expect.node || event.Time != expect.time {
+			t.Errorf("Should get event %+v, but got %+v", expect, event)
+		}
+	}
+	if events[2].From != "swarm" || events[4].Actor.Attributes["name"] != "hello.proc.web.web.v0-i1-d0" {
+		t.Errorf("Events should be filled like swarm does, but got %+v", events)
+	}
+	if len(errs) != 1 {
+		t.Errorf("Should get the interrupted error, but got %v", errs)
+	}
+}
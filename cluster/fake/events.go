@@ -0,0 +1,122 @@
+package fake
+
+import (
+	"encoding/json"
+	"strings"
+	"sync"
+
+	"github.com/mijia/adoc"
+)
+
+type eventItem struct {
+	event adoc.Event
+	err   error
+}
+
+// monitor delivers the events to its callback in a dedicated go routine, the events are
+// kept in order and the cluster would never be blocked by a slow callback.
+type monitor struct {
+	filters  map[string][]string
+	callback adoc.EventCallback
+
+	sync.Mutex
+	stopped bool
+	queue   []eventItem
+	notify  chan struct{}
+	pending sync.WaitGroup
+}
+
+func newMonitor(filter string, callback adoc.EventCallback) *monitor {
+	m := &monitor{
+		filters:  make(map[string][]string),
+		callback: callback,
+		notify:   make(chan struct{}, 1),
+	}
+	if filter != "" {
+		json.Unmarshal([]byte(filter), &m.filters)
+	}
+	go m.pump()
+	return m
+}
+
+func (m *monitor) push(item eventItem) {
+	m.Lock()
+	defer m.Unlock()
+	if m.stopped {
+		return
+	}
+	if item.err == nil && !m.accept(item.event) {
+		return
+	}
+	m.queue = append(m.queue, item)
+	m.pending.Add(1)
+	select {
+	case m.notify <- struct{}{}:
+	default:
+	}
+}
+
+func (m *monitor) pump() {
+	for range m.notify {
+		for {
+			m.Lock()
+			if len(m.queue) == 0 {
+				m.Unlock()
+				break
+			}
+			item := m.queue[0]
+			m.queue = m.queue[1:]
+			m.Unlock()
+			m.callback(item.event, item.err)
+			m.pending.Done()
+		}
+	}
+}
+
+func (m *monitor) stop() {
+	m.Lock()
+	defer m.Unlock()
+	if m.stopped {
+		return
+	}
+	m.stopped = true
+	for range m.queue {
+		m.pending.Done()
+	}
+	m.queue = nil
+	close(m.notify)
+}
+
+// accept checks the event against the docker event filters, supports type, event, container and label
+func (m *monitor) accept(event adoc.Event) bool {
+	for key, values := range m.filters {
+		if len(values) == 0 {
+			continue
+		}
+		matched := false
+		for _, value := range values {
+			switch key {
+			case "type":
+				matched = event.Type == value
+			case "event":
+				matched = event.Status == value || event.Action == value
+			case "container":
+				matched = event.Type == adoc.ContainerEventType &&
+					(event.ID == value || event.Actor.Attributes["name"] == value)
+			case "label":
+				parts := strings.SplitN(value, "=", 2)
+				labelValue, ok := event.Actor.Attributes[parts[0]]
+				matched = ok && (len(parts) == 1 || labelValue == parts[1])
+			default:
+				matched = true
+			}
+			if matched {
+				break
+			}
+		}
+		if !matched {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,96 @@
+package cluster
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+const (
+	FilterConstraint = "constraint"
+	FilterAffinity   = "affinity"
+)
+
+// FilterExpr is one swarm scheduling filter passed by the env, like `constraint:node==node1` or
+// `affinity:cc.bdp.lain.deployd.pg_name!=~hello.proc.web.web`, the `~` after the operator means soft.
+type FilterExpr struct {
+	Kind  string
+	Key   string
+	Equal bool
+	Soft  bool
+	Value string
+}
+
+func (expr FilterExpr) String() string {
+	operator := "=="
+	if !expr.Equal {
+		operator = "!="
+	}
+	if expr.Soft {
+		operator += "~"
+	}
+	return fmt.Sprintf("%s:%s%s%s", expr.Kind, expr.Key, operator, expr.Value)
+}
+
+// Match tells if the value matches the expression value, which can be a plain string,
+// a glob pattern with `*` or a regexp surrounded by `/`, the same as swarm does.
+func (expr FilterExpr) Match(value string) bool {
+	pattern := expr.Value
+	if len(pattern) > 2 && strings.HasPrefix(pattern, "/") && strings.HasSuffix(pattern, "/") {
+		pattern = pattern[1 : len(pattern)-1]
+	} else {
+		pattern = "^" + strings.Replace(regexp.QuoteMeta(pattern), "\\*", ".*", -1) + "$"
+	}
+	re, err := regexp.Compile("(?i)" + pattern)
+	if err != nil {
+		return false
+	}
+	return re.MatchString(value)
+}
+
+// ParseFilters picks out the scheduling filters from the container env,
+// returns the filters and the env left for the container.
+func ParseFilters(env []string) ([]FilterExpr, []string, error) {
+	filters := make([]FilterExpr, 0)
+	leftEnv := make([]string, 0, len(env))
+	for _, e := range env {
+		var kind string
+		if strings.HasPrefix(e, FilterConstraint+":") {
+			kind = FilterConstraint
+		} else if strings.HasPrefix(e, FilterAffinity+":") {
+			kind = FilterAffinity
+		} else {
+			leftEnv = append(leftEnv, e)
+			continue
+		}
+		expr, err := parseFilterExpr(kind, strings.TrimPrefix(e, kind+":"))
+		if err != nil {
+			return nil, nil, err
+		}
+		filters = append(filters, expr)
+	}
+	return filters, leftEnv, nil
+}
+
+func parseFilterExpr(kind, s string) (FilterExpr, error) {
+	expr := FilterExpr{Kind: kind}
+	index := strings.Index(s, "==")
+	expr.Equal = true
+	if neIndex := strings.Index(s, "!="); neIndex >= 0 && (index < 0 || neIndex < index) {
+		index = neIndex
+		expr.Equal = false
+	}
+	if index <= 0 {
+		return expr, fmt.Errorf("Invalid %s expression %q", kind, s)
+	}
+	expr.Key = s[:index]
+	expr.Value = s[index+2:]
+	if strings.HasPrefix(expr.Value, "~") {
+		expr.Soft = true
+		expr.Value = expr.Value[1:]
+	}
+	if expr.Value == "" {
+		return expr, fmt.Errorf("Invalid %s expression %q", kind, s)
+	}
+	return expr, nil
+}
@@ -0,0 +1,55 @@
+package cluster
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// ReadLogs reads the last lines of the stdout and stderr of the container from the docker api at the address,
+// the address is like tcp://<IP>:<PORT>.
+func ReadLogs(addr, id string, tail int, timeout time.Duration) (string, error) {
+	u, err := url.Parse(addr)
+	if err != nil || u.Host == "" {
+		u = &url.URL{Host: addr}
+	}
+	if u.Scheme != "https" {
+		u.Scheme = "http"
+	}
+	u.Path = fmt.Sprintf("/containers/%s/logs", id)
+	u.RawQuery = fmt.Sprintf("stdout=1&stderr=1&tail=%d", tail)
+
+	client := &http.Client{Timeout: timeout}
+	resp, err := client.Get(u.String())
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	data, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return "", err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("Cannot read the logs of container %s, %s: %s", id, resp.Status, strings.TrimSpace(string(data)))
+	}
+	return demuxLogs(data), nil
+}
+
+// demuxLogs strips the stream headers of the logs of the container without tty, every frame has an 8 bytes
+// header of the stream type and the size of the frame.
+func demuxLogs(data []byte) string {
+	var logs []byte
+	for len(data) >= 8 && data[0] <= 2 && data[1] == 0 && data[2] == 0 && data[3] == 0 {
+		size := int(binary.BigEndian.Uint32(data[4:8]))
+		if size > len(data)-8 {
+			size = len(data) - 8
+		}
+		logs = append(logs, data[8:8+size]...)
+		data = data[8+size:]
+	}
+	return string(append(logs, data...))
+}
@@ -10,6 +10,12 @@ import (
 
 type SwarmCluster struct {
 	*adoc.DockerClient
+	addr string
+}
+
+// ContainerLogs reads the last lines of the logs of the container through the swarm master
+func (c *SwarmCluster) ContainerLogs(id string, tail int) (string, error) {
+	return cluster.ReadLogs(c.addr, id, tail, 10*time.Second)
 }
 
 func (c *SwarmCluster) GetResources() ([]cluster.Node, error) {
@@ -26,6 +32,7 @@ func (c *SwarmCluster) GetResources() ([]cluster.Node, error) {
 				UsedCPUs:   node.UsedCPUs,
 				Memory:     node.Memory,
 				UsedMemory: node.UsedMemory,
+				Labels:     node.Labels,
 			}
 		}
 		return nodes, nil
@@ -37,7 +44,7 @@ func NewCluster(addr string, timeout, rwTimeout time.Duration) (cluster.Cluster,
 	if err != nil {
 		return nil, fmt.Errorf("Cannot connect swarm master[%s], %s", addr, err)
 	}
-	swarm := &SwarmCluster{}
+	swarm := &SwarmCluster{addr: addr}
 	swarm.DockerClient = docker
 	return swarm, nil
 }
@@ -0,0 +1,186 @@
+package engine
+
+import (
+	"fmt"
+	"strings"
+)
+
+const (
+	ApplyStepCreate         = "create"
+	ApplyStepUpdatePolicies = "update_policies"
+	ApplyStepScaleIn        = "scale_in"
+	ApplyStepRedeploy       = "redeploy"
+	ApplyStepUpdateInPlace  = "update_in_place"
+	ApplyStepScaleOut       = "scale_out"
+)
+
+// ApplyPlan tells how the pod group is reconciled to the desired spec, the steps are run in order in one operation:
+// the instances are scaled in before the upgrade, and scaled out with the new pod spec after it.
+type ApplyPlan struct {
+	Name        string       `json:"name"`
+	Changes     []SpecChange `json:"changes"`
+	Steps       []string     `json:"steps"`
+	Notes       []string     `json:"notes"`
+	DryRun      bool         `json:"dry_run"`
+	OperationId string       `json:"operation_id,omitempty"`
+}
+
+func (plan ApplyPlan) has(step string) bool {
+	for _, s := range plan.Steps {
+		if s == step {
+			return true
+		}
+	}
+	return false
+}
+
+// ApplyPodGroup reconciles the pod group to the desired spec with the minimal operations, the pod group is created
+// if not exists. Nothing is changed for the dry run, and the plan is returned in both cases.
+func (engine *OrcEngine) ApplyPodGroup(spec PodGroupSpec, dryRun bool) (*ApplyPlan, error) {
+	engine.RLock()
+	pgCtrl, ok := engine.pgCtrls[spec.Name]
+	engine.RUnlock()
+	if !ok {
+		plan := &ApplyPlan{
+			Name:    spec.Name,
+			Changes: []SpecChange{{"NumInstances", SpecChangeScale, 0, spec.NumInstances}},
+			Steps:   []string{ApplyStepCreate},
+			Notes:   []string{},
+			DryRun:  dryRun,
+		}
+		if !dryRun {
+			operationId, err := engine.NewPodGroup(spec)
+			if err != nil {
+				return nil, err
+			}
+			plan.OperationId = operationId
+		}
+		return plan, nil
+	}
+
+	if pgCtrl.IsJob() {
+		return nil, ErrJobNotUpdatable
+	}
+	if pgCtrl.IsDaemon() {
+		return nil, ErrDaemonNotScalable
+	}
+	engine.RLock()
+	defer engine.RUnlock()
+	plan := planApply(pgCtrl.Inspect().Spec, spec)
+	plan.DryRun = dryRun
+	if dryRun || len(plan.Steps) == 0 {
+		return plan, nil
+	}
+	podChanged := plan.has(ApplyStepRedeploy) || plan.has(ApplyStepUpdateInPlace)
+	if podChanged && pgCtrl.InCanary() {
+		return nil, ErrCanaryInProgress
+	}
+	if pgCtrl.InBlueGreen() {
+		return nil, ErrBlueGreenInProgress
+	}
+	if podChanged && !engine.hasEnoughResource(pgCtrl, spec.Pod) {
+		return nil, ErrNotEnoughResources
+	}
+	if err := canOperation(pgCtrl, PGOpStateUpgrading); err != nil {
+		return nil, err
+	}
+	operation := engine.operations.add(spec.Name, "apply")
+	engine.opsChan <- orcOperApply{pgCtrl, operation, spec, *plan}
+	plan.OperationId = operation.Id
+	return plan, nil
+}
+
+// planApply diffs the desired spec against the current one, the pod spec is diffed as it would be merged,
+// so the limits left as 0 keep the current ones.
+func planApply(current, desired PodGroupSpec) *ApplyPlan {
+	plan := &ApplyPlan{
+		Name:    current.Name,
+		Changes: []SpecChange{},
+		Steps:   []string{},
+		Notes:   mergeNotes(current.Pod, desired.Pod),
+	}
+
+	if current.RestartPolicy != desired.RestartPolicy {
+		plan.Changes = append(plan.Changes, SpecChange{"RestartPolicy", SpecChangeMetadata, current.RestartPolicy.String(), desired.RestartPolicy.String()})
+	}
+	if current.UpdateStrategy != desired.UpdateStrategy {
+		plan.Changes = append(plan.Changes, SpecChange{"UpdateStrategy", SpecChangeMetadata, current.UpdateStrategy, desired.UpdateStrategy})
+	}
+	if current.FailurePolicy != desired.FailurePolicy {
+		plan.Changes = append(plan.Changes, SpecChange{"FailurePolicy", SpecChangeMetadata, current.FailurePolicy, desired.FailurePolicy})
+	}
+	if len(plan.Changes) > 0 {
+		plan.Steps = append(plan.Steps, ApplyStepUpdatePolicies)
+	}
+	if desired.NumInstances < current.NumInstances {
+		plan.Steps = append(plan.Steps, ApplyStepScaleIn)
+	}
+	podSpec := current.Pod.Merge(desired.Pod.Clone())
+	if podChanges := DiffPodSpec(current.Pod, podSpec); len(podChanges) > 0 {
+		plan.Changes = append(plan.Changes, podChanges...)
+		if !shouldReDeploy(current.Pod, podSpec) {
+			plan.Steps = append(plan.Steps, ApplyStepUpdateInPlace)
+		} else if shouldResize(current.Pod, podSpec) {
+			plan.Steps = append(plan.Steps, ApplyStepUpdateInPlace, ApplyStepRedeploy)
+		} else {
+			plan.Steps = append(plan.Steps, ApplyStepRedeploy)
+		}
+	}
+	if desired.NumInstances > current.NumInstances {
+		plan.Steps = append(plan.Steps, ApplyStepScaleOut)
+	}
+	if desired.NumInstances != current.NumInstances {
+		plan.Changes = append(plan.Changes, SpecChange{"NumInstances", SpecChangeScale, current.NumInstances, desired.NumInstances})
+	}
+	return plan
+}
+
+// Apply reconciles the pod group to the desired spec by the plan in one operation
+func (pgCtrl *podGroupController) Apply(operation *Operation, desired PodGroupSpec, plan ApplyPlan) {
+	pgCtrl.flushAllOps()
+	pgCtrl.emitOperationEvent(OperationStart)
+	defer func() {
+		pgCtrl.opsChan <- pgOperOver{}
+	}()
+	pgCtrl.RLock()
+	spec := pgCtrl.spec.Clone()
+	pgCtrl.RUnlock()
+	curNumInstances := spec.NumInstances
+	podChanged := plan.has(ApplyStepRedeploy) || plan.has(ApplyStepUpdateInPlace)
+	total := desired.NumInstances - curNumInstances
+	if total < 0 {
+		total *= -1
+	}
+	if podChanged && desired.NumInstances < curNumInstances {
+		total += desired.NumInstances
+	} else if podChanged {
+		total += curNumInstances
+	}
+	pgCtrl.beginOperation(operation, total)
+	pgCtrl.emptyError()
+
+	spec.RestartPolicy = desired.RestartPolicy
+	spec.UpdateStrategy = desired.UpdateStrategy
+	spec.FailurePolicy = desired.FailurePolicy
+	if desired.NumInstances < curNumInstances {
+		spec.NumInstances = desired.NumInstances
+	}
+	pgCtrl.Lock()
+	pgCtrl.spec = spec
+	pgCtrl.Unlock()
+	pgCtrl.opsChan <- pgOperLogOperation{fmt.Sprintf("Start to apply %s", strings.Join(plan.Steps, ", "))}
+	pgCtrl.opsChan <- pgOperSaveStore{true}
+	pgCtrl.scaleInstances(spec, curNumInstances)
+	if podChanged && !pgCtrl.rescheduleSpec(spec, desired.Pod) {
+		return
+	}
+	if desired.NumInstances > curNumInstances {
+		pgCtrl.Lock()
+		pgCtrl.spec.NumInstances = desired.NumInstances
+		spec = pgCtrl.spec.Clone()
+		pgCtrl.Unlock()
+		pgCtrl.opsChan <- pgOperSaveStore{true}
+		pgCtrl.scaleInstances(spec, curNumInstances)
+	}
+	pgCtrl.opsChan <- pgOperLogOperation{"Apply finished"}
+}
@@ -0,0 +1,76 @@
+package engine
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestApplyPodGroup(t *testing.T) {
+	engine, _, _ := initFakeEngine(t, 2)
+	defer engine.Stop()
+
+	namespace, name := "hello", "hello.proc.web.web"
+	pgSpec := createPodGroupSpec(namespace, name, 2)
+	pgSpec.UpdateStrategy = UpdateStrategy{MaxSurge: 1}
+	plan, err := engine.ApplyPodGroup(pgSpec, true)
+	if err != nil || !reflect.DeepEqual(plan.Steps, []string{ApplyStepCreate}) || plan.OperationId != "" {
+		t.Fatalf("Should plan to create the pod group, got %+v, %v", plan, err)
+	}
+	if _, ok := engine.InspectPodGroup(name); ok {
+		t.Fatalf("Should not create the pod group for the dry run")
+	}
+	if plan, err = engine.ApplyPodGroup(pgSpec, false); err != nil {
+		t.Fatalf("Should be able to create the pod group, %s", err)
+	}
+	waitOperationEnded(t, engine, plan.OperationId)
+
+	// the memory limit left as 0 keeps the current one
+	pgSpec = pgSpec.Clone()
+	pgSpec.NumInstances = 3
+	pgSpec.Pod.Containers[0].Command = []string{"/bin/sh", "-c", "sleep 3600"}
+	pgSpec.Pod.Containers[0].MemoryLimit = 0
+	if plan, err = engine.ApplyPodGroup(pgSpec, true); err != nil {
+		t.Fatalf("Should be able to plan the apply, %s", err)
+	}
+	if !reflect.DeepEqual(plan.Steps, []string{ApplyStepRedeploy, ApplyStepScaleOut}) || len(plan.Changes) != 2 ||
+		plan.Changes[0].Field != "container[0].Command" || plan.Changes[1].Field != "NumInstances" || len(plan.Notes) != 1 {
+		t.Fatalf("Should plan to redeploy and scale out with the memory limit kept, got %+v", plan)
+	}
+	resized := pgSpec.Clone()
+	resized.Pod.Containers[0].MemoryLimit = 30 * 1024 * 1024
+	if plan, err := engine.ApplyPodGroup(resized, true); err != nil ||
+		!reflect.DeepEqual(plan.Steps, []string{ApplyStepUpdateInPlace, ApplyStepRedeploy, ApplyStepScaleOut}) {
+		t.Fatalf("Should plan to resize in place before the redeploy, got %+v, %v", plan, err)
+	}
+	if plan, err = engine.ApplyPodGroup(pgSpec, false); err != nil {
+		t.Fatalf("Should be able to apply the spec, %s", err)
+	}
+	if o := waitOperationEnded(t, engine, plan.OperationId); o.Type != "apply" || o.Status != OperationSucceeded || o.Done != 3 {
+		t.Fatalf("Should upgrade the 2 instances and deploy the new one, got %+v", o)
+	}
+	pg, _ := engine.InspectPodGroup(name)
+	if pg.Spec.Version != 2 || len(pg.Pods) != 3 || pg.Spec.Pod.Containers[0].MemoryLimit != 15*1024*1024 {
+		t.Fatalf("Should reconcile the pod group to the spec, got %+v", pg.Spec)
+	}
+	for _, pod := range pg.Pods {
+		if pod.State != RunStateSuccess || pod.Containers[0].Runtime.Config.Cmd[2] != "sleep 3600" {
+			t.Errorf("Should run all the instances with the new command, got %+v", pod)
+		}
+	}
+
+	// the same spec has nothing to do, and the policies are changed by an operation as well
+	if plan, err = engine.ApplyPodGroup(pgSpec, false); err != nil || len(plan.Steps) != 0 || len(plan.Changes) != 0 {
+		t.Errorf("Should have nothing to apply for the same spec, got %+v, %v", plan, err)
+	}
+	pgSpec.FailurePolicy = FailurePolicy{Action: FailureActionPause}
+	if plan, err = engine.ApplyPodGroup(pgSpec, false); err != nil ||
+		!reflect.DeepEqual(plan.Steps, []string{ApplyStepUpdatePolicies}) || plan.OperationId == "" {
+		t.Fatalf("Should only update the policies, got %+v, %v", plan, err)
+	}
+	if o := waitOperationEnded(t, engine, plan.OperationId); o.Status != OperationSucceeded || o.Total != 0 {
+		t.Fatalf("Should update the policies in an operation, got %+v", o)
+	}
+	if pg, _ = engine.InspectPodGroup(name); pg.Spec.FailurePolicy.Action != FailureActionPause {
+		t.Errorf("Should update the failure policy, got %+v", pg.Spec.FailurePolicy)
+	}
+}
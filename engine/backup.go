@@ -0,0 +1,248 @@
+package engine
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/laincloud/deployd/storage"
+	"github.com/mijia/sweb/log"
+)
+
+const (
+	BackupFormat  = "lain-deployd-backup"
+	BackupVersion = 1
+
+	kLainConfigRootKey = "/lain/config"
+)
+
+var (
+	// BackupRoots are all the key spaces owned by deployd
+	BackupRoots = []string{kLainDeploydRootKey, kLainConfigRootKey}
+
+	// the leader key belongs to the running electors, the operating marks and the last specs expire with the
+	// operations, none of them make sense out of the running cluster
+	backupExcludedKeys = []string{
+		kLainDeploydRootKey + "/leader",
+		kLainDeploydRootKey + "/" + kLainPgOpingKey,
+		kLainDeploydRootKey + "/" + kLainLastPodSpecKey,
+	}
+)
+
+type BackupEntry struct {
+	Key   string `json:"key"`
+	Value string `json:"value"`
+}
+
+// BackupArchive is the self-describing dump of the deployd state, values are kept as the raw strings
+// in the store so that the archive can be restored byte to byte.
+type BackupArchive struct {
+	Format    string        `json:"format"`
+	Version   int           `json:"version"`
+	CreatedAt time.Time     `json:"created_at"`
+	Roots     []string      `json:"roots"`
+	Checksum  string        `json:"checksum"`
+	Entries   []BackupEntry `json:"entries"`
+}
+
+type RestoreResult struct {
+	DryRun  bool     `json:"dry_run"`
+	Keys    []string `json:"keys"`
+	Skipped []string `json:"skipped"` // the keys out of /lain/deployd already in the store, which are kept
+}
+
+// NewBackup walks all the backup roots in the store and dumps every leaf key into the archive
+func NewBackup(store storage.Store) (*BackupArchive, error) {
+	entries, err := dumpEntries(store)
+	if err != nil {
+		return nil, err
+	}
+	archive := &BackupArchive{
+		Format:    BackupFormat,
+		Version:   BackupVersion,
+		CreatedAt: time.Now(),
+		Roots:     BackupRoots,
+		Entries:   entries,
+	}
+	archive.Checksum = archive.checksum()
+	return archive, nil
+}
+
+// Validate checks the archive is a deployd backup which can be restored by this version
+func (archive *BackupArchive) Validate() error {
+	if archive.Format != BackupFormat {
+		return fmt.Errorf("Unknown backup format %q", archive.Format)
+	}
+	if archive.Version <= 0 || archive.Version > BackupVersion {
+		return fmt.Errorf("Unsupported backup version %d, supports up to %d", archive.Version, BackupVersion)
+	}
+	if archive.Checksum != archive.checksum() {
+		return fmt.Errorf("Backup checksum mismatch, the archive may be corrupted")
+	}
+	keys := make(map[string]struct{}, len(archive.Entries))
+	for _, entry := range archive.Entries {
+		if !isBackupKey(entry.Key) {
+			return fmt.Errorf("Key %q is out of the deployd key spaces", entry.Key)
+		}
+		if _, ok := keys[entry.Key]; ok {
+			return fmt.Errorf("Duplicated key %q in backup", entry.Key)
+		}
+		keys[entry.Key] = struct{}{}
+	}
+	return nil
+}
+
+func (archive *BackupArchive) checksum() string {
+	h := sha256.New()
+	for _, entry := range archive.Entries {
+		fmt.Fprintf(h, "%s\x00%s\x00", entry.Key, entry.Value)
+	}
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// RestoreBackup loads the archive into the store, the store should have nothing under /lain/deployd. The keys
+// under the other roots, e.g. /lain/config which is populated by lain, are kept if they are already in the store.
+// With dryRun, nothing will be written and the keys which would be written are returned.
+func RestoreBackup(store storage.Store, archive *BackupArchive, dryRun bool) (*RestoreResult, error) {
+	if err := archive.Validate(); err != nil {
+		return nil, err
+	}
+	existed := make([]BackupEntry, 0)
+	if err := dumpKey(store, kLainDeploydRootKey, &existed); err != nil {
+		return nil, err
+	}
+	if len(existed) > 0 {
+		return nil, fmt.Errorf("Store is not empty, found %d keys like %q", len(existed), existed[0].Key)
+	}
+
+	result := &RestoreResult{DryRun: dryRun, Keys: make([]string, 0, len(archive.Entries)), Skipped: []string{}}
+	for _, entry := range archive.Entries {
+		owned := strings.HasPrefix(entry.Key, kLainDeploydRootKey+"/")
+		if !owned {
+			if _, err := store.GetRaw(entry.Key); err == nil {
+				result.Skipped = append(result.Skipped, entry.Key)
+				continue
+			} else if err != storage.KMissingError {
+				return result, fmt.Errorf("Failed to check key %q, %s", entry.Key, err)
+			}
+		}
+		if !dryRun {
+			// never overwrite anything, in case others are writing to the store at the same time
+			if _, err := store.SetIfAbsent(entry.Key, storage.RawValue(entry.Value), 0); err != nil {
+				if err == storage.KKeyExistsError && !owned {
+					result.Skipped = append(result.Skipped, entry.Key)
+					continue
+				}
+				return result, fmt.Errorf("Failed to restore key %q after %d keys restored, %s", entry.Key, len(result.Keys), err)
+			}
+		}
+		result.Keys = append(result.Keys, entry.Key)
+	}
+	if !dryRun {
+		log.Infof("Restored %d keys from backup created at %s", len(result.Keys), archive.CreatedAt)
+	}
+	return result, nil
+}
+
+func dumpEntries(store storage.Store) ([]BackupEntry, error) {
+	entries := make([]BackupEntry, 0)
+	for _, root := range BackupRoots {
+		if err := dumpKey(store, root, &entries); err != nil {
+			return nil, err
+		}
+	}
+	sort.Sort(byBackupKey(entries))
+	return entries, nil
+}
+
+func dumpKey(store storage.Store, key string, entries *[]BackupEntry) error {
+	if isExcludedKey(key) {
+		return nil
+	}
+	value, err := store.GetRaw(key)
+	switch err {
+	case nil:
+		*entries = append(*entries, BackupEntry{Key: key, Value: value})
+		return nil
+	case storage.KMissingError:
+		return nil
+	case storage.KDirNodeError:
+	default:
+		return err
+	}
+	keys, err := store.KeysByPrefix(key)
+	if err != nil {
+		if err == storage.KMissingError {
+			return nil
+		}
+		return err
+	}
+	for _, child := range keys {
+		if err := dumpKey(store, child, entries); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func isBackupKey(key string) bool {
+	if isExcludedKey(key) {
+		return false
+	}
+	for _, root := range BackupRoots {
+		if strings.HasPrefix(key, root+"/") {
+			return true
+		}
+	}
+	return false
+}
+
+func isExcludedKey(key string) bool {
+	for _, excluded := range backupExcludedKeys {
+		if key == excluded || strings.HasPrefix(key, excluded+"/") {
+			return true
+		}
+	}
+	return false
+}
+
+type byBackupKey []BackupEntry
+
+func (entries byBackupKey) Len() int           { return len(entries) }
+func (entries byBackupKey) Swap(i, j int)      { entries[i], entries[j] = entries[j], entries[i] }
+func (entries byBackupKey) Less(i, j int) bool { return entries[i].Key < entries[j].Key }
+
+func (engine *OrcEngine) Backup() (*BackupArchive, error) {
+	return NewBackup(engine.store)
+}
+
+// Restore loads the archive into the store of a fresh engine, and reloads the engine from the restored data
+func (engine *OrcEngine) Restore(archive *BackupArchive, dryRun bool) (*RestoreResult, error) {
+	engine.Lock()
+	defer engine.Unlock()
+	if len(engine.pgCtrls) > 0 || len(engine.dependsCtrls) > 0 {
+		return nil, fmt.Errorf("Engine is managing pod groups or dependency pods, can only restore into an empty deployd")
+	}
+	result, err := RestoreBackup(engine.store, archive, dryRun)
+	if err != nil || dryRun {
+		return result, err
+	}
+
+	configSpecsVars(engine.store)
+	if err := cstController.LoadConstraints(engine.store); err != nil {
+		return result, err
+	}
+	if err := ntfController.LoadNotifies(engine.store); err != nil {
+		return result, err
+	}
+	if err := engine.LoadDependsPods(); err != nil {
+		return result, err
+	}
+	if err := engine.LoadPodGroups(); err != nil {
+		return result, err
+	}
+	return result, nil
+}
@@ -0,0 +1,108 @@
+package engine
+
+import (
+	"encoding/json"
+	"testing"
+
+	"github.com/laincloud/deployd/storage"
+	"github.com/laincloud/deployd/storage/memory"
+)
+
+func TestBackupAndRestore(t *testing.T) {
+	store := memory.NewStore()
+	pgKey := kLainDeploydRootKey + "/" + kLainPodGroupKey + "/hello/hello.proc.web"
+	store.Set(pgKey, PodGroupWithSpec{Spec: createPodGroupSpec("hello", "hello.proc.web", 1)})
+	store.Set(KeyPrefixStreamPorts+"/9000", StreamProc{StreamPort: StreamPort{SrcPort: 9000, DstPort: 80, Proto: "tcp"}})
+	store.Set(EtcdCloudVolumeRootKey, storage.RawValue("/mfs/lain/cloud-volumes"))
+	store.Set(kLainDeploydRootKey+"/leader", "127.0.0.1:9000")
+	store.SetWithTTL(kLainDeploydRootKey+"/"+kLainPgOpingKey+"/hello.proc.web", "Start", 60)
+	store.SetWithTTL(kLainDeploydRootKey+"/"+kLainLastPodSpecKey+"/hello/hello.proc.web", createPodSpec("hello", "hello.proc.web"), 600)
+
+	archive, err := NewBackup(store)
+	if err != nil {
+		t.Fatalf("Should be able to backup the store, %s", err)
+	}
+	if len(archive.Entries) != 3 {
+		t.Fatalf("Should backup 3 keys without the leader, operating marks and last specs, %+v", archive.Entries)
+	}
+	if err := archive.Validate(); err != nil {
+		t.Fatalf("Should be a valid archive, %s", err)
+	}
+
+	// the archive should survive the json round trip
+	data, err := json.Marshal(archive)
+	if err != nil {
+		t.Fatalf("Should be able to encode the archive, %s", err)
+	}
+	var decoded BackupArchive
+	if err := json.Unmarshal(data, &decoded); err != nil {
+		t.Fatalf("Should be able to decode the archive, %s", err)
+	}
+
+	if _, err := RestoreBackup(store, &decoded, true); err == nil {
+		t.Errorf("Should not restore into a non-empty store")
+	}
+
+	target := memory.NewStore()
+	result, err := RestoreBackup(target, &decoded, true)
+	if err != nil {
+		t.Fatalf("Should be able to dry run the restore, %s", err)
+	}
+	if !result.DryRun || len(result.Keys) != 3 {
+		t.Errorf("Should show the 3 keys to write, %+v", result)
+	}
+	if keys, _ := target.KeysByPrefix(kLainDeploydRootKey); len(keys) != 0 {
+		t.Errorf("Should write nothing in dry run, %v", keys)
+	}
+
+	if _, err := RestoreBackup(target, &decoded, false); err != nil {
+		t.Fatalf("Should be able to restore into an empty store, %s", err)
+	}
+	for _, entry := range archive.Entries {
+		if value, err := target.GetRaw(entry.Key); err != nil || value != entry.Value {
+			t.Errorf("Should restore %q as %q, got %q, %v", entry.Key, entry.Value, value, err)
+		}
+	}
+
+	// the config of lain is already in the store of a live cluster, it is kept as it is
+	live := memory.NewStore()
+	live.Set(EtcdCloudVolumeRootKey, storage.RawValue("/data/cloud-volumes"))
+	result, err = RestoreBackup(live, &decoded, false)
+	if err != nil {
+		t.Fatalf("Should be able to restore with the lain config in the store, %s", err)
+	}
+	if len(result.Keys) != 2 || len(result.Skipped) != 1 || result.Skipped[0] != EtcdCloudVolumeRootKey {
+		t.Errorf("Should skip the lain config in the store, %+v", result)
+	}
+	if value, _ := live.GetRaw(EtcdCloudVolumeRootKey); value != "/data/cloud-volumes" {
+		t.Errorf("Should not overwrite the lain config, got %q", value)
+	}
+}
+
+func TestBackupValidate(t *testing.T) {
+	store := memory.NewStore()
+	store.Set(KeyPrefixStreamPorts+"/9000", StreamProc{})
+	archive, err := NewBackup(store)
+	if err != nil {
+		t.Fatalf("Should be able to backup the store, %s", err)
+	}
+
+	corrupted := *archive
+	corrupted.Entries = []BackupEntry{{Key: KeyPrefixStreamPorts + "/9000", Value: "{}"}}
+	if err := corrupted.Validate(); err == nil {
+		t.Errorf("Should reject the archive with mismatched checksum")
+	}
+
+	unknown := *archive
+	unknown.Version = BackupVersion + 1
+	if err := unknown.Validate(); err == nil {
+		t.Errorf("Should reject the archive of a newer version")
+	}
+
+	outside := *archive
+	outside.Entries = []BackupEntry{{Key: "/lain/other/key", Value: "{}"}}
+	outside.Checksum = outside.checksum()
+	if err := outside.Validate(); err == nil {
+		t.Errorf("Should reject the keys out of the deployd key spaces")
+	}
+}
@@ -0,0 +1,370 @@
+package engine
+
+import (
+	"errors"
+	"time"
+
+	"github.com/laincloud/deployd/cluster"
+	"github.com/laincloud/deployd/storage"
+	"github.com/mijia/sweb/log"
+)
+
+const (
+	DefaultBlueGreenRemoveDelay = 300
+)
+
+var (
+	ErrBlueGreenInProgress = errors.New("PodGroup has a blue-green deployment in progress, switch or discard it first")
+	ErrBlueGreenNotExists  = errors.New("PodGroup has no blue-green deployment in progress")
+	ErrBlueGreenNotReady   = errors.New("The new pods of the blue-green deployment are not all running")
+	ErrBlueGreenStateful   = errors.New("Blue-green deployment is only for the stateless pod groups")
+)
+
+// DeployBlueGreen deploys the pod spec as a complete new set of pods next to the running ones,
+// the dependency events are not emitted for the new pods until the group is switched to them.
+func (pgCtrl *podGroupController) DeployBlueGreen(operation *Operation, podSpec PodSpec, removeDelay int) {
+	pgCtrl.flushAllOps()
+	pgCtrl.emitOperationEvent(OperationStart)
+	defer func() {
+		pgCtrl.opsChan <- pgOperOver{}
+	}()
+	pgCtrl.RLock()
+	spec := pgCtrl.spec.Clone()
+	pgCtrl.RUnlock()
+	pgCtrl.beginOperation(operation, spec.NumInstances)
+	pgCtrl.emptyError()
+	blueGreen := BlueGreenSpec{
+		Version:     spec.nextVersion(),
+		Pod:         spec.Pod.Merge(podSpec),
+		RemoveDelay: removeDelay,
+	}
+	blueGreen.Pod.Version = blueGreen.Version
+	spec.BlueGreen = &blueGreen
+	spec.UpdatedAt = time.Now()
+	pgCtrl.Lock()
+	pgCtrl.spec = spec
+	pgCtrl.greenCtrls = nil
+	pgCtrl.Unlock()
+	pgCtrl.opsChan <- pgOperLogOperation{"Start to deploy blue-green"}
+	pgCtrl.opsChan <- pgOperSaveStore{true}
+	for i := 0; i < spec.NumInstances; i += 1 {
+		pgCtrl.opsChan <- pgOperDeployGreenInstance{i + 1}
+	}
+	pgCtrl.opsChan <- pgOperSnapshotGroup{true}
+	pgCtrl.opsChan <- pgOperSaveStore{true}
+	pgCtrl.opsChan <- pgOperLogOperation{"Deploy blue-green finished"}
+}
+
+// SwitchBlueGreen makes the new pods the pods of the group, the dependency events are emitted for them
+// and the old pods are removed after the remove delay of the blue-green deployment.
+func (pgCtrl *podGroupController) SwitchBlueGreen(operation *Operation) {
+	pgCtrl.flushAllOps()
+	pgCtrl.emitOperationEvent(OperationStart)
+	defer func() {
+		pgCtrl.opsChan <- pgOperOver{}
+	}()
+	pgCtrl.RLock()
+	spec := pgCtrl.spec.Clone()
+	pgCtrl.RUnlock()
+	if spec.BlueGreen == nil {
+		pgCtrl.beginOperation(operation, 0)
+		return
+	}
+	pgCtrl.beginOperation(operation, spec.NumInstances)
+	pgCtrl.emptyError()
+	blueGreen := *spec.BlueGreen
+	if ok := pgCtrl.updatePodPorts(blueGreen.Pod); !ok {
+		return
+	}
+	oldPodSpec := spec.Pod
+	spec.Pod, spec.Version, spec.BlueGreen = blueGreen.Pod, blueGreen.Version, nil
+	spec.UpdatedAt = time.Now()
+	pgCtrl.Lock()
+	pgCtrl.spec = spec
+	pgCtrl.Unlock()
+	pgCtrl.opsChan <- pgOperLogOperation{"Start to switch blue-green"}
+	pgCtrl.opsChan <- pgOperSwitchBlueGreen{spec.NumInstances, oldPodSpec.Version, blueGreen.RemoveDelay}
+	pgCtrl.opsChan <- pgOperSnapshotGroup{true}
+	pgCtrl.opsChan <- pgOperSnapshotPrevState{}
+	pgCtrl.opsChan <- pgOperSaveStore{true}
+	pgCtrl.opsChan <- pgOperSaveRevision{spec, "Blue-green switched, " + specChangeSummary(oldPodSpec, spec.Pod)}
+	pgCtrl.opsChan <- pgOperLogOperation{"Switch blue-green finished"}
+}
+
+// DiscardBlueGreen removes the new pods of the blue-green deployment, the group keeps running as it is
+func (pgCtrl *podGroupController) DiscardBlueGreen(operation *Operation) {
+	pgCtrl.flushAllOps()
+	pgCtrl.emitOperationEvent(OperationStart)
+	defer func() {
+		pgCtrl.opsChan <- pgOperOver{}
+	}()
+	pgCtrl.Lock()
+	spec := pgCtrl.spec.Clone()
+	spec.BlueGreen = nil
+	spec.UpdatedAt = time.Now()
+	pgCtrl.spec = spec
+	greens := len(pgCtrl.greenCtrls)
+	pgCtrl.Unlock()
+	pgCtrl.beginOperation(operation, greens)
+	pgCtrl.emptyError()
+	pgCtrl.opsChan <- pgOperLogOperation{"Start to discard blue-green"}
+	pgCtrl.opsChan <- pgOperRemoveGreen{}
+	pgCtrl.opsChan <- pgOperSnapshotGroup{true}
+	pgCtrl.opsChan <- pgOperSaveStore{true}
+	pgCtrl.opsChan <- pgOperLogOperation{"Discard blue-green finished"}
+}
+
+// InBlueGreen tells if the pod group has a blue-green deployment not switched yet
+func (pgCtrl *podGroupController) InBlueGreen() bool {
+	pgCtrl.RLock()
+	defer pgCtrl.RUnlock()
+	return pgCtrl.spec.BlueGreen != nil
+}
+
+// IsBlueGreenReady tells if all the new pods of the blue-green deployment are running
+func (pgCtrl *podGroupController) IsBlueGreenReady() bool {
+	pgCtrl.RLock()
+	defer pgCtrl.RUnlock()
+	if pgCtrl.spec.BlueGreen == nil || len(pgCtrl.greenCtrls) != pgCtrl.spec.NumInstances {
+		return false
+	}
+	for _, green := range pgCtrl.greenCtrls {
+		if green.pod.State != RunStateSuccess || green.pod.Healthst == HealthStateUnHealthy {
+			return false
+		}
+	}
+	return true
+}
+
+// isSideContainer tells if the container belongs to the pods running alongside the group, the new pods
+// of the blue-green deployment or the old pods waiting to be removed, which are not the instances of the group.
+// Should be called with the lock held.
+func (pgCtrl *podGroupController) isSideContainer(pod RuntimeEaglePod) bool {
+	if pgCtrl.spec.BlueGreen != nil && pod.Version == pgCtrl.spec.BlueGreen.Version {
+		return true
+	}
+	return len(pgCtrl.retiredCtrls) > 0 && pod.Version == pgCtrl.retiredVersion && time.Now().Before(pgCtrl.retireAt)
+}
+
+type pgOperDeployGreenInstance struct {
+	instanceNo int
+}
+
+func (op pgOperDeployGreenInstance) Do(pgCtrl *podGroupController, c cluster.Cluster, store storage.Store, ev *RuntimeEagleView) bool {
+	var runtime ImRuntime
+	start := time.Now()
+	defer func() {
+		pgCtrl.RLock()
+		log.Infof("%s deploy green instance, iNo=%d, runtime=%+v, duration=%s", pgCtrl, op.instanceNo, runtime, time.Now().Sub(start))
+		pgCtrl.RUnlock()
+	}()
+	pgCtrl.RLock()
+	blueGreen := pgCtrl.spec.BlueGreen
+	pgCtrl.RUnlock()
+	if blueGreen == nil || op.instanceNo > len(pgCtrl.podCtrls) {
+		return false
+	}
+	spec := blueGreen.Pod.Clone()
+	spec.PrevState = NewPodPrevState(len(spec.Containers))
+	green := &podController{
+		spec:  spec,
+		pod:   Pod{InstanceNo: op.instanceNo},
+		event: pgCtrl.podCtrls[op.instanceNo-1].event,
+	}
+	green.pod.State = RunStatePending
+	green.Deploy(c)
+	runtime = green.pod.ImRuntime
+	pgCtrl.Lock()
+	pgCtrl.greenCtrls = append(pgCtrl.greenCtrls, green)
+	pgCtrl.Unlock()
+	return false
+}
+
+// pgOperSwitchBlueGreen swaps the new pods in as the instances of the group, the old pods are retired
+// and removed after the delay.
+type pgOperSwitchBlueGreen struct {
+	numInstances int
+	oldVersion   int
+	removeDelay  int
+}
+
+func (op pgOperSwitchBlueGreen) Do(pgCtrl *podGroupController, c cluster.Cluster, store storage.Store, ev *RuntimeEagleView) bool {
+	start := time.Now()
+	defer func() {
+		pgCtrl.RLock()
+		log.Infof("%s switch blue-green, op=%+v, duration=%s", pgCtrl, op, time.Now().Sub(start))
+		pgCtrl.RUnlock()
+	}()
+	pgCtrl.Lock()
+	retired := pgCtrl.podCtrls
+	pgCtrl.podCtrls, pgCtrl.greenCtrls = pgCtrl.greenCtrls, nil
+	pgCtrl.retiredCtrls, pgCtrl.retiredVersion = retired, op.oldVersion
+	pgCtrl.retireAt = time.Now().Add(time.Duration(op.removeDelay) * time.Second)
+	pgCtrl.Unlock()
+	for _, podCtrl := range pgCtrl.podCtrls {
+		pod := podCtrl.pod.Clone()
+		pgCtrl.emitChangeEvent("add", podCtrl.spec, pod, pod.NodeName())
+	}
+	for _, podCtrl := range retired {
+		pgCtrl.forgetContainers(podCtrl.pod.ContainerIds())
+		pgCtrl.emitChangeEvent("remove", podCtrl.spec, podCtrl.pod, podCtrl.pod.NodeName())
+	}
+	pgCtrl.RLock()
+	retireAt := pgCtrl.retireAt
+	pgCtrl.RUnlock()
+	pgCtrl.removeRetiredAt(op.oldVersion, retireAt)
+	return false
+}
+
+// removeRetiredAt queues the removal of the retired pods of the version at the deadline, the removal is
+// given up if the operation loop has exited by then.
+func (pgCtrl *podGroupController) removeRetiredAt(version int, retireAt time.Time) {
+	time.AfterFunc(retireAt.Sub(time.Now()), func() {
+		select {
+		case pgCtrl.opsChan <- pgOperRemoveRetired{version}:
+		case <-pgCtrl.quit:
+		}
+	})
+}
+
+func (op pgOperSwitchBlueGreen) instances() int {
+	return op.numInstances
+}
+
+// pgOperRemoveRetired removes the old pods retired by the blue-green switch of the version
+type pgOperRemoveRetired struct {
+	version int
+}
+
+func (op pgOperRemoveRetired) Do(pgCtrl *podGroupController, c cluster.Cluster, store storage.Store, ev *RuntimeEagleView) bool {
+	pgCtrl.Lock()
+	if op.version != pgCtrl.retiredVersion {
+		pgCtrl.Unlock()
+		return false
+	}
+	retired := pgCtrl.retiredCtrls
+	pgCtrl.retiredCtrls, pgCtrl.retiredVersion, pgCtrl.retireAt = nil, 0, time.Time{}
+	pgCtrl.Unlock()
+	for _, podCtrl := range retired {
+		ids := podCtrl.pod.ContainerIds()
+		podCtrl.Remove(c)
+		pgCtrl.forgetContainers(ids)
+	}
+	pgCtrl.RLock()
+	log.Infof("%s removed the %d pods retired by the blue-green switch", pgCtrl, len(retired))
+	pgCtrl.RUnlock()
+	// the retired pods are dropped from the stored record
+	lowOp1 := pgOperSnapshotGroup{true}
+	lowOp1.Do(pgCtrl, c, store, ev)
+	lowOp2 := pgOperSaveStore{true}
+	lowOp2.Do(pgCtrl, c, store, ev)
+	return false
+}
+
+// pgOperRemoveGreen removes the new pods of the blue-green deployment
+type pgOperRemoveGreen struct{}
+
+func (op pgOperRemoveGreen) Do(pgCtrl *podGroupController, c cluster.Cluster, store storage.Store, ev *RuntimeEagleView) bool {
+	pgCtrl.Lock()
+	greens := pgCtrl.greenCtrls
+	pgCtrl.greenCtrls = nil
+	pgCtrl.Unlock()
+	for _, green := range greens {
+		green.Remove(c)
+	}
+	pgCtrl.RLock()
+	log.Infof("%s removed the %d green pods", pgCtrl, len(greens))
+	pgCtrl.RUnlock()
+	return false
+}
+
+// pgOperRefreshGreen refreshes the runtime of the new pods of the blue-green deployment
+type pgOperRefreshGreen struct{}
+
+func (op pgOperRefreshGreen) Do(pgCtrl *podGroupController, c cluster.Cluster, store storage.Store, ev *RuntimeEagleView) bool {
+	pgCtrl.RLock()
+	greens := pgCtrl.greenCtrls
+	pgCtrl.RUnlock()
+	for _, green := range greens {
+		green.Refresh(c)
+	}
+	return false
+}
+
+// RescheduleBlueGreen deploys the pod spec next to the running pods of the pod group, returns the id of the operation
+func (engine *OrcEngine) RescheduleBlueGreen(name string, podSpec PodSpec, removeDelay int) (string, error) {
+	engine.RLock()
+	defer engine.RUnlock()
+	if pgCtrl, ok := engine.pgCtrls[name]; !ok {
+		return "", ErrPodGroupNotExists
+	} else {
+		if pgCtrl.IsJob() {
+			return "", ErrJobNotUpdatable
+		}
+		if pgCtrl.IsDaemon() {
+			return "", ErrDaemonNotScalable
+		}
+		if pgCtrl.InCanary() {
+			return "", ErrCanaryInProgress
+		}
+		if pgCtrl.InBlueGreen() {
+			return "", ErrBlueGreenInProgress
+		}
+		pgCtrl.RLock()
+		stateful := pgCtrl.spec.Pod.IsStateful() || podSpec.IsStateful()
+		pgCtrl.RUnlock()
+		if stateful {
+			return "", ErrBlueGreenStateful
+		}
+		if !engine.hasEnoughResource(pgCtrl, podSpec) {
+			return "", ErrNotEnoughResources
+		}
+		if err := canOperation(pgCtrl, PGOpStateUpgrading); err != nil {
+			return "", err
+		}
+		operation := engine.operations.add(name, "bluegreen")
+		engine.opsChan <- orcOperDeployBlueGreen{pgCtrl, operation, podSpec, removeDelay}
+		return operation.Id, nil
+	}
+}
+
+// SwitchBlueGreen switches the pod group to the new pods of the blue-green deployment
+func (engine *OrcEngine) SwitchBlueGreen(name string) (string, error) {
+	engine.RLock()
+	defer engine.RUnlock()
+	if pgCtrl, ok := engine.pgCtrls[name]; !ok {
+		return "", ErrPodGroupNotExists
+	} else {
+		if !pgCtrl.InBlueGreen() {
+			return "", ErrBlueGreenNotExists
+		}
+		if !pgCtrl.IsBlueGreenReady() {
+			return "", ErrBlueGreenNotReady
+		}
+		if err := canOperation(pgCtrl, PGOpStateUpgrading); err != nil {
+			return "", err
+		}
+		operation := engine.operations.add(name, "switch")
+		engine.opsChan <- orcOperSwitchBlueGreen{pgCtrl, operation}
+		return operation.Id, nil
+	}
+}
+
+// DiscardBlueGreen removes the new pods of the blue-green deployment of the pod group
+func (engine *OrcEngine) DiscardBlueGreen(name string) (string, error) {
+	engine.RLock()
+	defer engine.RUnlock()
+	if pgCtrl, ok := engine.pgCtrls[name]; !ok {
+		return "", ErrPodGroupNotExists
+	} else {
+		if !pgCtrl.InBlueGreen() {
+			return "", ErrBlueGreenNotExists
+		}
+		if err := canOperation(pgCtrl, PGOpStateUpgrading); err != nil {
+			return "", err
+		}
+		operation := engine.operations.add(name, "discard")
+		engine.opsChan <- orcOperDiscardBlueGreen{pgCtrl, operation}
+		return operation.Id, nil
+	}
+}
@@ -4,7 +4,9 @@ import (
 	"encoding/json"
 
 	"github.com/laincloud/deployd/storage"
+	"github.com/mijia/adoc"
 	"github.com/mijia/sweb/log"
+	"golang.org/x/net/context"
 )
 
 type Device struct {
@@ -29,6 +31,11 @@ type CUpdateConfig struct {
 	CPUQuota   int64 `json:"CpuQuota,omitempty"`   // CPU CFS (Completely Fair Scheduler) quota
 	Memory     int64 `json:"Memory,omitempty"`     // Memory limit (in bytes)
 	MemorySwap int64 `json:"MemorySwap,omitempty"` // Total memory usage (memory + swap); set `-1` to enable unlimited swap
+
+	BlkioDeviceReadBps   []*adoc.ThrottleDevice `json:"BlkioDeviceReadBps,omitempty"`   // Limit read rate (bytes per second) from a device
+	BlkioDeviceWriteBps  []*adoc.ThrottleDevice `json:"BlkioDeviceWriteBps,omitempty"`  // Limit write rate (bytes per second) to a device
+	BlkioDeviceReadIOps  []*adoc.ThrottleDevice `json:"BlkioDeviceReadIOps,omitempty"`  // Limit read rate (IO per second) from a device
+	BlkioDeviceWriteIOps []*adoc.ThrottleDevice `json:"BlkioDeviceWriteIOps,omitempty"` // Limit write rate (IO per second) to a device
 }
 
 const (
@@ -48,31 +55,65 @@ var (
 	guard    = &Guard{Working: true}
 )
 
-func watchGuard(store storage.Store) {
-	watcher(store, EtcdGuardSwitchKey, guard)
+func watchGuard(ctx context.Context, store storage.Store) {
+	watcher(ctx, store, EtcdGuardSwitchKey, func(value string) error {
+		return json.Unmarshal([]byte(value), guard)
+	})
 }
 
-func watchResource(store storage.Store) {
-	watcher(store, EtcdResourcesKey, resource)
+func watchResource(ctx context.Context, store storage.Store) {
+	watcher(ctx, store, EtcdResourcesKey, func(value string) error {
+		return json.Unmarshal([]byte(value), resource)
+	})
 }
 
 func WatchEngineConfig(engine *OrcEngine) {
-	watcher(engine.store, EtcdConfigKey, engine.config)
+	watcher(engine.watchCtx, engine.store, EtcdConfigKey, func(value string) error {
+		var config EngineConfig
+		if err := json.Unmarshal([]byte(value), &config); err != nil {
+			return err
+		}
+		engine.Lock()
+		engine.config = config
+		engine.Unlock()
+		return nil
+	})
 }
 
-func watcher(store storage.Store, key string, v interface{}) {
-	rsCh := store.Watch(key)
-	store.Get(key, v)
+// watcher updates the value by the key until the context is done
+func watcher(ctx context.Context, store storage.Store, key string, update func(value string) error) {
+	events := store.Watch(ctx, key)
+	load := func() {
+		if value, err := store.GetRaw(key); err == nil {
+			if err := update(value); err != nil {
+				log.Warnf("watcher faild with marshall error:%v", err)
+			}
+		} else if err != storage.KMissingError {
+			log.Warnf("watcher failed to get %s, %s", key, err)
+		}
+	}
+	load()
 	go func() {
-		for {
-			select {
-			case rsc := <-rsCh:
-				if err := json.Unmarshal([]byte(rsc), v); err == nil {
-					log.Infof("got value:%v", v)
-				} else {
-					log.Warnf("watcher faild with marshall error:%v", err)
+		for event := range events {
+			if event.Err != nil {
+				log.Warnf("watcher of %s got error:%v", key, event.Err)
+				if event.Err == storage.KWatchCompactedError {
+					// some changes may be missed, read the key again
+					load()
 				}
-				break
+				continue
+			}
+			if event.Key != key {
+				continue
+			}
+			if event.Action != storage.WatchActionSet {
+				log.Warnf("watched key %s is %s, keep the current value", key, event.Action)
+				continue
+			}
+			if err := update(event.Value); err == nil {
+				log.Infof("got value of %s:%s", key, event.Value)
+			} else {
+				log.Warnf("watcher faild with marshall error:%v", err)
 			}
 		}
 	}()
@@ -0,0 +1,393 @@
+package engine
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/laincloud/deployd/storage"
+	"github.com/laincloud/deployd/utils/cron"
+	"github.com/mijia/sweb/log"
+)
+
+const (
+	ConcurrencyAllow   = "allow"
+	ConcurrencyForbid  = "forbid"
+	ConcurrencyReplace = "replace"
+
+	CronRunReplaced = "replaced" // the run was removed by the replace policy at the next tick
+	CronRunRemoved  = "removed"  // the job pod group of the run was removed before it finished
+
+	DefaultCronHistoryLimit = 3
+
+	kLainCronKey = "crons"
+)
+
+// CronCheckInterval is how often the operation worker checks the crons for the ticks due
+var CronCheckInterval = 10 * time.Second
+
+var (
+	ErrCronExists    = errors.New("Cron has already existed")
+	ErrCronNotExists = errors.New("Cron not existed")
+)
+
+// CronSpec launches a run at each tick of the Schedule in the TimeZone, the run is a job pod group of the Pod
+// named after the cron and the tick. ConcurrencyPolicy tells what to do if the last run is still running at the tick:
+// allow runs them at the same time, forbid skips the tick and replace removes the running one first.
+type CronSpec struct {
+	Name              string
+	Namespace         string
+	Schedule          string  // the cron expression, like `0 3 * * *`
+	TimeZone          string  // the IANA time zone of the schedule, like `Asia/Shanghai`, UTC if empty
+	ConcurrencyPolicy string  // allow, forbid or replace, allow if empty
+	HistoryLimit      int     // how many finished runs are kept with their pod groups, 3 if 0
+	Pod               PodSpec // the pod spec of the runs
+	Job               JobSpec // how the pods of a run are run to completion, 1 completion if Completions is 0
+	CreatedAt         time.Time
+}
+
+func (spec CronSpec) Clone() CronSpec {
+	newSpec := spec
+	newSpec.Pod = spec.Pod.Clone()
+	return newSpec
+}
+
+func (spec CronSpec) VerifyParams() bool {
+	if spec.Name == "" || spec.Namespace == "" || spec.HistoryLimit < 0 {
+		return false
+	}
+	if _, err := cron.Parse(spec.Schedule); err != nil {
+		return false
+	}
+	if _, err := time.LoadLocation(spec.TimeZone); err != nil {
+		return false
+	}
+	switch spec.ConcurrencyPolicy {
+	case "", ConcurrencyAllow, ConcurrencyForbid, ConcurrencyReplace:
+	default:
+		return false
+	}
+	return spec.runSpec(spec.Name).VerifyParams()
+}
+
+func (spec CronSpec) GetHistoryLimit() int {
+	if spec.HistoryLimit <= 0 {
+		return DefaultCronHistoryLimit
+	}
+	return spec.HistoryLimit
+}
+
+// runSpec returns the spec of the job pod group of the run
+func (spec CronSpec) runSpec(name string) PodGroupSpec {
+	pgSpec := NewPodGroupSpec(name, spec.Namespace, spec.Pod.Clone(), 0)
+	job := spec.Job
+	if job.Completions == 0 {
+		job.Completions = 1
+	}
+	pgSpec.Job = &job
+	return pgSpec
+}
+
+// CronRun is a job pod group launched by the cron, the status of the job is kept after the pod group is removed
+type CronRun struct {
+	Name        string    // the name of the job pod group
+	ScheduledAt time.Time // the tick of the schedule, or when the run was triggered
+	Manual      bool      // triggered by the api instead of the schedule
+	JobStatus
+}
+
+// CronWithRuns is the cron with the history of its runs from the oldest, all of them are saved in the store
+// so the schedule goes on from LastScheduleAt after the engine is started again, e.g. on the new leader.
+type CronWithRuns struct {
+	Spec           CronSpec
+	LastScheduleAt time.Time // the ticks before it are never run again
+	NextScheduleAt time.Time
+	Runs           []CronRun
+}
+
+func (c CronWithRuns) Clone() CronWithRuns {
+	n := c
+	n.Spec = c.Spec.Clone()
+	n.Runs = append([]CronRun{}, c.Runs...)
+	return n
+}
+
+type cronController struct {
+	sync.Mutex
+	crons map[string]*CronWithRuns
+}
+
+func newCronController() *cronController {
+	return &cronController{crons: make(map[string]*CronWithRuns)}
+}
+
+func cronKey(name string) string {
+	return fmt.Sprintf("%s/%s/%s", kLainDeploydRootKey, kLainCronKey, name)
+}
+
+func (engine *OrcEngine) LoadCrons() error {
+	crons := make(map[string]*CronWithRuns)
+	keys, err := engine.store.KeysByPrefix(fmt.Sprintf("%s/%s", kLainDeploydRootKey, kLainCronKey))
+	if err != nil && err != storage.KMissingError {
+		return err
+	}
+	for _, key := range keys {
+		var c CronWithRuns
+		if err := engine.store.Get(key, &c); err != nil {
+			log.Errorf("Failed to load cron %q from storage, %s", key, err)
+			return err
+		}
+		crons[c.Spec.Name] = &c
+		log.Infof("Loaded cron %s, last scheduled at %s", c.Spec.Name, c.LastScheduleAt)
+	}
+	engine.crons.Lock()
+	engine.crons.crons = crons
+	engine.crons.Unlock()
+	return nil
+}
+
+// NewCron adds the cron, the first run is launched at the next tick of the schedule
+func (engine *OrcEngine) NewCron(spec CronSpec) error {
+	engine.crons.Lock()
+	defer engine.crons.Unlock()
+	if _, ok := engine.crons.crons[spec.Name]; ok {
+		return ErrCronExists
+	}
+	now := time.Now()
+	spec.CreatedAt = now
+	c := &CronWithRuns{Spec: spec, LastScheduleAt: now, Runs: []CronRun{}}
+	c.NextScheduleAt = nextCronTick(spec, now)
+	if err := engine.store.Set(cronKey(spec.Name), c); err != nil {
+		return err
+	}
+	engine.crons.crons[spec.Name] = c
+	return nil
+}
+
+func (engine *OrcEngine) InspectCron(name string) (CronWithRuns, error) {
+	engine.crons.Lock()
+	defer engine.crons.Unlock()
+	if c, ok := engine.crons.crons[name]; ok {
+		return c.Clone(), nil
+	}
+	return CronWithRuns{}, ErrCronNotExists
+}
+
+// ListCrons returns all the crons sorted by the name
+func (engine *OrcEngine) ListCrons() []CronWithRuns {
+	engine.crons.Lock()
+	defer engine.crons.Unlock()
+	crons := []CronWithRuns{}
+	for _, c := range engine.crons.crons {
+		crons = append(crons, c.Clone())
+	}
+	sort.Sort(byCronName(crons))
+	return crons
+}
+
+type byCronName []CronWithRuns
+
+func (crons byCronName) Len() int           { return len(crons) }
+func (crons byCronName) Swap(i, j int)      { crons[i], crons[j] = crons[j], crons[i] }
+func (crons byCronName) Less(i, j int) bool { return crons[i].Spec.Name < crons[j].Spec.Name }
+
+// RemoveCron removes the cron with the job pod groups of its runs
+func (engine *OrcEngine) RemoveCron(name string) error {
+	engine.crons.Lock()
+	defer engine.crons.Unlock()
+	c, ok := engine.crons.crons[name]
+	if !ok {
+		return ErrCronNotExists
+	}
+	if err := engine.store.Remove(cronKey(name)); err != nil && err != storage.KMissingError {
+		return err
+	}
+	delete(engine.crons.crons, name)
+	for _, run := range c.Runs {
+		if run.State != CronRunReplaced && run.State != CronRunRemoved {
+			engine.removeCronRun(run)
+		}
+	}
+	return nil
+}
+
+// TriggerCron launches a run of the cron now, the concurrency policy is not applied to the manual runs
+func (engine *OrcEngine) TriggerCron(name string) (CronRun, error) {
+	engine.crons.Lock()
+	defer engine.crons.Unlock()
+	c, ok := engine.crons.crons[name]
+	if !ok {
+		return CronRun{}, ErrCronNotExists
+	}
+	if err := engine.launchCronRun(c, time.Now(), true); err != nil {
+		return CronRun{}, err
+	}
+	engine.saveCron(c)
+	return c.Runs[len(c.Runs)-1], nil
+}
+
+// checkCrons launches the runs of the ticks due, only the latest one is launched if some ticks were missed.
+// The status of the runs are refreshed from their jobs, and the finished runs beyond the history limit are removed.
+func (engine *OrcEngine) checkCrons(now time.Time) {
+	if engine.ReadOnly() {
+		return
+	}
+	engine.crons.Lock()
+	defer engine.crons.Unlock()
+	for _, c := range engine.crons.crons {
+		changed := engine.refreshCronRuns(c, now)
+		if tick := lastCronTick(c.Spec, c.LastScheduleAt, now); !tick.IsZero() {
+			c.LastScheduleAt = tick
+			if err := engine.launchCronRun(c, tick, false); err != nil {
+				log.Warnf("Failed to launch the run of cron %s at %s, %s", c.Spec.Name, tick, err)
+			}
+			changed = true
+		}
+		if engine.pruneCronRuns(c) {
+			changed = true
+		}
+		if next := nextCronTick(c.Spec, now); !next.Equal(c.NextScheduleAt) {
+			c.NextScheduleAt = next
+			changed = true
+		}
+		if changed {
+			engine.saveCron(c)
+		}
+	}
+}
+
+// launchCronRun launches the job pod group of the run by the concurrency policy of the cron
+func (engine *OrcEngine) launchCronRun(c *CronWithRuns, at time.Time, manual bool) error {
+	if !manual {
+		for i := range c.Runs {
+			run := &c.Runs[i]
+			if run.State != JobStateRunning {
+				continue
+			}
+			switch c.Spec.ConcurrencyPolicy {
+			case ConcurrencyForbid:
+				log.Infof("Cron %s skips the tick at %s, the run %s is still running", c.Spec.Name, at, run.Name)
+				return nil
+			case ConcurrencyReplace:
+				if err := engine.removeCronRun(*run); err != nil {
+					return err
+				}
+				run.State, run.FinishedAt = CronRunReplaced, time.Now()
+			}
+		}
+	}
+	name := fmt.Sprintf("%s-%d", c.Spec.Name, at.Unix())
+	if _, err := engine.NewPodGroup(c.Spec.runSpec(name)); err != nil {
+		return err
+	}
+	log.Infof("Cron %s launched the run %s", c.Spec.Name, name)
+	c.Runs = append(c.Runs, CronRun{
+		Name:        name,
+		ScheduledAt: at,
+		Manual:      manual,
+		JobStatus:   JobStatus{State: JobStateRunning, StartedAt: time.Now()},
+	})
+	return nil
+}
+
+// refreshCronRuns copies the status of the jobs into the runs, returns true if any of them is changed
+func (engine *OrcEngine) refreshCronRuns(c *CronWithRuns, now time.Time) bool {
+	changed := false
+	for i := range c.Runs {
+		run := &c.Runs[i]
+		if run.State == CronRunReplaced || run.State == CronRunRemoved {
+			continue
+		}
+		job, err := engine.InspectJob(run.Name)
+		if err != nil {
+			if run.State == JobStateRunning {
+				run.State, run.FinishedAt = CronRunRemoved, now
+				run.LastError = "The job pod group was removed before it finished"
+				changed = true
+			}
+			continue
+		}
+		if job.Status != run.JobStatus {
+			run.JobStatus = job.Status
+			changed = true
+		}
+	}
+	return changed
+}
+
+// pruneCronRuns removes the oldest finished runs beyond the history limit with their job pod groups
+func (engine *OrcEngine) pruneCronRuns(c *CronWithRuns) bool {
+	finished := 0
+	for _, run := range c.Runs {
+		if run.State != JobStateRunning {
+			finished += 1
+		}
+	}
+	excess := finished - c.Spec.GetHistoryLimit()
+	if excess <= 0 {
+		return false
+	}
+	runs := make([]CronRun, 0, len(c.Runs))
+	for _, run := range c.Runs {
+		if excess > 0 && run.State != JobStateRunning {
+			if run.State == CronRunReplaced || run.State == CronRunRemoved || engine.removeCronRun(run) == nil {
+				excess -= 1
+				continue
+			}
+		}
+		runs = append(runs, run)
+	}
+	changed := len(runs) != len(c.Runs)
+	c.Runs = runs
+	return changed
+}
+
+func (engine *OrcEngine) removeCronRun(run CronRun) error {
+	if _, err := engine.RemovePodGroup(run.Name); err != nil && err != ErrPodGroupNotExists {
+		log.Warnf("Failed to remove the job pod group %s of the cron run, %s", run.Name, err)
+		return err
+	}
+	return nil
+}
+
+func (engine *OrcEngine) saveCron(c *CronWithRuns) {
+	if err := engine.store.Set(cronKey(c.Spec.Name), c); err != nil {
+		log.Warnf("Failed to save cron %s, %s", c.Spec.Name, err)
+	}
+}
+
+// lastCronTick returns the latest tick of the cron after the time and not after now, zero if there is none
+func lastCronTick(spec CronSpec, after, now time.Time) time.Time {
+	schedule, loc, err := spec.schedule()
+	if err != nil {
+		return time.Time{}
+	}
+	var tick time.Time
+	for next := schedule.Next(after.In(loc)); !next.IsZero() && !next.After(now); next = schedule.Next(next) {
+		tick = next
+	}
+	return tick
+}
+
+// nextCronTick returns the first tick of the cron after now
+func nextCronTick(spec CronSpec, now time.Time) time.Time {
+	schedule, loc, err := spec.schedule()
+	if err != nil {
+		return time.Time{}
+	}
+	return schedule.Next(now.In(loc))
+}
+
+func (spec CronSpec) schedule() (*cron.Schedule, *time.Location, error) {
+	schedule, err := cron.Parse(spec.Schedule)
+	if err != nil {
+		return nil, nil, err
+	}
+	loc, err := time.LoadLocation(spec.TimeZone)
+	if err != nil {
+		return nil, nil, err
+	}
+	return schedule, loc, nil
+}
@@ -0,0 +1,157 @@
+package engine
+
+import (
+	"testing"
+	"time"
+)
+
+func createCronSpec(name, policy string) CronSpec {
+	return CronSpec{
+		Name:              name,
+		Namespace:         "hello",
+		Schedule:          "*/5 * * * *",
+		TimeZone:          "Asia/Shanghai",
+		ConcurrencyPolicy: policy,
+		HistoryLimit:      1,
+		Pod:               createPodSpec("hello", name),
+	}
+}
+
+// waitCronRun waits until the pods of the run are deployed and the operation is over
+func waitCronRun(t *testing.T, engine *OrcEngine, run CronRun) JobInfo {
+	for i := 0; ; i++ {
+		engine.RLock()
+		pgCtrl, ok := engine.pgCtrls[run.Name]
+		engine.RUnlock()
+		job, err := engine.InspectJob(run.Name)
+		if ok && !pgCtrl.IsOperating() && err == nil && len(job.Pods) == 1 && len(job.Pods[0].Containers) > 0 {
+			return job
+		}
+		if i > 100 {
+			t.Fatalf("Should deploy the run %s, got %+v, %v", run.Name, job, err)
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+}
+
+func TestCronSpec(t *testing.T) {
+	spec := createCronSpec("hello.cron.backup", "")
+	if !spec.VerifyParams() {
+		t.Errorf("Should accept the cron spec")
+	}
+	invalid := []CronSpec{createCronSpec("hello.cron.backup", "sometimes"), spec, spec, spec}
+	invalid[1].Schedule = "*/5 * * *"
+	invalid[2].TimeZone = "Mars/Olympus"
+	invalid[3].HistoryLimit = -1
+	for _, spec := range invalid {
+		if spec.VerifyParams() {
+			t.Errorf("Should not accept the cron spec %+v", spec)
+		}
+	}
+	if runSpec := spec.runSpec("hello.cron.backup-1"); runSpec.Job == nil || runSpec.Job.Completions != 1 ||
+		runSpec.Pod.Name != "hello.cron.backup-1" {
+		t.Errorf("Should run the pod to 1 completion by default, got %+v", runSpec)
+	}
+
+	shanghai, _ := time.LoadLocation("Asia/Shanghai")
+	spec.Schedule = "0 3 * * *"
+	after := time.Date(2017, 6, 1, 10, 0, 0, 0, time.UTC)
+	if tick := lastCronTick(spec, after, after.Add(8*time.Hour)); !tick.IsZero() {
+		t.Errorf("Should not find the tick before 3 o'clock in Shanghai, got %s", tick)
+	}
+	if tick := lastCronTick(spec, after, after.Add(72*time.Hour)); !tick.Equal(time.Date(2017, 6, 4, 3, 0, 0, 0, shanghai)) {
+		t.Errorf("Should only find the latest one of the missed ticks, got %s", tick)
+	}
+}
+
+func TestCronRuns(t *testing.T) {
+	engine, c, _ := initFakeEngine(t, 2)
+	defer engine.Stop()
+
+	name := "hello.cron.backup"
+	if err := engine.NewCron(createCronSpec(name, ConcurrencyForbid)); err != nil {
+		t.Fatalf("Should be able to add the cron, %s", err)
+	}
+	if err := engine.NewCron(createCronSpec(name, ConcurrencyForbid)); err != ErrCronExists {
+		t.Errorf("Should not add the cron twice, got %v", err)
+	}
+
+	now := time.Now()
+	engine.checkCrons(now.Add(11 * time.Minute))
+	cron, _ := engine.InspectCron(name)
+	if len(cron.Runs) != 1 || cron.Runs[0].State != JobStateRunning || cron.Runs[0].Manual {
+		t.Fatalf("Should launch only one run for the missed ticks, got %+v", cron.Runs)
+	}
+	first := cron.Runs[0]
+	job := waitCronRun(t, engine, first)
+
+	// the next tick is skipped by the forbid policy while the first run is running
+	engine.checkCrons(now.Add(16 * time.Minute))
+	if cron, _ = engine.InspectCron(name); len(cron.Runs) != 1 {
+		t.Fatalf("Should skip the tick while the run is running, got %+v", cron.Runs)
+	}
+
+	c.ExitContainer(job.Pods[0].Containers[0].Id, 0, "")
+	refreshJob(t, engine, first.Name, func(job JobInfo) bool { return job.Status.State == JobStateComplete })
+	engine.checkCrons(now.Add(21 * time.Minute))
+	cron, _ = engine.InspectCron(name)
+	if len(cron.Runs) != 2 || cron.Runs[0].State != JobStateComplete || cron.Runs[1].State != JobStateRunning {
+		t.Fatalf("Should launch the next run after the first one completed, got %+v", cron.Runs)
+	}
+	second := cron.Runs[1]
+	waitCronRun(t, engine, second)
+
+	// the manual run ignores the policy, and the oldest finished runs are pruned by the history limit
+	run, err := engine.TriggerCron(name)
+	if err != nil || !run.Manual || run.State != JobStateRunning {
+		t.Fatalf("Should trigger the run manually, got %+v, %v", run, err)
+	}
+	waitCronRun(t, engine, run)
+	c.ExitContainer(waitCronRun(t, engine, second).Pods[0].Containers[0].Id, 0, "")
+	refreshJob(t, engine, second.Name, func(job JobInfo) bool { return job.Status.State == JobStateComplete })
+	engine.checkCrons(now.Add(22 * time.Minute))
+	cron, _ = engine.InspectCron(name)
+	if len(cron.Runs) != 2 || cron.Runs[0].Name != second.Name || cron.Runs[1].Name != run.Name {
+		t.Fatalf("Should keep 1 finished run besides the running one, got %+v", cron.Runs)
+	}
+	if _, ok := engine.InspectPodGroup(first.Name); ok {
+		t.Errorf("Should remove the pod group of the pruned run")
+	}
+
+	// the runs are loaded from the store, like after the leader failover
+	engine.crons = newCronController()
+	if err := engine.LoadCrons(); err != nil {
+		t.Fatalf("Should load the crons, %s", err)
+	}
+	if loaded, err := engine.InspectCron(name); err != nil || len(loaded.Runs) != 2 ||
+		!loaded.LastScheduleAt.Equal(cron.LastScheduleAt) {
+		t.Fatalf("Should load the cron with its runs, got %+v, %v", loaded, err)
+	}
+
+	// the replace policy removes the running run at the next tick
+	replaced := "hello.cron.sync"
+	if err := engine.NewCron(createCronSpec(replaced, ConcurrencyReplace)); err != nil {
+		t.Fatalf("Should be able to add the cron, %s", err)
+	}
+	engine.checkCrons(now.Add(6 * time.Minute))
+	cron, _ = engine.InspectCron(replaced)
+	waitCronRun(t, engine, cron.Runs[0])
+	engine.checkCrons(now.Add(11 * time.Minute))
+	cron, _ = engine.InspectCron(replaced)
+	if len(cron.Runs) != 2 || cron.Runs[0].State != CronRunReplaced || cron.Runs[1].State != JobStateRunning {
+		t.Fatalf("Should replace the running run, got %+v", cron.Runs)
+	}
+	if crons := engine.ListCrons(); len(crons) != 2 || crons[0].Spec.Name != name || crons[1].Spec.Name != replaced {
+		t.Errorf("Should list the crons sorted by the name, got %+v", crons)
+	}
+
+	if err := engine.RemoveCron(replaced); err != nil {
+		t.Fatalf("Should be able to remove the cron, %s", err)
+	}
+	if _, err := engine.InspectCron(replaced); err != ErrCronNotExists {
+		t.Errorf("Should not find the removed cron, got %v", err)
+	}
+	if _, ok := engine.InspectPodGroup(cron.Runs[1].Name); ok {
+		t.Errorf("Should remove the pod groups of the runs with the cron")
+	}
+}
@@ -0,0 +1,335 @@
+package engine
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"time"
+
+	"github.com/laincloud/deployd/cluster"
+	"github.com/laincloud/deployd/storage"
+	"github.com/mijia/sweb/log"
+)
+
+var (
+	ErrPodGroupNotDaemon   = errors.New("PodGroup is not a daemon")
+	ErrDaemonNotScalable   = errors.New("PodGroup is a daemon, its instances follow the nodes matching its selector")
+	ErrDaemonSpecNotExists = errors.New("PodGroupSpec has no DaemonSpec")
+)
+
+// DaemonNodeDownDelay is how long a node disconnected is waited before its daemon instances are removed,
+// so a flapping node keeps its instances
+var DaemonNodeDownDelay = downNodeResetPeriod
+
+// DaemonNodeStatus is the instance of the daemon on the node
+type DaemonNodeStatus struct {
+	Node       string
+	InstanceNo int
+	Version    int // the version of the pod group the instance is running, 0 if not deployed
+	State      RunState
+	Healthst   HealthState
+	LastError  string
+}
+
+// DaemonInfo is the daemon pod group shown by the daemons api. Desired is the number of the nodes matching the
+// selector, Running the instances running, Ready the running ones healthy or without a health check, and UpToDate
+// the ones running the version of the spec.
+type DaemonInfo struct {
+	Name      string
+	Version   int
+	Spec      DaemonSpec
+	Desired   int
+	Running   int
+	Ready     int
+	UpToDate  int
+	Nodes     []DaemonNodeStatus
+	LastError string
+	UpdatedAt time.Time
+}
+
+func newDaemonInfo(pg PodGroupWithSpec) DaemonInfo {
+	info := DaemonInfo{
+		Name:      pg.Spec.Name,
+		Version:   pg.Spec.Version,
+		Nodes:     []DaemonNodeStatus{},
+		LastError: pg.LastError,
+		UpdatedAt: pg.UpdatedAt,
+	}
+	if pg.Spec.Daemon == nil {
+		return info
+	}
+	info.Spec = pg.Spec.Daemon.Clone()
+	info.Desired = len(info.Spec.Nodes)
+	for i, node := range info.Spec.Nodes {
+		status := DaemonNodeStatus{Node: node, InstanceNo: i + 1, State: RunStatePending}
+		if i < len(pg.Pods) {
+			pod := pg.Pods[i]
+			status.Version = podVersion(pod)
+			status.State, status.Healthst, status.LastError = pod.State, pod.Healthst, pod.LastError
+		}
+		if status.State == RunStateSuccess {
+			info.Running += 1
+			if status.Healthst == HealthStateNone || status.Healthst == HealthStateHealthy {
+				info.Ready += 1
+			}
+		}
+		if status.Version == pg.Spec.Version {
+			info.UpToDate += 1
+		}
+		info.Nodes = append(info.Nodes, status)
+	}
+	return info
+}
+
+// podVersion returns the version of the pod group labeled on the container of the pod, 0 if not deployed
+func podVersion(pod Pod) int {
+	if len(pod.Containers) == 0 || pod.Containers[0].Runtime.Config == nil {
+		return 0
+	}
+	var label ContainerLabel
+	if !label.FromMaps(pod.Containers[0].Runtime.Config.Labels) {
+		return 0
+	}
+	return label.Version
+}
+
+// InspectDaemon returns the daemon pod group by the name
+func (engine *OrcEngine) InspectDaemon(name string) (DaemonInfo, error) {
+	pg, ok := engine.InspectPodGroup(name)
+	if !ok {
+		return DaemonInfo{}, ErrPodGroupNotExists
+	}
+	if pg.Spec.Daemon == nil {
+		return DaemonInfo{}, ErrPodGroupNotDaemon
+	}
+	return newDaemonInfo(pg), nil
+}
+
+// ListDaemons returns all the daemon pod groups sorted by the name
+func (engine *OrcEngine) ListDaemons() []DaemonInfo {
+	engine.RLock()
+	defer engine.RUnlock()
+	daemons := []DaemonInfo{}
+	for _, pgCtrl := range engine.pgCtrls {
+		if pgCtrl.IsDaemon() {
+			daemons = append(daemons, newDaemonInfo(pgCtrl.Inspect()))
+		}
+	}
+	sort.Sort(byDaemonName(daemons))
+	return daemons
+}
+
+type byDaemonName []DaemonInfo
+
+func (daemons byDaemonName) Len() int           { return len(daemons) }
+func (daemons byDaemonName) Swap(i, j int)      { daemons[i], daemons[j] = daemons[j], daemons[i] }
+func (daemons byDaemonName) Less(i, j int) bool { return daemons[i].Name < daemons[j].Name }
+
+// IsDaemon tells if the pod group runs one instance on each node matching its selector
+func (pgCtrl *podGroupController) IsDaemon() bool {
+	pgCtrl.RLock()
+	defer pgCtrl.RUnlock()
+	return pgCtrl.spec.Daemon != nil
+}
+
+// pinDaemonInstance returns the clone of the pod spec pinned to the node of the instance if the pod group is a daemon
+func (pgCtrl *podGroupController) pinDaemonInstance(instanceNo int, podSpec PodSpec) PodSpec {
+	pgCtrl.RLock()
+	defer pgCtrl.RUnlock()
+	if pgCtrl.spec.Daemon == nil {
+		return podSpec.Clone()
+	}
+	return pgCtrl.spec.Daemon.PinPodSpec(instanceNo, podSpec)
+}
+
+// matchDaemonNodes returns the names of the nodes matching the selector of the daemon sorted by the name,
+// the nodes without labels reported by the cluster match only the empty selector.
+func matchDaemonNodes(daemon DaemonSpec, nodes []cluster.Node) []string {
+	names := make([]string, 0, len(nodes))
+	for _, node := range nodes {
+		matched := true
+		for key, value := range daemon.NodeSelector {
+			if v, ok := node.Labels[key]; !ok || v != value {
+				matched = false
+				break
+			}
+		}
+		if matched {
+			names = append(names, node.Name)
+		}
+	}
+	sort.Strings(names)
+	return names
+}
+
+func sameNodes(a, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	set := make(map[string]bool, len(a))
+	for _, node := range a {
+		set[node] = true
+	}
+	for _, node := range b {
+		if !set[node] {
+			return false
+		}
+	}
+	return true
+}
+
+// syncDaemons makes the instances of the daemons follow the nodes of the cluster, it is called when the nodes
+// connect to or disconnect from the cluster, and with the refreshing for the nodes changed without the events.
+// The daemons in operation are synced next time.
+func (engine *OrcEngine) syncDaemons() {
+	if engine.ReadOnly() {
+		return
+	}
+	nodes, err := engine.cluster.GetResources()
+	if err != nil {
+		log.Warnf("<OrcEngine> Cannot get the nodes to sync the daemons, %s", err)
+		return
+	}
+	engine.RLock()
+	defer engine.RUnlock()
+	for name, pgCtrl := range engine.pgCtrls {
+		pgCtrl.RLock()
+		var daemon *DaemonSpec
+		if pgCtrl.spec.Daemon != nil {
+			d := pgCtrl.spec.Daemon.Clone()
+			daemon = &d
+		}
+		pgCtrl.RUnlock()
+		if daemon == nil {
+			continue
+		}
+		matched := matchDaemonNodes(*daemon, nodes)
+		if sameNodes(daemon.Nodes, matched) {
+			continue
+		}
+		if err := canOperation(pgCtrl, PGOpStateScheduling); err != nil {
+			log.Infof("<OrcEngine> Daemon %s is in operation, the nodes %v will be synced later", name, matched)
+			continue
+		}
+		operation := engine.operations.add(name, "daemon")
+		engine.opsChan <- orcOperSyncDaemon{pgCtrl, operation, matched}
+	}
+}
+
+// SyncDaemonNodes deploys the instances onto the nodes joined and removes the instances on the nodes gone.
+// The nodes joined take the instance numbers of the nodes gone first, the rest of the numbers are filled by
+// moving the last instances into them, so the instance numbers are kept continuous.
+func (pgCtrl *podGroupController) SyncDaemonNodes(operation *Operation, nodes []string) {
+	pgCtrl.flushAllOps()
+	pgCtrl.emitOperationEvent(OperationStart)
+	defer func() {
+		pgCtrl.opsChan <- pgOperOver{}
+	}()
+	pgCtrl.RLock()
+	spec := pgCtrl.spec.Clone()
+	pgCtrl.RUnlock()
+	if spec.Daemon == nil {
+		pgCtrl.beginOperation(operation, 0)
+		return
+	}
+
+	current, desired := spec.Daemon.Nodes, make(map[string]bool, len(nodes))
+	for _, node := range nodes {
+		desired[node] = true
+	}
+	known := make(map[string]bool, len(current))
+	vacant := make([]int, 0, len(current))
+	for i, node := range current {
+		known[node] = true
+		if !desired[node] {
+			vacant = append(vacant, i+1)
+		}
+	}
+	joined := make([]string, 0, len(nodes))
+	for _, node := range nodes {
+		if !known[node] {
+			joined = append(joined, node)
+		}
+	}
+
+	newNodes := append([]string{}, current...)
+	ops := make([]pgOperation, 0, 2*(len(vacant)+len(joined)))
+	for _, instanceNo := range vacant {
+		ops = append(ops, pgOperRemoveInstance{instanceNo, spec.Pod})
+	}
+	deploy := func(instanceNo int) {
+		podSpec := spec.Daemon.nodePodSpec(newNodes[instanceNo-1], spec.Pod)
+		ops = append(ops, pgOperDeployDaemonInstance{instanceNo, spec.Version, podSpec})
+	}
+	for len(vacant) > 0 && len(joined) > 0 {
+		newNodes[vacant[0]-1] = joined[0]
+		deploy(vacant[0])
+		vacant, joined = vacant[1:], joined[1:]
+	}
+	for len(vacant) > 0 {
+		last := len(newNodes)
+		if vacant[len(vacant)-1] == last {
+			vacant = vacant[:len(vacant)-1]
+		} else {
+			ops = append(ops, pgOperRemoveInstance{last, spec.Pod})
+			newNodes[vacant[0]-1] = newNodes[last-1]
+			deploy(vacant[0])
+			vacant = vacant[1:]
+		}
+		ops = append(ops, pgOperPopPodCtrl{})
+		newNodes = newNodes[:last-1]
+	}
+	for _, node := range joined {
+		newNodes = append(newNodes, node)
+		instanceNo := len(newNodes)
+		ops = append(ops, pgOperPushPodCtrl{spec.Daemon.nodePodSpec(node, spec.Pod)})
+		ops = append(ops, pgOperDeployInstance{instanceNo, spec.Version})
+	}
+
+	total := 0
+	for _, op := range ops {
+		if _, ok := op.(instanceOperation); ok {
+			total += 1
+		}
+	}
+	pgCtrl.beginOperation(operation, total)
+	spec.Daemon.Nodes = newNodes
+	spec.NumInstances = len(newNodes)
+	pgCtrl.Lock()
+	pgCtrl.spec = spec
+	pgCtrl.Unlock()
+	pgCtrl.opsChan <- pgOperLogOperation{fmt.Sprintf("Start to sync the daemon from the nodes %v to %v", current, newNodes)}
+	pgCtrl.opsChan <- pgOperSaveStore{true}
+	pgCtrl.opsChan <- pgOperSnapshotEagleView{spec.Name}
+	for _, op := range ops {
+		pgCtrl.opsChan <- op
+	}
+	pgCtrl.opsChan <- pgOperSnapshotGroup{true}
+	pgCtrl.opsChan <- pgOperSnapshotPrevState{}
+	pgCtrl.opsChan <- pgOperSaveStore{true}
+	pgCtrl.opsChan <- pgOperLogOperation{"Sync daemon finished"}
+}
+
+// pgOperDeployDaemonInstance deploys the removed instance onto the node it is moved to, it is regarded as a drift
+// so the new containers are not named after the ones left on the node gone
+type pgOperDeployDaemonInstance struct {
+	instanceNo int
+	version    int
+	podSpec    PodSpec
+}
+
+func (op pgOperDeployDaemonInstance) Do(pgCtrl *podGroupController, c cluster.Cluster, store storage.Store, ev *RuntimeEagleView) bool {
+	if op.instanceNo > len(pgCtrl.podCtrls) {
+		return false
+	}
+	podCtrl := pgCtrl.podCtrls[op.instanceNo-1]
+	podCtrl.spec = op.podSpec.Clone()
+	podCtrl.spec.PrevState = NewPodPrevState(len(podCtrl.spec.Containers))
+	driftCount := podCtrl.pod.DriftCount
+	podCtrl.pod = Pod{InstanceNo: op.instanceNo}
+	podCtrl.pod.State = RunStatePending
+	podCtrl.pod.DriftCount = driftCount + 1
+	lowOp := pgOperDeployInstance{op.instanceNo, op.version}
+	lowOp.Do(pgCtrl, c, store, ev)
+	return false
+}
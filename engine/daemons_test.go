@@ -0,0 +1,167 @@
+package engine
+
+import (
+	"testing"
+	"time"
+
+	"github.com/laincloud/deployd/cluster"
+	"github.com/mijia/go-generics"
+)
+
+func createDaemonSpec(name string, selector map[string]string) PodGroupSpec {
+	spec := createPodGroupSpec("hello", name, 1)
+	spec.Daemon = &DaemonSpec{NodeSelector: selector}
+	return spec
+}
+
+// waitDaemon waits until the daemon is not in operation and matches the condition
+func waitDaemon(t *testing.T, engine *OrcEngine, name string, cond func(DaemonInfo) bool) DaemonInfo {
+	for i := 0; ; i++ {
+		engine.RLock()
+		pgCtrl, ok := engine.pgCtrls[name]
+		engine.RUnlock()
+		daemon, err := engine.InspectDaemon(name)
+		if ok && !pgCtrl.IsOperating() && err == nil && cond(daemon) {
+			return daemon
+		}
+		if i > 100 {
+			t.Fatalf("Should sync the daemon %s, got %+v, %v", name, daemon, err)
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+}
+
+// checkDaemonNodes checks the instance of the daemon runs on the node recorded by its instance number
+func checkDaemonNodes(t *testing.T, engine *OrcEngine, name string, nodes ...string) {
+	pg, _ := engine.InspectPodGroup(name)
+	if len(pg.Pods) != len(nodes) {
+		t.Fatalf("Should run %d instances, got %d", len(nodes), len(pg.Pods))
+	}
+	for i, pod := range pg.Pods {
+		if len(pod.Containers) == 0 || pod.Containers[0].NodeName != nodes[i] {
+			t.Errorf("Should run the instance %d on %s, got %+v", i+1, nodes[i], pod.Containers)
+		}
+	}
+}
+
+func TestDaemonSpec(t *testing.T) {
+	daemon := DaemonSpec{NodeSelector: map[string]string{"role": "edge", "disk": "ssd"}, Nodes: []string{"node3", "node1"}}
+	if !daemon.VerifyParams() || daemon.GetMaxUnavailable() != 1 {
+		t.Errorf("Should accept the daemon spec and update 1 node at a time by default")
+	}
+	if invalid := (DaemonSpec{NodeSelector: map[string]string{"": "edge"}}); invalid.VerifyParams() {
+		t.Errorf("Should not accept the empty label key")
+	}
+	if invalid := (DaemonSpec{MaxUnavailable: -1}); invalid.VerifyParams() {
+		t.Errorf("Should not accept the negative MaxUnavailable")
+	}
+
+	podSpec := createPodSpec("hello", "hello.proc.agent")
+	podSpec.Filters = []string{"constraint:disk==ssd"}
+	pinned := daemon.PinPodSpec(2, podSpec)
+	expected := []string{"constraint:disk==ssd", "constraint:node==node1", "constraint:role==edge"}
+	if len(pinned.Filters) != len(expected) {
+		t.Fatalf("Should pin the pod onto its node with the selector once, got %v", pinned.Filters)
+	}
+	for i, filter := range expected {
+		if pinned.Filters[i] != filter {
+			t.Errorf("Should pin the pod onto its node with the selector once, got %v", pinned.Filters)
+		}
+	}
+	if len(podSpec.Filters) != 1 {
+		t.Errorf("Should not change the filters of the pod spec, got %v", podSpec.Filters)
+	}
+
+	spec := createDaemonSpec("hello.proc.agent", nil)
+	spec.Job = &JobSpec{Completions: 1}
+	if spec.VerifyParams() {
+		t.Errorf("Should not accept the pod group being both a job and a daemon")
+	}
+
+	nodes := []cluster.Node{
+		{Name: "node2", Labels: map[string]string{"role": "edge", "disk": "ssd"}},
+		{Name: "node1", Labels: map[string]string{"role": "edge"}},
+		{Name: "node3"},
+		{Name: "node4", Labels: map[string]string{"role": "edge", "disk": "ssd", "zone": "a"}},
+	}
+	if matched := matchDaemonNodes(daemon, nodes); !generics.Equal_StringSlice(matched, []string{"node2", "node4"}) {
+		t.Errorf("Should match only the nodes having all the labels, got %v", matched)
+	}
+	if matched := matchDaemonNodes(DaemonSpec{}, nodes); len(matched) != 4 {
+		t.Errorf("Should match all the nodes without the selector, got %v", matched)
+	}
+}
+
+func TestPodGroupDaemon(t *testing.T) {
+	defer func(delay time.Duration) { DaemonNodeDownDelay = delay }(DaemonNodeDownDelay)
+	DaemonNodeDownDelay = 500 * time.Millisecond
+	engine, c, _ := initFakeEngine(t, 2)
+	defer engine.Stop()
+
+	edge := map[string]string{"role": "edge"}
+	c.AddNode("edge1", "192.168.77.31:2375", 8, 16*1024*1024*1024, edge)
+	c.AddNode("edge2", "192.168.77.32:2375", 8, 16*1024*1024*1024, edge)
+	c.Flush()
+
+	name := "hello.proc.agent"
+	spec := createDaemonSpec(name, edge)
+	if _, err := engine.NewPodGroup(spec); err != nil {
+		t.Fatalf("Should be able to deploy the daemon, %s", err)
+	}
+	daemon := waitDaemon(t, engine, name, func(d DaemonInfo) bool { return d.Running == 2 })
+	if daemon.Desired != 2 || daemon.UpToDate != 2 || len(daemon.Nodes) != 2 || daemon.Nodes[0].Node != "edge1" {
+		t.Fatalf("Should deploy the daemon onto the edge nodes only, got %+v", daemon)
+	}
+	checkDaemonNodes(t, engine, name, "edge1", "edge2")
+	if _, err := engine.RescheduleInstance(name, 5); err != ErrDaemonNotScalable {
+		t.Errorf("Should not scale the daemon, got %v", err)
+	}
+	if _, err := engine.InspectDaemon("hello.proc.web"); err != ErrPodGroupNotExists {
+		t.Errorf("Should not find the daemon, got %v", err)
+	}
+
+	// the new node is synced by the engine_connect event
+	c.AddNode("edge3", "192.168.77.33:2375", 8, 16*1024*1024*1024, edge)
+	c.AddNode("node3", "192.168.77.23:2375", 8, 16*1024*1024*1024, nil)
+	c.Flush()
+	daemon = waitDaemon(t, engine, name, func(d DaemonInfo) bool { return d.Desired == 3 && d.Running == 3 })
+	checkDaemonNodes(t, engine, name, "edge1", "edge2", "edge3")
+
+	// the node flapping back within the delay keeps its instance
+	c.DisconnectNode("edge1")
+	c.ReconnectNode("edge1")
+	c.Flush()
+	time.Sleep(2 * DaemonNodeDownDelay)
+	checkDaemonNodes(t, engine, name, "edge1", "edge2", "edge3")
+
+	// the instance of the node gone is removed, and the last instance is moved to keep the numbers continuous
+	c.DisconnectNode("edge1")
+	c.Flush()
+	if daemon, _ := engine.InspectDaemon(name); daemon.Desired != 3 {
+		t.Errorf("Should keep the instance of the node disconnected until the delay passes, got %+v", daemon)
+	}
+	daemon = waitDaemon(t, engine, name, func(d DaemonInfo) bool { return d.Desired == 2 && d.Running == 2 })
+	checkDaemonNodes(t, engine, name, "edge3", "edge2")
+	if pg, _ := engine.InspectPodGroup(name); pg.Spec.NumInstances != 2 {
+		t.Errorf("Should follow the nodes with the number of the instances, got %d", pg.Spec.NumInstances)
+	}
+
+	// the rolling update keeps each instance on its node
+	podSpec := spec.Pod.Clone()
+	podSpec.Containers[0].Command = []string{"/bin/sh", "-c", "while true; do echo Hello daemon; sleep 1; done"}
+	id, err := engine.RescheduleSpec(name, podSpec)
+	if err != nil {
+		t.Fatalf("Should be able to update the daemon, %s", err)
+	}
+	if op := waitOperationEnded(t, engine, id); op.Status != OperationSucceeded {
+		t.Fatalf("Should update the daemon, got %+v", op)
+	}
+	daemon = waitDaemon(t, engine, name, func(d DaemonInfo) bool { return d.Running == 2 })
+	if daemon.Version != spec.Version+1 || daemon.UpToDate != 2 {
+		t.Errorf("Should update all the instances, got %+v", daemon)
+	}
+	checkDaemonNodes(t, engine, name, "edge3", "edge2")
+	if daemons := engine.ListDaemons(); len(daemons) != 1 || daemons[0].Name != name {
+		t.Errorf("Should list the daemons, got %+v", daemons)
+	}
+}
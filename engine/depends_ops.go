@@ -47,7 +47,7 @@ func (op depOperStoreSaveSpec) Do(depCtrl *dependsController, c cluster.Cluster,
 	defer func() {
 		log.Infof("DependsCtrl %s, save spec into storage, err=%v, duration=%s", op.spec, err, time.Now().Sub(start))
 	}()
-	err = store.Set(depCtrl.specStoredKey, op.spec, op.force)
+	err = store.Set(depCtrl.specStoredKey, newStoredDependsSpec(op.spec), op.force)
 	if err != nil {
 		log.Warnf("[Store] Failed to save depends pod spec %s, %s", depCtrl.specStoredKey, err)
 	}
@@ -7,8 +7,6 @@ import (
 )
 
 func TestDependsPodCtrl(t *testing.T) {
-	etcdAddr := "http://127.0.0.1:2379"
-	ConfigPortsManager(etcdAddr)
 	c, store, err := initClusterAndStore()
 	if err != nil {
 		t.Fatalf("Cannot create the cluster and storage, %s", err)
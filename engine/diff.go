@@ -0,0 +1,166 @@
+package engine
+
+import (
+	"fmt"
+
+	"github.com/mijia/go-generics"
+)
+
+const (
+	SpecChangeRedeploy = "redeploy"
+	SpecChangeInPlace  = "in_place"
+	SpecChangeMetadata = "metadata"
+	SpecChangeScale    = "scale"
+)
+
+// SpecChange is a field changed from the current spec to the desired one, Kind tells how it takes effect:
+// redeploy needs new containers, in_place updates the running containers by UpdateContainer,
+// metadata is only used by the engine, and scale changes the number of instances.
+type SpecChange struct {
+	Field string      `json:"field"`
+	Kind  string      `json:"kind"`
+	Old   interface{} `json:"old"`
+	New   interface{} `json:"new"`
+}
+
+// SpecDiff is the diff between the current pod spec of the pod group and a proposed one,
+// Kind is the most disruptive kind of the changes, empty if nothing changed.
+type SpecDiff struct {
+	Name    string       `json:"name"`
+	Version int          `json:"version"`
+	Kind    string       `json:"kind"`
+	Changes []SpecChange `json:"changes"`
+	Notes   []string     `json:"notes"`
+}
+
+// DiffPodGroup diffs the proposed pod spec against the current one of the pod group, the proposed one is merged
+// as cmd=spec does, so the limits left as 0 keep the current ones.
+func (engine *OrcEngine) DiffPodGroup(name string, podSpec PodSpec) (*SpecDiff, error) {
+	engine.RLock()
+	pgCtrl, ok := engine.pgCtrls[name]
+	engine.RUnlock()
+	if !ok {
+		return nil, ErrPodGroupNotExists
+	}
+	current := pgCtrl.Inspect().Spec.Pod
+	notes := mergeNotes(current, podSpec)
+	changes := DiffPodSpec(current, current.Merge(podSpec.Clone()))
+	return &SpecDiff{
+		Name:    name,
+		Version: current.Version,
+		Kind:    changesKind(changes),
+		Changes: changes,
+		Notes:   notes,
+	}, nil
+}
+
+// changesKind returns the most disruptive kind of the changes
+func changesKind(changes []SpecChange) string {
+	kind := ""
+	for _, c := range changes {
+		switch {
+		case c.Kind == SpecChangeRedeploy:
+			return SpecChangeRedeploy
+		case c.Kind == SpecChangeInPlace:
+			kind = SpecChangeInPlace
+		case kind == "":
+			kind = c.Kind
+		}
+	}
+	return kind
+}
+
+// mergeNotes tells the limits of the proposed pod spec left as 0, which keep the current ones when merged
+func mergeNotes(current, podSpec PodSpec) []string {
+	notes := []string{}
+	for i, c := range podSpec.Containers {
+		if i >= len(current.Containers) {
+			break
+		}
+		if c.CpuLimit == 0 && current.Containers[i].CpuLimit != 0 {
+			notes = append(notes, fmt.Sprintf("container[%d].CpuLimit is 0, keeps the current %d",
+				i, current.Containers[i].CpuLimit))
+		}
+		if c.MemoryLimit == 0 && current.Containers[i].MemoryLimit != 0 {
+			notes = append(notes, fmt.Sprintf("container[%d].MemoryLimit is 0, keeps the current %d",
+				i, current.Containers[i].MemoryLimit))
+		}
+	}
+	return notes
+}
+
+// DiffPodSpec lists the fields changed from the old pod spec to the new one, classified by how they take effect:
+// the resources are updated in place, the labels and annotation go into the container labels and the filters
+// only take effect when scheduled, so they need a redeploy like the other container configs.
+func DiffPodSpec(oldSpec, newSpec PodSpec) []SpecChange {
+	changes := make([]SpecChange, 0)
+	add := func(changed bool, kind string, field string, o, n interface{}) {
+		if changed {
+			changes = append(changes, SpecChange{field, kind, o, n})
+		}
+	}
+	add(len(oldSpec.Containers) != len(newSpec.Containers), SpecChangeRedeploy,
+		"#containers", len(oldSpec.Containers), len(newSpec.Containers))
+	for i := 0; i < len(oldSpec.Containers) && i < len(newSpec.Containers); i += 1 {
+		o, n := oldSpec.Containers[i], newSpec.Containers[i]
+		prefix := fmt.Sprintf("container[%d].", i)
+		add(o.Name != n.Name, SpecChangeRedeploy, prefix+"Name", o.Name, n.Name)
+		add(o.Image != n.Image, SpecChangeRedeploy, prefix+"Image", o.Image, n.Image)
+		add(!generics.Equal_StringSlice(o.Command, n.Command), SpecChangeRedeploy, prefix+"Command", o.Command, n.Command)
+		add((o.Entrypoint == nil) != (n.Entrypoint == nil) || !generics.Equal_StringSlice(o.Entrypoint, n.Entrypoint),
+			SpecChangeRedeploy, prefix+"Entrypoint", o.Entrypoint, n.Entrypoint)
+		add(!generics.Equal_StringSlice(o.Env, n.Env), SpecChangeRedeploy, prefix+"Env", o.Env, n.Env)
+		add(o.User != n.User, SpecChangeRedeploy, prefix+"User", o.User, n.User)
+		add(o.WorkingDir != n.WorkingDir, SpecChangeRedeploy, prefix+"WorkingDir", o.WorkingDir, n.WorkingDir)
+		add(!generics.Equal_StringSlice(o.DnsSearch, n.DnsSearch), SpecChangeRedeploy, prefix+"DnsSearch", o.DnsSearch, n.DnsSearch)
+		add(!generics.Equal_StringSlice(o.Volumes, n.Volumes), SpecChangeRedeploy, prefix+"Volumes", o.Volumes, n.Volumes)
+		add(!generics.Equal_StringSlice(o.SystemVolumes, n.SystemVolumes), SpecChangeRedeploy,
+			prefix+"SystemVolumes", o.SystemVolumes, n.SystemVolumes)
+		add(!equalCloudVolumes(o.CloudVolumes, n.CloudVolumes), SpecChangeRedeploy,
+			prefix+"CloudVolumes", o.CloudVolumes, n.CloudVolumes)
+		add(o.CpuLimit != n.CpuLimit, SpecChangeInPlace, prefix+"CpuLimit", o.CpuLimit, n.CpuLimit)
+		add(o.MemoryLimit != n.MemoryLimit, SpecChangeInPlace, prefix+"MemoryLimit", o.MemoryLimit, n.MemoryLimit)
+		add(o.Expose != n.Expose, SpecChangeRedeploy, prefix+"Expose", o.Expose, n.Expose)
+		add(!equalPorts(o.Ports, n.Ports), SpecChangeRedeploy, prefix+"Ports", o.Ports, n.Ports)
+		add(o.LogConfig.Type != n.LogConfig.Type || !generics.Equal_StringStringMap(o.LogConfig.Config, n.LogConfig.Config),
+			SpecChangeRedeploy, prefix+"LogConfig", o.LogConfig, n.LogConfig)
+	}
+	add(!equalContainers(oldSpec.InitContainers, newSpec.InitContainers), SpecChangeRedeploy,
+		"InitContainers", oldSpec.InitContainers, newSpec.InitContainers)
+	add(oldSpec.InitTimeout != newSpec.InitTimeout, SpecChangeMetadata, "InitTimeout", oldSpec.InitTimeout, newSpec.InitTimeout)
+	add(!generics.Equal_StringSlice(oldSpec.Filters, newSpec.Filters), SpecChangeRedeploy, "Filters", oldSpec.Filters, newSpec.Filters)
+	add(!generics.Equal_StringStringMap(oldSpec.Labels, newSpec.Labels), SpecChangeRedeploy, "Labels", oldSpec.Labels, newSpec.Labels)
+	add(oldSpec.Annotation != newSpec.Annotation, SpecChangeRedeploy, "Annotation", oldSpec.Annotation, newSpec.Annotation)
+	add(oldSpec.Stateful != newSpec.Stateful, SpecChangeMetadata, "Stateful", oldSpec.Stateful, newSpec.Stateful)
+	add(!equalDependencies(oldSpec.Dependencies, newSpec.Dependencies), SpecChangeMetadata,
+		"Dependencies", oldSpec.Dependencies, newSpec.Dependencies)
+	add(oldSpec.SetupTime != newSpec.SetupTime, SpecChangeMetadata, "SetupTime", oldSpec.SetupTime, newSpec.SetupTime)
+	add(oldSpec.KillTimeout != newSpec.KillTimeout, SpecChangeMetadata, "KillTimeout", oldSpec.KillTimeout, newSpec.KillTimeout)
+	add(!oldSpec.HealthConfig.Equals(newSpec.HealthConfig), SpecChangeRedeploy,
+		"HealthConfig", oldSpec.HealthConfig, newSpec.HealthConfig)
+	return changes
+}
+
+func equalDependencies(a, b []Dependency) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+func equalCloudVolumes(a, b []CloudVolumeSpec) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i].Type != b[i].Type || !generics.Equal_StringSlice(a[i].Dirs, b[i].Dirs) {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,79 @@
+package engine
+
+import (
+	"testing"
+)
+
+func TestDiffPodSpec(t *testing.T) {
+	oldSpec := createPodSpec("hello", "hello.proc.web.web")
+	if changes := DiffPodSpec(oldSpec, oldSpec.Clone()); len(changes) != 0 || changesKind(changes) != "" {
+		t.Errorf("Should have no changes for the same spec, got %+v", changes)
+	}
+
+	newSpec := oldSpec.Clone()
+	newSpec.Containers[0].MemoryLimit *= 2
+	newSpec.SetupTime = 30
+	changes := DiffPodSpec(oldSpec, newSpec)
+	if len(changes) != 2 || changes[0].Field != "container[0].MemoryLimit" || changes[0].Kind != SpecChangeInPlace ||
+		changes[1].Field != "SetupTime" || changes[1].Kind != SpecChangeMetadata {
+		t.Fatalf("Should classify the memory limit as in place and the setup time as metadata, got %+v", changes)
+	}
+	if kind := changesKind(changes); kind != SpecChangeInPlace {
+		t.Errorf("Should be updated in place, got %s", kind)
+	}
+
+	newSpec.Containers[0].Env = append(newSpec.Containers[0].Env, "DEBUG=1")
+	newSpec.Annotation = "{}"
+	changes = DiffPodSpec(oldSpec, newSpec)
+	if len(changes) != 4 || changes[0].Field != "container[0].Env" || changes[0].Kind != SpecChangeRedeploy ||
+		changes[2].Field != "Annotation" || changes[2].Kind != SpecChangeRedeploy {
+		t.Fatalf("Should classify the env and the annotation as redeploy, got %+v", changes)
+	}
+	if kind := changesKind(changes); kind != SpecChangeRedeploy {
+		t.Errorf("Should need a redeploy, got %s", kind)
+	}
+
+	renamed := oldSpec.Clone()
+	renamed.Containers[0].Name = "hello.proc.web.web.renamed"
+	renamed.Containers[0].CloudVolumes = []CloudVolumeSpec{{Type: CloudVolumeMultiMode, Dirs: []string{"/data"}}}
+	renamed.Containers[0].CpuLimit += 1
+	changes = DiffPodSpec(oldSpec, renamed)
+	if len(changes) != 3 || changes[0].Field != "container[0].Name" || changes[0].Kind != SpecChangeRedeploy ||
+		changes[1].Field != "container[0].CloudVolumes" || changes[1].Kind != SpecChangeRedeploy {
+		t.Fatalf("Should classify the container name and the cloud volumes as redeploy, got %+v", changes)
+	}
+	if kind := changesKind(changes); kind != SpecChangeRedeploy {
+		t.Errorf("Should need a redeploy with the resources changed as well, got %s", kind)
+	}
+}
+
+func TestDiffPodGroup(t *testing.T) {
+	engine, _, _ := initFakeEngine(t, 1)
+	defer engine.Stop()
+
+	namespace, name := "hello", "hello.proc.web.web"
+	pgSpec := createPodGroupSpec(namespace, name, 1)
+	if _, err := engine.DiffPodGroup(name, pgSpec.Pod); err != ErrPodGroupNotExists {
+		t.Fatalf("Should not diff a not existed pod group, got %v", err)
+	}
+	operationId, err := engine.NewPodGroup(pgSpec)
+	if err != nil {
+		t.Fatalf("Should be able to create the pod group, %s", err)
+	}
+	waitOperationEnded(t, engine, operationId)
+
+	podSpec := pgSpec.Pod.Clone()
+	podSpec.Containers[0].CpuLimit = 2
+	podSpec.Containers[0].MemoryLimit = 0
+	diff, err := engine.DiffPodGroup(name, podSpec)
+	if err != nil {
+		t.Fatalf("Should be able to diff the pod spec, %s", err)
+	}
+	if diff.Version != pgSpec.Pod.Version || diff.Kind != SpecChangeInPlace || len(diff.Changes) != 1 ||
+		diff.Changes[0].Field != "container[0].CpuLimit" || len(diff.Notes) != 1 {
+		t.Errorf("Should diff the cpu limit with the memory limit kept, got %+v", diff)
+	}
+	if pg, _ := engine.InspectPodGroup(name); pg.Spec.Pod.Containers[0].CpuLimit == 2 {
+		t.Errorf("Should not change the pod group by the diff")
+	}
+}
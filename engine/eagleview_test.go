@@ -7,9 +7,6 @@ import (
 )
 
 func TestEagleViewRefresh(t *testing.T) {
-	etcdAddr := "http://127.0.0.1:2379"
-	ConfigPortsManager(etcdAddr)
-
 	kluster, store, err := initClusterAndStore()
 	if err != nil {
 		t.Fatalf("Cannot create the cluster and storage, %s", err)
@@ -24,7 +21,7 @@ func TestEagleViewRefresh(t *testing.T) {
 	name := "hello.web.web"
 	pgSpec := createPodGroupSpec(namespace, name, 1)
 	pgSpec.RestartPolicy = RestartPolicyAlways
-	if err := engine.NewPodGroup(pgSpec); err != nil {
+	if _, err := engine.NewPodGroup(pgSpec); err != nil {
 		t.Fatalf("Should not return error, %s", err)
 	}
 
@@ -50,7 +47,7 @@ func TestEagleViewRefresh(t *testing.T) {
 		fmt.Printf("%+v\n", pods)
 	}
 
-	if err := engine.RemovePodGroup(name); err != nil {
+	if _, err := engine.RemovePodGroup(name); err != nil {
 		t.Errorf("We should be able to remove the pod group, %s", err)
 	}
 
@@ -12,6 +12,7 @@ import (
 	"github.com/laincloud/deployd/storage"
 	"github.com/mijia/adoc"
 	"github.com/mijia/sweb/log"
+	"golang.org/x/net/context"
 )
 
 var RefreshInterval int
@@ -29,6 +30,10 @@ var (
 	ErrDependencyPodNotExists = errors.New("DependencyPod not existed")
 	ErrConstraintNotExists    = errors.New("Constraint not existed")
 	ErrNotifyNotExists        = errors.New("Notify uri not existed")
+	ErrCanaryInProgress       = errors.New("PodGroup has a canary in progress, promote or abort it first")
+	ErrCanaryNotExists        = errors.New("PodGroup has no canary in progress")
+	ErrPodGroupNotOperating   = errors.New("PodGroup has no operation in progress")
+	ErrPodGroupNotPaused      = errors.New("PodGroup operation is not paused")
 )
 
 const (
@@ -43,18 +48,24 @@ type EngineConfig struct {
 type OrcEngine struct {
 	sync.RWMutex
 
-	config       EngineConfig
-	cluster      cluster.Cluster
-	store        storage.Store
-	eagleView    *RuntimeEagleView
-	pgCtrls      map[string]*podGroupController
-	rmPgCtrls    map[string]*podGroupController
-	dependsCtrls map[string]*dependsController
-	rmDepCtrls   map[string]*dependsController
-	opsChan      chan orcOperation
-	refreshAllChan chan bool
-	stop         chan struct{}
-	clstrFailCnt int
+	config          EngineConfig
+	cluster         cluster.Cluster
+	store           storage.Store
+	eagleView       *RuntimeEagleView
+	pgCtrls         map[string]*podGroupController
+	rmPgCtrls       map[string]*podGroupController
+	dependsCtrls    map[string]*dependsController
+	rmDepCtrls      map[string]*dependsController
+	crons           *cronController
+	opsChan         chan orcOperation
+	refreshAllChan  chan bool
+	syncDaemonsChan chan bool
+	operations      *operationTracker
+	opVersions      map[string]uint64 // versions of the operating keys, only touched by the operation worker
+	stop            chan struct{}
+	watchCtx        context.Context
+	stopWatch       context.CancelFunc
+	clstrFailCnt    int
 }
 
 const (
@@ -84,11 +95,11 @@ func (engine *OrcEngine) SetConfig(config EngineConfig) {
 }
 
 func (engine *OrcEngine) PgOpStart(pgName string) {
-	pgOpStart(engine.store, pgName)
+	pgOpStart(engine.store, pgName, engine.opVersions)
 }
 
 func (engine *OrcEngine) PgOpOver(pgName string) {
-	pgOpOver(engine.store, pgName)
+	pgOpOver(engine.store, pgName, engine.opVersions)
 }
 
 func (engine *OrcEngine) ListenerId() string {
@@ -174,17 +185,36 @@ func (engine *OrcEngine) GetNodes() ([]cluster.Node, error) {
 	return engine.cluster.GetResources()
 }
 
-func (engine *OrcEngine) NewPodGroup(spec PodGroupSpec) error {
+// NewPodGroup deploys the pod group, returns the id of the deploy operation
+func (engine *OrcEngine) NewPodGroup(spec PodGroupSpec) (string, error) {
+	if spec.Daemon != nil {
+		// the daemon runs one instance on each of the nodes matching the selector
+		nodes, err := engine.cluster.GetResources()
+		if err != nil {
+			return "", err
+		}
+		daemon := spec.Daemon.Clone()
+		daemon.Nodes = matchDaemonNodes(daemon, nodes)
+		spec.Daemon = &daemon
+		spec.NumInstances = len(daemon.Nodes)
+	}
 	engine.Lock()
 	defer engine.Unlock()
 	if _, ok := engine.pgCtrls[spec.Name]; ok {
-		return ErrPodGroupExists
+		return "", ErrPodGroupExists
 	}
 	if _, ok := engine.rmPgCtrls[spec.Name]; ok {
-		return ErrPodGroupCleaning
+		return "", ErrPodGroupCleaning
 	}
 	spec.CreatedAt = time.Now()
 	spec.Pod.CreatedAt = spec.CreatedAt
+	spec.Canary = nil // a canary or a blue-green deployment is only started on the running pod groups
+	spec.BlueGreen = nil
+	if spec.Job != nil {
+		// the job pods run to completion, as many as the parallelism at the same time
+		spec.NumInstances = spec.Job.GetParallelism()
+		spec.RestartPolicy = RestartPolicyNever
+	}
 	for _, depends := range spec.Pod.Dependencies {
 		if _, ok := engine.dependsCtrls[depends.PodName]; !ok {
 			//We will allow the weak reference to the dependency pods and won't return an error
@@ -195,10 +225,18 @@ func (engine *OrcEngine) NewPodGroup(spec PodGroupSpec) error {
 
 	var pg PodGroup
 	pg.State = RunStatePending
-	pgCtrl := engine.initPodGroupCtrl(spec, nil, pg)
+	if spec.Job != nil {
+		pg.Job = &JobStatus{State: JobStateRunning, StartedAt: spec.CreatedAt}
+	}
+	states := make([]PodPrevState, spec.NumInstances)
+	for i := range states {
+		states[i] = NewPodPrevState(1)
+	}
+	pgCtrl := engine.initPodGroupCtrl(spec, states, pg)
 	engine.pgCtrls[spec.Name] = pgCtrl
-	engine.opsChan <- orcOperDeploy{pgCtrl}
-	return nil
+	operation := engine.operations.add(spec.Name, "deploy")
+	engine.opsChan <- orcOperDeploy{pgCtrl, operation}
+	return operation.Id, nil
 }
 
 func (engine *OrcEngine) InspectPodGroup(name string) (PodGroupWithSpec, bool) {
@@ -226,46 +264,66 @@ func (engine *OrcEngine) RefreshPodGroup(name string, forceUpdate bool) error {
 	}
 }
 
-func (engine *OrcEngine) RemovePodGroup(name string) error {
+func (engine *OrcEngine) RemovePodGroup(name string) (string, error) {
 	engine.Lock()
 	defer engine.Unlock()
 	if pgCtrl, ok := engine.pgCtrls[name]; !ok {
-		return ErrPodGroupNotExists
+		return "", ErrPodGroupNotExists
 	} else {
 		if err := canOperation(pgCtrl, PGOpStateRemoving); err != nil {
-			return err
+			return "", err
 		}
 		log.Infof("start delete %v\n", name)
-		engine.opsChan <- orcOperRemove{pgCtrl}
+		operation := engine.operations.add(name, "remove")
+		engine.opsChan <- orcOperRemove{pgCtrl, operation}
 		delete(engine.pgCtrls, name)
 		engine.rmPgCtrls[name] = pgCtrl
 		go engine.checkPodGroupRemoveResult(name, pgCtrl)
-		return nil
+		return operation.Id, nil
 	}
 }
 
-func (engine *OrcEngine) RescheduleInstance(name string, numInstances int, restartPolicy ...RestartPolicy) error {
+func (engine *OrcEngine) RescheduleInstance(name string, numInstances int, restartPolicy ...RestartPolicy) (string, error) {
 	engine.RLock()
 	defer engine.RUnlock()
 	if pgCtrl, ok := engine.pgCtrls[name]; !ok {
-		return ErrPodGroupNotExists
+		return "", ErrPodGroupNotExists
 	} else {
+		if pgCtrl.IsJob() {
+			return "", ErrJobNotUpdatable
+		}
+		if pgCtrl.IsDaemon() {
+			return "", ErrDaemonNotScalable
+		}
+		if pgCtrl.InBlueGreen() {
+			return "", ErrBlueGreenInProgress
+		}
 		if err := canOperation(pgCtrl, PGOpStateScheduling); err != nil {
-			return err
+			return "", err
 		}
-		engine.opsChan <- orcOperRescheduleInstance{pgCtrl, numInstances, restartPolicy}
-		return nil
+		operation := engine.operations.add(name, "replica")
+		engine.opsChan <- orcOperRescheduleInstance{pgCtrl, operation, numInstances, restartPolicy}
+		return operation.Id, nil
 	}
 }
 
-func (engine *OrcEngine) RescheduleSpec(name string, podSpec PodSpec) error {
+func (engine *OrcEngine) RescheduleSpec(name string, podSpec PodSpec) (string, error) {
 	engine.RLock()
 	defer engine.RUnlock()
 	if pgCtrl, ok := engine.pgCtrls[name]; !ok {
-		return ErrPodGroupNotExists
+		return "", ErrPodGroupNotExists
 	} else {
+		if pgCtrl.IsJob() {
+			return "", ErrJobNotUpdatable
+		}
+		if pgCtrl.InCanary() {
+			return "", ErrCanaryInProgress
+		}
+		if pgCtrl.InBlueGreen() {
+			return "", ErrBlueGreenInProgress
+		}
 		if err := canOperation(pgCtrl, PGOpStateUpgrading); err != nil {
-			return err
+			return "", err
 		}
 		for _, depends := range podSpec.Dependencies {
 			if _, ok := engine.dependsCtrls[depends.PodName]; !ok {
@@ -274,39 +332,196 @@ func (engine *OrcEngine) RescheduleSpec(name string, podSpec PodSpec) error {
 				log.Warnf("Engine found some missing dependency pod, %s", depends.PodName)
 			}
 		}
+		operation := engine.operations.add(name, "spec")
 		if engine.hasEnoughResource(pgCtrl, podSpec) {
-			engine.opsChan <- orcOperRescheduleSpec{pgCtrl, podSpec}
+			engine.opsChan <- orcOperRescheduleSpec{pgCtrl, operation, podSpec}
 		} else {
 			pgCtrl.Lock()
 			pgCtrl.group.LastError = "No resources available to scheduler container"
 			pgCtrl.Unlock()
 			log.Info("No resources available to scheduler container")
+			engine.operations.end(operation, OperationFailed, "No resources available to scheduler container")
 			pgCtrl.opsChan <- pgOperSaveStore{true}
 			pgCtrl.opsChan <- pgOperOver{}
 		}
 
+		return operation.Id, nil
+	}
+}
+
+// RescheduleCanary upgrades the first instances of the pod group to the pod spec, the others are upgraded
+// when the canary is promoted.
+func (engine *OrcEngine) RescheduleCanary(name string, podSpec PodSpec, instances int) (string, error) {
+	engine.RLock()
+	defer engine.RUnlock()
+	if pgCtrl, ok := engine.pgCtrls[name]; !ok {
+		return "", ErrPodGroupNotExists
+	} else {
+		if pgCtrl.IsJob() {
+			return "", ErrJobNotUpdatable
+		}
+		if pgCtrl.IsDaemon() {
+			return "", ErrDaemonNotScalable
+		}
+		if pgCtrl.InCanary() {
+			return "", ErrCanaryInProgress
+		}
+		if pgCtrl.InBlueGreen() {
+			return "", ErrBlueGreenInProgress
+		}
+		if !engine.hasEnoughResource(pgCtrl, podSpec) {
+			return "", ErrNotEnoughResources
+		}
+		if err := canOperation(pgCtrl, PGOpStateUpgrading); err != nil {
+			return "", err
+		}
+		operation := engine.operations.add(name, "canary")
+		engine.opsChan <- orcOperRescheduleCanary{pgCtrl, operation, podSpec, instances}
+		return operation.Id, nil
+	}
+}
+
+// PromoteCanary upgrades the rest instances of the pod group to the canary pod spec
+func (engine *OrcEngine) PromoteCanary(name string) (string, error) {
+	engine.RLock()
+	defer engine.RUnlock()
+	if pgCtrl, ok := engine.pgCtrls[name]; !ok {
+		return "", ErrPodGroupNotExists
+	} else {
+		if !pgCtrl.InCanary() {
+			return "", ErrCanaryNotExists
+		}
+		if err := canOperation(pgCtrl, PGOpStateUpgrading); err != nil {
+			return "", err
+		}
+		operation := engine.operations.add(name, "promote")
+		engine.opsChan <- orcOperPromoteCanary{pgCtrl, operation}
+		return operation.Id, nil
+	}
+}
+
+// AbortCanary upgrades the canary instances of the pod group back to the pod spec of the group
+func (engine *OrcEngine) AbortCanary(name string) (string, error) {
+	engine.RLock()
+	defer engine.RUnlock()
+	if pgCtrl, ok := engine.pgCtrls[name]; !ok {
+		return "", ErrPodGroupNotExists
+	} else {
+		if !pgCtrl.InCanary() {
+			return "", ErrCanaryNotExists
+		}
+		if err := canOperation(pgCtrl, PGOpStateUpgrading); err != nil {
+			return "", err
+		}
+		operation := engine.operations.add(name, "abort")
+		engine.opsChan <- orcOperAbortCanary{pgCtrl, operation}
+		return operation.Id, nil
+	}
+}
+
+// PauseOperation stops the operation of the pod group after the current instance
+func (engine *OrcEngine) PauseOperation(name string) error {
+	engine.RLock()
+	defer engine.RUnlock()
+	if pgCtrl, ok := engine.pgCtrls[name]; !ok {
+		return ErrPodGroupNotExists
+	} else {
+		if !pgCtrl.IsOperating() {
+			return ErrPodGroupNotOperating
+		}
+		pgCtrl.Pause()
+		return nil
+	}
+}
+
+// ResumeOperation goes on with the paused operation of the pod group
+func (engine *OrcEngine) ResumeOperation(name string) error {
+	engine.RLock()
+	defer engine.RUnlock()
+	if pgCtrl, ok := engine.pgCtrls[name]; !ok {
+		return ErrPodGroupNotExists
+	} else {
+		if !pgCtrl.IsPaused() {
+			return ErrPodGroupNotPaused
+		}
+		pgCtrl.Resume()
+		return nil
+	}
+}
+
+// CancelOperation drops the rest of the operation of the pod group, paused or not
+func (engine *OrcEngine) CancelOperation(name string) error {
+	engine.RLock()
+	defer engine.RUnlock()
+	if pgCtrl, ok := engine.pgCtrls[name]; !ok {
+		return ErrPodGroupNotExists
+	} else {
+		if !pgCtrl.IsOperating() {
+			return ErrPodGroupNotOperating
+		}
+		engine.opsChan <- orcOperCancel{pgCtrl}
 		return nil
 	}
 }
 
-func (engine *OrcEngine) DriftNode(fromNode, toNode string, pgName string, pgInstance int, force bool) {
+// ChangeUpdateStrategy changes the strategy used by the following spec reschedules of the pod group
+func (engine *OrcEngine) ChangeUpdateStrategy(name string, strategy UpdateStrategy) error {
 	engine.RLock()
 	defer engine.RUnlock()
+	if pgCtrl, ok := engine.pgCtrls[name]; !ok {
+		return ErrPodGroupNotExists
+	} else {
+		pgCtrl.Lock()
+		pgCtrl.spec.UpdateStrategy = strategy
+		pgCtrl.Unlock()
+		pgCtrl.opsChan <- pgOperSaveStore{true}
+		return nil
+	}
+}
+
+// ChangeFailurePolicy changes the policy used when the upgraded instances fail in the following upgrades of the pod group
+func (engine *OrcEngine) ChangeFailurePolicy(name string, policy FailurePolicy) error {
+	engine.RLock()
+	defer engine.RUnlock()
+	if pgCtrl, ok := engine.pgCtrls[name]; !ok {
+		return ErrPodGroupNotExists
+	} else {
+		pgCtrl.Lock()
+		pgCtrl.spec.FailurePolicy = policy
+		pgCtrl.Unlock()
+		pgCtrl.opsChan <- pgOperSaveStore{true}
+		return nil
+	}
+}
+
+// DriftNode drifts the pod groups off the node, returns the ids of the drift operations
+func (engine *OrcEngine) DriftNode(fromNode, toNode string, pgName string, pgInstance int, force bool) []string {
+	engine.RLock()
+	defer engine.RUnlock()
+	ids := make([]string, 0)
 	if pgName == "" {
-		for _, pgCtrl := range engine.pgCtrls {
+		for name, pgCtrl := range engine.pgCtrls {
+			if pgCtrl.IsDaemon() {
+				continue // the daemon instances stay on their nodes
+			}
 			_pgCtrl := pgCtrl
-			engine.opsChan <- orcOperScheduleDrift{_pgCtrl, fromNode, toNode, pgInstance, force}
+			operation := engine.operations.add(name, "drift")
+			engine.opsChan <- orcOperScheduleDrift{_pgCtrl, operation, fromNode, toNode, pgInstance, force}
+			ids = append(ids, operation.Id)
 		}
 	} else {
-		if pgCtrl, ok := engine.pgCtrls[pgName]; ok {
-			engine.opsChan <- orcOperScheduleDrift{pgCtrl, fromNode, toNode, pgInstance, force}
+		if pgCtrl, ok := engine.pgCtrls[pgName]; ok && !pgCtrl.IsDaemon() {
+			operation := engine.operations.add(pgName, "drift")
+			engine.opsChan <- orcOperScheduleDrift{pgCtrl, operation, fromNode, toNode, pgInstance, force}
+			ids = append(ids, operation.Id)
 		}
 	}
 	// FIXME: do we need to tell dependsCtrl to drift?
 	// so far we just wait for the dependsCtrl to react to the events
+	return ids
 }
 
-func (engine *OrcEngine) ChangeState(pgName, op string, instance int) error {
+func (engine *OrcEngine) ChangeState(pgName, op string, instance int) (string, error) {
 	engine.RLock()
 	defer engine.RUnlock()
 	if pgCtrl, ok := engine.pgCtrls[pgName]; ok {
@@ -320,34 +535,44 @@ func (engine *OrcEngine) ChangeState(pgName, op string, instance int) error {
 			targetState = PGOpStateRestarting
 		}
 		if err := canOperation(pgCtrl, (PGOpState)(targetState)); err != nil {
-			return err
+			return "", err
 		}
-		engine.opsChan <- orcOperChangeState{pgCtrl, op, instance}
+		operation := engine.operations.add(pgName, "operation")
+		engine.opsChan <- orcOperChangeState{pgCtrl, operation, op, instance}
+		return operation.Id, nil
 	} else {
-		return ErrPodGroupNotExists
+		return "", ErrPodGroupNotExists
 	}
-	return nil
 }
 
 func (engine *OrcEngine) hasEnoughResource(pgCtrl *podGroupController, podSpec PodSpec) bool {
 	if resources, err := engine.cluster.GetResources(); err != nil {
 		return false
 	} else {
-		podsLen := pgCtrl.spec.NumInstances
-		singleMemory := podSpec.Containers[0].MemoryLimit
-		availbleNums := 0
-		for _, resource := range resources {
-			nodeAvailMem := (resource.Memory - resource.UsedMemory)
-			for _, pod := range pgCtrl.group.Pods {
-				if pod.NodeName() == resource.Name {
-					nodeAvailMem += pgCtrl.spec.Pod.Containers[0].MemoryLimit
-				}
-			}
-			availbleNums += int(nodeAvailMem / singleMemory)
-			if availbleNums >= podsLen {
-				return true
+		return fitsResources(resources, pgCtrl.spec, pgCtrl.group.Pods, podSpec)
+	}
+}
+
+// fitsResources tells if the spare memory of the nodes holds all the instances of the pod spec,
+// the memory taken by the pod group's own pods is counted as spare since they are going to be replaced.
+func fitsResources(resources []cluster.Node, pgSpec PodGroupSpec, pods []Pod, podSpec PodSpec) bool {
+	podsLen := pgSpec.NumInstances
+	singleMemory := podSpec.Containers[0].MemoryLimit
+	if podsLen <= 0 || singleMemory <= 0 {
+		return true
+	}
+	availbleNums := 0
+	for _, resource := range resources {
+		nodeAvailMem := (resource.Memory - resource.UsedMemory)
+		for _, pod := range pods {
+			if pod.NodeName() == resource.Name {
+				nodeAvailMem += pgSpec.Pod.Containers[0].MemoryLimit
 			}
 		}
+		availbleNums += int(nodeAvailMem / singleMemory)
+		if availbleNums >= podsLen {
+			return true
+		}
 	}
 	return false
 }
@@ -385,6 +610,12 @@ func (engine *OrcEngine) Stop() {
 	engine.stop = nil
 }
 
+// Close stops the engine and all the store watchers, the engine can not be started again
+func (engine *OrcEngine) Close() {
+	engine.Stop()
+	engine.stopWatch()
+}
+
 func (engine *OrcEngine) GuardGotoSleep() bool {
 	engine.Lock()
 	defer engine.Unlock()
@@ -411,7 +642,7 @@ func (engine *OrcEngine) LoadDependsPods() error {
 	} else {
 		for _, name := range specNames {
 			var spec PodSpec
-			if err := engine.store.Get(name, &spec); err != nil {
+			if _, err := loadMigrated(engine.store, RecordDependsSpec, name, &spec); err != nil {
 				log.Errorf("Failed to load dependency pod spec %q from storage, %s", name, err)
 				return err
 			}
@@ -452,12 +683,14 @@ func (engine *OrcEngine) LoadPodGroups() error {
 			}
 			for _, pgName := range pgNames {
 				var pgWithSpec PodGroupWithSpec
-				if err := engine.store.Get(pgName, &pgWithSpec); err != nil {
+				version, err := loadMigrated(engine.store, RecordPodGroup, pgName, &pgWithSpec)
+				if err != nil {
 					log.Errorf("Failed to load pod group with spec %q from storage, %s", pgName, err)
 					return err
 				}
 				spec, states, pg := pgWithSpec.Spec, pgWithSpec.PrevState, pgWithSpec.PodGroup
 				pgCtrls[spec.Name] = engine.initPodGroupCtrl(spec, states, pg)
+				pgCtrls[spec.Name].storedVersion = version
 				log.Infof("Loaded PodGroupController, %s", pgCtrls[spec.Name])
 			}
 		}
@@ -594,6 +827,7 @@ func (engine *OrcEngine) refreshAllPodGroups() {
 func (engine *OrcEngine) initOperationWorker() {
 	tick := time.Tick(time.Duration(RefreshInterval) * time.Second)
 	portsTick := time.Tick(5 * time.Minute)
+	cronTick := time.Tick(CronCheckInterval)
 	for {
 		select {
 		case op := <-engine.opsChan:
@@ -602,8 +836,13 @@ func (engine *OrcEngine) initOperationWorker() {
 			engine.refreshAllPodGroups()
 		case <-tick:
 			engine.refreshAllPodGroups()
+			go engine.syncDaemons()
+		case <-engine.syncDaemonsChan:
+			go engine.syncDaemons()
 		case <-portsTick:
 			RefreshPorts(engine.pgCtrls)
+		case <-cronTick:
+			go engine.checkCrons(time.Now())
 		case <-engine.stop:
 			return
 		}
@@ -660,6 +899,8 @@ func canOperation(pgCtrl *podGroupController, target PGOpState) error {
 	if canOp := pgCtrl.CanOperate(target); !canOp {
 		return OperLockedError{info: "Scheduling"}
 	}
+	// the accepted operation supersedes the paused one
+	pgCtrl.supersedePause()
 	return nil
 }
 
@@ -677,16 +918,33 @@ func operatings(store storage.Store) []string {
 	return results
 }
 
-func pgOpStart(store storage.Store, pgname string) {
+// pgOpStart marks the pod group operating, the versions keep the marks we made, so we will never
+// remove the marks made by other deployd instances, e.g. the new leader during a leadership flap.
+func pgOpStart(store storage.Store, pgname string, versions map[string]uint64) {
 	operatingKey := kLainDeploydRootKey + "/" + kLainPgOpingKey + "/" + pgname
-	if err := store.SetWithTTL(operatingKey, struct{}{}, DefaultLastSpecCacheTTL, true); err != nil {
+	if version, ok := versions[pgname]; ok {
+		// restart the mark to refresh the ttl
+		if err := store.Commit(storage.NewTxn().IfVersion(operatingKey, version).Remove(operatingKey)); err != nil {
+			log.Warnf("[Store] Failed to restart operating pod group %s, %s", operatingKey, err)
+		}
+		delete(versions, pgname)
+	}
+	if version, err := store.SetIfAbsent(operatingKey, struct{}{}, DefaultLastSpecCacheTTL); err != nil {
 		log.Warnf("[Store] Failed to save operating pod group %s, %s", operatingKey, err)
+	} else {
+		versions[pgname] = version
 	}
 }
 
-func pgOpOver(store storage.Store, pgname string) {
+func pgOpOver(store storage.Store, pgname string, versions map[string]uint64) {
 	operatingKey := kLainDeploydRootKey + "/" + kLainPgOpingKey + "/" + pgname
-	if err := store.Remove(operatingKey); err != nil {
+	version, ok := versions[pgname]
+	if !ok {
+		log.Warnf("[Store] Operating pod group %s is not marked by us, leave it", operatingKey)
+		return
+	}
+	delete(versions, pgname)
+	if err := store.Commit(storage.NewTxn().IfVersion(operatingKey, version).Remove(operatingKey)); err != nil {
 		log.Warnf("[Store] Failed to remove operating pod group %s, %s", operatingKey, err)
 	}
 }
@@ -700,12 +958,55 @@ func (engine *OrcEngine) onClusterNodeLost(nodeName string, downCount int) {
 		ntfController.Send(NewNotifySpec("Cluster", "Deployd",
 			1, time.Now(), NotifyClusterAbnormal))
 		engine.Stop()
+		return
+	}
+	// the daemons are synced after the node stays down for a while, nothing changes if it is back by then
+	time.AfterFunc(DaemonNodeDownDelay, engine.notifyNodesChanged)
+}
+
+// notifyNodesChanged tells the operation worker to sync the daemons with the nodes
+func (engine *OrcEngine) notifyNodesChanged() {
+	select {
+	case engine.syncDaemonsChan <- true:
+	default: // a sync is already pending
 	}
 }
 
+// clusterDownNodes remembers when the cluster nodes went down, to tell how many nodes are lost in the recent period
+type clusterDownNodes map[string]time.Time
+
+// Down records the node is down at the time, returns the count of nodes down within downNodeResetPeriod
+func (downNodes clusterDownNodes) Down(nodeName string, downTime time.Time) int {
+	downNodes[nodeName] = downTime
+	downCount := 0
+	for _, v := range downNodes {
+		if v.Add(downNodeResetPeriod).After(downTime) {
+			downCount++
+		}
+	}
+	return downCount
+}
+
+// Up forgets the node, returns true if the node was down before
+func (downNodes clusterDownNodes) Up(nodeName string) bool {
+	if _, ok := downNodes[nodeName]; ok {
+		delete(downNodes, nodeName)
+		return true
+	}
+	return false
+}
+
+// eventTime uses the time when the cluster emitted the event, so that the events can be replayed
+func eventTime(event adoc.Event) time.Time {
+	if event.Time > 0 {
+		return time.Unix(event.Time, 0)
+	}
+	return time.Now()
+}
+
 func (engine *OrcEngine) startClusterMonitor() {
 	restart := make(chan bool)
-	downNodes := make(map[string]time.Time)
+	downNodes := make(clusterDownNodes)
 	for {
 		succeed := SyncEventsDataFromStorage(engine)
 		if !succeed {
@@ -725,22 +1026,19 @@ func (engine *OrcEngine) startClusterMonitor() {
 			if strings.HasPrefix(event.From, "swarm") {
 				switch event.Status {
 				case "engine_disconnect":
-					now := time.Now()
-					log.Warnf("got engine disconnect event from %s, downTime: %v", event.Node.Name, now)
-					downNodes[event.Node.Name] = now
-					downCount := 0
-					for _, v := range downNodes {
-						if v.Add(downNodeResetPeriod).After(now) {
-							downCount++
-						}
-					}
+					downTime := eventTime(event)
+					log.Warnf("got engine disconnect event from %s, downTime: %v", event.Node.Name, downTime)
+					downCount := downNodes.Down(event.Node.Name, downTime)
 					engine.onClusterNodeLost(event.Node.Name, downCount)
 				case "engine_connect":
 					log.Infof("got engine connect event from %s", event.Node.Name)
-					if _, ok := downNodes[event.Node.Name]; ok {
-						delete(downNodes, event.Node.Name)
-						engine.refreshAllChan <- true
+					if downNodes.Up(event.Node.Name) {
+						select {
+						case engine.refreshAllChan <- true:
+						default: // a refresh is already pending
+						}
 					}
+					engine.notifyNodesChanged()
 				}
 			} else {
 				HandleDockerEvent(engine, &event)
@@ -764,19 +1062,25 @@ func (engine *OrcEngine) startClusterMonitor() {
 
 func New(cluster cluster.Cluster, store storage.Store) (*OrcEngine, error) {
 	engine := &OrcEngine{
-		cluster:      cluster,
-		config:       EngineConfig{ReadOnly: false},
-		store:        store,
-		pgCtrls:      make(map[string]*podGroupController),
-		rmPgCtrls:    make(map[string]*podGroupController),
-		dependsCtrls: make(map[string]*dependsController),
-		rmDepCtrls:   make(map[string]*dependsController),
-		opsChan:      make(chan orcOperation, 500),
-		stop:         nil,
-		clstrFailCnt: 0,
+		cluster:         cluster,
+		config:          EngineConfig{ReadOnly: false},
+		store:           store,
+		pgCtrls:         make(map[string]*podGroupController),
+		rmPgCtrls:       make(map[string]*podGroupController),
+		dependsCtrls:    make(map[string]*dependsController),
+		rmDepCtrls:      make(map[string]*dependsController),
+		crons:           newCronController(),
+		opsChan:         make(chan orcOperation, 500),
+		refreshAllChan:  make(chan bool, 1),
+		syncDaemonsChan: make(chan bool, 1),
+		operations:      newOperationTracker(),
+		opVersions:      make(map[string]uint64),
+		stop:            nil,
+		clstrFailCnt:    0,
 	}
+	engine.watchCtx, engine.stopWatch = context.WithCancel(context.Background())
 	configSpecsVars(store)
-	watchResource(store)
+	watchResource(engine.watchCtx, store)
 	WatchEngineConfig(engine)
 
 	eagleView := NewRuntimeEagleView()
@@ -804,6 +1108,10 @@ func New(cluster cluster.Cluster, store storage.Store) (*OrcEngine, error) {
 		return nil, err
 	}
 
+	if err := engine.LoadCrons(); err != nil {
+		return nil, err
+	}
+
 	engine.Start()
 
 	return engine, nil
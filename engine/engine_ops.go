@@ -74,11 +74,12 @@ func (op orcOperEventHandler) Do(engine *OrcEngine) {
 // PodGroup Operations
 
 type orcOperDeploy struct {
-	pgCtrl *podGroupController
+	pgCtrl    *podGroupController
+	operation *Operation
 }
 
 func (op orcOperDeploy) Do(engine *OrcEngine) {
-	op.pgCtrl.Deploy()
+	op.pgCtrl.Deploy(op.operation)
 }
 
 type orcOperRefresh struct {
@@ -91,34 +92,126 @@ func (op orcOperRefresh) Do(engine *OrcEngine) {
 }
 
 type orcOperRemove struct {
-	pgCtrl *podGroupController
+	pgCtrl    *podGroupController
+	operation *Operation
 }
 
 func (op orcOperRemove) Do(engine *OrcEngine) {
-	op.pgCtrl.Remove()
+	op.pgCtrl.Remove(op.operation)
 }
 
 type orcOperRescheduleInstance struct {
 	pgCtrl        *podGroupController
+	operation     *Operation
 	numInstances  int
 	restartPolicy []RestartPolicy
 }
 
 func (op orcOperRescheduleInstance) Do(engine *OrcEngine) {
-	op.pgCtrl.RescheduleInstance(op.numInstances, op.restartPolicy...)
+	op.pgCtrl.RescheduleInstance(op.operation, op.numInstances, op.restartPolicy...)
+}
+
+// orcOperSyncDaemon makes the instances of the daemon follow the nodes
+type orcOperSyncDaemon struct {
+	pgCtrl    *podGroupController
+	operation *Operation
+	nodes     []string
+}
+
+func (op orcOperSyncDaemon) Do(engine *OrcEngine) {
+	op.pgCtrl.SyncDaemonNodes(op.operation, op.nodes)
 }
 
 type orcOperRescheduleSpec struct {
-	pgCtrl  *podGroupController
-	podSpec PodSpec
+	pgCtrl    *podGroupController
+	operation *Operation
+	podSpec   PodSpec
 }
 
 func (op orcOperRescheduleSpec) Do(engine *OrcEngine) {
-	op.pgCtrl.RescheduleSpec(op.podSpec)
+	op.pgCtrl.RescheduleSpec(op.operation, op.podSpec)
+}
+
+type orcOperApply struct {
+	pgCtrl    *podGroupController
+	operation *Operation
+	spec      PodGroupSpec
+	plan      ApplyPlan
+}
+
+func (op orcOperApply) Do(engine *OrcEngine) {
+	op.pgCtrl.Apply(op.operation, op.spec, op.plan)
+}
+
+type orcOperRescheduleCanary struct {
+	pgCtrl    *podGroupController
+	operation *Operation
+	podSpec   PodSpec
+	instances int
+}
+
+func (op orcOperRescheduleCanary) Do(engine *OrcEngine) {
+	op.pgCtrl.RescheduleCanary(op.operation, op.podSpec, op.instances)
+}
+
+type orcOperPromoteCanary struct {
+	pgCtrl    *podGroupController
+	operation *Operation
+}
+
+func (op orcOperPromoteCanary) Do(engine *OrcEngine) {
+	op.pgCtrl.PromoteCanary(op.operation)
+}
+
+type orcOperAbortCanary struct {
+	pgCtrl    *podGroupController
+	operation *Operation
+}
+
+func (op orcOperAbortCanary) Do(engine *OrcEngine) {
+	op.pgCtrl.AbortCanary(op.operation)
+}
+
+type orcOperDeployBlueGreen struct {
+	pgCtrl      *podGroupController
+	operation   *Operation
+	podSpec     PodSpec
+	removeDelay int
+}
+
+func (op orcOperDeployBlueGreen) Do(engine *OrcEngine) {
+	op.pgCtrl.DeployBlueGreen(op.operation, op.podSpec, op.removeDelay)
+}
+
+type orcOperSwitchBlueGreen struct {
+	pgCtrl    *podGroupController
+	operation *Operation
+}
+
+func (op orcOperSwitchBlueGreen) Do(engine *OrcEngine) {
+	op.pgCtrl.SwitchBlueGreen(op.operation)
+}
+
+type orcOperDiscardBlueGreen struct {
+	pgCtrl    *podGroupController
+	operation *Operation
+}
+
+func (op orcOperDiscardBlueGreen) Do(engine *OrcEngine) {
+	op.pgCtrl.DiscardBlueGreen(op.operation)
+}
+
+type orcOperCancel struct {
+	pgCtrl *podGroupController
+}
+
+func (op orcOperCancel) Do(engine *OrcEngine) {
+	op.pgCtrl.Cancel()
 }
 
 type orcOperScheduleDrift struct {
 	pgCtrl     *podGroupController
+	operation  *Operation
 	fromNode   string
 	toNode     string
 	instanceNo int
@@ -126,15 +219,16 @@ type orcOperScheduleDrift struct {
 }
 
 func (op orcOperScheduleDrift) Do(engine *OrcEngine) {
-	op.pgCtrl.RescheduleDrift(op.fromNode, op.toNode, op.instanceNo, op.force)
+	op.pgCtrl.RescheduleDrift(op.operation, op.fromNode, op.toNode, op.instanceNo, op.force)
 }
 
 type orcOperChangeState struct {
-	pgCtrl   *podGroupController
-	op       string
-	instance int
+	pgCtrl    *podGroupController
+	operation *Operation
+	op        string
+	instance  int
 }
 
 func (op orcOperChangeState) Do(engine *OrcEngine) {
-	op.pgCtrl.ChangeState(op.op, op.instance)
+	op.pgCtrl.ChangeState(op.operation, op.op, op.instance)
 }
@@ -0,0 +1,185 @@
+package engine
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/laincloud/deployd/cluster/fake"
+	"github.com/laincloud/deployd/storage/memory"
+)
+
+func initFakeEngine(t *testing.T, nodes int) (*OrcEngine, *fake.Cluster, *fake.Clock) {
+	c := fake.NewCluster()
+	clock := fake.NewClock(time.Date(2017, 6, 1, 10, 0, 0, 0, time.UTC))
+	c.SetClock(clock.Now)
+	for i := 1; i <= nodes; i++ {
+		c.AddNode(fmt.Sprintf("node%d", i), fmt.Sprintf("192.168.77.%d:2375", 20+i), 8, 16*1024*1024*1024, nil)
+	}
+	store := memory.NewStore()
+	ConfigPortsManager(store)
+	engine, err := New(c, store)
+	if err != nil {
+		t.Fatalf("Cannot create the orc engine, %s", err)
+	}
+	for i := 0; c.Monitors() == 0; i++ {
+		if i > 100 {
+			t.Fatalf("Engine should start monitoring the cluster events")
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+	return engine, c, clock
+}
+
+func TestClusterNodesLostInShortPeriod(t *testing.T) {
+	engine, c, clock := initFakeEngine(t, 5)
+	defer engine.Stop()
+
+	c.DisconnectNode("node1")
+	clock.Advance(time.Minute)
+	c.DisconnectNode("node2")
+	c.Flush()
+	if !engine.Started() {
+		t.Fatalf("Engine should keep working with 2 nodes down")
+	}
+
+	clock.Advance(time.Minute + 30*time.Second)
+	c.DisconnectNode("node3")
+	c.Flush()
+	if engine.Started() {
+		t.Errorf("Engine should be stopped with 3 nodes down in 3 minutes")
+	}
+}
+
+func TestClusterNodesLostInLongPeriod(t *testing.T) {
+	engine, c, clock := initFakeEngine(t, 5)
+	defer engine.Stop()
+
+	c.DisconnectNode("node1")
+	clock.Advance(2 * time.Minute)
+	c.DisconnectNode("node2")
+	clock.Advance(2 * time.Minute)
+	c.DisconnectNode("node3")
+	c.Flush()
+	if !engine.Started() {
+		t.Fatalf("Engine should keep working with nodes down in a long period")
+	}
+
+	// node recovered should not be counted anymore
+	c.ReconnectNode("node3")
+	clock.Advance(30 * time.Second)
+	c.DisconnectNode("node4")
+	c.Flush()
+	if !engine.Started() {
+		t.Fatalf("Engine should keep working since node3 is back")
+	}
+
+	clock.Advance(15 * time.Second)
+	c.DisconnectNode("node5")
+	c.Flush()
+	if engine.Started() {
+		t.Errorf("Engine should be stopped with node2, node4 and node5 down in 3 minutes")
+	}
+}
+
+func waitPodGroupState(t *testing.T, engine *OrcEngine, name string, state RunState) {
+	for i := 0; ; i++ {
+		if pg, ok := engine.InspectPodGroup(name); ok && pg.State == state {
+			return
+		}
+		if i > 100 {
+			t.Fatalf("Pod group %s should be in state %v", name, state)
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+}
+
+func TestPodGroupSaveConflict(t *testing.T) {
+	engine, _, _ := initFakeEngine(t, 2)
+	defer engine.Stop()
+
+	name := "hello.proc.web.web"
+	if _, err := engine.NewPodGroup(createPodGroupSpec("hello", name, 1)); err != nil {
+		t.Fatalf("Should be able to create the pod group, %s", err)
+	}
+	waitPodGroupState(t, engine, name, RunStateSuccess)
+
+	engine.RLock()
+	pgCtrl := engine.pgCtrls[name]
+	engine.RUnlock()
+	pgCtrl.opsChan <- pgOperSaveStore{true}
+	time.Sleep(200 * time.Millisecond)
+	if _, err := engine.store.GetRaw(pgCtrl.storedKey); err != nil {
+		t.Fatalf("Pod group should be saved, %s", err)
+	}
+
+	// another deployd instance overwrites the pod group during a leadership flap, the controller refuses to
+	// clobber it, the operation fails with the conflict
+	other := map[string]string{"owner": "other"}
+	engine.store.Set(pgCtrl.storedKey, other, true)
+	id, err := engine.RescheduleInstance(name, 2)
+	if err != nil {
+		t.Fatalf("Should be able to scale the pod group, %s", err)
+	}
+	if op := waitOperationEnded(t, engine, id); op.Status != OperationFailed || !strings.Contains(op.Error, "changed by others") {
+		t.Errorf("Operation should fail with the conflict, but got %+v", op)
+	}
+	if pg, _ := engine.InspectPodGroup(name); !strings.Contains(pg.LastError, "changed by others") {
+		t.Errorf("Conflict should be kept as the last error, but got %q", pg.LastError)
+	}
+	if raw, _ := engine.store.GetRaw(pgCtrl.storedKey); raw != `{"owner":"other"}` {
+		t.Errorf("Pod group changed by others should not be clobbered, but got %s", raw)
+	}
+
+	pgCtrl.opsChan <- pgOperRemoveStore{}
+	time.Sleep(200 * time.Millisecond)
+	if raw, _ := engine.store.GetRaw(pgCtrl.storedKey); raw != `{"owner":"other"}` {
+		t.Errorf("Pod group changed by others should not be removed, but got %s", raw)
+	}
+}
+
+func TestPodGroupOperatingMarks(t *testing.T) {
+	store := memory.NewStore()
+	versions := make(map[string]uint64)
+	pgOpStart(store, "hello.proc.web.web", versions)
+	pgOpStart(store, "hello.proc.web.web", versions)
+	if pgs := operatings(store); len(pgs) != 1 || pgs[0] != "hello.proc.web.web" {
+		t.Fatalf("Should get the operating pod group, but got %v", pgs)
+	}
+	pgOpOver(store, "hello.proc.web.web", versions)
+	if pgs := operatings(store); len(pgs) != 0 {
+		t.Errorf("Operating mark should be removed, but got %v", pgs)
+	}
+
+	// the mark made by another deployd instance should be kept
+	pgOpStart(store, "hello.proc.web.web", versions)
+	otherVersions := make(map[string]uint64)
+	store.Remove(kLainDeploydRootKey + "/" + kLainPgOpingKey + "/hello.proc.web.web")
+	pgOpStart(store, "hello.proc.web.web", otherVersions)
+	pgOpOver(store, "hello.proc.web.web", versions)
+	if pgs := operatings(store); len(pgs) != 1 {
+		t.Errorf("Operating mark of others should not be removed, but got %v", pgs)
+	}
+}
+
+func TestWatchEngineConfig(t *testing.T) {
+	engine, _, _ := initFakeEngine(t, 1)
+	defer engine.Close()
+
+	engine.store.Set(EtcdConfigKey, EngineConfig{ReadOnly: true}, true)
+	for i := 0; !engine.ReadOnly(); i++ {
+		if i > 20 {
+			t.Fatalf("Engine config should be updated by the watcher")
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+
+	engine.stopWatch()
+	time.Sleep(50 * time.Millisecond)
+	engine.store.Set(EtcdConfigKey, EngineConfig{ReadOnly: false}, true)
+	time.Sleep(200 * time.Millisecond)
+	if !engine.ReadOnly() {
+		t.Errorf("Engine config should not be updated after the watcher stopped")
+	}
+}
@@ -0,0 +1,103 @@
+package engine
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/laincloud/deployd/cluster"
+	"github.com/laincloud/deployd/storage"
+	"github.com/mijia/sweb/log"
+)
+
+// pgOperCheckUpgrade waits for the last upgraded batch to be healthy by the health deadline of the failure policy,
+// then checks all the instances upgraded so far and takes the action of the policy if too many of them failed.
+type pgOperCheckUpgrade struct {
+	lastBatch []int
+	upgraded  []int
+}
+
+func (op pgOperCheckUpgrade) Do(pgCtrl *podGroupController, c cluster.Cluster, store storage.Store, ev *RuntimeEagleView) bool {
+	var failures []string
+	start := time.Now()
+	defer func() {
+		pgCtrl.RLock()
+		log.Infof("%s check upgrade, iNos=%v, failures=%v, duration=%s", pgCtrl, op.upgraded, failures, time.Now().Sub(start))
+		pgCtrl.RUnlock()
+	}()
+	pgCtrl.RLock()
+	policy := pgCtrl.spec.FailurePolicy
+	pgCtrl.RUnlock()
+	for _, instanceNo := range op.lastBatch {
+		pgCtrl.waitPodHealth(instanceNo, policy.HealthDeadline)
+	}
+	var failed []int
+	for _, instanceNo := range op.upgraded {
+		if reason := upgradeFailure(pgCtrl.podCtrls[instanceNo-1], c); reason != "" {
+			failed = append(failed, instanceNo)
+			failures = append(failures, fmt.Sprintf("instance %d %s", instanceNo, reason))
+		}
+	}
+	if len(failed) <= policy.MaxFailed {
+		return false
+	}
+
+	lastError := fmt.Sprintf("%d of the %d upgraded instances failed, %s", len(failed), len(op.upgraded), strings.Join(failures, ", "))
+	switch policy.Action {
+	case FailureActionContinue:
+		pgCtrl.RLock()
+		log.Warnf("%s %s, go on with the upgrade", pgCtrl, lastError)
+		pgCtrl.RUnlock()
+		pgCtrl.failUpgrade(lastError)
+	case FailureActionPause:
+		pgCtrl.failUpgrade(lastError + ", the upgrade is paused")
+		lowOp1 := pgOperSnapshotGroup{true}
+		lowOp1.Do(pgCtrl, c, store, ev)
+		lowOp2 := pgOperSaveStore{true}
+		lowOp2.Do(pgCtrl, c, store, ev)
+		pgCtrl.notifyUpgradeFailed(failed[0], fmt.Sprintf(NotifyUpgradePausedTmplt, lastError))
+		pgCtrl.Pause()
+	default:
+		if !pgCtrl.rollBack(lastError, failed[0], op.upgraded...) {
+			pgCtrl.failUpgrade(lastError)
+		}
+	}
+	return false
+}
+
+// upgradeFailure refreshes the upgraded instance and tells why it failed, empty if it did not
+func upgradeFailure(podCtrl *podController, c cluster.Cluster) string {
+	podCtrl.Refresh(c)
+	pod := podCtrl.pod
+	switch {
+	case pod.OOMkilled:
+		return "was OOM killed"
+	case pod.State == RunStateExit || pod.State == RunStateFail:
+		if pod.LastError != "" {
+			return fmt.Sprintf("exited, %s", pod.LastError)
+		}
+		return "exited"
+	case pod.State != RunStateSuccess:
+		return fmt.Sprintf("is in state %s, %s", pod.State, pod.LastError)
+	case pod.RestartCount > 0:
+		return fmt.Sprintf("was restarted %d times", pod.RestartCount)
+	case pod.Healthst != HealthStateNone && pod.Healthst != HealthStateHealthy:
+		return fmt.Sprintf("is %s", pod.Healthst)
+	}
+	return ""
+}
+
+// failUpgrade keeps the failure of the upgrade as the last error of the group until the next operation begins
+func (pgCtrl *podGroupController) failUpgrade(lastError string) {
+	pgCtrl.Lock()
+	defer pgCtrl.Unlock()
+	pgCtrl.upgradeError = lastError
+	pgCtrl.group.LastError = lastError
+}
+
+func (pgCtrl *podGroupController) notifyUpgradeFailed(instanceNo int, message string) {
+	pgCtrl.RLock()
+	namespace, name := pgCtrl.spec.Namespace, pgCtrl.spec.Name
+	pgCtrl.RUnlock()
+	ntfController.Send(NewNotifySpec(namespace, name, instanceNo, time.Now(), message))
+}
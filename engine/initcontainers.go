@@ -0,0 +1,122 @@
+package engine
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/laincloud/deployd/cluster"
+	"github.com/mijia/adoc"
+	"github.com/mijia/sweb/log"
+)
+
+const (
+	kInitLogsTail     = 10  // lines of the logs of the failed init container kept in the last error
+	kInitLogsMaxBytes = 512 // bytes of the logs summary kept in the last error
+)
+
+// InitPollInterval is how often the running init container is inspected
+var InitPollInterval = time.Second
+
+// runInitContainers runs the init containers one by one on the node of the pod, each should exit 0 in the init
+// timeout. The init containers are removed once completed, the pod fails with the exit code and the logs of
+// the failed one, and the containers of the pod are not created then.
+func (pc *podController) runInitContainers(cluster cluster.Cluster, filters []string) bool {
+	for i, cSpec := range pc.spec.InitContainers {
+		log.Infof("%s run init container %d, filter is %v", pc, i, filters)
+		id, err := pc.createInitContainer(cluster, filters, i)
+		if err != nil {
+			log.Warnf("%s Cannot create init container, error=%q, spec=%+v", pc, err, cSpec)
+			pc.pod.State = RunStateError
+			pc.pod.LastError = fmt.Sprintf("Cannot create init container %d, %s", i, err)
+			return false
+		}
+		failure := pc.waitInitContainer(cluster, id)
+		if failure != "" {
+			if logs := initLogsSummary(cluster, id); logs != "" {
+				failure = fmt.Sprintf("%s, logs: %s", failure, logs)
+			}
+		}
+		if err := cluster.RemoveContainer(id, true, false); err != nil {
+			log.Warnf("%s Cannot remove the init container %s, %s", pc, id, err)
+		}
+		if failure != "" {
+			log.Warnf("%s init container %d failed, %s", pc, i, failure)
+			pc.pod.State = RunStateFail
+			pc.pod.LastError = fmt.Sprintf("Init container %d %s", i, failure)
+			pc.pod.InitError = pc.pod.LastError
+			return false
+		}
+	}
+	return true
+}
+
+// createInitContainer creates the init container like the only container of the pod, so it shares the volumes
+// of the instance, but without the labels of the pod group, the ports, the health check and the fixed ip.
+func (pc *podController) createInitContainer(cluster cluster.Cluster, filters []string, index int) (string, error) {
+	initCtrl := &podController{spec: pc.spec.Clone(), pod: pc.pod}
+	initCtrl.spec.Containers = []ContainerSpec{pc.spec.InitContainers[index]}
+	initCtrl.spec.PrevState.IPs = []string{""}
+
+	cc := initCtrl.createContainerConfig(filters, 0)
+	cc.Labels = map[string]string{kLainLabelPrefix + ".init_of": pc.spec.Name}
+	for key, value := range pc.spec.Labels {
+		cc.Labels[key] = value
+	}
+	cc.Healthcheck = &adoc.HealthConfig{Test: []string{"NONE"}}
+	cc.ExposedPorts = nil
+	hc := initCtrl.createHostConfig(0)
+	hc.PortBindings = nil
+	nc := initCtrl.createNetworkingConfig(0)
+	name := fmt.Sprintf("%s.v%d-i%d-d%d-init%d", pc.spec.Name, pc.spec.Version, pc.pod.InstanceNo, pc.pod.DriftCount, index)
+	return cluster.CreateContainer(cc, hc, nc, name)
+}
+
+// waitInitContainer starts the init container and waits for it to complete, returns why it failed, empty if
+// it exited 0. The init container still running after the init timeout is stopped.
+func (pc *podController) waitInitContainer(cluster cluster.Cluster, id string) string {
+	if err := cluster.StartContainer(id); err != nil {
+		return fmt.Sprintf("cannot start, %s", err)
+	}
+	timeout := pc.spec.GetInitTimeout()
+	deadline := time.Now().Add(time.Duration(timeout) * time.Second)
+	for {
+		info, err := cluster.InspectContainer(id)
+		if err != nil {
+			return fmt.Sprintf("cannot be inspected, %s", err)
+		}
+		if state := info.State; !state.Running {
+			if state.ExitCode == 0 && state.Error == "" && !state.OOMKilled {
+				return ""
+			}
+			failure := fmt.Sprintf("exited with code %d", state.ExitCode)
+			if state.OOMKilled {
+				failure += ", OOM killed"
+			}
+			if state.Error != "" {
+				failure += ", " + state.Error
+			}
+			return failure
+		}
+		if time.Now().After(deadline) {
+			cluster.StopContainer(id, pc.spec.GetKillTimeout())
+			return fmt.Sprintf("did not complete in %ds", timeout)
+		}
+		time.Sleep(InitPollInterval)
+	}
+}
+
+// initLogsSummary returns the last lines of the logs of the init container in one line
+func initLogsSummary(cluster cluster.Cluster, id string) string {
+	logs, err := cluster.ContainerLogs(id, kInitLogsTail)
+	if err != nil {
+		log.Warnf("Cannot read the logs of the init container %s, %s", id, err)
+		return ""
+	}
+	lines := strings.Split(strings.TrimSpace(logs), "\n")
+	summary := strings.Join(lines, " | ")
+	if len(summary) > kInitLogsMaxBytes {
+		summary = "..." + summary[len(summary)-kInitLogsMaxBytes:]
+	}
+	return summary
+}
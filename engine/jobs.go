@@ -0,0 +1,258 @@
+package engine
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"time"
+
+	"github.com/laincloud/deployd/cluster"
+	"github.com/laincloud/deployd/storage"
+	"github.com/mijia/sweb/log"
+)
+
+const (
+	JobStateRunning  = "running"
+	JobStateComplete = "complete"
+	JobStateFailed   = "failed"
+
+	kJobMaxBackoff = 10 * time.Minute
+)
+
+var (
+	ErrPodGroupNotJob   = errors.New("PodGroup is not a job")
+	ErrJobNotUpdatable  = errors.New("PodGroup is a job, it runs to completion with the spec it was submitted with")
+	ErrJobSpecNotExists = errors.New("PodGroupSpec has no JobSpec")
+)
+
+// JobStatus tells how many pods of the job pod group succeeded and failed, the job is complete when
+// the completions succeeded, and failed when more pods failed than the backoff limit.
+type JobStatus struct {
+	State      string
+	Succeeded  int
+	Failed     int
+	LastError  string
+	StartedAt  time.Time
+	FinishedAt time.Time
+	CleanedAt  time.Time // when the containers were removed after the TTL of the job
+}
+
+// JobInfo is the job pod group shown by the jobs api
+type JobInfo struct {
+	Name   string
+	Spec   JobSpec
+	Status JobStatus
+	Pods   []Pod
+}
+
+func newJobInfo(pg PodGroupWithSpec) JobInfo {
+	info := JobInfo{Name: pg.Spec.Name, Pods: pg.Pods}
+	if pg.Spec.Job != nil {
+		info.Spec = *pg.Spec.Job
+	}
+	if pg.Job != nil {
+		info.Status = *pg.Job
+	}
+	return info
+}
+
+// InspectJob returns the job pod group by the name
+func (engine *OrcEngine) InspectJob(name string) (JobInfo, error) {
+	pg, ok := engine.InspectPodGroup(name)
+	if !ok {
+		return JobInfo{}, ErrPodGroupNotExists
+	}
+	if pg.Spec.Job == nil {
+		return JobInfo{}, ErrPodGroupNotJob
+	}
+	return newJobInfo(pg), nil
+}
+
+// ListJobs returns all the job pod groups sorted by the name
+func (engine *OrcEngine) ListJobs() []JobInfo {
+	engine.RLock()
+	defer engine.RUnlock()
+	jobs := []JobInfo{}
+	for _, pgCtrl := range engine.pgCtrls {
+		if pgCtrl.IsJob() {
+			jobs = append(jobs, newJobInfo(pgCtrl.Inspect()))
+		}
+	}
+	sort.Sort(byJobName(jobs))
+	return jobs
+}
+
+type byJobName []JobInfo
+
+func (jobs byJobName) Len() int           { return len(jobs) }
+func (jobs byJobName) Swap(i, j int)      { jobs[i], jobs[j] = jobs[j], jobs[i] }
+func (jobs byJobName) Less(i, j int) bool { return jobs[i].Name < jobs[j].Name }
+
+// IsJob tells if the pod group runs to completion
+func (pgCtrl *podGroupController) IsJob() bool {
+	pgCtrl.RLock()
+	defer pgCtrl.RUnlock()
+	return pgCtrl.spec.Job != nil
+}
+
+// pgOperRefreshJob counts the job pods finished since the last refresh and runs them again while more completions
+// are needed, or finishes the job. The containers of the finished job are removed after the TTL of the job.
+type pgOperRefreshJob struct{}
+
+func (op pgOperRefreshJob) Do(pgCtrl *podGroupController, c cluster.Cluster, store storage.Store, ev *RuntimeEagleView) bool {
+	pgCtrl.RLock()
+	spec := pgCtrl.spec.Clone()
+	var status JobStatus
+	if pgCtrl.group.Job != nil {
+		status = *pgCtrl.group.Job
+	}
+	pgCtrl.RUnlock()
+	if spec.Job == nil {
+		return false
+	}
+	start := time.Now()
+	defer func() {
+		pgCtrl.RLock()
+		log.Infof("%s refresh job, status=%+v, duration=%s", pgCtrl, status, time.Now().Sub(start))
+		pgCtrl.RUnlock()
+	}()
+
+	job, last, now := *spec.Job, status, time.Now()
+	if status.State == "" {
+		status.State, status.StartedAt = JobStateRunning, spec.CreatedAt
+	}
+	changed := false
+	if status.State == JobStateRunning {
+		changed = pgCtrl.runJob(job, &status, now, c)
+	}
+	if status.State != JobStateRunning && job.TTL > 0 && status.CleanedAt.IsZero() &&
+		now.After(status.FinishedAt.Add(time.Duration(job.TTL)*time.Second)) {
+		for i, podCtrl := range pgCtrl.podCtrls {
+			if len(podCtrl.pod.Containers) > 0 {
+				removeOp := pgOperRemoveInstance{i + 1, podCtrl.spec}
+				removeOp.Do(pgCtrl, c, store, ev)
+			}
+		}
+		status.CleanedAt = now
+	}
+	if changed || status != last {
+		pgCtrl.Lock()
+		pgCtrl.group.Job = &status
+		pgCtrl.Unlock()
+		op1 := pgOperSnapshotGroup{true}
+		op1.Do(pgCtrl, c, store, ev)
+		op2 := pgOperSaveStore{true}
+		op2.Do(pgCtrl, c, store, ev)
+	}
+	return false
+}
+
+// runJob counts the finished pods into the status, the finished pods are run again while more completions are
+// needed, the failed ones after the backoff. Returns true if any pod is changed.
+func (pgCtrl *podGroupController) runJob(job JobSpec, status *JobStatus, now time.Time, c cluster.Cluster) bool {
+	changed, active := false, 0
+	for _, podCtrl := range pgCtrl.podCtrls {
+		pod := &podCtrl.pod
+		if !pod.CompletedAt.IsZero() {
+			continue
+		}
+		if !jobPodFinished(*pod) {
+			active += 1
+			continue
+		}
+		pod.CompletedAt = now
+		if jobPodSucceeded(*pod) {
+			status.Succeeded += 1
+		} else {
+			status.Failed += 1
+			status.LastError = fmt.Sprintf("instance %d failed, %s", pod.InstanceNo, jobPodFailure(*pod))
+		}
+		changed = true
+	}
+
+	switch {
+	case status.Succeeded >= job.Completions:
+		status.State, status.FinishedAt = JobStateComplete, now
+	case status.Failed > job.BackoffLimit:
+		status.State, status.FinishedAt = JobStateFailed, now
+		status.LastError = fmt.Sprintf("%d pods failed, more than the backoff limit %d, the last %s",
+			status.Failed, job.BackoffLimit, status.LastError)
+		for _, podCtrl := range pgCtrl.podCtrls {
+			if podCtrl.pod.CompletedAt.IsZero() {
+				podCtrl.Stop(c)
+				podCtrl.pod.CompletedAt = now
+				changed = true
+			}
+		}
+	default:
+		needed := job.Completions - status.Succeeded - active
+		for _, podCtrl := range pgCtrl.podCtrls {
+			if needed <= 0 {
+				break
+			}
+			pod := podCtrl.pod
+			if pod.CompletedAt.IsZero() ||
+				(!jobPodSucceeded(pod) && now.Before(pod.CompletedAt.Add(job.GetBackoff(status.Failed)))) {
+				continue
+			}
+			pgCtrl.rerunJobPod(podCtrl, c)
+			needed -= 1
+			changed = true
+		}
+	}
+	return changed
+}
+
+// rerunJobPod replaces the containers of the finished job pod with the new ones
+func (pgCtrl *podGroupController) rerunJobPod(podCtrl *podController, c cluster.Cluster) {
+	nodeName, ids := podCtrl.pod.NodeName(), podCtrl.pod.ContainerIds()
+	podCtrl.Remove(c)
+	pgCtrl.forgetContainers(ids)
+	pgCtrl.emitChangeEvent("remove", podCtrl.spec, podCtrl.pod, nodeName)
+	podCtrl.pod.State = RunStatePending
+	podCtrl.pod.CompletedAt = time.Time{}
+	podCtrl.Deploy(c)
+	if podCtrl.pod.State == RunStateSuccess {
+		pod := podCtrl.pod.Clone()
+		pgCtrl.emitChangeEvent("add", podCtrl.spec, pod, pod.NodeName())
+	}
+}
+
+// jobPodFinished tells if the job pod is not running any more, the pods failed to deploy or missing are finished too
+func jobPodFinished(pod Pod) bool {
+	switch pod.State {
+	case RunStateExit, RunStateFail, RunStateError, RunStateMissing:
+		return true
+	}
+	return false
+}
+
+// jobPodSucceeded tells if all the containers of the job pod exited with 0
+func jobPodSucceeded(pod Pod) bool {
+	if pod.State != RunStateExit || pod.OOMkilled || len(pod.Containers) == 0 {
+		return false
+	}
+	for _, container := range pod.Containers {
+		if container.Id == "" || container.Runtime.State.ExitCode != 0 {
+			return false
+		}
+	}
+	return true
+}
+
+func jobPodFailure(pod Pod) string {
+	if pod.State == RunStateExit && !pod.OOMkilled {
+		for _, container := range pod.Containers {
+			if container.Runtime.State.ExitCode != 0 {
+				return fmt.Sprintf("exited with code %d", container.Runtime.State.ExitCode)
+			}
+		}
+	}
+	if pod.OOMkilled {
+		return "was OOM killed"
+	}
+	if pod.LastError != "" {
+		return pod.LastError
+	}
+	return fmt.Sprintf("is in state %s", pod.State)
+}
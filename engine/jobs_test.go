@@ -0,0 +1,134 @@
+package engine
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestJobSpec(t *testing.T) {
+	if (JobSpec{}).VerifyParams() || (JobSpec{Completions: 1, BackoffLimit: -1}).VerifyParams() {
+		t.Errorf("Should not accept the job without completions or with the negative limits")
+	}
+	if p := (JobSpec{Completions: 3}).GetParallelism(); p != 1 {
+		t.Errorf("Should run 1 pod at the same time by default, got %d", p)
+	}
+	if p := (JobSpec{Completions: 2, Parallelism: 5}).GetParallelism(); p != 2 {
+		t.Errorf("Should not run more pods than the completions, got %d", p)
+	}
+	job := JobSpec{Completions: 1, Backoff: 10}
+	if b := job.GetBackoff(1); b != 10*time.Second {
+		t.Errorf("Should wait the backoff before the first retry, got %s", b)
+	}
+	if b := job.GetBackoff(3); b != 40*time.Second {
+		t.Errorf("Should double the backoff on each failure, got %s", b)
+	}
+	if b := job.GetBackoff(20); b != kJobMaxBackoff {
+		t.Errorf("Should wait 10 minutes at most, got %s", b)
+	}
+}
+
+// refreshJob refreshes the job pod group until its status satisfies the condition
+func refreshJob(t *testing.T, engine *OrcEngine, name string, cond func(JobInfo) bool) JobInfo {
+	for i := 0; ; i++ {
+		if err := engine.RefreshPodGroup(name, false); err != nil {
+			t.Fatalf("Should be able to refresh the job, %s", err)
+		}
+		time.Sleep(100 * time.Millisecond)
+		job, err := engine.InspectJob(name)
+		if err != nil {
+			t.Fatalf("Should find the job, %s", err)
+		}
+		if cond(job) {
+			return job
+		}
+		if i > 50 {
+			t.Fatalf("Should refresh the job to the expected status, got %+v", job.Status)
+		}
+	}
+}
+
+func TestPodGroupJob(t *testing.T) {
+	engine, c, _ := initFakeEngine(t, 2)
+	defer engine.Stop()
+
+	namespace, name := "hello", "hello.job.migrate"
+	pgSpec := createPodGroupSpec(namespace, name, 5)
+	pgSpec.RestartPolicy = RestartPolicyAlways
+	pgSpec.Job = &JobSpec{Completions: 3, Parallelism: 2, BackoffLimit: 1, TTL: 1}
+	operationId, err := engine.NewPodGroup(pgSpec)
+	if err != nil {
+		t.Fatalf("Should be able to submit the job, %s", err)
+	}
+	waitOperationEnded(t, engine, operationId)
+	pg, _ := engine.InspectPodGroup(name)
+	if pg.Spec.NumInstances != 2 || pg.Spec.RestartPolicy != RestartPolicyNever || pg.Job.State != JobStateRunning {
+		t.Fatalf("Should run the job with 2 pods never restarted, got %+v, %+v", pg.Spec, pg.Job)
+	}
+	if _, err := engine.RescheduleInstance(name, 3); err != ErrJobNotUpdatable {
+		t.Errorf("Should not reschedule the job, got %v", err)
+	}
+	if _, err := engine.InspectJob("hello.proc.web.foo"); err != ErrPodGroupNotExists {
+		t.Errorf("Should not find the job not submitted, got %v", err)
+	}
+
+	// both pods succeed, only one of them runs again for the last completion
+	firstId, secondId := pg.Pods[0].Containers[0].Id, pg.Pods[1].Containers[0].Id
+	c.ExitContainer(firstId, 0, "")
+	c.ExitContainer(secondId, 0, "")
+	job := refreshJob(t, engine, name, func(job JobInfo) bool { return job.Status.Succeeded == 2 })
+	if job.Status.State != JobStateRunning || job.Pods[0].State != RunStateSuccess || job.Pods[0].Containers[0].Id == firstId ||
+		job.Pods[1].State != RunStateExit || job.Pods[1].Containers[0].Id != secondId {
+		t.Fatalf("Should run the first pod again and keep the second one exited, got %+v", job)
+	}
+	if _, err := c.InspectContainer(firstId); err == nil {
+		t.Errorf("Should remove the container of the pod run again")
+	}
+
+	// the failed pod is retried within the backoff limit
+	firstId = job.Pods[0].Containers[0].Id
+	c.ExitContainer(firstId, 2, "")
+	job = refreshJob(t, engine, name, func(job JobInfo) bool { return job.Status.Failed == 1 })
+	if job.Status.State != JobStateRunning || !strings.Contains(job.Status.LastError, "instance 1 failed, exited with code 2") ||
+		job.Pods[0].State != RunStateSuccess || job.Pods[0].Containers[0].Id == firstId {
+		t.Fatalf("Should retry the failed pod, got %+v", job)
+	}
+
+	c.ExitContainer(job.Pods[0].Containers[0].Id, 0, "")
+	job = refreshJob(t, engine, name, func(job JobInfo) bool { return job.Status.State != JobStateRunning })
+	if job.Status.State != JobStateComplete || job.Status.Succeeded != 3 || job.Status.Failed != 1 ||
+		job.Status.FinishedAt.IsZero() {
+		t.Fatalf("Should complete the job with 3 pods succeeded, got %+v", job.Status)
+	}
+
+	// the containers are removed after the TTL
+	time.Sleep(1100 * time.Millisecond)
+	job = refreshJob(t, engine, name, func(job JobInfo) bool { return !job.Status.CleanedAt.IsZero() })
+	if _, err := c.InspectContainer(secondId); err == nil {
+		t.Errorf("Should remove the containers of the finished job after the TTL")
+	}
+	if job.Status.State != JobStateComplete || job.Status.Succeeded != 3 {
+		t.Errorf("Should keep the status of the job after the TTL, got %+v", job.Status)
+	}
+
+	// the job fails when more pods failed than the backoff limit
+	failed := "hello.job.failed"
+	pgSpec = createPodGroupSpec(namespace, failed, 1)
+	pgSpec.Job = &JobSpec{Completions: 2, Parallelism: 2}
+	if operationId, err = engine.NewPodGroup(pgSpec); err != nil {
+		t.Fatalf("Should be able to submit the job, %s", err)
+	}
+	waitOperationEnded(t, engine, operationId)
+	job, _ = engine.InspectJob(failed)
+	c.ExitContainer(job.Pods[0].Containers[0].Id, 1, "")
+	job = refreshJob(t, engine, failed, func(job JobInfo) bool { return job.Status.State != JobStateRunning })
+	if job.Status.State != JobStateFailed || !strings.Contains(job.Status.LastError, "more than the backoff limit 0") {
+		t.Fatalf("Should fail the job, got %+v", job.Status)
+	}
+	if info, err := c.InspectContainer(job.Pods[1].Containers[0].Id); err != nil || info.State.Running {
+		t.Errorf("Should stop the running pods of the failed job")
+	}
+	if jobs := engine.ListJobs(); len(jobs) != 2 || jobs[0].Name != failed || jobs[1].Name != name {
+		t.Errorf("Should list the jobs sorted by the name, got %+v", jobs)
+	}
+}
@@ -26,7 +26,8 @@ var (
 	NotifyClusterUnHealthy = "LAIN found Cluster Manager Unhealthy, please check your cluster"
 	NotifyClusterAbnormal = "LAIN found too many cluster nodes stoped in a short period, need stop the engine, please check your cluster"
 
-	NotifyUpgradeFailedTmplt = "LAIN found Last version:%d upgrade is terrrible, please check your code carefully!!"
+	NotifyUpgradeRolledBackTmplt = "LAIN found the upgrade to version:%d failed, %s, all the upgraded instances are rolled back to version:%d, please check your code carefully!!"
+	NotifyUpgradePausedTmplt     = "LAIN found the upgrade failed, %s, the upgrade is paused, please resume or cancel it"
 )
 
 type notifyController struct {
@@ -0,0 +1,244 @@
+package engine
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/laincloud/deployd/cluster"
+	"github.com/laincloud/deployd/storage"
+)
+
+const (
+	OperationPending    = "pending"
+	OperationRunning    = "running"
+	OperationPaused     = "paused"
+	OperationSucceeded  = "succeeded"
+	OperationFailed     = "failed"
+	OperationSuperseded = "superseded"
+	OperationCancelled  = "cancelled"
+
+	DefaultOperationsKept = 20
+)
+
+var (
+	ErrOperationNotExists = errors.New("Operation not existed")
+)
+
+// Operation is the progress of an accepted pod group command, the latest DefaultOperationsKept operations
+// of each pod group are kept in memory.
+type Operation struct {
+	Id        string    `json:"id"`
+	PgName    string    `json:"pg_name"`
+	Type      string    `json:"type"`
+	Status    string    `json:"status"`
+	Step      string    `json:"step"`
+	Done      int       `json:"done"`
+	Total     int       `json:"total"`
+	CreatedAt time.Time `json:"created_at"`
+	StartedAt time.Time `json:"started_at"`
+	EndedAt   time.Time `json:"ended_at"`
+	Error     string    `json:"error"`
+}
+
+func (o Operation) IsEnded() bool {
+	switch o.Status {
+	case OperationPending, OperationRunning, OperationPaused:
+		return false
+	}
+	return true
+}
+
+type operationTracker struct {
+	sync.RWMutex
+	seq uint64
+	ops map[string][]*Operation // pg name => operations from the oldest
+}
+
+func newOperationTracker() *operationTracker {
+	return &operationTracker{ops: make(map[string][]*Operation)}
+}
+
+// add records a pending operation of the pod group, the oldest ones are dropped beyond DefaultOperationsKept
+func (tracker *operationTracker) add(pgName, opType string) *Operation {
+	tracker.Lock()
+	defer tracker.Unlock()
+	tracker.seq += 1
+	now := time.Now()
+	o := &Operation{
+		Id:        fmt.Sprintf("%s-%d", now.Format("20060102150405"), tracker.seq),
+		PgName:    pgName,
+		Type:      opType,
+		Status:    OperationPending,
+		CreatedAt: now,
+	}
+	ops := append(tracker.ops[pgName], o)
+	if len(ops) > DefaultOperationsKept {
+		ops = ops[len(ops)-DefaultOperationsKept:]
+	}
+	tracker.ops[pgName] = ops
+	return o
+}
+
+func (tracker *operationTracker) update(o *Operation, updateFn func(o *Operation)) {
+	if o == nil {
+		return
+	}
+	tracker.Lock()
+	defer tracker.Unlock()
+	updateFn(o)
+}
+
+// end finishes the operation if it is not ended yet, the operation fails with a non-empty lastError
+func (tracker *operationTracker) end(o *Operation, status string, lastError string) {
+	tracker.update(o, func(o *Operation) {
+		if o.IsEnded() {
+			return
+		}
+		if status == OperationSucceeded && lastError != "" {
+			status = OperationFailed
+		}
+		o.Status, o.Error, o.EndedAt = status, lastError, time.Now()
+	})
+}
+
+func (tracker *operationTracker) get(id string) (Operation, bool) {
+	tracker.RLock()
+	defer tracker.RUnlock()
+	for _, ops := range tracker.ops {
+		for _, o := range ops {
+			if o.Id == id {
+				return *o, true
+			}
+		}
+	}
+	return Operation{}, false
+}
+
+// list returns the operations of the pod group from the latest to the oldest
+func (tracker *operationTracker) list(pgName string) []Operation {
+	tracker.RLock()
+	defer tracker.RUnlock()
+	ops := tracker.ops[pgName]
+	result := make([]Operation, 0, len(ops))
+	for i := len(ops) - 1; i >= 0; i -= 1 {
+		result = append(result, *ops[i])
+	}
+	return result
+}
+
+// instanceOperation is the pod group operation on some instances, counted in the progress of the operation
+type instanceOperation interface {
+	instances() int
+}
+
+func (op pgOperDeployInstance) instances() int       { return 1 }
+func (op pgOperUpgradeBatch) instances() int         { return len(op.instanceNos) }
+func (op pgOperUpdateInsConfig) instances() int      { return 1 }
+func (op pgOperRemoveInstance) instances() int       { return 1 }
+func (op pgOperDriftInstance) instances() int        { return 1 }
+func (op pgOperChangeState) instances() int          { return 1 }
+func (op pgOperDeployGreenInstance) instances() int  { return 1 }
+func (op pgOperDeployDaemonInstance) instances() int { return 1 }
+
+// pgOperBegin starts tracking the operation, the operation still running is superseded by the new one
+type pgOperBegin struct {
+	operation *Operation
+	total     int
+}
+
+func (op pgOperBegin) Do(pgCtrl *podGroupController, c cluster.Cluster, store storage.Store, ev *RuntimeEagleView) bool {
+	tracker := pgCtrl.engine.operations
+	pgCtrl.Lock()
+	last := pgCtrl.operation
+	pgCtrl.operation = op.operation
+	// the failure of the last upgrade is not carried over
+	pgCtrl.upgradeError = ""
+	pgCtrl.Unlock()
+	tracker.end(last, OperationSuperseded, "")
+	status := OperationRunning
+	if pgCtrl.IsPaused() {
+		// paused as soon as accepted, the loop stops before its first instance
+		status = OperationPaused
+	}
+	tracker.update(op.operation, func(o *Operation) {
+		o.Status, o.Total, o.StartedAt = status, op.total, time.Now()
+	})
+	return false
+}
+
+// beginOperation queues the start of the operation, should be called after the last operations are flushed,
+// the paused operation superseded by the new one does not keep the operation loop paused.
+func (pgCtrl *podGroupController) beginOperation(operation *Operation, total int) {
+	if operation != nil {
+		pgCtrl.opsChan <- pgOperBegin{operation, total}
+	}
+	if atomic.CompareAndSwapInt32(&pgCtrl.paused, pauseSuperseded, pauseNone) {
+		pgCtrl.wakeUp()
+	}
+}
+
+// currentOperation returns the last tracked operation, nil if none
+func (pgCtrl *podGroupController) currentOperation() *Operation {
+	pgCtrl.RLock()
+	defer pgCtrl.RUnlock()
+	return pgCtrl.operation
+}
+
+// trackOperation records the progress of the current operation after the pod group operation is done
+func (pgCtrl *podGroupController) trackOperation(op pgOperation) {
+	o := pgCtrl.currentOperation()
+	if o == nil {
+		return
+	}
+	tracker := pgCtrl.engine.operations
+	switch op := op.(type) {
+	case pgOperLogOperation:
+		tracker.update(o, func(o *Operation) {
+			if !o.IsEnded() {
+				o.Step = op.msg
+			}
+		})
+	case pgOperOver, pgOperPurge:
+		pgCtrl.RLock()
+		lastError := pgCtrl.group.LastError
+		pgCtrl.RUnlock()
+		tracker.end(o, OperationSucceeded, lastError)
+	case instanceOperation:
+		tracker.update(o, func(o *Operation) {
+			if !o.IsEnded() {
+				o.Done += op.instances()
+			}
+		})
+	}
+}
+
+// pauseOperation marks the current operation paused or running again
+func (pgCtrl *podGroupController) pauseOperation(paused bool) {
+	o := pgCtrl.currentOperation()
+	if o == nil {
+		return
+	}
+	pgCtrl.engine.operations.update(o, func(o *Operation) {
+		if paused && o.Status == OperationRunning {
+			o.Status = OperationPaused
+		} else if !paused && o.Status == OperationPaused {
+			o.Status = OperationRunning
+		}
+	})
+}
+
+// GetOperation returns the operation by its id
+func (engine *OrcEngine) GetOperation(id string) (Operation, error) {
+	if o, ok := engine.operations.get(id); ok {
+		return o, nil
+	}
+	return Operation{}, ErrOperationNotExists
+}
+
+// ListOperations returns the recent operations of the pod group from the latest to the oldest
+func (engine *OrcEngine) ListOperations(pgName string) []Operation {
+	return engine.operations.list(pgName)
+}
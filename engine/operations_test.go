@@ -0,0 +1,120 @@
+package engine
+
+import (
+	"testing"
+	"time"
+)
+
+func TestOperationTracker(t *testing.T) {
+	name := "hello.proc.web.web"
+	tracker := newOperationTracker()
+	first := tracker.add(name, "deploy")
+	tracker.end(first, OperationSucceeded, "bad things")
+	if o, _ := tracker.get(first.Id); o.Status != OperationFailed || o.Error != "bad things" {
+		t.Errorf("Should fail the operation ended with the last error, got %+v", o)
+	}
+	tracker.end(first, OperationCancelled, "")
+	if o, _ := tracker.get(first.Id); o.Status != OperationFailed {
+		t.Errorf("Should not end the operation twice, got %+v", o)
+	}
+
+	var last *Operation
+	for i := 0; i < DefaultOperationsKept; i++ {
+		last = tracker.add(name, "replica")
+	}
+	if _, ok := tracker.get(first.Id); ok {
+		t.Errorf("Should drop the oldest operation beyond %d operations", DefaultOperationsKept)
+	}
+	ops := tracker.list(name)
+	if len(ops) != DefaultOperationsKept || ops[0].Id != last.Id {
+		t.Errorf("Should list the kept operations from the latest, got %d operations", len(ops))
+	}
+}
+
+func TestPodGroupOperations(t *testing.T) {
+	engine, _, _ := initFakeEngine(t, 2)
+	defer engine.Stop()
+
+	namespace, name := "hello", "hello.proc.web.web"
+	deployId, err := engine.NewPodGroup(createPodGroupSpec(namespace, name, 1))
+	if err != nil {
+		t.Fatalf("Should be able to create the pod group, %s", err)
+	}
+	deploy := waitOperationEnded(t, engine, deployId)
+	if deploy.Type != "deploy" || deploy.Status != OperationSucceeded || deploy.Done != 1 || deploy.Total != 1 {
+		t.Errorf("Should track the deploy of 1 instance, got %+v", deploy)
+	}
+	if deploy.Step != "deploy finished" || deploy.StartedAt.IsZero() || deploy.EndedAt.Before(deploy.StartedAt) {
+		t.Errorf("Should record the last step and the time of the deploy, got %+v", deploy)
+	}
+
+	var replicaId string
+	for i := 0; ; i++ {
+		if replicaId, err = engine.RescheduleInstance(name, 3); err == nil {
+			break
+		}
+		if i > 100 {
+			t.Fatalf("Should be able to reschedule the instances, %s", err)
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+	replica := waitOperationEnded(t, engine, replicaId)
+	if replica.Type != "replica" || replica.Status != OperationSucceeded || replica.Done != 2 || replica.Total != 2 {
+		t.Errorf("Should track the deploy of the 2 new instances, got %+v", replica)
+	}
+
+	if ops := engine.ListOperations(name); len(ops) != 2 || ops[0].Id != replicaId || ops[1].Id != deployId {
+		t.Errorf("Should list the operations of the pod group from the latest, got %+v", ops)
+	}
+	if _, err := engine.GetOperation("missing"); err != ErrOperationNotExists {
+		t.Errorf("Should not find the missing operation, got %v", err)
+	}
+
+	removeId, err := engine.RemovePodGroup(name)
+	if err != nil {
+		t.Fatalf("Should be able to remove the pod group, %s", err)
+	}
+	if remove := waitOperationEnded(t, engine, removeId); remove.Status != OperationSucceeded || remove.Done != 3 {
+		t.Errorf("Should track the removal of the 3 instances, got %+v", remove)
+	}
+}
+
+func waitOperationEnded(t *testing.T, engine *OrcEngine, id string) Operation {
+	for i := 0; ; i++ {
+		o, err := engine.GetOperation(id)
+		if err != nil {
+			t.Fatalf("Should find the operation %s, %s", id, err)
+		}
+		if o.IsEnded() {
+			return o
+		}
+		if i > 600 {
+			t.Fatalf("Should end the operation in time, got %+v", o)
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+}
+
+func TestFlushedOperations(t *testing.T) {
+	engine, _, _ := initFakeEngine(t, 1)
+	defer engine.Stop()
+
+	// the operation loop is not activated, the operations stay in the chan until flushed
+	name := "hello.proc.web.web"
+	pgCtrl := &podGroupController{engine: engine, opsChan: make(chan pgOperation, 10)}
+	pending := engine.operations.add(name, "spec")
+	pgCtrl.beginOperation(pending, 1)
+	if flushed := pgCtrl.flushAllOps(); flushed != 1 {
+		t.Errorf("Should flush the queued operation, got %d", flushed)
+	}
+	if o, _ := engine.GetOperation(pending.Id); o.Status != OperationSuperseded || o.EndedAt.IsZero() {
+		t.Errorf("Should supersede the operation flushed before it began, got %+v", o)
+	}
+
+	pending = engine.operations.add(name, "spec")
+	pgCtrl.beginOperation(pending, 1)
+	pgCtrl.Cancel()
+	if o, _ := engine.GetOperation(pending.Id); o.Status != OperationCancelled {
+		t.Errorf("Should cancel the operation dropped before it began, got %+v", o)
+	}
+}
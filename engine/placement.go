@@ -0,0 +1,134 @@
+package engine
+
+import (
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/laincloud/deployd/cluster"
+	"github.com/laincloud/deployd/engine/scheduler"
+)
+
+// deployFilters are the filters of the pod spec, the anti affinity to the pods of the same pod group
+// and all the constraints of the cluster.
+func deployFilters(spec PodSpec) []string {
+	filters := make([]string, 0, len(spec.Filters)+1)
+	filters = append(filters, spec.Filters...)
+	containerLabel := ContainerLabel{
+		Name: spec.Name,
+	}
+
+	filters = append(filters, containerLabel.NameAffinity())
+
+	constraints := cstController.GetAllConstraints()
+	for _, cstSpec := range constraints {
+		filter := cstController.LoadFilterFromConstrain(cstSpec)
+		filters = append(filters, filter)
+	}
+	return filters
+}
+
+// schedulePod picks the node for the pod in deployd itself with the filters, the resources of the nodes
+// and the containers already placed, so the cluster backend only needs to put the containers onto the node.
+func schedulePod(c cluster.Cluster, spec PodSpec, filters []string) (scheduler.Decision, error) {
+	nodes, err := c.GetResources()
+	if err != nil {
+		return scheduler.Decision{}, err
+	}
+	pods, err := placements.list(c)
+	if err != nil {
+		return scheduler.Decision{}, err
+	}
+	return scheduler.Schedule(newScheduleRequest(spec, filters), nodes, pods)
+}
+
+// PlacementsRefreshInterval is how often the containers of the whole cluster are listed for the scheduling
+var PlacementsRefreshInterval = 30 * time.Second
+
+// placementCache keeps the containers placed in the cluster for evaluating the affinities, the whole cluster
+// is listed at most once every PlacementsRefreshInterval, and the containers created and removed by deployd are
+// applied in between, so deploying an instance does not list the containers on every node.
+type placementCache struct {
+	sync.Mutex
+	cluster  cluster.Cluster
+	pods     map[string]scheduler.Pod // container id -> pod
+	listedAt time.Time
+}
+
+var placements = &placementCache{}
+
+func (pc *placementCache) list(c cluster.Cluster) ([]scheduler.Pod, error) {
+	pc.Lock()
+	defer pc.Unlock()
+	if pc.cluster != c || pc.pods == nil || time.Since(pc.listedAt) > PlacementsRefreshInterval {
+		listed, err := listScheduledPods(c)
+		if err != nil {
+			return nil, err
+		}
+		pc.cluster, pc.listedAt = c, time.Now()
+		pc.pods = make(map[string]scheduler.Pod, len(listed))
+		for _, pod := range listed {
+			pc.pods[pod.Id] = pod
+		}
+	}
+	pods := make([]scheduler.Pod, 0, len(pc.pods))
+	for _, pod := range pc.pods {
+		pods = append(pods, pod)
+	}
+	return pods, nil
+}
+
+// add puts the container just created onto its node, it is applied only to the cache of the same cluster
+func (pc *placementCache) add(c cluster.Cluster, pod scheduler.Pod) {
+	pc.Lock()
+	defer pc.Unlock()
+	if pc.cluster == c && pc.pods != nil {
+		pc.pods[pod.Id] = pod
+	}
+}
+
+func (pc *placementCache) remove(c cluster.Cluster, id string) {
+	pc.Lock()
+	defer pc.Unlock()
+	if pc.cluster == c && pc.pods != nil {
+		delete(pc.pods, id)
+	}
+}
+
+// newScheduleRequest reserves the memory of all the containers in the pod, no cpus are reserved since
+// the containers are only limited by the cpu quota, the same as the swarm scheduling.
+func newScheduleRequest(spec PodSpec, filters []string) scheduler.Request {
+	req := scheduler.Request{
+		Name:    spec.Name,
+		Filters: filters,
+	}
+	for _, cSpec := range spec.Containers {
+		req.Memory += cSpec.MemoryLimit
+	}
+	return req
+}
+
+// listScheduledPods lists all the containers in the cluster, the names are like "/node1/hello.web.web.v0-i1-d0"
+func listScheduledPods(c cluster.Cluster) ([]scheduler.Pod, error) {
+	containers, err := c.ListContainers(true, false)
+	if err != nil {
+		return nil, err
+	}
+	pods := make([]scheduler.Pod, 0, len(containers))
+	for _, container := range containers {
+		pod := scheduler.Pod{
+			Id:     container.Id,
+			Image:  container.Image,
+			Labels: container.Labels,
+		}
+		if len(container.Names) > 0 {
+			parts := strings.Split(strings.TrimPrefix(container.Names[0], "/"), "/")
+			pod.Name = parts[len(parts)-1]
+			if len(parts) > 1 {
+				pod.Node = parts[0]
+			}
+		}
+		pods = append(pods, pod)
+	}
+	return pods, nil
+}
@@ -8,6 +8,7 @@ import (
 	"time"
 
 	"github.com/laincloud/deployd/cluster"
+	"github.com/laincloud/deployd/engine/scheduler"
 	"github.com/laincloud/deployd/network"
 	"github.com/laincloud/deployd/utils/units"
 	"github.com/laincloud/deployd/utils/util"
@@ -68,18 +69,19 @@ func (pc *podController) Deploy(cluster cluster.Cluster) {
 
 	pc.pod.Containers = make([]Container, len(pc.spec.Containers))
 	pc.pod.LastError = ""
-	filters := make([]string, 0, len(pc.spec.Filters)+1)
-	filters = append(filters, pc.spec.Filters...)
-	containerLabel := ContainerLabel{
-		Name: pc.spec.Name,
+	pc.pod.InitError = ""
+	filters := deployFilters(pc.spec)
+	decision, err := schedulePod(cluster, pc.spec, filters)
+	if err != nil {
+		log.Warnf("%s Cannot schedule pod, error=%q", pc, err)
+		pc.pod.State = RunStateError
+		pc.pod.LastError = fmt.Sprintf("Cannot schedule pod, %s", err)
+		return
 	}
-
-	filters = append(filters, containerLabel.NameAffinity())
-
-	constraints := cstController.GetAllConstraints()
-	for _, cstSpec := range constraints {
-		filter := cstController.LoadFilterFromConstrain(cstSpec)
-		filters = append(filters, filter)
+	log.Infof("%s scheduled to node %s, %s", pc, decision.Node, decision.Explain())
+	filters = append(filters, fmt.Sprintf("constraint:node==%s", decision.Node))
+	if !pc.runInitContainers(cluster, filters) {
+		return
 	}
 
 	for i, cSpec := range pc.spec.Containers {
@@ -91,6 +93,13 @@ func (pc *podController) Deploy(cluster cluster.Cluster) {
 			pc.pod.LastError = fmt.Sprintf("Cannot create container, %s", err)
 			return
 		}
+		placements.add(cluster, scheduler.Pod{
+			Id:     id,
+			Name:   pc.createContainerName(i),
+			Node:   decision.Node,
+			Image:  cSpec.Image,
+			Labels: pc.createContainerConfig(nil, i).Labels,
+		})
 		pc.startContainer(cluster, id)
 		pc.pod.Containers[i].Id = id
 		pc.refreshContainer(cluster, i)
@@ -184,6 +193,20 @@ func (pc *podController) Update(cluster cluster.Cluster) error {
 	return err
 }
 
+// UpdateResources updates the resources of the running containers in place, the state of the pod is kept
+func (pc *podController) UpdateResources(cluster cluster.Cluster) error {
+	var err error
+	for i, cSpec := range pc.spec.Containers {
+		if e := pc.updateContainer(cluster, i); e != nil {
+			log.Warnf("%s Cannot update the resources of container, error=%q, spec=%+v", pc, e, cSpec)
+			if err == nil {
+				err = e
+			}
+		}
+	}
+	return err
+}
+
 func (pc *podController) Remove(cluster cluster.Cluster) {
 	log.Infof("%s removing", pc)
 	start := time.Now()
@@ -203,6 +226,8 @@ func (pc *podController) Remove(cluster cluster.Cluster) {
 		if err := cluster.RemoveContainer(container.Id, true, false); err != nil {
 			log.Warnf("%s Cannot remove the container %s, %s", pc, container.Id, err)
 			pc.pod.LastError = fmt.Sprintf("Fail to remove container, %s", err)
+		} else {
+			placements.remove(cluster, container.Id)
 		}
 	}
 	pc.pod.Containers = nil
@@ -294,13 +319,19 @@ func (pc *podController) Refresh(cluster cluster.Cluster) {
 		log.Infof("%s refreshed, state=%+v, duration=%s", pc, pc.pod.ImRuntime, time.Now().Sub(start))
 	}()
 
+	pc.pod.UpdatedAt = time.Now()
+	if pc.pod.InitError != "" {
+		// the containers were not created since the init containers failed, they are not missing
+		pc.pod.State = RunStateFail
+		pc.pod.LastError = pc.pod.InitError
+		return
+	}
 	pc.pod.State = RunStateSuccess
 	pc.pod.LastError = ""
 
 	for i := 0; i < len(pc.spec.Containers); i += 1 {
 		pc.refreshContainer(cluster, i)
 	}
-	pc.pod.UpdatedAt = time.Now()
 }
 
 func (pc *podController) startContainer(cluster cluster.Cluster, id string) error {
@@ -386,20 +417,27 @@ func (pc *podController) refreshContainer(kluster cluster.Cluster, index int) {
 			}
 		}
 
+		mainPort := spec.MainPort()
 		container := Container{
 			Id:            id,
 			Runtime:       info,
 			NodeName:      info.Node.Name,
 			NodeIp:        info.Node.IP,
-			Protocol:      "tcp",
+			Protocol:      mainPort.Protocol,
 			ContainerIp:   nowIP,
-			ContainerPort: spec.Expose,
+			ContainerPort: mainPort.Port,
 		}
-		// FIXME: until we start working on the multiple ports
-		if ports, ok := info.NetworkSettings.Ports[fmt.Sprintf("%d/tcp", spec.Expose)]; ok && len(ports) > 0 {
-			if port, err := strconv.Atoi(ports[0].HostPort); err == nil {
-				container.NodePort = port
+		for _, p := range spec.ExposedPorts() {
+			mapping := PortMapping{Name: p.Name, ContainerPort: p.Port, Protocol: p.Protocol}
+			if ports, ok := info.NetworkSettings.Ports[p.Key()]; ok && len(ports) > 0 {
+				if port, err := strconv.Atoi(ports[0].HostPort); err == nil {
+					mapping.NodePort = port
+				}
+			}
+			if p.Key() == mainPort.Key() {
+				container.NodePort = mapping.NodePort
 			}
+			container.Ports = append(container.Ports, mapping)
 		}
 
 		pc.spec.PrevState.NodeName = info.Node.Name
@@ -443,17 +481,60 @@ func (pc *podController) createContainer(cluster cluster.Cluster, filters []stri
 	return cluster.CreateContainer(cc, hc, nc, name)
 }
 
+// updateContainer updates the cpu, memory and blkio device limits of the running container, the update API
+// ignores what it cannot apply, so the result is verified by inspecting the container.
 func (pc *podController) updateContainer(cluster cluster.Cluster, index int) error {
-	podSpec := pc.spec
-	spec := podSpec.Containers[index]
 	id := pc.pod.Containers[index].Id
+	resources := pc.createResources(index)
 	config := &CUpdateConfig{
-		Memory:     spec.MemoryLimit,
-		MemorySwap: spec.MemoryLimit, // Memory == MemorySwap means disable swap
-		CPUPeriod:  CPUQuota,
-		CPUQuota:   int64(spec.CpuLimit*resource.Cpu*CPUMaxPctg) * CPUQuota / int64(CPUMaxLevel*100),
+		Memory:               resources.Memory,
+		MemorySwap:           resources.MemorySwap,
+		CPUPeriod:            resources.CPUPeriod,
+		CPUQuota:             resources.CPUQuota,
+		BlkioDeviceReadBps:   resources.BlkioDeviceReadBps,
+		BlkioDeviceWriteBps:  resources.BlkioDeviceWriteBps,
+		BlkioDeviceReadIOps:  resources.BlkioDeviceReadIOps,
+		BlkioDeviceWriteIOps: resources.BlkioDeviceWriteIOps,
+	}
+	if err := cluster.UpdateContainer(id, config); err != nil {
+		return err
 	}
-	return cluster.UpdateContainer(id, config)
+	info, err := cluster.InspectContainer(id)
+	if err != nil {
+		return err
+	}
+	if info.HostConfig == nil {
+		return fmt.Errorf("no host config of container %s", id)
+	}
+	return verifyResources(resources, info.HostConfig.Resources)
+}
+
+// verifyResources tells which of the updated resources is not applied to the container
+func verifyResources(expected, actual adoc.Resources) error {
+	switch {
+	case actual.Memory != expected.Memory || actual.MemorySwap != expected.MemorySwap:
+		return fmt.Errorf("memory limit is %d with swap %d, but expected %d", actual.Memory, actual.MemorySwap, expected.Memory)
+	case actual.CPUPeriod != expected.CPUPeriod || actual.CPUQuota != expected.CPUQuota:
+		return fmt.Errorf("cpu quota is %d/%d, but expected %d/%d", actual.CPUQuota, actual.CPUPeriod, expected.CPUQuota, expected.CPUPeriod)
+	case !equalThrottleDevices(actual.BlkioDeviceReadBps, expected.BlkioDeviceReadBps),
+		!equalThrottleDevices(actual.BlkioDeviceWriteBps, expected.BlkioDeviceWriteBps),
+		!equalThrottleDevices(actual.BlkioDeviceReadIOps, expected.BlkioDeviceReadIOps),
+		!equalThrottleDevices(actual.BlkioDeviceWriteIOps, expected.BlkioDeviceWriteIOps):
+		return fmt.Errorf("blkio device limits are not applied")
+	}
+	return nil
+}
+
+func equalThrottleDevices(a, b []*adoc.ThrottleDevice) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i].Path != b[i].Path || a[i].Rate != b[i].Rate {
+			return false
+		}
+	}
+	return true
 }
 
 func (pc *podController) createContainerConfig(filters []string, index int) adoc.ContainerConfig {
@@ -514,7 +595,7 @@ func (pc *podController) createContainerConfig(filters []string, index int) adoc
 			var annotions map[string]interface{}
 			if err := json.Unmarshal([]byte(podSpec.Annotation), &annotions); err == nil {
 				if healthcheck, ok := annotions["healthcheck"]; ok {
-					port := spec.Expose
+					port := spec.MainPort().Port
 					healthcheckUrl, ok := healthcheck.(string)
 					if ok {
 						url := "http://localhost:" + strconv.Itoa(port) + healthcheckUrl
@@ -537,17 +618,18 @@ func (pc *podController) createContainerConfig(filters []string, index int) adoc
 		}
 	}
 
-	if spec.Expose > 0 {
-		cc.ExposedPorts = map[string]struct{}{
-			fmt.Sprintf("%d/tcp", spec.Expose): struct{}{},
+	if ports := spec.ExposedPorts(); len(ports) > 0 {
+		cc.ExposedPorts = make(map[string]struct{}, len(ports))
+		for _, p := range ports {
+			cc.ExposedPorts[p.Key()] = struct{}{}
 		}
 	}
 	return cc
 }
 
-func (pc *podController) createHostConfig(index int) adoc.HostConfig {
-	podSpec := pc.spec
-	spec := podSpec.Containers[index]
+// createResources returns the cpu, memory and blkio device limits of the container
+func (pc *podController) createResources(index int) adoc.Resources {
+	spec := pc.spec.Containers[index]
 	if spec.CpuLimit > CPUMaxLevel {
 		spec.CpuLimit = CPUMaxLevel
 	} else if spec.CpuLimit < 1 {
@@ -573,24 +655,31 @@ func (pc *podController) createHostConfig(index int) adoc.HostConfig {
 		}
 	}
 	swappiness := int64(0)
+	return adoc.Resources{
+		Memory:               spec.MemoryLimit,
+		MemorySwap:           spec.MemoryLimit, // Memory == MemorySwap means disable swap
+		MemorySwappiness:     &swappiness,
+		CPUPeriod:            CPUQuota,
+		CPUQuota:             int64(spec.CpuLimit*resource.Cpu*CPUMaxPctg) * CPUQuota / int64(CPUMaxLevel*100),
+		BlkioDeviceReadBps:   BlkioDeviceReadBps,
+		BlkioDeviceWriteBps:  BlkioDeviceWriteBps,
+		BlkioDeviceReadIOps:  BlkioDeviceReadIOps,
+		BlkioDeviceWriteIOps: BlkioDeviceWriteIOps,
+	}
+}
+
+func (pc *podController) createHostConfig(index int) adoc.HostConfig {
+	podSpec := pc.spec
+	spec := podSpec.Containers[index]
 	hc := adoc.HostConfig{
-		Resources: adoc.Resources{
-			Memory:               spec.MemoryLimit,
-			MemorySwap:           spec.MemoryLimit, // Memory == MemorySwap means disable swap
-			MemorySwappiness:     &swappiness,
-			CPUPeriod:            CPUQuota,
-			CPUQuota:             int64(spec.CpuLimit*resource.Cpu*CPUMaxPctg) * CPUQuota / int64(CPUMaxLevel*100),
-			BlkioDeviceReadBps:   BlkioDeviceReadBps,
-			BlkioDeviceWriteBps:  BlkioDeviceWriteBps,
-			BlkioDeviceReadIOps:  BlkioDeviceReadIOps,
-			BlkioDeviceWriteIOps: BlkioDeviceWriteIOps,
-		},
+		Resources: pc.createResources(index),
 	}
-	if spec.Expose > 0 {
-		hc.PortBindings = map[string][]adoc.PortBinding{
-			fmt.Sprintf("%d/tcp", spec.Expose): []adoc.PortBinding{
+	if ports := spec.ExposedPorts(); len(ports) > 0 {
+		hc.PortBindings = make(map[string][]adoc.PortBinding, len(ports))
+		for _, p := range ports {
+			hc.PortBindings[p.Key()] = []adoc.PortBinding{
 				adoc.PortBinding{},
-			},
+			}
 		}
 	}
 	if len(spec.Volumes) > 0 {
@@ -1,28 +1,19 @@
 package engine
 
 import (
+	"strings"
 	"testing"
 	"time"
 
-	"github.com/laincloud/deployd/cluster/swarm"
-	"github.com/laincloud/deployd/storage/etcd"
+	"github.com/laincloud/deployd/cluster/fake"
+	"github.com/mijia/adoc"
 	"github.com/mijia/sweb/log"
 )
 
 func TestPodController(t *testing.T) {
-	etcdAddr := "http://127.0.0.1:2379"
-	swarmAddr := "tcp://127.0.0.1:2376"
-	isDebug := false
-
-	_, err := etcd.NewStore(etcdAddr, isDebug)
-	if err != nil {
-		t.Errorf("Cannot init the etcd storage")
-	}
-
-	c, err := swarm.NewCluster(swarmAddr, 30*time.Second, 10*time.Minute)
-	if err != nil {
-		t.Errorf("Cannot init the swarm cluster manager")
-	}
+	c := fake.NewCluster()
+	c.AddNode("node1", "192.168.77.21:2375", 8, 16*1024*1024*1024, nil)
+	c.AddNode("node2", "192.168.77.22:2375", 8, 16*1024*1024*1024, nil)
 
 	cstController = NewConstraintController()
 
@@ -86,3 +77,257 @@ func TestPodController(t *testing.T) {
 		t.Fatal("Should not get data for the pods")
 	}
 }
+
+func TestPodControllerFaults(t *testing.T) {
+	c := fake.NewCluster()
+	c.AddNode("node1", "192.168.77.21:2375", 8, 16*1024*1024*1024, nil)
+	c.AddNode("node2", "192.168.77.22:2375", 8, 16*1024*1024*1024, nil)
+
+	cstController = NewConstraintController()
+
+	cSpec := NewContainerSpec("training/webapp")
+	cSpec.Command = []string{"python", "app.py"}
+	cSpec.MemoryLimit = 15 * 1024 * 1024
+	cSpec.Expose = 5000
+	podSpec := NewPodSpec(cSpec)
+	podSpec.Name = "hello.proc.web.foo"
+	podSpec.Namespace = "hello"
+	podSpec.Filters = []string{"constraint:node==node1"}
+
+	pc := &podController{
+		spec: podSpec,
+		pod: Pod{
+			InstanceNo: 1,
+		},
+	}
+	pc.pod.State = RunStatePending
+	pc.Deploy(c)
+	if pc.pod.State != RunStateSuccess || pc.pod.NodeName() != "node1" {
+		t.Fatalf("Pod should be deployed to node1, but got %+v", pc.pod)
+	}
+	cId := pc.pod.Containers[0].Id
+	ip := pc.pod.Containers[0].ContainerIp
+
+	c.OOMKill(cId)
+	pc.Refresh(c)
+	if pc.pod.State != RunStateExit || !pc.pod.OOMkilled {
+		t.Errorf("The pod should be exited by OOM, but got %+v", pc.pod.ImRuntime)
+	}
+	pc.Start(c)
+
+	// the container comes back with another ip, refresh should correct it
+	c.SetContainerIP(cId, "hello", "172.20.10.10")
+	pc.Refresh(c)
+	if pc.pod.State != RunStateSuccess || pc.pod.Containers[0].ContainerIp != ip {
+		t.Errorf("The pod should get the previous ip %s back, but got %+v", ip, pc.pod.Containers[0])
+	}
+
+	c.DisconnectNode("node1")
+	pc.Refresh(c)
+	if pc.pod.State != RunStateError {
+		t.Errorf("The pod should be in error state when the node is disconnected, but got %+v", pc.pod.ImRuntime)
+	}
+	c.ReconnectNode("node1")
+
+	if !pc.Drift(c, "node1", "node2", false) {
+		t.Fatalf("The pod should be drifted")
+	}
+	if pc.pod.State != RunStateSuccess || pc.pod.NodeName() != "node2" || pc.pod.DriftCount != 1 {
+		t.Errorf("The pod should be drifted to node2, but got %+v", pc.pod)
+	}
+	if _, err := c.InspectContainer(cId); err == nil {
+		t.Errorf("The drifted container should be removed")
+	}
+}
+
+func TestPodControllerPorts(t *testing.T) {
+	c := fake.NewCluster()
+	c.AddNode("node1", "192.168.77.21:2375", 8, 16*1024*1024*1024, nil)
+
+	cstController = NewConstraintController()
+
+	cSpec := NewContainerSpec("training/webapp")
+	cSpec.Command = []string{"python", "app.py"}
+	cSpec.MemoryLimit = 15 * 1024 * 1024
+	cSpec.Expose = 5000
+	cSpec.Ports = []PortSpec{
+		{Name: "http", Port: 5000},
+		{Name: "metrics", Port: 9100, Protocol: ProtocolTCP},
+		{Name: "stats", Port: 8125, Protocol: ProtocolUDP},
+	}
+	if !cSpec.VerifyParams() {
+		t.Fatalf("Should accept the ports")
+	}
+	if ports := cSpec.ExposedPorts(); len(ports) != 3 || ports[0].Key() != "5000/tcp" || ports[2].Key() != "8125/udp" {
+		t.Fatalf("Should not expose the declared Expose port twice, got %+v", ports)
+	}
+	invalid := cSpec.Clone()
+	invalid.Ports = append(invalid.Ports, PortSpec{Name: "stats", Port: 8126, Protocol: "sctp"})
+	if invalid.VerifyParams() {
+		t.Errorf("Should not accept the unknown protocol")
+	}
+	invalid.Ports[3] = PortSpec{Name: "statsd", Port: 8125, Protocol: ProtocolUDP}
+	if invalid.VerifyParams() {
+		t.Errorf("Should not accept the same port twice")
+	}
+
+	podSpec := NewPodSpec(cSpec)
+	podSpec.Name = "hello.proc.web.foo"
+	podSpec.Namespace = "hello"
+	pc := &podController{
+		spec: podSpec,
+		pod: Pod{
+			InstanceNo: 1,
+		},
+	}
+	pc.pod.State = RunStatePending
+	pc.Deploy(c)
+	if pc.pod.State != RunStateSuccess {
+		t.Fatalf("Pod should be deployed, but got %+v", pc.pod)
+	}
+	container := pc.pod.Containers[0]
+	if len(container.Ports) != 3 || container.ContainerPort != 5000 || container.Protocol != ProtocolTCP ||
+		container.NodePort == 0 || container.NodePort != container.Ports[0].NodePort {
+		t.Fatalf("Should report the main port and all the port mappings, got %+v", container)
+	}
+	for i, name := range []string{"http", "metrics", "stats"} {
+		if p := container.Ports[i]; p.Name != name || p.ContainerPort != cSpec.Ports[i].Port || p.NodePort == 0 {
+			t.Errorf("Should publish the port %s on the node, got %+v", name, p)
+		}
+	}
+	if container.Ports[2].Protocol != ProtocolUDP {
+		t.Errorf("Should keep the udp protocol, got %+v", container.Ports[2])
+	}
+
+	// the specs with only Expose keep working
+	cSpec.Ports = nil
+	if ports := cSpec.ExposedPorts(); len(ports) != 1 || ports[0].Key() != "5000/tcp" || cSpec.MainPort().Port != 5000 {
+		t.Errorf("Should expose the Expose port, got %+v", ports)
+	}
+}
+
+// completeInitContainer makes the init container exit with the code and the logs once it is running
+func completeInitContainer(c *fake.Cluster, name string, exitCode int, lines ...string) {
+	go func() {
+		for i := 0; i < 100; i++ {
+			if info, err := c.InspectContainer(name); err == nil && info.State.Running {
+				c.WriteLogs(info.Id, lines...)
+				c.ExitContainer(info.Id, exitCode, "")
+				return
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+	}()
+}
+
+func TestPodControllerInitContainers(t *testing.T) {
+	c := fake.NewCluster()
+	c.AddNode("node1", "192.168.77.21:2375", 8, 16*1024*1024*1024, nil)
+
+	cstController = NewConstraintController()
+	defer func(interval time.Duration) { InitPollInterval = interval }(InitPollInterval)
+	InitPollInterval = 10 * time.Millisecond
+
+	cSpec := NewContainerSpec("training/webapp")
+	cSpec.Command = []string{"python", "app.py"}
+	cSpec.MemoryLimit = 15 * 1024 * 1024
+	cSpec.Expose = 5000
+	initSpec := NewContainerSpec("training/webapp")
+	initSpec.Command = []string{"python", "migrate.py"}
+	initSpec.MemoryLimit = 15 * 1024 * 1024
+	podSpec := NewPodSpec(cSpec)
+	podSpec.Name = "hello.proc.web.foo"
+	podSpec.Namespace = "hello"
+	podSpec.InitContainers = []ContainerSpec{initSpec}
+	podSpec.InitTimeout = 1
+	initName := "hello.proc.web.foo.v1-i1-d0-init0"
+
+	pc := &podController{
+		spec: podSpec,
+		pod: Pod{
+			InstanceNo: 1,
+		},
+	}
+	pc.pod.State = RunStatePending
+	completeInitContainer(c, initName, 0, "migrated")
+	pc.Deploy(c)
+	if pc.pod.State != RunStateSuccess || pc.pod.Containers[0].Id == "" {
+		t.Fatalf("Pod should be deployed after the init container completed, but got %+v", pc.pod)
+	}
+	if _, err := c.InspectContainer(initName); err == nil {
+		t.Errorf("The completed init container should be removed")
+	}
+	pc.Refresh(c)
+	if pc.pod.State != RunStateSuccess {
+		t.Errorf("The init container should not be missing, but got %+v", pc.pod.ImRuntime)
+	}
+
+	pc.Remove(c)
+	pc.pod.State = RunStatePending
+	completeInitContainer(c, initName, 3, "connecting", "migration failed")
+	pc.Deploy(c)
+	if pc.pod.State != RunStateFail || !strings.Contains(pc.pod.LastError, "exited with code 3") ||
+		!strings.Contains(pc.pod.LastError, "connecting | migration failed") || pc.pod.Containers[0].Id != "" {
+		t.Fatalf("Pod should fail without the containers created, but got %+v", pc.pod)
+	}
+	lastError := pc.pod.LastError
+	pc.Refresh(c)
+	if pc.pod.State != RunStateFail || pc.pod.LastError != lastError {
+		t.Errorf("The pod failed in the init containers should not be missing, but got %+v", pc.pod.ImRuntime)
+	}
+
+	pc.pod.State = RunStatePending
+	pc.Deploy(c)
+	if pc.pod.State != RunStateFail || !strings.Contains(pc.pod.LastError, "did not complete in 1s") {
+		t.Errorf("Pod should fail when the init container timed out, but got %+v", pc.pod.ImRuntime)
+	}
+	if _, err := c.InspectContainer(initName); err == nil {
+		t.Errorf("The timed out init container should be removed")
+	}
+}
+
+// listCountingCluster counts the listing of all the containers in the cluster
+type listCountingCluster struct {
+	*fake.Cluster
+	lists int
+}
+
+func (c *listCountingCluster) ListContainers(showAll bool, showSize bool, filters ...string) ([]adoc.Container, error) {
+	c.lists += 1
+	return c.Cluster.ListContainers(showAll, showSize, filters...)
+}
+
+func TestPodPlacements(t *testing.T) {
+	c := &listCountingCluster{Cluster: fake.NewCluster()}
+	c.AddNode("node1", "192.168.77.21:2375", 8, 16*1024*1024*1024, nil)
+	c.AddNode("node2", "192.168.77.22:2375", 8, 16*1024*1024*1024, nil)
+	cstController = NewConstraintController()
+
+	pcs := make([]*podController, 3)
+	for i := range pcs {
+		pcs[i] = &podController{spec: createPodSpec("hello", "hello.proc.web.foo"), pod: Pod{InstanceNo: i + 1}}
+		pcs[i].spec.PrevState = NewPodPrevState(1)
+		pcs[i].Deploy(c)
+		if pcs[i].pod.State != RunStateSuccess {
+			t.Fatalf("Pod should be deployed, %s", pcs[i].pod.LastError)
+		}
+	}
+	if c.lists != 1 {
+		t.Errorf("Should list the containers of the cluster once for all the deploys, listed %d times", c.lists)
+	}
+	if pcs[0].pod.NodeName() == pcs[1].pod.NodeName() {
+		t.Errorf("Should spread the instances by the containers deployed just now, got %s", pcs[0].pod.NodeName())
+	}
+
+	pcs[0].Remove(c)
+	pods, _ := placements.list(c)
+	if len(pods) != 2 {
+		t.Errorf("Should remove the container from the placements, got %+v", pods)
+	}
+	saved := PlacementsRefreshInterval
+	PlacementsRefreshInterval = 0
+	defer func() { PlacementsRefreshInterval = saved }()
+	if pods, _ := placements.list(c); len(pods) != 2 || c.lists != 2 {
+		t.Errorf("Should list the containers again after the refresh interval, got %+v", pods)
+	}
+}
@@ -18,6 +18,12 @@ const (
 	OperationOver  = "over"
 )
 
+const (
+	pauseNone       int32 = iota
+	pausePaused           // paused by the request or the failure policy
+	pauseSuperseded       // still paused until the new operation accepted begins
+)
+
 type PodGroupWithSpec struct {
 	Spec      PodGroupSpec
 	PrevState []PodPrevState
@@ -40,11 +46,24 @@ type podGroupController struct {
 	podCtrls   []*podController
 	opsChan    chan pgOperation
 
+	greenCtrls     []*podController // the new pods of the blue-green deployment
+	retiredCtrls   []*podController // the old pods switched from, removed at retireAt
+	retiredVersion int
+	retireAt       time.Time
+
 	refreshable int32
 
-	lastPodSpecKey string
-	storedKey      string
-	storedKeyDir   string
+	operation    *Operation // the last tracked operation
+	upgradeError string     // why the last upgrade failed, kept as the last error of the group
+
+	paused int32         // pauseNone, pausePaused or pauseSuperseded, the loop stops before the next instance if paused
+	wakeCh chan struct{} // wakes up the operation loop when paused or resumed
+	heldOp pgOperation   // the instance operation dequeued while paused, run first when resumed
+	quit   chan struct{} // closed when the operation loop exits
+
+	storedKey     string
+	storedKeyDir  string
+	storedVersion uint64 // version of the stored key we read or wrote last time, 0 if not stored yet
 }
 
 func (pgCtrl *podGroupController) String() string {
@@ -111,7 +130,7 @@ func (pgCtrl *podGroupController) IsPending() bool {
 	return pgCtrl.group.State == RunStatePending
 }
 
-func (pgCtrl *podGroupController) Deploy() {
+func (pgCtrl *podGroupController) Deploy(operation *Operation) {
 	pgCtrl.flushAllOps()
 	pgCtrl.emitOperationEvent(OperationStart)
 	defer func() {
@@ -121,6 +140,7 @@ func (pgCtrl *podGroupController) Deploy() {
 	pgCtrl.RLock()
 	spec := pgCtrl.spec.Clone()
 	pgCtrl.RUnlock()
+	pgCtrl.beginOperation(operation, spec.NumInstances)
 
 	pgCtrl.group.LastError = ""
 	if ok := pgCtrl.checkPodPorts(); !ok {
@@ -129,6 +149,7 @@ func (pgCtrl *podGroupController) Deploy() {
 
 	pgCtrl.opsChan <- pgOperLogOperation{"Start to deploy"}
 	pgCtrl.opsChan <- pgOperSaveStore{true}
+	pgCtrl.opsChan <- pgOperSaveRevision{spec, "Deployed"}
 	pgCtrl.opsChan <- pgOperSnapshotEagleView{spec.Name}
 	for i := 0; i < spec.NumInstances; i += 1 {
 		pgCtrl.opsChan <- pgOperDeployInstance{i + 1, spec.Version}
@@ -139,7 +160,7 @@ func (pgCtrl *podGroupController) Deploy() {
 	pgCtrl.opsChan <- pgOperLogOperation{"deploy finished"}
 }
 
-func (pgCtrl *podGroupController) RescheduleInstance(numInstances int, restartPolicy ...RestartPolicy) {
+func (pgCtrl *podGroupController) RescheduleInstance(operation *Operation, numInstances int, restartPolicy ...RestartPolicy) {
 	pgCtrl.flushAllOps()
 	pgCtrl.emitOperationEvent(OperationStart)
 	defer func() {
@@ -151,6 +172,14 @@ func (pgCtrl *podGroupController) RescheduleInstance(numInstances int, restartPo
 
 	isDirty := false
 	curNumInstances := spec.NumInstances
+	total := 0
+	if numInstances >= 0 {
+		total = numInstances - curNumInstances
+		if total < 0 {
+			total *= -1
+		}
+	}
+	pgCtrl.beginOperation(operation, total)
 	if numInstances >= 0 && curNumInstances != numInstances {
 		spec.NumInstances = numInstances
 		isDirty = true
@@ -168,30 +197,37 @@ func (pgCtrl *podGroupController) RescheduleInstance(numInstances int, restartPo
 	pgCtrl.Unlock()
 	pgCtrl.opsChan <- pgOperLogOperation{fmt.Sprintf("Start to reschedule instance from %d to %d", curNumInstances, numInstances)}
 	pgCtrl.opsChan <- pgOperSaveStore{true}
-	delta := numInstances - curNumInstances
-	if delta != 0 {
-		pgCtrl.opsChan <- pgOperSnapshotEagleView{spec.Name}
-		if delta > 0 {
-			for i := 0; i < delta; i += 1 {
-				instanceNo := i + 1 + curNumInstances
-				pgCtrl.opsChan <- pgOperPushPodCtrl{spec.Pod}
-				pgCtrl.opsChan <- pgOperDeployInstance{instanceNo, spec.Version}
-			}
-		} else {
-			delta *= -1
-			for i := 0; i < delta; i += 1 {
-				pgCtrl.opsChan <- pgOperRemoveInstance{curNumInstances - i, spec.Pod}
-				pgCtrl.opsChan <- pgOperPopPodCtrl{}
-			}
+	pgCtrl.scaleInstances(spec, curNumInstances)
+	pgCtrl.opsChan <- pgOperLogOperation{"Reschedule instance number finished"}
+}
+
+// scaleInstances queues the deploy or the removal of the instances from curNumInstances to the number of the spec,
+// the instances are removed from the one with the largest instance number.
+func (pgCtrl *podGroupController) scaleInstances(spec PodGroupSpec, curNumInstances int) {
+	delta := spec.NumInstances - curNumInstances
+	if delta == 0 {
+		return
+	}
+	pgCtrl.opsChan <- pgOperSnapshotEagleView{spec.Name}
+	if delta > 0 {
+		for i := 0; i < delta; i += 1 {
+			instanceNo := i + 1 + curNumInstances
+			pgCtrl.opsChan <- pgOperPushPodCtrl{spec.Pod}
+			pgCtrl.opsChan <- pgOperDeployInstance{instanceNo, spec.Version}
+		}
+	} else {
+		delta *= -1
+		for i := 0; i < delta; i += 1 {
+			pgCtrl.opsChan <- pgOperRemoveInstance{curNumInstances - i, spec.Pod}
+			pgCtrl.opsChan <- pgOperPopPodCtrl{}
 		}
-		pgCtrl.opsChan <- pgOperSnapshotGroup{true}
-		pgCtrl.opsChan <- pgOperSnapshotPrevState{}
-		pgCtrl.opsChan <- pgOperSaveStore{true}
 	}
-	pgCtrl.opsChan <- pgOperLogOperation{"Reschedule instance number finished"}
+	pgCtrl.opsChan <- pgOperSnapshotGroup{true}
+	pgCtrl.opsChan <- pgOperSnapshotPrevState{}
+	pgCtrl.opsChan <- pgOperSaveStore{true}
 }
 
-func (pgCtrl *podGroupController) RescheduleSpec(podSpec PodSpec) {
+func (pgCtrl *podGroupController) RescheduleSpec(operation *Operation, podSpec PodSpec) {
 	pgCtrl.flushAllOps()
 	pgCtrl.emitOperationEvent(OperationStart)
 	defer func() {
@@ -200,18 +236,25 @@ func (pgCtrl *podGroupController) RescheduleSpec(podSpec PodSpec) {
 	pgCtrl.RLock()
 	spec := pgCtrl.spec.Clone()
 	pgCtrl.RUnlock()
+	pgCtrl.beginOperation(operation, spec.NumInstances)
 	pgCtrl.emptyError()
+	pgCtrl.rescheduleSpec(spec, podSpec)
+}
+
+// rescheduleSpec queues the upgrade of the instances of the spec to the pod spec, the instances are redeployed
+// in batches or updated in place, returns false if the ports of the pod spec cannot be updated.
+// For the mixed changes, the resources of all the instances are updated in place before they are redeployed.
+func (pgCtrl *podGroupController) rescheduleSpec(spec PodGroupSpec, podSpec PodSpec) bool {
 	if ok := pgCtrl.updatePodPorts(podSpec); !ok {
-		return
+		return false
 	}
 	oldPodSpec := spec.Pod.Clone()
 	spec.Pod = spec.Pod.Merge(podSpec)
 	spec.UpdatedAt = time.Now()
-	reDeploy := shouldReDeploy(oldPodSpec, podSpec)
+	reDeploy := shouldReDeploy(oldPodSpec, spec.Pod)
 	if reDeploy {
-		// store oldPodSpec for rollback(with ttl 10min)
-		pgCtrl.opsChan <- pgOperCacheLastSpec{spec: spec}
-		spec.Version += 1
+		spec.Version = spec.nextVersion()
+		spec.Pod.Version = spec.Version
 	} else {
 		spec.Pod.Version -= 1
 	}
@@ -220,30 +263,199 @@ func (pgCtrl *podGroupController) RescheduleSpec(podSpec PodSpec) {
 	pgCtrl.Unlock()
 	pgCtrl.opsChan <- pgOperLogOperation{"Start to reschedule spec"}
 	pgCtrl.opsChan <- pgOperSaveStore{true}
+	pgCtrl.opsChan <- pgOperSaveRevision{spec, specChangeSummary(oldPodSpec, spec.Pod)}
 	pgCtrl.opsChan <- pgOperSnapshotEagleView{spec.Name}
-	for i := 0; i < spec.NumInstances; i += 1 {
-		if reDeploy {
-			pgCtrl.opsChan <- pgOperUpgradeInstance{i + 1, spec.Version, oldPodSpec, spec.Pod}
-		} else {
+	if reDeploy {
+		if shouldResize(oldPodSpec, spec.Pod) {
+			for i := 0; i < spec.NumInstances; i += 1 {
+				pgCtrl.opsChan <- pgOperUpdateInsResources{i + 1, spec.Pod}
+			}
+		}
+		pgCtrl.upgradeInBatches(spec, 1, spec.NumInstances, spec.Version, oldPodSpec, spec.Pod)
+	} else {
+		for i := 0; i < spec.NumInstances; i += 1 {
 			pgCtrl.opsChan <- pgOperUpdateInsConfig{i + 1, spec.Version, oldPodSpec, spec.Pod}
+			pgCtrl.opsChan <- pgOperSnapshotGroup{true}
+			pgCtrl.opsChan <- pgOperSaveStore{true}
 		}
-		pgCtrl.opsChan <- pgOperSnapshotGroup{true}
-		pgCtrl.opsChan <- pgOperSaveStore{true}
 	}
 	pgCtrl.opsChan <- pgOperSnapshotGroup{true}
 	pgCtrl.opsChan <- pgOperSnapshotPrevState{}
 	pgCtrl.opsChan <- pgOperSaveStore{true}
 	pgCtrl.opsChan <- pgOperLogOperation{"Reschedule spec finished"}
+	return true
+}
+
+// RescheduleCanary upgrades only the first instances to the pod spec, the group keeps running the mixed
+// versions until the canary is promoted or aborted.
+func (pgCtrl *podGroupController) RescheduleCanary(operation *Operation, podSpec PodSpec, instances int) {
+	pgCtrl.flushAllOps()
+	pgCtrl.emitOperationEvent(OperationStart)
+	defer func() {
+		pgCtrl.opsChan <- pgOperOver{}
+	}()
+	pgCtrl.RLock()
+	spec := pgCtrl.spec.Clone()
+	pgCtrl.RUnlock()
+	pgCtrl.emptyError()
+	if instances > spec.NumInstances {
+		instances = spec.NumInstances
+	}
+	pgCtrl.beginOperation(operation, instances)
+	canary := CanarySpec{
+		Instances: instances,
+		Version:   spec.nextVersion(),
+		Pod:       spec.Pod.Merge(podSpec),
+	}
+	canary.Pod.Version = canary.Version
+	// the canary pods serve on the new stream ports next to the stable pods on the old ones
+	freshArr, _, _, ok := pgCtrl.diffPodPorts(canary.Pod)
+	if !ok || !pgCtrl.registerPodPorts(freshArr) {
+		return
+	}
+	spec.Canary = &canary
+	spec.UpdatedAt = time.Now()
+	pgCtrl.Lock()
+	pgCtrl.spec = spec
+	pgCtrl.Unlock()
+	pgCtrl.opsChan <- pgOperLogOperation{fmt.Sprintf("Start to reschedule canary on %d instances", instances)}
+	pgCtrl.opsChan <- pgOperSaveStore{true}
+	pgCtrl.opsChan <- pgOperSnapshotEagleView{spec.Name}
+	pgCtrl.upgradeInBatches(spec, 1, instances, canary.Version, spec.Pod, canary.Pod)
+	pgCtrl.opsChan <- pgOperSnapshotGroup{true}
+	pgCtrl.opsChan <- pgOperSnapshotPrevState{}
+	pgCtrl.opsChan <- pgOperSaveStore{true}
+	pgCtrl.opsChan <- pgOperLogOperation{"Reschedule canary finished"}
+}
+
+// PromoteCanary makes the canary pod spec the spec of the group and upgrades the rest instances to it,
+// the stream ports only used by the old pod spec are cancelled now.
+func (pgCtrl *podGroupController) PromoteCanary(operation *Operation) {
+	pgCtrl.flushAllOps()
+	pgCtrl.emitOperationEvent(OperationStart)
+	defer func() {
+		pgCtrl.opsChan <- pgOperOver{}
+	}()
+	pgCtrl.RLock()
+	spec := pgCtrl.spec.Clone()
+	pgCtrl.RUnlock()
+	if spec.Canary == nil {
+		pgCtrl.beginOperation(operation, 0)
+		return
+	}
+	pgCtrl.beginOperation(operation, spec.NumInstances-spec.Canary.Instances)
+	pgCtrl.emptyError()
+	canary := *spec.Canary
+	freshArr, updateArr, datedArr, ok := pgCtrl.diffPodPorts(canary.Pod)
+	if !ok {
+		return
+	}
+	// the fresh ports were registered when the canary started
+	UpdatePorts(append(freshArr, updateArr...)...)
+	CancelPorts(datedArr...)
+	oldPodSpec := spec.Pod
+	spec.Pod, spec.Version, spec.Canary = canary.Pod, canary.Version, nil
+	spec.UpdatedAt = time.Now()
+	pgCtrl.Lock()
+	pgCtrl.spec = spec
+	pgCtrl.Unlock()
+	pgCtrl.opsChan <- pgOperLogOperation{"Start to promote canary"}
+	pgCtrl.opsChan <- pgOperSaveStore{true}
+	pgCtrl.opsChan <- pgOperSaveRevision{spec, "Canary promoted, " + specChangeSummary(oldPodSpec, spec.Pod)}
+	pgCtrl.opsChan <- pgOperSnapshotEagleView{spec.Name}
+	pgCtrl.upgradeInBatches(spec, canary.Instances+1, spec.NumInstances, spec.Version, oldPodSpec, spec.Pod)
+	pgCtrl.opsChan <- pgOperSnapshotGroup{true}
+	pgCtrl.opsChan <- pgOperSnapshotPrevState{}
+	pgCtrl.opsChan <- pgOperSaveStore{true}
+	pgCtrl.opsChan <- pgOperLogOperation{"Promote canary finished"}
 }
 
-func (pgCtrl *podGroupController) RescheduleDrift(fromNode, toNode string, instanceNo int, force bool) {
+// AbortCanary upgrades the canary instances back to the pod spec of the group, and cancels the stream
+// ports only used by the canary.
+func (pgCtrl *podGroupController) AbortCanary(operation *Operation) {
 	pgCtrl.flushAllOps()
+	pgCtrl.emitOperationEvent(OperationStart)
 	defer func() {
 		pgCtrl.opsChan <- pgOperOver{}
 	}()
 	pgCtrl.RLock()
 	spec := pgCtrl.spec.Clone()
 	pgCtrl.RUnlock()
+	if spec.Canary == nil {
+		pgCtrl.beginOperation(operation, 0)
+		return
+	}
+	pgCtrl.beginOperation(operation, spec.Canary.Instances)
+	pgCtrl.emptyError()
+	canary := *spec.Canary
+	if freshArr, _, _, ok := pgCtrl.diffPodPorts(canary.Pod); ok {
+		CancelPorts(freshArr...)
+	}
+	// the version of the canary is burned, the containers left by it are never taken as the next version
+	spec.BurnedVersion = canary.Version
+	spec.Canary = nil
+	spec.UpdatedAt = time.Now()
+	pgCtrl.Lock()
+	pgCtrl.spec = spec
+	pgCtrl.Unlock()
+	pgCtrl.opsChan <- pgOperLogOperation{"Start to abort canary"}
+	pgCtrl.opsChan <- pgOperSaveStore{true}
+	pgCtrl.opsChan <- pgOperSnapshotEagleView{spec.Name}
+	pgCtrl.upgradeInBatches(spec, 1, canary.Instances, spec.Version, canary.Pod, spec.Pod)
+	pgCtrl.opsChan <- pgOperSnapshotGroup{true}
+	pgCtrl.opsChan <- pgOperSnapshotPrevState{}
+	pgCtrl.opsChan <- pgOperSaveStore{true}
+	pgCtrl.opsChan <- pgOperLogOperation{"Abort canary finished"}
+}
+
+// upgradeInBatches queues the upgrade of the instances from first to last in batches by the update strategy,
+// the upgraded instances are checked by the failure policy before the next batch and after the last one.
+func (pgCtrl *podGroupController) upgradeInBatches(spec PodGroupSpec, first, last int, version int, oldPodSpec, newPodSpec PodSpec) {
+	size, surge := spec.UpdateStrategy.Batch(!oldPodSpec.IsStateful() && !newPodSpec.IsStateful())
+	if spec.Daemon != nil {
+		// the daemons are updated node by node, the new pod never runs next to the old one
+		size, surge = spec.Daemon.GetMaxUnavailable(), 0
+	}
+	var lastBatch, upgraded []int
+	for i := first; i <= last; i += size {
+		batch := make([]int, 0, size)
+		for j := i; j < i+size && j <= last; j += 1 {
+			batch = append(batch, j)
+		}
+		if len(lastBatch) > 0 {
+			pgCtrl.opsChan <- pgOperCheckUpgrade{lastBatch, upgraded}
+		}
+		pgCtrl.opsChan <- pgOperUpgradeBatch{batch, surge, version, oldPodSpec, newPodSpec}
+		pgCtrl.opsChan <- pgOperSnapshotGroup{true}
+		pgCtrl.opsChan <- pgOperSaveStore{true}
+		lastBatch = batch
+		upgraded = append(upgraded[:len(upgraded):len(upgraded)], batch...)
+	}
+	if len(lastBatch) > 0 {
+		pgCtrl.opsChan <- pgOperCheckUpgrade{lastBatch, upgraded}
+	}
+}
+
+// InCanary tells if the pod group is running a canary
+func (pgCtrl *podGroupController) InCanary() bool {
+	pgCtrl.RLock()
+	defer pgCtrl.RUnlock()
+	return pgCtrl.spec.Canary != nil
+}
+
+func (pgCtrl *podGroupController) RescheduleDrift(operation *Operation, fromNode, toNode string, instanceNo int, force bool) {
+	pgCtrl.flushAllOps()
+	defer func() {
+		pgCtrl.opsChan <- pgOperOver{}
+	}()
+	pgCtrl.RLock()
+	spec := pgCtrl.spec.Clone()
+	pgCtrl.RUnlock()
+	if instanceNo == -1 {
+		pgCtrl.beginOperation(operation, spec.NumInstances)
+	} else {
+		pgCtrl.beginOperation(operation, 1)
+	}
 	if spec.NumInstances == 0 {
 		return
 	}
@@ -261,7 +473,7 @@ func (pgCtrl *podGroupController) RescheduleDrift(fromNode, toNode string, insta
 	pgCtrl.opsChan <- pgOperLogOperation{"Reschedule drift finished"}
 }
 
-func (pgCtrl *podGroupController) Remove() {
+func (pgCtrl *podGroupController) Remove(operation *Operation) {
 	pgCtrl.flushAllOps()
 	pgCtrl.emitOperationEvent(OperationStart)
 	defer func() {
@@ -269,10 +481,15 @@ func (pgCtrl *podGroupController) Remove() {
 	}()
 	pgCtrl.RLock()
 	spec := pgCtrl.spec.Clone()
+	retiredVersion := pgCtrl.retiredVersion
 	pgCtrl.RUnlock()
+	pgCtrl.beginOperation(operation, spec.NumInstances)
 	pgCtrl.cancelPodPorts()
 	pgCtrl.opsChan <- pgOperLogOperation{"Start to remove"}
 	pgCtrl.opsChan <- pgOperRemoveStore{}
+	pgCtrl.opsChan <- pgOperRemoveRevisions{}
+	pgCtrl.opsChan <- pgOperRemoveGreen{}
+	pgCtrl.opsChan <- pgOperRemoveRetired{retiredVersion}
 	for i := 0; i < spec.NumInstances; i += 1 {
 		pgCtrl.opsChan <- pgOperRemoveInstance{i + 1, spec.Pod}
 	}
@@ -281,7 +498,7 @@ func (pgCtrl *podGroupController) Remove() {
 	pgCtrl.opsChan <- pgOperPurge{}
 }
 
-func (pgCtrl *podGroupController) ChangeState(op string, instance int) {
+func (pgCtrl *podGroupController) ChangeState(operation *Operation, op string, instance int) {
 	pgCtrl.flushAllOps()
 	pgCtrl.emitOperationEvent(OperationStart)
 	defer func() {
@@ -290,12 +507,18 @@ func (pgCtrl *podGroupController) ChangeState(op string, instance int) {
 	pgCtrl.RLock()
 	spec := pgCtrl.spec.Clone()
 	pgCtrl.RUnlock()
+	instanceNos := make([]int, 0, spec.NumInstances)
 	if instance == 0 {
 		for i := 0; i < spec.NumInstances; i += 1 {
-			pgCtrl.opsChan <- pgOperChangeState{op, i + 1}
+			instanceNos = append(instanceNos, i+1)
 		}
 	} else if instance > 0 && instance <= spec.NumInstances {
-		pgCtrl.opsChan <- pgOperChangeState{op, instance}
+		instanceNos = append(instanceNos, instance)
+	}
+	pgCtrl.beginOperation(operation, len(instanceNos))
+	pgCtrl.opsChan <- pgOperLogOperation{fmt.Sprintf("Start to %s instances", op)}
+	for _, instanceNo := range instanceNos {
+		pgCtrl.opsChan <- pgOperChangeState{op, instanceNo}
 	}
 	pgCtrl.opsChan <- pgOperSnapshotGroup{true}
 	pgCtrl.opsChan <- pgOperSaveStore{true}
@@ -319,6 +542,10 @@ func (pgCtrl *podGroupController) Refresh(force bool) {
 		pgCtrl.opsChan <- pgOperRefreshInstance{i + 1, spec}
 	}
 	pgCtrl.opsChan <- pgOperVerifyInstanceCount{spec}
+	if spec.Job != nil {
+		pgCtrl.opsChan <- pgOperRefreshJob{}
+	}
+	pgCtrl.opsChan <- pgOperRefreshGreen{}
 	pgCtrl.opsChan <- pgOperSnapshotGroup{force}
 	pgCtrl.opsChan <- pgOperSnapshotPrevState{}
 	pgCtrl.opsChan <- pgOperSaveStore{false}
@@ -326,46 +553,209 @@ func (pgCtrl *podGroupController) Refresh(force bool) {
 }
 
 func (pgCtrl *podGroupController) Activate(c cluster.Cluster, store storage.Store, eagle *RuntimeEagleView, stop chan struct{}) {
+	if len(pgCtrl.retiredCtrls) > 0 {
+		// the retired pods loaded from the store are removed at the deadline as well
+		pgCtrl.removeRetiredAt(pgCtrl.retiredVersion, pgCtrl.retireAt)
+	}
 	go func() {
+		defer close(pgCtrl.quit)
 		for {
-			select {
-			case op := <-pgCtrl.opsChan:
-				toShutdown := op.Do(pgCtrl, c, store, eagle)
-				if toShutdown {
+			if pgCtrl.IsPaused() && pgCtrl.hasHeldOp() {
+				select {
+				case <-pgCtrl.wakeCh:
+				case <-stop:
 					return
 				}
-			case <-stop:
-				if len(pgCtrl.opsChan) == 0 {
-					return
+				continue
+			}
+			op := pgCtrl.takeHeldOp()
+			if op == nil {
+				select {
+				case op = <-pgCtrl.opsChan:
+				case <-pgCtrl.wakeCh:
+					continue
+				case <-stop:
+					if len(pgCtrl.opsChan) == 0 {
+						return
+					}
+					continue
+				}
+				if _, ok := op.(instanceOperation); ok && pgCtrl.IsPaused() {
+					// the bookkeeping of the current instance is done, the next instance waits for the resume
+					pgCtrl.holdOp(op)
+					continue
 				}
 			}
+			toShutdown := op.Do(pgCtrl, c, store, eagle)
+			pgCtrl.trackOperation(op)
+			if toShutdown {
+				return
+			}
 		}
 	}()
 }
 
-func (pgCtrl *podGroupController) LastSpec() *PodGroupSpec {
-	var lastSpec PodGroupSpec
-	if err := pgCtrl.engine.store.Get(pgCtrl.lastPodSpecKey, &lastSpec); err != nil {
-		log.Infof("Fetch LastPodSpec with err:%v", err)
-		return nil
+func (pgCtrl *podGroupController) holdOp(op pgOperation) {
+	pgCtrl.Lock()
+	defer pgCtrl.Unlock()
+	pgCtrl.heldOp = op
+}
+
+func (pgCtrl *podGroupController) hasHeldOp() bool {
+	pgCtrl.RLock()
+	defer pgCtrl.RUnlock()
+	return pgCtrl.heldOp != nil
+}
+
+// takeHeldOp returns the held operation and clears it, nil if none
+func (pgCtrl *podGroupController) takeHeldOp() pgOperation {
+	pgCtrl.Lock()
+	defer pgCtrl.Unlock()
+	op := pgCtrl.heldOp
+	pgCtrl.heldOp = nil
+	return op
+}
+
+// Pause stops the operation loop after the current instance, the operations on the current instance such as
+// the snapshot and the saving are still done.
+func (pgCtrl *podGroupController) Pause() {
+	if atomic.CompareAndSwapInt32(&pgCtrl.paused, pauseNone, pausePaused) {
+		pgCtrl.pauseOperation(true)
+		pgCtrl.wakeUp()
+	} else {
+		// paused again before the superseding operation begins
+		atomic.CompareAndSwapInt32(&pgCtrl.paused, pauseSuperseded, pausePaused)
+	}
+}
+
+// Resume lets the paused operation loop go on with the rest operations
+func (pgCtrl *podGroupController) Resume() {
+	if atomic.CompareAndSwapInt32(&pgCtrl.paused, pausePaused, pauseNone) ||
+		atomic.CompareAndSwapInt32(&pgCtrl.paused, pauseSuperseded, pauseNone) {
+		pgCtrl.pauseOperation(false)
+		pgCtrl.wakeUp()
+	}
+}
+
+// supersedePause marks the pause to be lifted when the new operation accepted begins, the pause made after
+// the acceptance is kept for the new operation.
+func (pgCtrl *podGroupController) supersedePause() {
+	atomic.CompareAndSwapInt32(&pgCtrl.paused, pausePaused, pauseSuperseded)
+}
+
+func (pgCtrl *podGroupController) IsPaused() bool {
+	return atomic.LoadInt32(&pgCtrl.paused) != pauseNone
+}
+
+// IsOperating tells if the pod group has operation in progress, drifting is operated without the op state
+func (pgCtrl *podGroupController) IsOperating() bool {
+	if atomic.LoadInt32((*int32)(&pgCtrl.opState)) != PGOpStateIdle || len(pgCtrl.opsChan) > 0 {
+		return true
+	}
+	return pgCtrl.hasHeldOp()
+}
+
+// Cancel drops the operations not started yet, the pod group is snapshotted and saved as it is,
+// with the cancellation in the LastError.
+func (pgCtrl *podGroupController) Cancel() {
+	dropped := pgCtrl.flushOps(OperationCancelled)
+	pgCtrl.opsChan <- pgOperLogOperation{fmt.Sprintf("Operation cancelled, %d operations dropped", dropped)}
+	pgCtrl.opsChan <- pgOperCancelled{dropped}
+	pgCtrl.opsChan <- pgOperSnapshotPrevState{}
+	pgCtrl.opsChan <- pgOperSaveStore{true}
+	pgCtrl.opsChan <- pgOperOver{}
+	pgCtrl.Resume()
+}
+
+// keepUpgradedAsCanary turns the spec upgrade stopped half way into a canary of the upgraded instances, so
+// the refreshing will not go on upgrading the rest, returns the number of the canary instances.
+// The stable pod spec is found in the revisions, should be called with the lock held.
+func (pgCtrl *podGroupController) keepUpgradedAsCanary(store storage.Store) int {
+	spec := pgCtrl.spec
+	if spec.Canary != nil {
+		// the canary itself is cancelled, only the instances already upgraded are kept in it
+		upgraded := 0
+		for upgraded < spec.Canary.Instances && upgraded < len(pgCtrl.podCtrls) &&
+			pgCtrl.podCtrls[upgraded].spec.Version == spec.Canary.Pod.Version {
+			upgraded += 1
+		}
+		if upgraded == 0 {
+			pgCtrl.spec.Canary = nil
+		} else {
+			canary := spec.Canary.Clone()
+			canary.Instances = upgraded
+			pgCtrl.spec.Canary = &canary
+		}
+		return upgraded
+	}
+	upgraded := 0
+	for upgraded < len(pgCtrl.podCtrls) && pgCtrl.podCtrls[upgraded].spec.Version == spec.Pod.Version {
+		upgraded += 1
+	}
+	if upgraded == 0 || upgraded == len(pgCtrl.podCtrls) {
+		return 0
+	}
+	stableVersion := pgCtrl.podCtrls[upgraded].spec.Version
+	for _, podCtrl := range pgCtrl.podCtrls[upgraded:] {
+		if podCtrl.spec.Version != stableVersion {
+			return 0
+		}
+	}
+	revisions, err := revisionNumbers(store, spec.Namespace, spec.Name)
+	if err != nil {
+		return 0
+	}
+	for i := len(revisions) - 1; i >= 0; i -= 1 {
+		var rev SpecRevision
+		if err := store.Get(revisionKey(spec.Namespace, spec.Name, revisions[i]), &rev); err != nil ||
+			rev.Spec.Pod.Version != stableVersion {
+			continue
+		}
+		pgCtrl.spec.Canary = &CanarySpec{
+			Instances: upgraded,
+			Version:   spec.Version,
+			Pod:       spec.Pod,
+		}
+		pgCtrl.spec.Pod = rev.Spec.Pod
+		pgCtrl.spec.Version = rev.Spec.Version
+		return upgraded
+	}
+	return 0
+}
+
+func (pgCtrl *podGroupController) wakeUp() {
+	select {
+	case pgCtrl.wakeCh <- struct{}{}:
+	default:
 	}
-	log.Infof("Fetch LastPodSpec :%v", lastSpec)
-	return &lastSpec
 }
 
 /*
- * clean all ops in chan synchronously
- *
+ * clean all ops in chan synchronously, returns the number of ops cleaned
+ * the operations flushed before they began are superseded by the new one
  */
-func (pgCtrl *podGroupController) flushAllOps() {
+func (pgCtrl *podGroupController) flushAllOps() int {
+	return pgCtrl.flushOps(OperationSuperseded)
+}
+
+// flushOps cleans all the ops in chan, the operations flushed before they began are ended with the status
+func (pgCtrl *podGroupController) flushOps(status string) int {
+	flushed := 0
+	if op := pgCtrl.takeHeldOp(); op != nil {
+		flushed += 1
+	}
 	for {
 		if len(pgCtrl.opsChan) == 0 {
-			return
+			return flushed
 		}
 		select {
-		case <-pgCtrl.opsChan:
+		case op := <-pgCtrl.opsChan:
+			if begin, ok := op.(pgOperBegin); ok {
+				pgCtrl.engine.operations.end(begin.operation, status, "")
+			}
+			flushed += 1
 		default:
-			return
+			return flushed
 		}
 	}
 }
@@ -420,6 +810,14 @@ func (pgCtrl *podGroupController) cleanCorruptedContainers() {
 	}
 }
 
+// forgetContainers takes the removed containers away from the eagle view snapshot, so the refreshing
+// triggered by their die events will not find the old version still running.
+func (pgCtrl *podGroupController) forgetContainers(ids []string) {
+	for _, id := range ids {
+		delete(pgCtrl.evSnapshot, id)
+	}
+}
+
 func removeContainers(c cluster.Cluster, ids []string) {
 	for _, cId := range ids {
 		log.Warnf("find some corrupted container alive, try to remove it")
@@ -505,81 +903,97 @@ func (pgCtrl *podGroupController) checkPodPorts() bool {
 }
 
 func (pgCtrl *podGroupController) updatePodPorts(podSpec PodSpec) bool {
+	freshArr, updateArr, datedArr, ok := pgCtrl.diffPodPorts(podSpec)
+	if !ok {
+		return false
+	}
+	if ok := pgCtrl.registerPodPorts(freshArr); !ok {
+		return false
+	}
+	UpdatePorts(updateArr...)
+	CancelPorts(datedArr...)
+	return true
+}
+
+// diffPodPorts compares the stream ports of the pod spec with the ones of the group, returns the ports to
+// register, the ports changed and the ports no longer used.
+func (pgCtrl *podGroupController) diffPodPorts(podSpec PodSpec) (freshArr, updateArr, datedArr []*StreamProc, ok bool) {
 	spec := pgCtrl.spec
 	var oldsps, sps StreamPorts
 	if err := json.Unmarshal([]byte(spec.Pod.Annotation), &oldsps); err != nil {
 		log.Errorf("annotation unmarshal error:%v\n", err)
-		return false
+		return nil, nil, nil, false
 	}
 	if err := json.Unmarshal([]byte(podSpec.Annotation), &sps); err != nil {
 		log.Errorf("annotation unmarshal error:%v\n", err)
-		return false
+		return nil, nil, nil, false
 	}
-	if !oldsps.Equals(sps) {
-		//register fresh ports && cancel dated ports
-		freshArr := make([]*StreamProc, 0)
-		datedArr := make([]*StreamProc, 0)
-		updateArr := make([]*StreamProc, 0)
-		var exists bool
-		for _, fresh := range sps.Ports {
-			exists = false
-			for _, dated := range oldsps.Ports {
-				if dated.Equals(fresh) {
-					exists = true
-					break
-				} else if dated.SrcPort == fresh.SrcPort {
-					exists = true
-					updateArr = append(freshArr, &StreamProc{
-						StreamPort: fresh,
-						NameSpace:  pgCtrl.spec.Namespace,
-						ProcName:   pgCtrl.spec.Name,
-					})
-					break
-				}
-			}
-			if !exists {
-				freshArr = append(freshArr, &StreamProc{
+	if oldsps.Equals(sps) {
+		return nil, nil, nil, true
+	}
+	var exists bool
+	for _, fresh := range sps.Ports {
+		exists = false
+		for _, dated := range oldsps.Ports {
+			if dated.Equals(fresh) {
+				exists = true
+				break
+			} else if dated.SrcPort == fresh.SrcPort {
+				exists = true
+				updateArr = append(updateArr, &StreamProc{
 					StreamPort: fresh,
-					NameSpace:  pgCtrl.spec.Namespace,
-					ProcName:   pgCtrl.spec.Name,
+					NameSpace:  spec.Namespace,
+					ProcName:   spec.Name,
 				})
+				break
 			}
 		}
+		if !exists {
+			freshArr = append(freshArr, &StreamProc{
+				StreamPort: fresh,
+				NameSpace:  spec.Namespace,
+				ProcName:   spec.Name,
+			})
+		}
+	}
 
-		for _, dated := range oldsps.Ports {
-			exists = false
-			for _, fresh := range sps.Ports {
-				if dated.SrcPort == fresh.SrcPort {
-					exists = true
-					break
-				}
-			}
-			if !exists {
-				datedArr = append(datedArr, &StreamProc{
-					StreamPort: dated,
-					NameSpace:  pgCtrl.spec.Namespace,
-					ProcName:   pgCtrl.spec.Name,
-				})
+	for _, dated := range oldsps.Ports {
+		exists = false
+		for _, fresh := range sps.Ports {
+			if dated.SrcPort == fresh.SrcPort {
+				exists = true
+				break
 			}
 		}
-
-		succ, existsPorts := RegisterPorts(freshArr...)
-		if succ {
-			UpdatePorts(updateArr...)
-			CancelPorts(datedArr...)
-			return true
-		} else {
-			pgCtrl.group.State = RunStateFail
-			pgCtrl.group.LastError = fmt.Sprintf("Cannot start podgroup %v, some ports like %v were alerady in used!", pgCtrl.spec.Name, existsPorts)
-			return false
+		if !exists {
+			datedArr = append(datedArr, &StreamProc{
+				StreamPort: dated,
+				NameSpace:  spec.Namespace,
+				ProcName:   spec.Name,
+			})
 		}
 	}
+	return freshArr, updateArr, datedArr, true
+}
+
+// registerPodPorts registers the fresh ports, the pod group fails if any of them is already used
+func (pgCtrl *podGroupController) registerPodPorts(freshArr []*StreamProc) bool {
+	if len(freshArr) == 0 {
+		return true
+	}
+	if succ, existsPorts := RegisterPorts(freshArr...); !succ {
+		pgCtrl.group.State = RunStateFail
+		pgCtrl.group.LastError = fmt.Sprintf("Cannot start podgroup %v, some ports like %v were alerady in used!", pgCtrl.spec.Name, existsPorts)
+		return false
+	}
 	return true
 }
 
-func (pgCtrl *podGroupController) rollBack() bool {
+// rollBack upgrades all the upgraded instances back to the last spec if the upgrade failed,
+// the owner is notified once with the reason.
+func (pgCtrl *podGroupController) rollBack(reason string, notifyInstance int, instanceNos ...int) bool {
 	log.Infof("upgrade Failed!")
-	lastSpec := pgCtrl.LastSpec()
+	lastSpec := pgCtrl.lastRevisionSpec(pgCtrl.engine.store)
 	if lastSpec != nil {
 		// 1. disable refresh(so no others can produce operation) and flush ops chan
 		log.Infof("Start Rollback!")
@@ -590,73 +1004,108 @@ func (pgCtrl *podGroupController) rollBack() bool {
 		spec := pgCtrl.spec.Clone()
 		pgCtrl.spec = *lastSpec
 		pgCtrl.Unlock()
-		// 3. rollback instance 1
-		pgCtrl.opsChan <- pgOperUpgradeInstance{1, spec.Version, spec.Pod, lastSpec.Pod}
+		// 3. rollback the upgraded instances
+		pgCtrl.opsChan <- pgOperLogOperation{fmt.Sprintf("Start to roll back the %d upgraded instances", len(instanceNos))}
+		for _, instanceNo := range instanceNos {
+			version, podSpec := spec.InstanceSpec(instanceNo)
+			pgCtrl.opsChan <- pgOperUpgradeInstance{instanceNo, version, podSpec, lastSpec.Pod}
+		}
 		// 4. return error
-		pgCtrl.Lock()
-		pgCtrl.group.LastError = fmt.Sprintf("Your Last upgrade is terrrible, so we won't upgrade it, please check your code carefully!!")
-		pgCtrl.Unlock()
+		pgCtrl.failUpgrade(fmt.Sprintf("%s, rolled back to version %d", reason, lastSpec.Version))
 		pgCtrl.opsChan <- pgOperSnapshotGroup{true}
 		pgCtrl.opsChan <- pgOperSaveStore{true}
+		pgCtrl.opsChan <- pgOperSaveRevision{*lastSpec, "Rolled back the unhealthy upgrade"}
 		// 5. enable refresh
 		pgCtrl.EnableRefresh()
 		// 6. op over
 		pgCtrl.opsChan <- pgOperOver{}
 		// 7. notify
-		ntfController.Send(NewNotifySpec(pgCtrl.spec.Namespace, pgCtrl.spec.Name,
-			1, time.Now(), fmt.Sprintf(NotifyUpgradeFailedTmplt, spec.Version)))
+		pgCtrl.notifyUpgradeFailed(notifyInstance, fmt.Sprintf(NotifyUpgradeRolledBackTmplt, spec.Version, reason, lastSpec.Version))
 		log.Infof("Rollback Over!")
 		return true
 	} else {
-		log.Warn("No last spec info found, do nothing and upgrade anyway!")
+		log.Warn("No last revision found, do nothing and upgrade anyway!")
 	}
 	return false
 }
 
 // Called when upgrade/restart podgroup
 func (pgCtrl *podGroupController) waitLastPodHealth(instanceNo int) bool {
+	var lastBatch []int
+	if instanceNo > 1 {
+		lastBatch = []int{instanceNo - 1}
+	}
+	return pgCtrl.waitBatchHealth(lastBatch, []int{instanceNo})
+}
+
+// resetHealth resets the health state of the instances to starting before they are operated
+func (pgCtrl *podGroupController) resetHealth(instanceNos []int) {
+	for _, instanceNo := range instanceNos {
+		if pgCtrl.podCtrls[instanceNo-1].pod.Healthst != HealthStateNone {
+			pgCtrl.podCtrls[instanceNo-1].pod.Healthst = HealthStateStarting
+		}
+	}
+}
+
+// waitBatchHealth waits for all the instances of the last batch to be healthy before the batch is operated,
+// returns false if any of them is still not healthy after the retries.
+func (pgCtrl *podGroupController) waitBatchHealth(lastBatch, batch []int) bool {
+	healthy := true
+	for _, instanceNo := range lastBatch {
+		if !pgCtrl.waitPodHealth(instanceNo, 0) {
+			healthy = false
+		}
+	}
+	pgCtrl.resetHealth(batch)
+	return healthy
+}
+
+// waitPodHealth waits for the instance to be healthy, gives up after 5 times of the setup time,
+// or after the deadline seconds if it is not 0.
+func (pgCtrl *podGroupController) waitPodHealth(instanceNo int, deadline int) bool {
 	maxRetries := 5
 	retryTimes := 0
-	if instanceNo > 1 {
-		sleepTime := DefaultSetUpTime
-		podSpec := pgCtrl.spec.Pod
-		if podSpec.GetSetupTime() > DefaultSetUpTime {
-			sleepTime = podSpec.GetSetupTime()
-		}
-		lastPodCtrl := pgCtrl.podCtrls[instanceNo-2]
-		// wait some seconds for new instance's initialization completed, before we update next one
-		if lastPodCtrl.pod.Healthst == HealthStateNone {
-			time.Sleep(time.Second * time.Duration(podSpec.GetSetupTime()))
-		} else {
-			tick := time.Tick(time.Duration(sleepTime) * time.Second)
-		Loop:
-			for {
-				select {
-				case <-tick:
-					retryTimes++
-					// wait until to healthy state
-					lastPodCtrl.Refresh(pgCtrl.engine.cluster)
-					log.Infof("emit with loop :%v", lastPodCtrl.pod.Healthst)
-					if lastPodCtrl.pod.Healthst == HealthStateHealthy {
-						break Loop
-					}
-				case <-lastPodCtrl.event:
-					log.Infof("emit with event:%v", lastPodCtrl.pod.Healthst)
-					if lastPodCtrl.pod.Healthst == HealthStateHealthy {
-						break Loop
-					}
+	sleepTime := DefaultSetUpTime
+	podSpec := pgCtrl.spec.Pod
+	if podSpec.GetSetupTime() > DefaultSetUpTime {
+		sleepTime = podSpec.GetSetupTime()
+	}
+	podCtrl := pgCtrl.podCtrls[instanceNo-1]
+	// wait some seconds for new instance's initialization completed, before we update next one
+	if podCtrl.pod.Healthst == HealthStateNone {
+		time.Sleep(time.Second * time.Duration(podSpec.GetSetupTime()))
+	} else {
+		tick := time.Tick(time.Duration(sleepTime) * time.Second)
+		var timeout <-chan time.Time
+		if deadline > 0 {
+			timeout = time.After(time.Duration(deadline) * time.Second)
+		}
+	Loop:
+		for {
+			select {
+			case <-timeout:
+				podCtrl.Refresh(pgCtrl.engine.cluster)
+				return podCtrl.pod.Healthst == HealthStateHealthy
+			case <-tick:
+				retryTimes++
+				// wait until to healthy state
+				podCtrl.Refresh(pgCtrl.engine.cluster)
+				log.Infof("emit with loop :%v", podCtrl.pod.Healthst)
+				if podCtrl.pod.Healthst == HealthStateHealthy {
+					break Loop
 				}
-				if retryTimes >= maxRetries {
-					break
+			case <-podCtrl.event:
+				log.Infof("emit with event:%v", podCtrl.pod.Healthst)
+				if podCtrl.pod.Healthst == HealthStateHealthy {
+					break Loop
 				}
 			}
+			if retryTimes >= maxRetries {
+				break
+			}
 		}
 	}
-	// reset health state to starting
-	if pgCtrl.podCtrls[instanceNo-1].pod.Healthst != HealthStateNone {
-		pgCtrl.podCtrls[instanceNo-1].pod.Healthst = HealthStateStarting
-	}
-	if retryTimes >= maxRetries && pgCtrl.podCtrls[instanceNo-2].pod.Healthst != HealthStateHealthy {
+	if retryTimes >= maxRetries && podCtrl.pod.Healthst != HealthStateHealthy {
 		return false
 	}
 	return true
@@ -674,11 +1123,13 @@ func newPodGroupController(spec PodGroupSpec, states []PodPrevState, pg PodGroup
 		var pod Pod
 		pod.InstanceNo = i + 1
 		pod.State = RunStatePending
-		podSpec := spec.Pod.Clone()
+		_, instanceSpec := spec.InstanceSpec(i + 1)
+		podSpec := instanceSpec.Clone()
 		if states != nil && i < len(states) {
 			podSpec.PrevState = states[i].Clone() // set the pod's prev state
 		} else {
-			podSpec.PrevState = NewPodPrevState(1) // set empty prev state
+			// the record saved before the prev states of the instances scaled out
+			podSpec.PrevState = NewPodPrevState(len(spec.Pod.Containers))
 		}
 		podCtrls[i] = &podController{
 			spec:  podSpec,
@@ -694,6 +1145,27 @@ func newPodGroupController(spec PodGroupSpec, states []PodPrevState, pg PodGroup
 		}
 		podCtrls[pod.InstanceNo-1].pod = pod
 	}
+	var retiredCtrls []*podController
+	for _, pod := range pg.RetiredPods {
+		// the old pod spec is gone, only the kill timeout of the current one is used on removal
+		retiredCtrls = append(retiredCtrls, &podController{
+			spec:  spec.Pod.Clone(),
+			pod:   pod,
+			event: make(chan interface{}),
+		})
+	}
+	var greenCtrls []*podController
+	if spec.BlueGreen != nil {
+		for _, pod := range pg.GreenPods {
+			podSpec := spec.BlueGreen.Pod.Clone()
+			podSpec.PrevState = NewPodPrevState(len(podSpec.Containers))
+			greenCtrls = append(greenCtrls, &podController{
+				spec:  podSpec,
+				pod:   pod,
+				event: make(chan interface{}),
+			})
+		}
+	}
 
 	pgCtrl := &podGroupController{
 		engine:   engine,
@@ -703,26 +1175,48 @@ func newPodGroupController(spec PodGroupSpec, states []PodPrevState, pg PodGroup
 		podCtrls: podCtrls,
 		opsChan:  make(chan pgOperation, 500),
 
+		greenCtrls:     greenCtrls,
+		retiredCtrls:   retiredCtrls,
+		retiredVersion: pg.RetiredVersion,
+		retireAt:       pg.RetireAt,
+
 		refreshable: 1,
+		wakeCh:      make(chan struct{}, 1),
+		quit:        make(chan struct{}),
 
-		lastPodSpecKey: strings.Join([]string{kLainDeploydRootKey, kLainLastPodSpecKey, spec.Namespace, spec.Name}, "/"),
-		storedKey:      strings.Join([]string{kLainDeploydRootKey, kLainPodGroupKey, spec.Namespace, spec.Name}, "/"),
-		storedKeyDir:   strings.Join([]string{kLainDeploydRootKey, kLainPodGroupKey, spec.Namespace}, "/"),
+		storedKey:    strings.Join([]string{kLainDeploydRootKey, kLainPodGroupKey, spec.Namespace, spec.Name}, "/"),
+		storedKeyDir: strings.Join([]string{kLainDeploydRootKey, kLainPodGroupKey, spec.Namespace}, "/"),
 	}
 	pgCtrl.Publisher = NewPublisher(true)
 	return pgCtrl
 }
 
-// Assume reschedule spec operation change MemoryLimit or CpuLimit will not change other pod spec
+// shouldReDeploy tells if the containers should be recreated for the new pod spec merged from the old one,
+// only the changes of the resources are updated in place, they are redeployed as well with any other change.
+// The containers are compared on everything but the resources as well, so no change is lost by the in-place update.
 func shouldReDeploy(oldSpec, newSpec PodSpec) bool {
-	if len(oldSpec.Containers) != len(newSpec.Containers) {
+	if changesKind(DiffPodSpec(oldSpec, newSpec)) != SpecChangeInPlace {
 		return true
 	}
-	for i, _ := range newSpec.Containers {
-		if oldSpec.Containers[i].MemoryLimit != newSpec.Containers[i].MemoryLimit ||
-			oldSpec.Containers[i].CpuLimit != newSpec.Containers[i].CpuLimit {
-			return false
+	for i, o := range oldSpec.Containers {
+		n := newSpec.Containers[i]
+		n.CpuLimit, n.MemoryLimit = o.CpuLimit, o.MemoryLimit
+		if !o.Equals(n) || !equalCloudVolumes(o.CloudVolumes, n.CloudVolumes) {
+			return true
 		}
 	}
-	return true
+	return false
+}
+
+// shouldResize tells if the resources of the running containers can be updated before they are redeployed
+func shouldResize(oldSpec, newSpec PodSpec) bool {
+	if len(oldSpec.Containers) != len(newSpec.Containers) {
+		return false
+	}
+	for _, c := range DiffPodSpec(oldSpec, newSpec) {
+		if c.Kind == SpecChangeInPlace {
+			return true
+		}
+	}
+	return false
 }
@@ -2,6 +2,7 @@ package engine
 
 import (
 	"fmt"
+	"sync/atomic"
 	"time"
 
 	"github.com/laincloud/deployd/cluster"
@@ -11,6 +12,10 @@ import (
 	"github.com/mijia/sweb/log"
 )
 
+// UpgradeRedeployDelay is how long the upgrade waits after the instances are removed before they are deployed again,
+// for every instance upgraded one by one and for every batch of the UpdateStrategy
+var UpgradeRedeployDelay = 10 * time.Second
+
 type pgOperation interface {
 	Do(pgCtrl *podGroupController, c cluster.Cluster, store storage.Store, ev *RuntimeEagleView) bool
 }
@@ -19,25 +24,6 @@ type pgOperSaveStore struct {
 	force bool
 }
 
-type pgOperCacheLastSpec struct {
-	spec PodGroupSpec
-}
-
-func (op pgOperCacheLastSpec) Do(pgCtrl *podGroupController, c cluster.Cluster, store storage.Store, ev *RuntimeEagleView) bool {
-	var _err error
-	start := time.Now()
-	defer func() {
-		pgCtrl.RLock()
-		log.Infof("%s save last pod spec info, op=%+v, err=%v, duration=%s", pgCtrl, op, _err, time.Now().Sub(start))
-		pgCtrl.RUnlock()
-	}()
-	if err := store.SetWithTTL(pgCtrl.lastPodSpecKey, op.spec, DefaultLastSpecCacheTTL, true); err != nil {
-		log.Warnf("[Store] Failed to save last pod spec %s, %s", pgCtrl.lastPodSpecKey, err)
-		_err = err
-	}
-	return false
-}
-
 func (op pgOperSaveStore) Do(pgCtrl *podGroupController, c cluster.Cluster, store storage.Store, ev *RuntimeEagleView) bool {
 	var _err error
 	start := time.Now()
@@ -48,9 +34,16 @@ func (op pgOperSaveStore) Do(pgCtrl *podGroupController, c cluster.Cluster, stor
 	}()
 	pg := pgCtrl.Inspect()
 	if pgCtrl.IsHealthy() {
-		if err := store.Set(pgCtrl.storedKey, pg, op.force); err != nil {
-			log.Warnf("[Store] Failed to save pod group %s, %s", pgCtrl.storedKey, err)
+		version, err := store.SetIfVersion(pgCtrl.storedKey, newStoredPodGroup(pg), pgCtrl.storedVersion, op.force)
+		if err != nil {
+			if err == storage.KVersionError {
+				pgCtrl.stopOnStoreConflict("overwrite")
+			} else {
+				log.Warnf("[Store] Failed to save pod group %s, %s", pgCtrl.storedKey, err)
+			}
 			_err = err
+		} else {
+			pgCtrl.storedVersion = version
 		}
 	} else {
 		log.Warnf("Some pods lost IP, will not save pod group %s", pgCtrl.storedKey)
@@ -69,14 +62,36 @@ func (op pgOperRemoveStore) Do(pgCtrl *podGroupController, c cluster.Cluster, st
 		log.Infof("%s remove, op=%+v, err=%v, duration=%s", pgCtrl, op, _err, time.Now().Sub(start))
 		pgCtrl.RUnlock()
 	}()
-	if err := store.Remove(pgCtrl.storedKey); err != nil {
+	txn := storage.NewTxn().IfVersion(pgCtrl.storedKey, pgCtrl.storedVersion).Remove(pgCtrl.storedKey)
+	if err := store.Commit(txn); err != nil {
+		if err == storage.KTxnFailedError {
+			pgCtrl.stopOnStoreConflict("remove")
+		} else {
+			log.Warnf("[Store] Failed to remove pod group %s, %s", pgCtrl.storedKey, err)
+		}
 		_err = err
 	} else {
+		pgCtrl.storedVersion = 0
 		store.TryRemoveDir(pgCtrl.storedKeyDir)
 	}
 	return false
 }
 
+// stopOnStoreConflict stops the operation when the stored pod group was changed by others, e.g. another deployd
+// during a leadership flap, the record is left as it is. The controller is the only writer of the record in the
+// process and keeps the version of its last write, so the conflict is never caused by itself.
+// The conflict is kept as the last error of the group until the next operation begins.
+func (pgCtrl *podGroupController) stopOnStoreConflict(action string) {
+	lastError := fmt.Sprintf("Pod group %s was changed by others in the store, refused to %s it", pgCtrl.storedKey, action)
+	log.Warnf("[Store] %s", lastError)
+	pgCtrl.failUpgrade(lastError)
+	pgCtrl.flushOps(OperationFailed)
+	pgCtrl.engine.operations.end(pgCtrl.currentOperation(), OperationFailed, lastError)
+	if atomic.LoadInt32((*int32)(&pgCtrl.opState)) != PGOpStateIdle {
+		pgCtrl.OperateOver()
+	}
+}
+
 type pgOperSnapshotEagleView struct {
 	pgName string
 }
@@ -93,9 +108,14 @@ func (op pgOperSnapshotEagleView) Do(pgCtrl *podGroupController, c cluster.Clust
 		_err = err
 	} else {
 		snapshot := make(map[string]RuntimeEaglePod)
+		pgCtrl.RLock()
 		for _, p := range pods {
-			snapshot[p.Container.Id] = p
+			// the pods running alongside the group are not taken as its instances
+			if !pgCtrl.isSideContainer(p) {
+				snapshot[p.Container.Id] = p
+			}
 		}
+		pgCtrl.RUnlock()
 		pgCtrl.evSnapshot = snapshot
 		pgCtrl.cleanCorruptedContainers()
 	}
@@ -117,30 +137,130 @@ func (op pgOperUpgradeInstance) Do(pgCtrl *podGroupController, c cluster.Cluster
 		pgCtrl.RUnlock()
 	}()
 
-	podCtrl := pgCtrl.podCtrls[op.instanceNo-1]
-	newPodSpec := op.newPodSpec.Clone()
-	newPodSpec.PrevState = podCtrl.spec.PrevState.Clone() // upgrade action, state should not changed
-	prevNodeName := newPodSpec.PrevState.NodeName
+	pgCtrl.waitLastPodHealth(op.instanceNo)
+	log.Infof("upgrade instance : %d !", op.instanceNo)
+	lowOp := pgOperRemoveInstance{op.instanceNo, op.oldPodSpec}
+	lowOp.Do(pgCtrl, c, store, ev)
+	time.Sleep(UpgradeRedeployDelay)
+	deployUpgradedInstance(pgCtrl, c, store, ev, op.instanceNo, op.version, op.oldPodSpec, op.newPodSpec)
+	return false
+}
 
-	isLastPodHealthy := pgCtrl.waitLastPodHealth(op.instanceNo)
-	if !isLastPodHealthy && op.instanceNo == 2 && pgCtrl.rollBack() {
+// pgOperUpgradeBatch upgrades the instances together after the last batch is checked by pgOperCheckUpgrade,
+// the first surge instances get their new pods deployed before the old pods are removed,
+// the others are removed first and redeployed.
+type pgOperUpgradeBatch struct {
+	instanceNos []int
+	surge       int
+	version     int
+	oldPodSpec  PodSpec
+	newPodSpec  PodSpec
+}
+
+func (op pgOperUpgradeBatch) Do(pgCtrl *podGroupController, c cluster.Cluster, store storage.Store, ev *RuntimeEagleView) bool {
+	start := time.Now()
+	defer func() {
+		pgCtrl.RLock()
+		log.Infof("%s upgrade batch, iNos=%v, surge=%d, version=%d, duration=%s", pgCtrl, op.instanceNos, op.surge, op.version, time.Now().Sub(start))
+		pgCtrl.RUnlock()
+	}()
+	pgCtrl.resetHealth(op.instanceNos)
+	log.Infof("upgrade instances : %v !", op.instanceNos)
+	replaced := make([]int, 0, len(op.instanceNos))
+	for i, instanceNo := range op.instanceNos {
+		if i < op.surge && surgeInstance(pgCtrl, c, instanceNo, op.newPodSpec) {
+			continue
+		}
+		replaced = append(replaced, instanceNo)
+	}
+	if len(replaced) == 0 {
 		return false
 	}
-	log.Infof("upgrade instance : %d !", op.instanceNo)
-	var lowOp pgOperation
-	lowOp = pgOperRemoveInstance{op.instanceNo, op.oldPodSpec}
-	lowOp.Do(pgCtrl, c, store, ev)
-	time.Sleep(10 * time.Second)
+	for _, instanceNo := range replaced {
+		lowOp := pgOperRemoveInstance{instanceNo, op.oldPodSpec}
+		lowOp.Do(pgCtrl, c, store, ev)
+	}
+	time.Sleep(UpgradeRedeployDelay)
+	for _, instanceNo := range replaced {
+		deployUpgradedInstance(pgCtrl, c, store, ev, instanceNo, op.version, op.oldPodSpec, op.newPodSpec)
+	}
+	return false
+}
+
+// deployUpgradedInstance deploys the new pod spec for the removed instance, stateful pods stay on their node
+func deployUpgradedInstance(pgCtrl *podGroupController, c cluster.Cluster, store storage.Store, ev *RuntimeEagleView,
+	instanceNo int, version int, oldPodSpec PodSpec, newPodSpec PodSpec) {
+	podCtrl := pgCtrl.podCtrls[instanceNo-1]
+	spec := pgCtrl.pinDaemonInstance(instanceNo, newPodSpec)
+	spec.PrevState = podCtrl.spec.PrevState.Clone() // upgrade action, state should not changed
+	prevNodeName := spec.PrevState.NodeName
 
 	// FIXME: do we need to consider hard state flag on upgrade
-	if op.oldPodSpec.IsStateful() && newPodSpec.IsStateful() && prevNodeName != "" {
-		newPodSpec.Filters = append(newPodSpec.Filters, fmt.Sprintf("constraint:node==%s", prevNodeName))
+	if oldPodSpec.IsStateful() && spec.IsStateful() && prevNodeName != "" {
+		spec.Filters = append(spec.Filters, fmt.Sprintf("constraint:node==%s", prevNodeName))
 	}
-	podCtrl.spec = newPodSpec
+	podCtrl.spec = spec
 	podCtrl.pod.State = RunStatePending
 	podCtrl.pod.RestartCount = 0
-	lowOp = pgOperDeployInstance{op.instanceNo, op.version}
+	lowOp := pgOperDeployInstance{instanceNo, version}
+	lowOp.Do(pgCtrl, c, store, ev)
+}
+
+// surgeInstance deploys the new pod of the instance next to the old one and removes the old one after the
+// new one is running, the new pod cannot take the IPs of the old one since they are running together.
+// Returns false with nothing changed if the new pod cannot be deployed.
+func surgeInstance(pgCtrl *podGroupController, c cluster.Cluster, instanceNo int, newPodSpec PodSpec) bool {
+	podCtrl := pgCtrl.podCtrls[instanceNo-1]
+	spec := newPodSpec.Clone()
+	spec.PrevState = NewPodPrevState(len(spec.Containers))
+	surged := &podController{
+		spec:  spec,
+		pod:   Pod{InstanceNo: instanceNo},
+		event: podCtrl.event,
+	}
+	surged.pod.State = RunStatePending
+	surged.pod.DriftCount = podCtrl.pod.DriftCount
+	surged.Deploy(c)
+	if surged.pod.State != RunStateSuccess {
+		pgCtrl.RLock()
+		log.Warnf("%s cannot surge instance %d, %s, will remove the old pod first", pgCtrl, instanceNo, surged.pod.LastError)
+		pgCtrl.RUnlock()
+		surged.Remove(c)
+		return false
+	}
+
+	nodeName, ids := podCtrl.pod.NodeName(), podCtrl.pod.ContainerIds()
+	podCtrl.Remove(c)
+	pgCtrl.forgetContainers(ids)
+	pgCtrl.emitChangeEvent("remove", podCtrl.spec, podCtrl.pod, nodeName)
+	podCtrl.spec = surged.spec
+	podCtrl.pod = surged.pod
+	pod := podCtrl.pod.Clone()
+	pgCtrl.emitChangeEvent("add", podCtrl.spec, pod, pod.NodeName())
+	return true
+}
+
+type pgOperCancelled struct {
+	dropped int
+}
+
+func (op pgOperCancelled) Do(pgCtrl *podGroupController, c cluster.Cluster, store storage.Store, ev *RuntimeEagleView) bool {
+	lastError := fmt.Sprintf("Operation cancelled by request, %d operations were dropped", op.dropped)
+	pgCtrl.Lock()
+	// the pod controllers pushed or popped by the dropped operations are not there
+	pgCtrl.spec.NumInstances = len(pgCtrl.podCtrls)
+	if canary := pgCtrl.keepUpgradedAsCanary(store); canary > 0 {
+		lastError += fmt.Sprintf(", the %d upgraded instances are kept as a canary", canary)
+	}
+	pgCtrl.Unlock()
+
+	lowOp := pgOperSnapshotGroup{true}
 	lowOp.Do(pgCtrl, c, store, ev)
+	pgCtrl.Lock()
+	pgCtrl.group.LastError = lastError
+	operation := pgCtrl.operation
+	pgCtrl.Unlock()
+	pgCtrl.engine.operations.end(operation, OperationCancelled, lastError)
 	return false
 }
 
@@ -163,6 +283,16 @@ func (op pgOperRefreshInstance) Do(pgCtrl *podGroupController, c cluster.Cluster
 		return false
 	}
 	podCtrl := pgCtrl.podCtrls[op.instanceNo-1]
+	if op.spec.Job != nil {
+		// the job pods are not restarted, they are counted and run again by pgOperRefreshJob
+		if podCtrl.pod.CompletedAt.IsZero() {
+			podCtrl.Refresh(c)
+		}
+		runtime = podCtrl.pod.ImRuntime
+		return false
+	}
+	// the canary instances run their own version, they should not be upgraded to the version of the group
+	version, podSpec := op.spec.InstanceSpec(op.instanceNo)
 
 	podCtrl.Refresh(c)
 	runtime = podCtrl.pod.ImRuntime
@@ -188,10 +318,10 @@ func (op pgOperRefreshInstance) Do(pgCtrl *podGroupController, c cluster.Cluster
 	// if some thing need change after refresh
 	consistent := true
 	container := podCtrl.pod.Containers[0]
-	if (evVersion != -1 && op.spec.Version != evVersion) || podCtrl.spec.Version != op.spec.Version {
+	if (evVersion != -1 && version != evVersion) || podCtrl.spec.Version != version {
 		log.Warnf("PodGroupCtrl %s, we found pod running with lower version, just upgrade it", op.spec)
-		// the new spec should be in op.spec.Pod
-		op := pgOperUpgradeInstance{op.instanceNo, op.spec.Version, podCtrl.spec, op.spec.Pod}
+		// the new spec should be in podSpec
+		op := pgOperUpgradeInstance{op.instanceNo, version, podCtrl.spec, podSpec}
 		op.Do(pgCtrl, c, store, ev)
 		runtime = podCtrl.pod.ImRuntime
 		consistent = false
@@ -208,7 +338,7 @@ func (op pgOperRefreshInstance) Do(pgCtrl *podGroupController, c cluster.Cluster
 					op.instanceNo, time.Now(), NotifyPodUnHealthy))
 			}
 		}
-		if generics.Equal_StringSlice(evIds, podCtrl.pod.ContainerIds()) && op.spec.Version == evVersion {
+		if generics.Equal_StringSlice(evIds, podCtrl.pod.ContainerIds()) && version == evVersion {
 			pod := podCtrl.pod.Clone()
 			pgCtrl.emitChangeEvent("verify", podCtrl.spec, pod, pod.NodeName())
 		}
@@ -248,7 +378,7 @@ func (op pgOperRefreshInstance) Do(pgCtrl *podGroupController, c cluster.Cluster
 			podCtrl.pod.State = RunStatePending
 			// when found pod down and redeploy it we just regard it as a drift operation and make driftcount incr
 			podCtrl.pod.DriftCount += 1
-			op := pgOperDeployInstance{op.instanceNo, op.spec.Version}
+			op := pgOperDeployInstance{op.instanceNo, version}
 			op.Do(pgCtrl, c, store, ev)
 			runtime = podCtrl.pod.ImRuntime
 			consistent = false
@@ -260,21 +390,32 @@ func (op pgOperRefreshInstance) Do(pgCtrl *podGroupController, c cluster.Cluster
 					op.instanceNo, container.Runtime.State.FinishedAt, NotifyLetPodGo))
 				return false
 			}
-			log.Warnf("PodGroupCtrl %s, we found pod down, just restart it", op.spec)
-			if podCtrl.pod.OOMkilled {
-				log.Errorf("pod down with oom:%v", op.spec)
-				ntfController.Send(NewNotifySpec(podCtrl.spec.Namespace, podCtrl.spec.Name,
-					op.instanceNo, container.Runtime.State.FinishedAt, NotifyPodDownOOM))
+			if podCtrl.pod.InitError != "" {
+				// nothing to restart, the init containers run again with the redeploy
+				log.Warnf("PodGroupCtrl %s, we found pod failed in the init containers, just redeploy it", op.spec)
+				podCtrl.UpdateRestartInfo()
+				podCtrl.pod.State = RunStatePending
+				op := pgOperDeployInstance{op.instanceNo, version}
+				op.Do(pgCtrl, c, store, ev)
+				runtime = podCtrl.pod.ImRuntime
+				consistent = false
 			} else {
-				ntfController.Send(NewNotifySpec(podCtrl.spec.Namespace, podCtrl.spec.Name,
-					op.instanceNo, container.Runtime.State.FinishedAt, NotifyPodDown))
-			}
+				log.Warnf("PodGroupCtrl %s, we found pod down, just restart it", op.spec)
+				if podCtrl.pod.OOMkilled {
+					log.Errorf("pod down with oom:%v", op.spec)
+					ntfController.Send(NewNotifySpec(podCtrl.spec.Namespace, podCtrl.spec.Name,
+						op.instanceNo, container.Runtime.State.FinishedAt, NotifyPodDownOOM))
+				} else {
+					ntfController.Send(NewNotifySpec(podCtrl.spec.Namespace, podCtrl.spec.Name,
+						op.instanceNo, container.Runtime.State.FinishedAt, NotifyPodDown))
+				}
 
-			podCtrl.Start(c)
-			runtime = podCtrl.pod.ImRuntime
-			if runtime.State == RunStateSuccess {
-				pod := podCtrl.pod.Clone()
-				pgCtrl.emitChangeEvent("verify", podCtrl.spec, pod, pod.NodeName())
+				podCtrl.Start(c)
+				runtime = podCtrl.pod.ImRuntime
+				if runtime.State == RunStateSuccess {
+					pod := podCtrl.pod.Clone()
+					pgCtrl.emitChangeEvent("verify", podCtrl.spec, pod, pod.NodeName())
+				}
 			}
 		}
 	}
@@ -330,7 +471,7 @@ func (op pgOperUpdateInsConfig) Do(pgCtrl *podGroupController, c cluster.Cluster
 		pgCtrl.RUnlock()
 	}()
 	podCtrl := pgCtrl.podCtrls[op.instanceNo-1]
-	newPodSpec := op.newPodSpec.Clone()
+	newPodSpec := pgCtrl.pinDaemonInstance(op.instanceNo, op.newPodSpec)
 	newPodSpec.PrevState = podCtrl.spec.PrevState.Clone() // upgrade action, state should not changed
 	podCtrl.spec = newPodSpec
 	podCtrl.pod.State = RunStatePending
@@ -341,6 +482,35 @@ func (op pgOperUpdateInsConfig) Do(pgCtrl *podGroupController, c cluster.Cluster
 	return false
 }
 
+// pgOperUpdateInsResources updates the resources of the running instance in place before it is redeployed,
+// so the new limits take effect at once, the redeploy applies them anyway if the update failed.
+type pgOperUpdateInsResources struct {
+	instanceNo int
+	podSpec    PodSpec
+}
+
+func (op pgOperUpdateInsResources) Do(pgCtrl *podGroupController, c cluster.Cluster, store storage.Store, ev *RuntimeEagleView) bool {
+	var err error
+	start := time.Now()
+	defer func() {
+		pgCtrl.RLock()
+		log.Infof("%s update instance resources, iNo=%d, err=%v, duration=%s", pgCtrl, op.instanceNo, err, time.Now().Sub(start))
+		pgCtrl.RUnlock()
+	}()
+	podCtrl := pgCtrl.podCtrls[op.instanceNo-1]
+	if podCtrl.pod.State != RunStateSuccess || len(podCtrl.spec.Containers) != len(op.podSpec.Containers) {
+		return false
+	}
+	podSpec := podCtrl.spec.Clone()
+	for i, cSpec := range op.podSpec.Containers {
+		podSpec.Containers[i].CpuLimit = cSpec.CpuLimit
+		podSpec.Containers[i].MemoryLimit = cSpec.MemoryLimit
+	}
+	podCtrl.spec = podSpec
+	err = podCtrl.UpdateResources(c)
+	return false
+}
+
 type pgOperDeployInstance struct {
 	instanceNo int
 	version    int
@@ -441,6 +611,18 @@ func (op pgOperSnapshotGroup) Do(pgCtrl *podGroupController, c cluster.Cluster,
 			group.Healthst = podCtrl.pod.Healthst
 		}
 	}
+	if pgCtrl.upgradeError != "" {
+		group.LastError = pgCtrl.upgradeError
+	}
+	group.GreenPods = nil
+	for _, green := range pgCtrl.greenCtrls {
+		group.GreenPods = append(group.GreenPods, green.pod)
+	}
+	group.RetiredPods = nil
+	for _, retired := range pgCtrl.retiredCtrls {
+		group.RetiredPods = append(group.RetiredPods, retired.pod)
+	}
+	group.RetiredVersion, group.RetireAt = pgCtrl.retiredVersion, pgCtrl.retireAt
 	if op.updateTime {
 		group.UpdatedAt = time.Now()
 	}
@@ -493,8 +675,9 @@ func (op pgOperRemoveInstance) Do(pgCtrl *podGroupController, c cluster.Cluster,
 		pgCtrl.RUnlock()
 	}()
 	podCtrl := pgCtrl.podCtrls[op.instanceNo-1]
-	nodeName := podCtrl.pod.NodeName()
+	nodeName, ids := podCtrl.pod.NodeName(), podCtrl.pod.ContainerIds()
 	podCtrl.Remove(c)
+	pgCtrl.forgetContainers(ids)
 	pgCtrl.emitChangeEvent("remove", podCtrl.spec, podCtrl.pod, nodeName)
 	return false
 }
@@ -3,13 +3,14 @@ package engine
 import (
 	"encoding/json"
 	"fmt"
+	"strings"
 	"testing"
 	"time"
 
 	"github.com/laincloud/deployd/cluster"
 	"github.com/laincloud/deployd/cluster/swarm"
 	"github.com/laincloud/deployd/storage"
-	"github.com/laincloud/deployd/storage/etcd"
+	"github.com/laincloud/deployd/storage/memory"
 )
 
 func TestContainerSorter(t *testing.T) {
@@ -25,8 +26,6 @@ func TestContainerSorter(t *testing.T) {
 }
 
 func TestPodGroupRefresh(t *testing.T) {
-	etcdAddr := "http://127.0.0.1:2379"
-	ConfigPortsManager(etcdAddr)
 	c, store, err := initClusterAndStore()
 	if err != nil {
 		t.Fatalf("Cannot create the cluster and storage, %s", err)
@@ -41,7 +40,7 @@ func TestPodGroupRefresh(t *testing.T) {
 	name := "hello.proc.web.web"
 	pgSpec := createPodGroupSpec(namespace, name, 2)
 	pgSpec.RestartPolicy = RestartPolicyAlways
-	if err := engine.NewPodGroup(pgSpec); err != nil {
+	if _, err := engine.NewPodGroup(pgSpec); err != nil {
 		t.Fatalf("Should not return error, %s", err)
 	}
 
@@ -65,7 +64,7 @@ func TestPodGroupRefresh(t *testing.T) {
 		t.Errorf("We should have the pod deployed and running, %#v", pg.State)
 	}
 
-	if err := engine.RemovePodGroup(name); err != nil {
+	if _, err := engine.RemovePodGroup(name); err != nil {
 		t.Errorf("We should be able to remove the pod group, %s", err)
 	}
 
@@ -73,8 +72,6 @@ func TestPodGroupRefresh(t *testing.T) {
 }
 
 func TestEnginePodGroup(t *testing.T) {
-	etcdAddr := "http://127.0.0.1:2379"
-	ConfigPortsManager(etcdAddr)
 	c, store, err := initClusterAndStore()
 	if err != nil {
 		t.Fatalf("Cannot create the cluster and storage, %s", err)
@@ -88,10 +85,10 @@ func TestEnginePodGroup(t *testing.T) {
 	namespace := "hello"
 	name := "hello.proc.web.web"
 	pgSpec := createPodGroupSpec(namespace, name, 1)
-	if err := engine.NewPodGroup(pgSpec); err != nil {
+	if _, err := engine.NewPodGroup(pgSpec); err != nil {
 		t.Fatalf("Should not return error, %s", err)
 	}
-	if err := engine.NewPodGroup(pgSpec); err == nil {
+	if _, err := engine.NewPodGroup(pgSpec); err == nil {
 		t.Errorf("Should return exists error, but we got no problem")
 	}
 
@@ -133,23 +130,19 @@ func TestEnginePodGroup(t *testing.T) {
 		t.Errorf("We should have version 1 of the pods")
 	}
 
-	if err := engine.RemovePodGroup(name); err != nil {
+	if _, err := engine.RemovePodGroup(name); err != nil {
 		t.Errorf("We should be able to remove the pod group, %s", err)
-	} else if err := engine.NewPodGroup(pgSpec); err == nil {
+	} else if _, err := engine.NewPodGroup(pgSpec); err == nil {
 		t.Errorf("We should not be able to deploy pod group again in short time we remove it")
 	}
 	time.Sleep(20 * time.Second)
 }
 
 func initClusterAndStore() (cluster.Cluster, storage.Store, error) {
-	etcdAddr := "http://127.0.0.1:2379"
 	swarmAddr := "tcp://127.0.0.1:2376"
 
-	store, err := etcd.NewStore(etcdAddr, false)
-	if err != nil {
-		return nil, nil, err
-	}
-
+	store := memory.NewStore()
+	ConfigPortsManager(store)
 	c, err := swarm.NewCluster(swarmAddr, 30*time.Second, 10*time.Minute)
 	if err != nil {
 		return nil, nil, err
@@ -174,3 +167,629 @@ func createPodSpec(namespace, name string) PodSpec {
 	podSpec.Annotation = fmt.Sprintf("{\"test\":\"Unit test for %s\"}", name)
 	return podSpec
 }
+
+func TestUpdateStrategyBatch(t *testing.T) {
+	cases := []struct {
+		strategy    UpdateStrategy
+		surgeable   bool
+		size, surge int
+	}{
+		{UpdateStrategy{}, true, 1, 0},
+		{UpdateStrategy{BatchSize: 4}, true, 1, 0},
+		{UpdateStrategy{BatchSize: 4, MaxUnavailable: 2}, true, 2, 0},
+		{UpdateStrategy{BatchSize: 4, MaxUnavailable: 1, MaxSurge: 2}, true, 3, 2},
+		{UpdateStrategy{BatchSize: 2, MaxSurge: 3}, true, 2, 2},
+		{UpdateStrategy{BatchSize: 2, MaxSurge: 3}, false, 1, 0},
+		{UpdateStrategy{BatchSize: 3, MaxUnavailable: 2, MaxSurge: 1}, false, 2, 0},
+	}
+	for _, tc := range cases {
+		if size, surge := tc.strategy.Batch(tc.surgeable); size != tc.size || surge != tc.surge {
+			t.Errorf("Strategy %+v surgeable=%v should upgrade %d instances with %d surged, but got %d and %d",
+				tc.strategy, tc.surgeable, tc.size, tc.surge, size, surge)
+		}
+	}
+	if (UpdateStrategy{MaxSurge: -1}).VerifyParams() {
+		t.Errorf("Negative update strategy should not be verified")
+	}
+}
+
+func TestPodGroupUpgradeSurge(t *testing.T) {
+	engine, c, _ := initFakeEngine(t, 2)
+	defer engine.Stop()
+
+	namespace, name := "hello", "hello.proc.web.web"
+	pgSpec := createPodGroupSpec(namespace, name, 2)
+	pgSpec.UpdateStrategy = UpdateStrategy{BatchSize: 2, MaxSurge: 2}
+	if _, err := engine.NewPodGroup(pgSpec); err != nil {
+		t.Fatalf("Should be able to create the pod group, %s", err)
+	}
+	waitPodGroupState(t, engine, name, RunStateSuccess)
+	pg, _ := engine.InspectPodGroup(name)
+	oldIds := append(pg.Pods[0].ContainerIds(), pg.Pods[1].ContainerIds()...)
+
+	podSpec := createPodSpec(namespace, name)
+	podSpec.Containers[0].Command = []string{"/bin/sh", "-c", "sleep 3600"}
+	if _, err := engine.RescheduleSpec(name, podSpec); err != nil {
+		t.Fatalf("Should be able to reschedule the spec, %s", err)
+	}
+	// surged instances are deployed before the old ones removed, so there is no removal pause
+	for i := 0; ; i++ {
+		pg, _ = engine.InspectPodGroup(name)
+		if pg.Spec.Pod.Version == 2 && pg.State == RunStateSuccess && len(pg.Pods) == 2 &&
+			pg.Pods[0].ContainerIds()[0] != oldIds[0] && pg.Pods[1].ContainerIds()[0] != oldIds[1] {
+			break
+		}
+		if i > 50 {
+			t.Fatalf("Should upgrade all the instances in one batch without waiting, got %+v", pg.Pods)
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+	for _, id := range oldIds {
+		if _, err := c.InspectContainer(id); err == nil {
+			t.Errorf("Old container %s should be removed after the new one is running", id)
+		}
+	}
+}
+
+func TestShouldReDeploy(t *testing.T) {
+	oldSpec := createPodSpec("hello", "hello.proc.web.web")
+	resized := oldSpec.Clone()
+	resized.Containers[0].MemoryLimit *= 2
+	mixed := resized.Clone()
+	mixed.Containers[0].Image = "busybox:latest"
+	added := resized.Clone()
+	added.Containers = append(added.Containers, added.Containers[0].Clone())
+	volumed := resized.Clone()
+	volumed.Containers[0].CloudVolumes = []CloudVolumeSpec{{Type: CloudVolumeSingleMode, Dirs: []string{"/data"}}}
+	cases := []struct {
+		spec             PodSpec
+		reDeploy, resize bool
+	}{
+		{oldSpec.Clone(), true, false},
+		{resized, false, true},
+		{mixed, true, true},
+		{added, true, false},
+		{volumed, true, true},
+	}
+	for i, tc := range cases {
+		if reDeploy, resize := shouldReDeploy(oldSpec, tc.spec), shouldResize(oldSpec, tc.spec); reDeploy != tc.reDeploy || resize != tc.resize {
+			t.Errorf("Case %d should be reDeploy=%v, resize=%v, but got %v, %v", i, tc.reDeploy, tc.resize, reDeploy, resize)
+		}
+	}
+}
+
+func TestPodGroupUpdateResources(t *testing.T) {
+	engine, c, _ := initFakeEngine(t, 2)
+	defer engine.Stop()
+
+	namespace, name := "hello", "hello.proc.web.web"
+	pgSpec := createPodGroupSpec(namespace, name, 2)
+	operationId, err := engine.NewPodGroup(pgSpec)
+	if err != nil {
+		t.Fatalf("Should be able to create the pod group, %s", err)
+	}
+	waitOperationEnded(t, engine, operationId)
+	pg, _ := engine.InspectPodGroup(name)
+	oldIds := append(pg.Pods[0].ContainerIds(), pg.Pods[1].ContainerIds()...)
+
+	// only the memory limit is changed, the running containers are updated in place
+	podSpec := pgSpec.Pod.Clone()
+	podSpec.Containers[0].MemoryLimit = 32 * 1024 * 1024
+	if operationId, err = engine.RescheduleSpec(name, podSpec); err != nil {
+		t.Fatalf("Should be able to reschedule the spec, %s", err)
+	}
+	if o := waitOperationEnded(t, engine, operationId); o.Status != OperationSucceeded || o.Done != 2 {
+		t.Fatalf("Should update the 2 instances, got %+v", o)
+	}
+	pg, _ = engine.InspectPodGroup(name)
+	if pg.Spec.Pod.Version != 1 || pg.Pods[0].ContainerIds()[0] != oldIds[0] || pg.Pods[1].ContainerIds()[0] != oldIds[1] {
+		t.Fatalf("Should keep the containers and the version, got %+v", pg)
+	}
+	for _, id := range oldIds {
+		if info, err := c.InspectContainer(id); err != nil || info.HostConfig.Memory != 32*1024*1024 || !info.State.Running {
+			t.Errorf("Should update the memory limit of the running container %s, got %+v, %v", id, info, err)
+		}
+	}
+
+	// the command is changed with the memory limit, the containers are resized and then redeployed
+	podSpec = podSpec.Clone()
+	podSpec.Containers[0].MemoryLimit = 48 * 1024 * 1024
+	podSpec.Containers[0].Command = []string{"/bin/sh", "-c", "sleep 3600"}
+	if operationId, err = engine.RescheduleSpec(name, podSpec); err != nil {
+		t.Fatalf("Should be able to reschedule the spec, %s", err)
+	}
+	if o := waitOperationEnded(t, engine, operationId); o.Status != OperationSucceeded || o.Done != 2 {
+		t.Fatalf("Should redeploy the 2 instances, got %+v", o)
+	}
+	pg, _ = engine.InspectPodGroup(name)
+	if pg.Spec.Pod.Version != 2 {
+		t.Fatalf("Should redeploy with a new version, got %d", pg.Spec.Pod.Version)
+	}
+	for i, pod := range pg.Pods {
+		id := pod.ContainerIds()[0]
+		info, err := c.InspectContainer(id)
+		if id == oldIds[i] || err != nil || info.HostConfig.Memory != 48*1024*1024 || info.Config.Cmd[2] != "sleep 3600" {
+			t.Errorf("Should recreate the container with the new command and memory limit, got %+v, %v", info, err)
+		}
+	}
+}
+
+func TestPodGroupCanary(t *testing.T) {
+	engine, _, _ := initFakeEngine(t, 3)
+	defer engine.Stop()
+
+	namespace, name := "hello", "hello.proc.web.web"
+	pgSpec := createPodGroupSpec(namespace, name, 3)
+	pgSpec.UpdateStrategy = UpdateStrategy{MaxSurge: 1}
+	if _, err := engine.NewPodGroup(pgSpec); err != nil {
+		t.Fatalf("Should be able to create the pod group, %s", err)
+	}
+	waitPodGroupState(t, engine, name, RunStateSuccess)
+	pg, _ := engine.InspectPodGroup(name)
+	oldIds := []string{pg.Pods[0].ContainerIds()[0], pg.Pods[1].ContainerIds()[0], pg.Pods[2].ContainerIds()[0]}
+
+	podSpec := createPodSpec(namespace, name)
+	podSpec.Containers[0].Command = []string{"/bin/sh", "-c", "sleep 3600"}
+	podSpec.Annotation = `{"ports":[{"srcport":9701,"dstport":9701,"proto":"tcp"}]}`
+	if _, err := engine.RescheduleCanary(name, podSpec, 1); err != nil {
+		t.Fatalf("Should be able to start the canary, %s", err)
+	}
+	waitCanary := func(upgraded int, msg string) {
+		for i := 0; ; i++ {
+			pg, _ = engine.InspectPodGroup(name)
+			done := pg.State == RunStateSuccess && len(pg.Pods) == 3
+			for j := 0; done && j < 3; j++ {
+				done = (pg.Pods[j].ContainerIds()[0] != oldIds[j]) == (j < upgraded)
+			}
+			if done {
+				return
+			}
+			if i > 100 {
+				t.Fatalf("Should %s, got %+v", msg, pg.Pods)
+			}
+			time.Sleep(100 * time.Millisecond)
+		}
+	}
+	waitCanary(1, "upgrade only the first instance for the canary")
+	if pg.Spec.Canary == nil || pg.Spec.Canary.Instances != 1 || pg.Spec.Version != 1 {
+		t.Fatalf("Should keep the group version and record the canary, got %+v", pg.Spec)
+	}
+	if occupied := OccupiedPorts(9701); len(occupied) != 1 {
+		t.Errorf("Should register the stream ports of the canary when it starts")
+	}
+	if _, err := engine.RescheduleSpec(name, podSpec); err != ErrCanaryInProgress {
+		t.Errorf("Should not reschedule the spec while the canary is in progress, got %v", err)
+	}
+
+	// the refresh should neither upgrade the stable instances nor roll back the canary one
+	engine.RLock()
+	pgCtrl := engine.pgCtrls[name]
+	engine.RUnlock()
+	canaryId := pg.Pods[0].ContainerIds()[0]
+	pgCtrl.Refresh(true)
+	for len(pgCtrl.opsChan) > 0 {
+		time.Sleep(100 * time.Millisecond)
+	}
+	time.Sleep(200 * time.Millisecond)
+	waitCanary(1, "keep the mixed versions after refresh")
+	if pg.Pods[0].ContainerIds()[0] != canaryId {
+		t.Errorf("Should not redeploy the canary instance on refresh, got %+v", pg.Pods[0])
+	}
+
+	if _, err := engine.AbortCanary(name); err != nil {
+		t.Fatalf("Should be able to abort the canary, %s", err)
+	}
+	for i := 0; ; i++ {
+		pg, _ = engine.InspectPodGroup(name)
+		if pg.Spec.Canary == nil && pg.State == RunStateSuccess && pg.Pods[0].ContainerIds()[0] != canaryId {
+			break
+		}
+		if i > 100 {
+			t.Fatalf("Should roll back the canary instance, got %+v", pg)
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+	if _, err := engine.PromoteCanary(name); err != ErrCanaryNotExists {
+		t.Errorf("Should not promote without a canary, got %v", err)
+	}
+	if occupied := OccupiedPorts(9701); len(occupied) != 0 {
+		t.Errorf("Should cancel the stream ports of the aborted canary")
+	}
+	if pg.Spec.Version != 1 || pg.Spec.BurnedVersion != 2 {
+		t.Errorf("Should burn the version of the aborted canary, got %+v", pg.Spec)
+	}
+	oldIds[0] = pg.Pods[0].ContainerIds()[0]
+
+	if _, err := engine.RescheduleCanary(name, podSpec, 1); err != nil {
+		t.Fatalf("Should be able to start the canary again, %s", err)
+	}
+	waitCanary(1, "upgrade the first instance for the canary again")
+	pgCtrl.RLock()
+	canaryVersion := pgCtrl.podCtrls[0].spec.Version
+	pgCtrl.RUnlock()
+	if pg.Spec.Canary == nil || pg.Spec.Canary.Version != 3 || canaryVersion != 3 {
+		t.Errorf("Should not reuse the version of the aborted canary, got %+v on version %d", pg.Spec.Canary, canaryVersion)
+	}
+	if _, err := engine.PromoteCanary(name); err != nil {
+		t.Fatalf("Should be able to promote the canary, %s", err)
+	}
+	waitCanary(3, "upgrade all the instances after promoted")
+	if pg.Spec.Canary != nil || pg.Spec.Version != 3 || pg.Spec.Pod.Containers[0].Command[2] != "sleep 3600" {
+		t.Errorf("Should make the canary the spec of the group, got %+v", pg.Spec)
+	}
+	if occupied := OccupiedPorts(9701); len(occupied) != 1 {
+		t.Errorf("Should keep the stream ports of the promoted canary")
+	}
+}
+
+func TestPodGroupPauseCancel(t *testing.T) {
+	engine, _, _ := initFakeEngine(t, 3)
+	defer engine.Stop()
+
+	namespace, name := "hello", "hello.proc.web.web"
+	if _, err := engine.NewPodGroup(createPodGroupSpec(namespace, name, 1)); err != nil {
+		t.Fatalf("Should be able to create the pod group, %s", err)
+	}
+	waitPodGroupState(t, engine, name, RunStateSuccess)
+	for i := 0; engine.PauseOperation(name) != ErrPodGroupNotOperating; i++ {
+		if i > 100 {
+			t.Fatalf("Should not pause the pod group without operation in progress")
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+
+	engine.RLock()
+	pgCtrl := engine.pgCtrls[name]
+	engine.RUnlock()
+	replicaId, err := engine.RescheduleInstance(name, 3)
+	if err != nil {
+		t.Fatalf("Should be able to reschedule the instances, %s", err)
+	}
+	if err := engine.PauseOperation(name); err != nil {
+		t.Fatalf("Should be able to pause the operation, %s", err)
+	}
+	waitOperationHeld(t, pgCtrl)
+	if o, _ := engine.GetOperation(replicaId); o.Status != OperationPaused || o.Done != 0 {
+		t.Errorf("Should pause the operation before the first instance, got %+v", o)
+	}
+	if pg, _ := engine.InspectPodGroup(name); len(pg.Pods) != 1 {
+		t.Fatalf("Should not deploy the new instances while paused, got %+v", pg.Pods)
+	}
+	if err := engine.ResumeOperation(name); err != nil {
+		t.Fatalf("Should be able to resume the operation, %s", err)
+	}
+	if err := engine.ResumeOperation(name); err != ErrPodGroupNotPaused {
+		t.Errorf("Should not resume the operation not paused, got %v", err)
+	}
+	if o := waitOperationEnded(t, engine, replicaId); o.Status != OperationSucceeded {
+		t.Fatalf("Should deploy the new instances after resumed, got %+v", o)
+	}
+	for i := 0; ; i++ {
+		if pg, _ := engine.InspectPodGroup(name); len(pg.Pods) == 3 && pg.State == RunStateSuccess {
+			break
+		}
+		if i > 100 {
+			t.Fatalf("Should deploy the new instances after resumed")
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+	for i := 0; pgCtrl.IsOperating(); i++ {
+		if i > 100 {
+			t.Fatalf("Should finish the reschedule of the instances")
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+
+	// the paused upgrade is superseded by the new one, which is not left paused
+	resized := createPodSpec(namespace, name)
+	resized.Containers[0].MemoryLimit *= 2
+	pausedId, err := engine.RescheduleSpec(name, resized)
+	if err != nil {
+		t.Fatalf("Should be able to reschedule the spec, %s", err)
+	}
+	if err := engine.PauseOperation(name); err != nil {
+		t.Fatalf("Should be able to pause the operation, %s", err)
+	}
+	waitOperationHeld(t, pgCtrl)
+	resized.Containers[0].MemoryLimit *= 2
+	resizeId, err := engine.RescheduleSpec(name, resized)
+	if err != nil {
+		t.Fatalf("Should be able to reschedule the spec of the paused pod group, %s", err)
+	}
+	if o := waitOperationEnded(t, engine, resizeId); o.Status != OperationSucceeded || pgCtrl.IsPaused() {
+		t.Fatalf("Should run the new operation instead of the paused one, got %+v", o)
+	}
+	if o, _ := engine.GetOperation(pausedId); o.Status != OperationSuperseded {
+		t.Errorf("Should supersede the paused operation, got %+v", o)
+	}
+	for i := 0; pgCtrl.IsOperating(); i++ {
+		if i > 100 {
+			t.Fatalf("Should finish the reschedule of the spec")
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+
+	// pause the rollout after the first instance and cancel it, the others are kept in the old version
+	pg, _ := engine.InspectPodGroup(name)
+	oldIds := []string{pg.Pods[0].ContainerIds()[0], pg.Pods[1].ContainerIds()[0], pg.Pods[2].ContainerIds()[0]}
+	stableVersion := pg.Spec.Version
+	podSpec := createPodSpec(namespace, name)
+	podSpec.Containers[0].Command = []string{"/bin/sh", "-c", "sleep 3600"}
+	specId, err := engine.RescheduleSpec(name, podSpec)
+	if err != nil {
+		t.Fatalf("Should be able to reschedule the spec, %s", err)
+	}
+	if err := engine.PauseOperation(name); err != nil {
+		t.Fatalf("Should be able to pause the operation, %s", err)
+	}
+	waitOperationHeld(t, pgCtrl)
+	if err := engine.ResumeOperation(name); err != nil {
+		t.Fatalf("Should be able to resume the operation, %s", err)
+	}
+	// pause again once the first instance is taken, the operation stops right after it
+	for i := 0; ; i++ {
+		pgCtrl.RLock()
+		held := pgCtrl.heldOp != nil
+		pgCtrl.RUnlock()
+		if !held {
+			break
+		}
+		if i > 100 {
+			t.Fatalf("Should go on with the first instance after resumed")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if err := engine.PauseOperation(name); err != nil {
+		t.Fatalf("Should be able to pause the operation, %s", err)
+	}
+	waitOperationHeld(t, pgCtrl)
+	if o, _ := engine.GetOperation(specId); o.Status != OperationPaused || o.Done != 1 {
+		t.Errorf("Should pause the operation after the first instance, got %+v", o)
+	}
+
+	if err := engine.CancelOperation(name); err != nil {
+		t.Fatalf("Should be able to cancel the operation, %s", err)
+	}
+	if o := waitOperationEnded(t, engine, specId); o.Status != OperationCancelled || o.Done >= o.Total {
+		t.Errorf("Should mark the spec reschedule cancelled half way, got %+v", o)
+	}
+	for i := 0; ; i++ {
+		pg, _ = engine.InspectPodGroup(name)
+		if pg.Spec.Canary != nil && strings.HasPrefix(pg.LastError, "Operation cancelled") {
+			break
+		}
+		if i > 200 {
+			t.Fatalf("Should cancel the rest of the upgrade, got %+v", pg)
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+	if pg.Spec.Canary.Instances != 1 || pg.Spec.Version != stableVersion || pg.Spec.Pod.Version != stableVersion ||
+		pg.Pods[0].ContainerIds()[0] == oldIds[0] ||
+		pg.Pods[1].ContainerIds()[0] != oldIds[1] || pg.Pods[2].ContainerIds()[0] != oldIds[2] {
+		t.Errorf("Should keep the upgraded instance as a canary and the rest untouched, got %+v", pg)
+	}
+}
+
+// waitOperationHeld waits until the paused pod group holds its next instance operation
+func waitOperationHeld(t *testing.T, pgCtrl *podGroupController) {
+	t.Helper()
+	for i := 0; ; i++ {
+		pgCtrl.RLock()
+		held := pgCtrl.heldOp != nil
+		pgCtrl.RUnlock()
+		if held {
+			return
+		}
+		if i > 300 {
+			t.Fatalf("Should stop the paused operation before the next instance")
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+}
+
+func TestPodGroupBlueGreen(t *testing.T) {
+	engine, c, _ := initFakeEngine(t, 3)
+	defer engine.Stop()
+
+	namespace, name := "hello", "hello.proc.web.web"
+	if _, err := engine.NewPodGroup(createPodGroupSpec(namespace, name, 2)); err != nil {
+		t.Fatalf("Should be able to create the pod group, %s", err)
+	}
+	waitPodGroupState(t, engine, name, RunStateSuccess)
+	pg, _ := engine.InspectPodGroup(name)
+	blueIds := []string{pg.Pods[0].ContainerIds()[0], pg.Pods[1].ContainerIds()[0]}
+	isRunning := func(id string) bool {
+		_, err := c.InspectContainer(id)
+		return err == nil
+	}
+
+	podSpec := createPodSpec(namespace, name)
+	podSpec.Containers[0].Command = []string{"/bin/sh", "-c", "sleep 3600"}
+	var (
+		operationId string
+		err         error
+	)
+	for i := 0; ; i++ {
+		if operationId, err = engine.RescheduleBlueGreen(name, podSpec, 1); err == nil {
+			break
+		}
+		if i > 100 {
+			t.Fatalf("Should be able to deploy the blue-green, %s", err)
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+	if o := waitOperationEnded(t, engine, operationId); o.Status != OperationSucceeded || o.Done != 2 {
+		t.Fatalf("Should deploy the 2 green pods, got %+v", o)
+	}
+	pg, _ = engine.InspectPodGroup(name)
+	if len(pg.GreenPods) != 2 || pg.Spec.BlueGreen == nil || pg.Spec.Version != 1 ||
+		pg.Pods[0].ContainerIds()[0] != blueIds[0] || pg.Pods[1].ContainerIds()[0] != blueIds[1] {
+		t.Fatalf("Should deploy the green pods alongside the blue ones, got %+v", pg)
+	}
+	greenIds := []string{pg.GreenPods[0].ContainerIds()[0], pg.GreenPods[1].ContainerIds()[0]}
+	if _, err := engine.RescheduleSpec(name, podSpec); err != ErrBlueGreenInProgress {
+		t.Errorf("Should not reschedule the spec during the blue-green deployment, got %v", err)
+	}
+
+	// the refresh should take neither the blue nor the green pods as corrupted
+	engine.RLock()
+	pgCtrl := engine.pgCtrls[name]
+	engine.RUnlock()
+	pgCtrl.Refresh(true)
+	for len(pgCtrl.opsChan) > 0 {
+		time.Sleep(100 * time.Millisecond)
+	}
+	time.Sleep(200 * time.Millisecond)
+	for _, id := range append(blueIds, greenIds...) {
+		if !isRunning(id) {
+			t.Fatalf("Should keep both the blue and the green pods after refresh, %s is gone", id)
+		}
+	}
+
+	if operationId, err = engine.SwitchBlueGreen(name); err != nil {
+		t.Fatalf("Should be able to switch the blue-green, %s", err)
+	}
+	if o := waitOperationEnded(t, engine, operationId); o.Status != OperationSucceeded || o.Done != 2 {
+		t.Fatalf("Should switch the 2 instances, got %+v", o)
+	}
+	pg, _ = engine.InspectPodGroup(name)
+	if pg.Spec.BlueGreen != nil || pg.Spec.Version != 2 || len(pg.GreenPods) != 0 ||
+		pg.Pods[0].ContainerIds()[0] != greenIds[0] || pg.Pods[1].ContainerIds()[0] != greenIds[1] {
+		t.Fatalf("Should make the green pods the instances of the group, got %+v", pg)
+	}
+	// the retired blue pods are kept in the record, so they are still removed after a restart
+	var stored PodGroupWithSpec
+	if err := engine.store.Get(pgCtrl.storedKey, &stored); err != nil || len(stored.RetiredPods) != 2 ||
+		stored.RetiredVersion != 1 || stored.RetireAt.IsZero() {
+		t.Fatalf("Should save the retired pods with the deadline, got %+v, %v", stored.PodGroup, err)
+	}
+	restored := newPodGroupController(stored.Spec, stored.PrevState, stored.PodGroup, engine)
+	if len(restored.retiredCtrls) != 2 || restored.retiredVersion != 1 || !restored.retireAt.Equal(stored.RetireAt) ||
+		restored.retiredCtrls[0].pod.ContainerIds()[0] != blueIds[0] {
+		t.Errorf("Should load the retired pods from the record, got %+v", restored.retiredCtrls)
+	}
+	for i := 0; isRunning(blueIds[0]) || isRunning(blueIds[1]); i++ {
+		if i > 100 {
+			t.Fatalf("Should remove the blue pods after the delay")
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+	for i := 0; ; i++ {
+		stored = PodGroupWithSpec{}
+		if err := engine.store.Get(pgCtrl.storedKey, &stored); err == nil && len(stored.RetiredPods) == 0 {
+			break
+		}
+		if i > 100 {
+			t.Fatalf("Should drop the removed pods from the record, got %+v", stored.PodGroup)
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+	if !isRunning(greenIds[0]) || !isRunning(greenIds[1]) {
+		t.Errorf("Should keep the green pods running")
+	}
+
+	if _, err := engine.SwitchBlueGreen(name); err != ErrBlueGreenNotExists {
+		t.Errorf("Should not switch without a blue-green deployment, got %v", err)
+	}
+	if operationId, err = engine.RescheduleBlueGreen(name, createPodSpec(namespace, name), 1); err != nil {
+		t.Fatalf("Should be able to deploy the blue-green again, %s", err)
+	}
+	waitOperationEnded(t, engine, operationId)
+	pg, _ = engine.InspectPodGroup(name)
+	discardedIds := []string{pg.GreenPods[0].ContainerIds()[0], pg.GreenPods[1].ContainerIds()[0]}
+	if operationId, err = engine.DiscardBlueGreen(name); err != nil {
+		t.Fatalf("Should be able to discard the blue-green, %s", err)
+	}
+	waitOperationEnded(t, engine, operationId)
+	pg, _ = engine.InspectPodGroup(name)
+	if pg.Spec.BlueGreen != nil || len(pg.GreenPods) != 0 || isRunning(discardedIds[0]) || isRunning(discardedIds[1]) ||
+		pg.Pods[0].ContainerIds()[0] != greenIds[0] {
+		t.Errorf("Should remove only the discarded green pods, got %+v", pg)
+	}
+}
+
+func TestPodGroupFailurePolicy(t *testing.T) {
+	if (FailurePolicy{Action: "retry"}).VerifyParams() || (FailurePolicy{MaxFailed: -1}).VerifyParams() {
+		t.Errorf("Should not accept the unknown action or the negative limits")
+	}
+	engine, c, _ := initFakeEngine(t, 3)
+	defer engine.Stop()
+
+	// the new pods never become healthy
+	namespace := "hello"
+	unhealthySpec := func(name string) PodSpec {
+		podSpec := createPodSpec(namespace, name)
+		podSpec.HealthConfig = HealthConfig{Cmd: "curl -f http://localhost:5000/ping"}
+		return podSpec
+	}
+	isRunning := func(id string) bool {
+		_, err := c.InspectContainer(id)
+		return err == nil
+	}
+
+	// the single instance is rolled back by the default policy
+	single := "hello.proc.web.single"
+	pgSpec := createPodGroupSpec(namespace, single, 1)
+	pgSpec.UpdateStrategy = UpdateStrategy{MaxSurge: 1}
+	pgSpec.FailurePolicy = FailurePolicy{HealthDeadline: 1}
+	if _, err := engine.NewPodGroup(pgSpec); err != nil {
+		t.Fatalf("Should be able to create the pod group, %s", err)
+	}
+	waitPodGroupState(t, engine, single, RunStateSuccess)
+	operationId, err := engine.RescheduleSpec(single, unhealthySpec(single))
+	if err != nil {
+		t.Fatalf("Should be able to reschedule the spec, %s", err)
+	}
+	if o := waitOperationEnded(t, engine, operationId); o.Status != OperationFailed ||
+		!strings.Contains(o.Error, "instance 1 is starting") || !strings.Contains(o.Error, "rolled back to version 1") {
+		t.Fatalf("Should fail the upgrade with the unhealthy instance rolled back, got %+v", o)
+	}
+	pg, _ := engine.InspectPodGroup(single)
+	if pg.Spec.Version != 1 || pg.Spec.Pod.HealthConfig.Cmd != "" || pg.Pods[0].State != RunStateSuccess ||
+		!strings.HasPrefix(pg.Pods[0].Containers[0].Runtime.Name, "/"+single+".v1-") {
+		t.Errorf("Should run the instance with the last spec, got %+v", pg)
+	}
+
+	// the upgrade is paused on the first failed instance, the second one is not upgraded
+	paused := "hello.proc.web.paused"
+	pgSpec = createPodGroupSpec(namespace, paused, 2)
+	pgSpec.UpdateStrategy = UpdateStrategy{MaxSurge: 1}
+	if _, err := engine.NewPodGroup(pgSpec); err != nil {
+		t.Fatalf("Should be able to create the pod group, %s", err)
+	}
+	waitPodGroupState(t, engine, paused, RunStateSuccess)
+	pg, _ = engine.InspectPodGroup(paused)
+	secondId := pg.Pods[1].ContainerIds()[0]
+	if err := engine.ChangeFailurePolicy(paused, FailurePolicy{HealthDeadline: 1, Action: FailureActionPause}); err != nil {
+		t.Fatalf("Should be able to change the failure policy, %s", err)
+	}
+	for i := 0; ; i++ {
+		if operationId, err = engine.RescheduleSpec(paused, unhealthySpec(paused)); err == nil {
+			break
+		}
+		if i > 100 {
+			t.Fatalf("Should be able to reschedule the spec, %s", err)
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+	for i := 0; ; i++ {
+		if o, _ := engine.GetOperation(operationId); o.Status == OperationPaused {
+			break
+		}
+		if i > 100 {
+			t.Fatalf("Should pause the upgrade with the failed instance")
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+	pg, _ = engine.InspectPodGroup(paused)
+	if !strings.Contains(pg.LastError, "1 of the 1 upgraded instances failed") || pg.Pods[1].ContainerIds()[0] != secondId ||
+		!isRunning(secondId) {
+		t.Errorf("Should keep the second instance not upgraded with the failure, got %+v", pg)
+	}
+	if err := engine.CancelOperation(paused); err != nil {
+		t.Fatalf("Should be able to cancel the paused upgrade, %s", err)
+	}
+	if o := waitOperationEnded(t, engine, operationId); o.Status != OperationCancelled {
+		t.Errorf("Should cancel the paused upgrade, got %+v", o)
+	}
+}
@@ -7,13 +7,14 @@ import (
 	"strings"
 	"sync"
 
-	etcd "github.com/coreos/etcd/client"
+	"github.com/laincloud/deployd/storage"
 	"github.com/mijia/sweb/log"
-	"golang.org/x/net/context"
 )
 
 const (
 	KeyPrefixStreamPorts = "/lain/deployd/stream/ports"
+
+	kRefreshTxnMaxOps = 100 // etcd v3 rejects the txn with more than 128 ops by default
 )
 
 var (
@@ -21,9 +22,9 @@ var (
 	pm   *PortsManager
 )
 
-func ConfigPortsManager(endpoint string) {
+func ConfigPortsManager(store storage.Store) {
 	onceBody := func() {
-		pm = NewPortsManager(endpoint)
+		pm = NewPortsManager(store)
 	}
 	once.Do(onceBody)
 }
@@ -63,23 +64,14 @@ type StreamProc struct {
 }
 
 type PortsManager struct {
-	etcd *etcd.Client
-	lock *sync.Mutex
+	store storage.Store
+	lock  *sync.Mutex
 }
 
-func NewPortsManager(endpoint string) *PortsManager {
-	cfg := etcd.Config{
-		Endpoints: []string{endpoint},
-		Transport: etcd.DefaultTransport,
-	}
-	c, err := etcd.New(cfg)
-	if err != nil {
-		log.Errorf("NewPortsManager with error:%v\n", err)
-		return nil
-	}
+func NewPortsManager(store storage.Store) *PortsManager {
 	return &PortsManager{
-		etcd: &c,
-		lock: &sync.Mutex{},
+		store: store,
+		lock:  &sync.Mutex{},
 	}
 }
 
@@ -87,7 +79,7 @@ func (pm PortsManager) occupiedProcs(spArr ...*StreamProc) []int {
 	occs := make([]int, 0)
 	for _, sp := range spArr {
 		key := fmt.Sprintf(KeyPrefixStreamPorts+"/%d", sp.SrcPort)
-		if keyExists(pm.etcd, key) {
+		if keyExists(pm.store, key) {
 			occs = append(occs, sp.SrcPort)
 		}
 	}
@@ -98,7 +90,7 @@ func (pm PortsManager) occupiedPorts(ports ...int) []int {
 	occs := make([]int, 0)
 	for _, port := range ports {
 		key := fmt.Sprintf(KeyPrefixStreamPorts+"/%d", port)
-		if keyExists(pm.etcd, key) {
+		if keyExists(pm.store, key) {
 			occs = append(occs, port)
 		}
 	}
@@ -110,57 +102,75 @@ func (pm PortsManager) Refresh(pgCtrls map[string]*podGroupController) {
 	defer pm.lock.Unlock()
 	occs := make([]*StreamProc, 0)
 	for _, pgCtrl := range pgCtrls {
-		annotation := pgCtrl.spec.Pod.Annotation
-		var sps StreamPorts
-		if err := json.Unmarshal([]byte(annotation), &sps); err != nil {
-			continue
+		annotations := []string{pgCtrl.spec.Pod.Annotation}
+		if pgCtrl.spec.Canary != nil {
+			// the ports of the running canary are registered as well
+			annotations = append(annotations, pgCtrl.spec.Canary.Pod.Annotation)
 		}
-		for _, sp := range sps.Ports {
-			occs = append(occs, &StreamProc{
-				StreamPort: sp,
-				NameSpace:  pgCtrl.spec.Namespace,
-				ProcName:   pgCtrl.spec.Name,
-			})
+		procPorts := make(map[int]struct{})
+		for _, annotation := range annotations {
+			var sps StreamPorts
+			if err := json.Unmarshal([]byte(annotation), &sps); err != nil {
+				continue
+			}
+			for _, sp := range sps.Ports {
+				if _, ok := procPorts[sp.SrcPort]; ok {
+					continue
+				}
+				procPorts[sp.SrcPort] = struct{}{}
+				occs = append(occs, &StreamProc{
+					StreamPort: sp,
+					NameSpace:  pgCtrl.spec.Namespace,
+					ProcName:   pgCtrl.spec.Name,
+				})
+			}
 		}
 	}
 
-	for _, sp := range occs {
-		key := fmt.Sprintf(KeyPrefixStreamPorts+"/%d", sp.SrcPort)
-		putValue(pm.etcd, key, sp, true)
-	}
-
-	markedPorts, err := fetchAll(pm.etcd, KeyPrefixStreamPorts)
+	markedPorts, err := fetchAll(pm.store, KeyPrefixStreamPorts)
 	if err != nil {
 		return
 	}
 	portsSets := make(map[int]struct{})
-	for _, port := range occs {
-		portsSets[port.SrcPort] = struct{}{}
+	txn := storage.NewTxn()
+	for _, sp := range occs {
+		if _, ok := portsSets[sp.SrcPort]; ok {
+			log.Warnf("Stream port %d is declared by more than one proc, ignore it in %s", sp.SrcPort, sp.ProcName)
+			continue
+		}
+		key := fmt.Sprintf(KeyPrefixStreamPorts+"/%d", sp.SrcPort)
+		txn.Set(key, sp)
+		portsSets[sp.SrcPort] = struct{}{}
 	}
-	garbagePorts := make([]int, 0)
 	for _, port := range markedPorts {
 		if _, ok := portsSets[port]; !ok {
-			garbagePorts = append(garbagePorts, port)
+			key := fmt.Sprintf(KeyPrefixStreamPorts+"/%d", port)
+			txn.Remove(key)
 		}
 	}
-	for _, port := range garbagePorts {
-		key := fmt.Sprintf(KeyPrefixStreamPorts+"/%d", port)
-		delValue(pm.etcd, key)
+	// the refreshing needs not to be atomic, commit it in chunks under the limit of the ops in a txn of etcd v3
+	for start := 0; start < len(txn.Ops); start += kRefreshTxnMaxOps {
+		end := start + kRefreshTxnMaxOps
+		if end > len(txn.Ops) {
+			end = len(txn.Ops)
+		}
+		chunk := storage.NewTxn()
+		chunk.Ops = txn.Ops[start:end]
+		commitTxn(pm.store, chunk)
 	}
 }
 
+// RegisterStreamPorts registers all the ports or none of them if any port is occupied
 func (pm PortsManager) RegisterStreamPorts(spArr ...*StreamProc) (bool, []int) {
 	pm.lock.Lock()
 	defer pm.lock.Unlock()
-	succeedArr := make([]*StreamProc, 0, len(spArr))
+	txn := storage.NewTxn()
 	for _, sp := range spArr {
-		if !pm.RegisterStreamPort(sp) {
-			for _, succeed := range succeedArr {
-				pm.CancelStreamPort(succeed)
-			}
-			return false, pm.occupiedProcs(spArr...)
-		}
-		succeedArr = append(succeedArr, sp)
+		key := fmt.Sprintf(KeyPrefixStreamPorts+"/%d", sp.SrcPort)
+		txn.IfAbsent(key).Set(key, sp)
+	}
+	if !commitTxn(pm.store, txn) {
+		return false, pm.occupiedProcs(spArr...)
 	}
 	return true, nil
 }
@@ -168,23 +178,29 @@ func (pm PortsManager) RegisterStreamPorts(spArr ...*StreamProc) (bool, []int) {
 func (pm PortsManager) UpdateStreamPorts(spArr ...*StreamProc) {
 	pm.lock.Lock()
 	defer pm.lock.Unlock()
+	txn := storage.NewTxn()
 	for _, sp := range spArr {
-		pm.UpdateStreamPort(sp)
+		key := fmt.Sprintf(KeyPrefixStreamPorts+"/%d", sp.SrcPort)
+		txn.Set(key, sp)
 	}
+	commitTxn(pm.store, txn)
 }
 
 func (pm PortsManager) CancelStreamPorts(spArr ...*StreamProc) {
 	pm.lock.Lock()
 	defer pm.lock.Unlock()
+	txn := storage.NewTxn()
 	for _, sp := range spArr {
-		pm.CancelStreamPort(sp)
+		key := fmt.Sprintf(KeyPrefixStreamPorts+"/%d", sp.SrcPort)
+		txn.Remove(key)
 	}
+	commitTxn(pm.store, txn)
 }
 
 func (pm PortsManager) FetchAllStreamPortsInfo() []StreamProc {
 	pm.lock.Lock()
 	defer pm.lock.Unlock()
-	ports, err := fetchAllInfo(pm.etcd, KeyPrefixStreamPorts)
+	ports, err := fetchAllInfo(pm.store, KeyPrefixStreamPorts)
 	if err != nil {
 		return nil
 	}
@@ -193,17 +209,17 @@ func (pm PortsManager) FetchAllStreamPortsInfo() []StreamProc {
 
 func (pm PortsManager) RegisterStreamPort(sp *StreamProc) bool {
 	key := fmt.Sprintf(KeyPrefixStreamPorts+"/%d", sp.SrcPort)
-	return putValue(pm.etcd, key, sp, false)
+	return putValue(pm.store, key, sp, false)
 }
 
 func (pm *PortsManager) UpdateStreamPort(sp *StreamProc) bool {
 	key := fmt.Sprintf(KeyPrefixStreamPorts+"/%d", sp.SrcPort)
-	return putValue(pm.etcd, key, sp, true)
+	return putValue(pm.store, key, sp, true)
 }
 
 func (pm *PortsManager) CancelStreamPort(sp *StreamProc) bool {
 	key := fmt.Sprintf(KeyPrefixStreamPorts+"/%d", sp.SrcPort)
-	return delValue(pm.etcd, key)
+	return delValue(pm.store, key)
 }
 
 func RegisterPorts(sps ...*StreamProc) (bool, []int) {
@@ -230,56 +246,51 @@ func RefreshPorts(pgCtrls map[string]*podGroupController) {
 	pm.Refresh(pgCtrls)
 }
 
-func keyExists(e *etcd.Client, key string) bool {
-	kapi := etcd.NewKeysAPI(*e)
+func keyExists(store storage.Store, key string) bool {
 	return storeOp(func() (bool, error) {
-		resp, err := kapi.Get(context.Background(), key, &etcd.GetOptions{Quorum: true})
+		value, err := store.GetRaw(key)
 		if err != nil {
-			if etcdErr, ok := err.(etcd.Error); ok {
-				switch etcdErr.Code {
-				case etcd.ErrorCodeKeyNotFound:
-					return false, nil
-				default:
-					return false, err
-				}
+			if err == storage.KMissingError {
+				return false, nil
 			}
 			return false, err
 		}
-		if resp == nil || resp.Node == nil || resp.Node.Value == "" {
-			return false, nil
-		}
-		return true, nil
+		return value != "", nil
 	})
 }
 
-func fetchAllInfo(e *etcd.Client, key string) ([]StreamProc, error) {
-	kapi := etcd.NewKeysAPI(*e)
-	resp, err := kapi.Get(context.Background(), key, &etcd.GetOptions{Recursive: true, Quorum: true})
+func fetchAllInfo(store storage.Store, key string) ([]StreamProc, error) {
+	keys, err := store.KeysByPrefix(key)
 	if err != nil {
+		if err == storage.KMissingError {
+			return []StreamProc{}, nil
+		}
 		return nil, err
 	}
-	portsInfo := make([]StreamProc, 0, len(resp.Node.Nodes))
+	portsInfo := make([]StreamProc, 0, len(keys))
 
 	var sp StreamProc
-	for _, node := range resp.Node.Nodes {
-		json.Unmarshal([]byte(node.Value), &sp)
-		portsInfo = append(portsInfo, sp)
+	for _, key := range keys {
+		if err := store.Get(key, &sp); err == nil {
+			portsInfo = append(portsInfo, sp)
+		}
 	}
 	return portsInfo, nil
 }
 
-func fetchAll(e *etcd.Client, key string) ([]int, error) {
-	kapi := etcd.NewKeysAPI(*e)
-	resp, err := kapi.Get(context.Background(), key, &etcd.GetOptions{Recursive: true, Quorum: true})
+func fetchAll(store storage.Store, key string) ([]int, error) {
+	keys, err := store.KeysByPrefix(key)
 	if err != nil {
+		if err == storage.KMissingError {
+			return []int{}, nil
+		}
 		return nil, err
 	}
-	ports := make([]int, 0, len(resp.Node.Nodes))
-	for _, node := range resp.Node.Nodes {
-		key := node.Key
+	ports := make([]int, 0, len(keys))
+	for _, key := range keys {
 		infos := strings.Split(key, "/")
 		if len(infos) > 0 {
-			if port, err := strconv.Atoi(strings.Split(key, "/")[len(infos)-1]); err == nil {
+			if port, err := strconv.Atoi(infos[len(infos)-1]); err == nil {
 				ports = append(ports, port)
 			}
 		}
@@ -287,42 +298,41 @@ func fetchAll(e *etcd.Client, key string) ([]int, error) {
 	return ports, nil
 }
 
-func putValue(e *etcd.Client, key string, value interface{}, force bool) bool {
-	kapi := etcd.NewKeysAPI(*e)
-	bytes, err := json.Marshal(value)
-	if err != nil {
-		return false
-	}
+func putValue(store storage.Store, key string, value interface{}, force bool) bool {
 	return storeOp(func() (bool, error) {
-		var opts *etcd.SetOptions = nil
 		if !force {
-			opts = &etcd.SetOptions{PrevExist: etcd.PrevNoExist}
-		}
-		_, err := kapi.Set(
-			context.Background(),
-			key, string(bytes),
-			opts,
-		)
-		if err != nil {
-			if etcdErr, ok := err.(etcd.Error); ok {
-				switch etcdErr.Code {
-				case etcd.ErrorCodeNodeExist:
+			if _, err := store.SetIfAbsent(key, value, 0); err != nil {
+				if err == storage.KKeyExistsError {
 					return false, nil
-				default:
-					log.Errorf("set key %v failed with error:%v", key, err)
 				}
+				log.Errorf("set key %v failed with error:%v", key, err)
+				return false, err
 			}
+			return true, nil
+		}
+		if err := store.Set(key, value, true); err != nil {
+			log.Errorf("set key %v failed with error:%v", key, err)
 			return false, err
 		}
 		return true, nil
 	})
 }
 
-func delValue(e *etcd.Client, key string) bool {
-	kapi := etcd.NewKeysAPI(*e)
+func delValue(store storage.Store, key string) bool {
 	return storeOp(func() (bool, error) {
-		_, err := kapi.Delete(context.Background(), key, nil)
-		if err != nil {
+		if err := store.Remove(key); err != nil {
+			return false, err
+		}
+		return true, nil
+	})
+}
+
+func commitTxn(store storage.Store, txn *storage.Txn) bool {
+	return storeOp(func() (bool, error) {
+		if err := store.Commit(txn); err != nil {
+			if err == storage.KTxnFailedError {
+				return false, nil
+			}
 			return false, err
 		}
 		return true, nil
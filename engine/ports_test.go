@@ -1,14 +1,19 @@
 package engine
 
 import (
+	"encoding/json"
+	"errors"
 	"fmt"
 	"strconv"
 	"testing"
+
+	"github.com/laincloud/deployd/storage"
+	"github.com/laincloud/deployd/storage/memory"
 )
 
 func TestRegisterPorts(t *testing.T) {
 	fmt.Println("Start")
-	ConfigPortsManager("http://127.0.0.1:2379")
+	ConfigPortsManager(memory.NewStore())
 	test := make([]*StreamProc, 0)
 	for i := 0; i < 2; i++ {
 		test = append(test, &StreamProc{
@@ -27,3 +32,66 @@ func TestRegisterPorts(t *testing.T) {
 	}
 	CancelPorts(test...)
 }
+
+func TestRegisterPortsConflict(t *testing.T) {
+	pm := NewPortsManager(memory.NewStore())
+	hello := &StreamProc{StreamPort: StreamPort{SrcPort: 9001, DstPort: 9001, Proto: "tcp"}, NameSpace: "hello", ProcName: "hello.proc.web.web"}
+	world := &StreamProc{StreamPort: StreamPort{SrcPort: 9002, DstPort: 9002, Proto: "tcp"}, NameSpace: "world", ProcName: "world.proc.web.web"}
+	if ok, _ := pm.RegisterStreamPorts(hello); !ok {
+		t.Fatalf("Should be able to register the port 9001")
+	}
+	ok, occupied := pm.RegisterStreamPorts(world, hello)
+	if ok || len(occupied) != 1 || occupied[0] != 9001 {
+		t.Errorf("Should get the occupied port 9001, but got %v", occupied)
+	}
+	if infos := pm.FetchAllStreamPortsInfo(); len(infos) != 1 || infos[0].NameSpace != "hello" {
+		t.Errorf("Nothing should be registered when any port is occupied, but got %v", infos)
+	}
+	pm.CancelStreamPorts(hello)
+	if ok, _ := pm.RegisterStreamPorts(world, hello); !ok {
+		t.Errorf("Should be able to register the ports after canceled")
+	}
+}
+
+// etcdv3TxnStore rejects the txns as etcd v3 does, with more than 128 ops or with the same key twice
+type etcdv3TxnStore struct {
+	storage.Store
+}
+
+func (store etcdv3TxnStore) Commit(txn *storage.Txn) error {
+	if len(txn.Ops) > 128 {
+		return errors.New("too many operations in txn request")
+	}
+	keys := make(map[string]bool, len(txn.Ops))
+	for _, op := range txn.Ops {
+		if keys[op.Key] {
+			return errors.New("duplicate key given in txn request")
+		}
+		keys[op.Key] = true
+	}
+	return store.Store.Commit(txn)
+}
+
+func TestRefreshPortsInChunks(t *testing.T) {
+	store := etcdv3TxnStore{memory.NewStore()}
+	pm := NewPortsManager(store)
+	for port := 8000; port < 8010; port++ {
+		store.Set(fmt.Sprintf(KeyPrefixStreamPorts+"/%d", port), StreamProc{}, true)
+	}
+	pgCtrls := make(map[string]*podGroupController)
+	for i := 0; i < 150; i++ {
+		name := fmt.Sprintf("hello.proc.stream%d", i)
+		ports := StreamPorts{Ports: []StreamPort{{SrcPort: 9000 + i, DstPort: 9000, Proto: "tcp"}}}
+		if i == 149 {
+			ports.Ports[0].SrcPort = 9000 // declared twice
+		}
+		annotation, _ := json.Marshal(ports)
+		spec := createPodGroupSpec("hello", name, 1)
+		spec.Pod.Annotation = string(annotation)
+		pgCtrls[name] = &podGroupController{spec: spec}
+	}
+	pm.Refresh(pgCtrls)
+	if ports, _ := fetchAll(store, KeyPrefixStreamPorts); len(ports) != 149 {
+		t.Errorf("Should register 149 ports and remove the stale ones, got %d ports", len(ports))
+	}
+}
@@ -0,0 +1,265 @@
+package engine
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/laincloud/deployd/cluster"
+	"github.com/laincloud/deployd/storage"
+	"github.com/mijia/go-generics"
+	"github.com/mijia/sweb/log"
+)
+
+const (
+	kLainRevisionKey = "revisions"
+
+	DefaultRevisionsKept = 30
+)
+
+var (
+	ErrRevisionNotExists = errors.New("Spec revision not existed")
+)
+
+// SpecRevision is the pod group spec accepted by a deploy or a spec reschedule, the revisions are numbered
+// from 1 for each pod group and the latest DefaultRevisionsKept revisions are kept in the store.
+type SpecRevision struct {
+	Revision  int          `json:"revision"`
+	CreatedAt time.Time    `json:"created_at"`
+	Requester string       `json:"requester"`
+	Summary   string       `json:"summary"`
+	Spec      PodGroupSpec `json:"spec"`
+}
+
+type pgOperSaveRevision struct {
+	spec    PodGroupSpec
+	summary string
+}
+
+func (op pgOperSaveRevision) Do(pgCtrl *podGroupController, c cluster.Cluster, store storage.Store, ev *RuntimeEagleView) bool {
+	var (
+		_err     error
+		revision int
+	)
+	start := time.Now()
+	defer func() {
+		pgCtrl.RLock()
+		log.Infof("%s save revision, revision=%d, summary=%q, err=%v, duration=%s", pgCtrl, revision, op.summary, _err, time.Now().Sub(start))
+		pgCtrl.RUnlock()
+	}()
+	revisions, err := revisionNumbers(store, op.spec.Namespace, op.spec.Name)
+	if err != nil {
+		_err = err
+		return false
+	}
+	revision = 1
+	if len(revisions) > 0 {
+		revision = revisions[len(revisions)-1] + 1
+	}
+	rev := SpecRevision{
+		Revision:  revision,
+		CreatedAt: time.Now(),
+		Requester: op.spec.Pod.UpdatedBy,
+		Summary:   op.summary,
+		Spec:      op.spec,
+	}
+	key := revisionKey(op.spec.Namespace, op.spec.Name, revision)
+	if _, err := store.SetIfAbsent(key, rev, 0); err != nil {
+		log.Warnf("[Store] Failed to save spec revision %s, %s", key, err)
+		_err = err
+		return false
+	}
+	for len(revisions) >= DefaultRevisionsKept {
+		store.Remove(revisionKey(op.spec.Namespace, op.spec.Name, revisions[0]))
+		revisions = revisions[1:]
+	}
+	return false
+}
+
+type pgOperRemoveRevisions struct{}
+
+func (op pgOperRemoveRevisions) Do(pgCtrl *podGroupController, c cluster.Cluster, store storage.Store, ev *RuntimeEagleView) bool {
+	pgCtrl.RLock()
+	spec := pgCtrl.spec
+	pgCtrl.RUnlock()
+	if err := store.RemoveDir(revisionDir(spec.Namespace, spec.Name)); err != nil && err != storage.KMissingError {
+		log.Warnf("[Store] Failed to remove the spec revisions of %s, %s", spec.Name, err)
+	}
+	store.TryRemoveDir(strings.Join([]string{kLainDeploydRootKey, kLainRevisionKey, spec.Namespace}, "/"))
+	return false
+}
+
+// ListRevisions returns the kept spec revisions of the pod group from the oldest to the latest
+func (engine *OrcEngine) ListRevisions(name string) ([]SpecRevision, error) {
+	namespace, err := engine.podGroupNamespace(name)
+	if err != nil {
+		return nil, err
+	}
+	revisions, err := revisionNumbers(engine.store, namespace, name)
+	if err != nil {
+		return nil, err
+	}
+	result := make([]SpecRevision, 0, len(revisions))
+	for _, revision := range revisions {
+		var rev SpecRevision
+		if err := engine.store.Get(revisionKey(namespace, name, revision), &rev); err == nil {
+			result = append(result, rev)
+		}
+	}
+	return result, nil
+}
+
+// RollbackRevision reschedules the pod group to the pod spec of the revision, which is accepted as
+// a new revision like any other spec reschedule.
+func (engine *OrcEngine) RollbackRevision(name string, revision int, requester string) (string, error) {
+	namespace, err := engine.podGroupNamespace(name)
+	if err != nil {
+		return "", err
+	}
+	var rev SpecRevision
+	if err := engine.store.Get(revisionKey(namespace, name, revision), &rev); err != nil {
+		if err == storage.KMissingError {
+			return "", ErrRevisionNotExists
+		}
+		return "", err
+	}
+	podSpec := rev.Spec.Pod.Clone()
+	podSpec.UpdatedBy = requester
+	return engine.RescheduleSpec(name, podSpec)
+}
+
+// lastRevisionSpec returns the spec to roll the failed upgrade back to, which runs the pod spec of the latest
+// revision before the version upgraded to, nil if there is no such revision kept.
+func (pgCtrl *podGroupController) lastRevisionSpec(store storage.Store) *PodGroupSpec {
+	pgCtrl.RLock()
+	spec := pgCtrl.spec.Clone()
+	pgCtrl.RUnlock()
+	upgraded := spec.Version
+	if spec.Canary != nil {
+		upgraded = spec.Canary.Version
+	}
+	revisions, err := revisionNumbers(store, spec.Namespace, spec.Name)
+	if err != nil {
+		log.Warnf("[Store] Failed to list the spec revisions of %s, %s", spec.Name, err)
+		return nil
+	}
+	for i := len(revisions) - 1; i >= 0; i -= 1 {
+		var rev SpecRevision
+		if err := store.Get(revisionKey(spec.Namespace, spec.Name, revisions[i]), &rev); err != nil ||
+			rev.Spec.Version >= upgraded {
+			continue
+		}
+		spec.Pod, spec.Version, spec.Canary = rev.Spec.Pod, rev.Spec.Version, nil
+		return &spec
+	}
+	return nil
+}
+
+func (engine *OrcEngine) podGroupNamespace(name string) (string, error) {
+	engine.RLock()
+	defer engine.RUnlock()
+	if pgCtrl, ok := engine.pgCtrls[name]; !ok {
+		return "", ErrPodGroupNotExists
+	} else {
+		pgCtrl.RLock()
+		defer pgCtrl.RUnlock()
+		return pgCtrl.spec.Namespace, nil
+	}
+}
+
+func revisionDir(namespace, name string) string {
+	return strings.Join([]string{kLainDeploydRootKey, kLainRevisionKey, namespace, name}, "/")
+}
+
+func revisionKey(namespace, name string, revision int) string {
+	return fmt.Sprintf("%s/%d", revisionDir(namespace, name), revision)
+}
+
+// revisionNumbers returns the sorted revision numbers of the pod group kept in the store
+func revisionNumbers(store storage.Store, namespace, name string) ([]int, error) {
+	dir := revisionDir(namespace, name)
+	keys, err := store.KeysByPrefix(dir)
+	if err != nil && err != storage.KMissingError {
+		return nil, err
+	}
+	revisions := make([]int, 0, len(keys))
+	for _, key := range keys {
+		if revision, err := strconv.Atoi(strings.TrimPrefix(key, dir+"/")); err == nil {
+			revisions = append(revisions, revision)
+		}
+	}
+	sort.Ints(revisions)
+	return revisions, nil
+}
+
+// specChangeSummary tells which parts of the pod spec are changed, e.g. "container[0].Image: a => b; Filters"
+func specChangeSummary(oldSpec, newSpec PodSpec) string {
+	changes := make([]string, 0)
+	if len(oldSpec.Containers) != len(newSpec.Containers) {
+		changes = append(changes, fmt.Sprintf("#containers: %d => %d", len(oldSpec.Containers), len(newSpec.Containers)))
+	}
+	for i := 0; i < len(oldSpec.Containers) && i < len(newSpec.Containers); i += 1 {
+		o, n := oldSpec.Containers[i], newSpec.Containers[i]
+		prefix := fmt.Sprintf("container[%d].", i)
+		if o.Image != n.Image {
+			changes = append(changes, fmt.Sprintf("%sImage: %s => %s", prefix, o.Image, n.Image))
+		}
+		if o.MemoryLimit != n.MemoryLimit {
+			changes = append(changes, fmt.Sprintf("%sMemoryLimit: %d => %d", prefix, o.MemoryLimit, n.MemoryLimit))
+		}
+		if o.CpuLimit != n.CpuLimit {
+			changes = append(changes, fmt.Sprintf("%sCpuLimit: %d => %d", prefix, o.CpuLimit, n.CpuLimit))
+		}
+		if o.Expose != n.Expose {
+			changes = append(changes, fmt.Sprintf("%sExpose: %d => %d", prefix, o.Expose, n.Expose))
+		}
+		if !equalPorts(o.Ports, n.Ports) {
+			changes = append(changes, prefix+"Ports")
+		}
+		if !generics.Equal_StringSlice(o.Command, n.Command) || !generics.Equal_StringSlice(o.Entrypoint, n.Entrypoint) {
+			changes = append(changes, prefix+"Command")
+		}
+		if !generics.Equal_StringSlice(o.Env, n.Env) {
+			changes = append(changes, prefix+"Env")
+		}
+		if !generics.Equal_StringSlice(o.Volumes, n.Volumes) || !generics.Equal_StringSlice(o.SystemVolumes, n.SystemVolumes) {
+			changes = append(changes, prefix+"Volumes")
+		}
+	}
+	if !generics.Equal_StringSlice(oldSpec.Filters, newSpec.Filters) {
+		changes = append(changes, "Filters")
+	}
+	if !generics.Equal_StringStringMap(oldSpec.Labels, newSpec.Labels) {
+		changes = append(changes, "Labels")
+	}
+	if oldSpec.Annotation != newSpec.Annotation {
+		changes = append(changes, "Annotation")
+	}
+	if oldSpec.Stateful != newSpec.Stateful {
+		changes = append(changes, fmt.Sprintf("Stateful: %v => %v", oldSpec.Stateful, newSpec.Stateful))
+	}
+	if len(oldSpec.Dependencies) != len(newSpec.Dependencies) {
+		changes = append(changes, "Dependencies")
+	} else {
+		for i := range oldSpec.Dependencies {
+			if oldSpec.Dependencies[i] != newSpec.Dependencies[i] {
+				changes = append(changes, "Dependencies")
+				break
+			}
+		}
+	}
+	if oldSpec.SetupTime != newSpec.SetupTime || oldSpec.KillTimeout != newSpec.KillTimeout ||
+		!oldSpec.HealthConfig.Equals(newSpec.HealthConfig) {
+		changes = append(changes, "HealthConfig")
+	}
+	if !equalContainers(oldSpec.InitContainers, newSpec.InitContainers) || oldSpec.InitTimeout != newSpec.InitTimeout {
+		changes = append(changes, "InitContainers")
+	}
+	if len(changes) == 0 {
+		return "No changes"
+	}
+	return strings.Join(changes, "; ")
+}
@@ -0,0 +1,80 @@
+package engine
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestSpecRevisions(t *testing.T) {
+	engine, _, _ := initFakeEngine(t, 2)
+	defer engine.Stop()
+
+	namespace, name := "hello", "hello.proc.web.web"
+	pgSpec := createPodGroupSpec(namespace, name, 1)
+	pgSpec.UpdateStrategy = UpdateStrategy{MaxSurge: 1}
+	pgSpec.Pod.UpdatedBy = "alice"
+	if _, err := engine.NewPodGroup(pgSpec); err != nil {
+		t.Fatalf("Should be able to create the pod group, %s", err)
+	}
+	waitPodGroupState(t, engine, name, RunStateSuccess)
+
+	podSpec := createPodSpec(namespace, name)
+	podSpec.Containers[0].Command = []string{"/bin/sh", "-c", "sleep 3600"}
+	podSpec.UpdatedBy = "bob"
+	if _, err := engine.RescheduleSpec(name, podSpec); err != nil {
+		t.Fatalf("Should be able to reschedule the spec, %s", err)
+	}
+	revisions := waitRevisions(t, engine, name, 2)
+	if revisions[0].Revision != 1 || revisions[0].Requester != "alice" || revisions[0].Summary != "Deployed" {
+		t.Errorf("Should record the deploy as the first revision, got %+v", revisions[0])
+	}
+	if revisions[1].Revision != 2 || revisions[1].Requester != "bob" || revisions[1].Summary != "container[0].Command" {
+		t.Errorf("Should record the spec change as the second revision, got %+v", revisions[1])
+	}
+
+	if _, err := engine.RollbackRevision(name, 9, "carol"); err != ErrRevisionNotExists {
+		t.Errorf("Should not roll back to a missing revision, got %v", err)
+	}
+	// wait for the last reschedule to be over before rolling back
+	waitPodGroupState(t, engine, name, RunStateSuccess)
+	for i := 0; ; i++ {
+		if _, err := engine.RollbackRevision(name, 1, "carol"); err == nil {
+			break
+		}
+		if i > 100 {
+			t.Fatalf("Should be able to roll back to the first revision")
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+	revisions = waitRevisions(t, engine, name, 3)
+	rolledBack := revisions[2]
+	if rolledBack.Requester != "carol" || !strings.Contains(rolledBack.Spec.Pod.Containers[0].Command[2], "Hello world") {
+		t.Errorf("Should reschedule the pod spec of the first revision as a new revision, got %+v", rolledBack)
+	}
+
+	if _, err := engine.RemovePodGroup(name); err != nil {
+		t.Fatalf("Should be able to remove the pod group, %s", err)
+	}
+	for i := 0; ; i++ {
+		if keys, _ := engine.store.KeysByPrefix(revisionDir(namespace, name)); len(keys) == 0 {
+			break
+		}
+		if i > 100 {
+			t.Fatalf("Should remove the revisions with the pod group")
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+}
+
+func waitRevisions(t *testing.T, engine *OrcEngine, name string, count int) []SpecRevision {
+	for i := 0; ; i++ {
+		if revisions, err := engine.ListRevisions(name); err == nil && len(revisions) == count {
+			return revisions
+		}
+		if i > 100 {
+			t.Fatalf("Pod group %s should have %d revisions", name, count)
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+}
@@ -141,23 +141,46 @@ type BaseRuntime struct {
 	UpdatedAt time.Time
 }
 
+// PortMapping is an exposed port of the container and the port it is published on the node
+type PortMapping struct {
+	Name          string
+	NodePort      int
+	ContainerPort int
+	Protocol      string
+}
+
 type Container struct {
-	// FIXME(mijia): multiple ports supporing, will have multiple entries of <NodePort, ContainerPort, Protocol>
 	Id            string
 	Runtime       adoc.ContainerDetail
 	NodeName      string
 	NodeIp        string
 	ContainerIp   string
-	NodePort      int
+	NodePort      int // NodePort, ContainerPort and Protocol are of the main port
 	ContainerPort int
 	Protocol      string
+	Ports         []PortMapping
 }
 
 func (c Container) Clone() Container {
 	// So far we maybe only care about the basic information like in the Equals
+	if c.Ports != nil {
+		c.Ports = append([]PortMapping{}, c.Ports...)
+	}
 	return c
 }
 
+func equalPortMappings(a, b []PortMapping) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
 func (c Container) Equals(o Container) bool {
 	// The ContainerDetail from adoc change would reflect to the Pod runtime changes
 	return c.Id == o.Id &&
@@ -166,13 +189,16 @@ func (c Container) Equals(o Container) bool {
 		c.ContainerIp == o.ContainerIp &&
 		c.NodePort == o.NodePort &&
 		c.ContainerPort == o.ContainerPort &&
-		c.Protocol == o.Protocol
+		c.Protocol == o.Protocol &&
+		equalPortMappings(c.Ports, o.Ports)
 }
 
 type Pod struct {
 	InstanceNo int
 	Containers []Container
+	InitError  string `json:",omitempty"` // why the init containers failed, the containers were not created then
 	ImRuntime
+	CompletedAt time.Time // when the job pod finished and was counted, zero while it is running
 }
 
 func (p Pod) Clone() Pod {
@@ -254,7 +280,13 @@ func (pod *Pod) ChangeTargetState(state ExpectState) {
 }
 
 type PodGroup struct {
-	Pods []Pod
+	Pods      []Pod
+	GreenPods []Pod      `json:",omitempty"` // the new pods of the blue-green deployment not switched to yet
+	Job       *JobStatus `json:",omitempty"` // the completions of the job pod group
+	// the old pods switched from by the blue-green deployment, removed at RetireAt
+	RetiredPods    []Pod `json:",omitempty"`
+	RetiredVersion int   `json:",omitempty"`
+	RetireAt       time.Time
 	BaseRuntime
 }
 
@@ -264,11 +296,27 @@ func (pg PodGroup) Clone() PodGroup {
 	for i := range pg.Pods {
 		n.Pods[i] = pg.Pods[i].Clone()
 	}
+	if pg.GreenPods != nil {
+		n.GreenPods = make([]Pod, len(pg.GreenPods))
+		for i := range pg.GreenPods {
+			n.GreenPods[i] = pg.GreenPods[i].Clone()
+		}
+	}
+	if pg.RetiredPods != nil {
+		n.RetiredPods = make([]Pod, len(pg.RetiredPods))
+		for i := range pg.RetiredPods {
+			n.RetiredPods[i] = pg.RetiredPods[i].Clone()
+		}
+	}
+	if pg.Job != nil {
+		job := *pg.Job
+		n.Job = &job
+	}
 	return n
 }
 
 func (pg PodGroup) Equals(o PodGroup) bool {
-	if len(pg.Pods) != len(o.Pods) {
+	if len(pg.Pods) != len(o.Pods) || len(pg.GreenPods) != len(o.GreenPods) || len(pg.RetiredPods) != len(o.RetiredPods) {
 		return false
 	}
 	for i := range pg.Pods {
@@ -276,8 +324,23 @@ func (pg PodGroup) Equals(o PodGroup) bool {
 			return false
 		}
 	}
+	for i := range pg.GreenPods {
+		if !pg.GreenPods[i].Equals(o.GreenPods[i]) {
+			return false
+		}
+	}
+	for i := range pg.RetiredPods {
+		if !pg.RetiredPods[i].Equals(o.RetiredPods[i]) {
+			return false
+		}
+	}
+	if (pg.Job == nil) != (o.Job == nil) || (pg.Job != nil && *pg.Job != *o.Job) {
+		return false
+	}
 	return pg.State == o.State &&
-		pg.LastError == o.LastError
+		pg.LastError == o.LastError &&
+		pg.RetiredVersion == o.RetiredVersion &&
+		pg.RetireAt.Equal(o.RetireAt)
 }
 
 func (group PodGroup) collectNodes() map[string]string {
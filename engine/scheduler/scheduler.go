@@ -0,0 +1,189 @@
+package scheduler
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/laincloud/deployd/cluster"
+	"github.com/laincloud/deployd/utils/units"
+)
+
+var (
+	ErrNoNodeAvailable = errors.New("No node available in the cluster")
+)
+
+// Request is what to be placed, the filters are the swarm styled constraint and affinity expressions,
+// like `constraint:node!=node1` or `affinity:cc.bdp.lain.deployd.pg_name!=~hello.proc.web.web`.
+type Request struct {
+	Name    string
+	Filters []string
+	Memory  int64
+	CPUs    int
+}
+
+// Pod is a container already placed in the cluster, the affinities are evaluated against them
+type Pod struct {
+	Id     string
+	Name   string
+	Node   string
+	Image  string
+	Labels map[string]string
+}
+
+type Rejection struct {
+	Node   string `json:"node"`
+	Reason string `json:"reason"`
+}
+
+// Decision is the picked node with the reasons why all the other nodes were not picked,
+// Ignored are the soft filters which none of the fit nodes satisfies.
+type Decision struct {
+	Node       string      `json:"node"`
+	Rejections []Rejection `json:"rejections"`
+	Ignored    []string    `json:"ignored"`
+}
+
+func (d Decision) Explain() string {
+	reasons := make([]string, 0, len(d.Rejections)+len(d.Ignored))
+	for _, r := range d.Rejections {
+		reasons = append(reasons, fmt.Sprintf("%s: %s", r.Node, r.Reason))
+	}
+	for _, filter := range d.Ignored {
+		reasons = append(reasons, fmt.Sprintf("ignored %s", filter))
+	}
+	return strings.Join(reasons, "; ")
+}
+
+func (d *Decision) reject(node cluster.Node, format string, args ...interface{}) {
+	d.Rejections = append(d.Rejections, Rejection{node.Name, fmt.Sprintf(format, args...)})
+}
+
+// Schedule picks the node for the request:
+//  1. the hard constraints and affinities rule out the nodes which do not satisfy them
+//  2. the nodes without enough spare memory or cpus are ruled out
+//  3. every soft filter narrows down the nodes left if any of them satisfies it, or it is ignored
+//  4. the node with the least containers is picked, then the one with the most spare memory
+//
+// Label constraints cannot be evaluated on the nodes without labels reported by the cluster, they are
+// left to the cluster backend which still gets the filters when creating the containers.
+func Schedule(req Request, nodes []cluster.Node, pods []Pod) (Decision, error) {
+	decision := Decision{Rejections: make([]Rejection, 0), Ignored: make([]string, 0)}
+	filters, _, err := cluster.ParseFilters(req.Filters)
+	if err != nil {
+		return decision, err
+	}
+	if len(nodes) == 0 {
+		return decision, ErrNoNodeAvailable
+	}
+	podsByNode := make(map[string][]Pod)
+	for _, pod := range pods {
+		podsByNode[pod.Node] = append(podsByNode[pod.Node], pod)
+	}
+
+	candidates := make([]cluster.Node, 0, len(nodes))
+	for _, node := range nodes {
+		if filter, ok := firstUnsatisfied(node, podsByNode[node.Name], filters); ok {
+			decision.reject(node, "does not satisfy %s", filter)
+			continue
+		}
+		if req.Memory > 0 && node.Memory > 0 && node.SpareMemory() < req.Memory {
+			decision.reject(node, "not enough memory, requires %s but %s spare",
+				units.BytesSize(float64(req.Memory)), units.BytesSize(float64(node.SpareMemory())))
+			continue
+		}
+		if req.CPUs > 0 && node.CPUs > 0 && node.SpareCPUs() < req.CPUs {
+			decision.reject(node, "not enough cpus, requires %d but %d spare", req.CPUs, node.SpareCPUs())
+			continue
+		}
+		candidates = append(candidates, node)
+	}
+	if len(candidates) == 0 {
+		return decision, fmt.Errorf("No node fits %s, %s", req.Name, decision.Explain())
+	}
+
+	for _, filter := range filters {
+		if !filter.Soft {
+			continue
+		}
+		satisfied := make([]cluster.Node, 0, len(candidates))
+		for _, node := range candidates {
+			if satisfies(node, podsByNode[node.Name], filter) {
+				satisfied = append(satisfied, node)
+			}
+		}
+		if len(satisfied) == 0 {
+			decision.Ignored = append(decision.Ignored, filter.String())
+			continue
+		}
+		for _, node := range candidates {
+			if !satisfies(node, podsByNode[node.Name], filter) {
+				decision.reject(node, "does not satisfy the preferred %s", filter)
+			}
+		}
+		candidates = satisfied
+	}
+
+	sort.Sort(bySpread(candidates))
+	picked := candidates[0]
+	for _, node := range candidates[1:] {
+		decision.reject(node, "has %d containers and %s spare memory, %s has %d containers and %s spare memory",
+			node.Containers, units.BytesSize(float64(node.SpareMemory())),
+			picked.Name, picked.Containers, units.BytesSize(float64(picked.SpareMemory())))
+	}
+	decision.Node = picked.Name
+	return decision, nil
+}
+
+func firstUnsatisfied(node cluster.Node, pods []Pod, filters []cluster.FilterExpr) (cluster.FilterExpr, bool) {
+	for _, filter := range filters {
+		if !filter.Soft && !satisfies(node, pods, filter) {
+			return filter, true
+		}
+	}
+	return cluster.FilterExpr{}, false
+}
+
+func satisfies(node cluster.Node, pods []Pod, filter cluster.FilterExpr) bool {
+	if filter.Kind == cluster.FilterConstraint {
+		if filter.Key == "node" {
+			return filter.Match(node.Name) == filter.Equal
+		}
+		if node.Labels == nil {
+			return true
+		}
+		value, ok := node.Labels[filter.Key]
+		return (ok && filter.Match(value)) == filter.Equal
+	}
+	matched := false
+	for _, pod := range pods {
+		switch filter.Key {
+		case "container":
+			matched = filter.Match(pod.Id) || filter.Match(pod.Name)
+		case "image":
+			matched = filter.Match(pod.Image)
+		default:
+			value, ok := pod.Labels[filter.Key]
+			matched = ok && filter.Match(value)
+		}
+		if matched {
+			break
+		}
+	}
+	return matched == filter.Equal
+}
+
+type bySpread []cluster.Node
+
+func (nodes bySpread) Len() int      { return len(nodes) }
+func (nodes bySpread) Swap(i, j int) { nodes[i], nodes[j] = nodes[j], nodes[i] }
+func (nodes bySpread) Less(i, j int) bool {
+	if nodes[i].Containers != nodes[j].Containers {
+		return nodes[i].Containers < nodes[j].Containers
+	}
+	if nodes[i].SpareMemory() != nodes[j].SpareMemory() {
+		return nodes[i].SpareMemory() > nodes[j].SpareMemory()
+	}
+	return nodes[i].Name < nodes[j].Name
+}
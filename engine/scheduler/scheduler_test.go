@@ -0,0 +1,127 @@
+package scheduler
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/laincloud/deployd/cluster"
+)
+
+func testNodes() []cluster.Node {
+	return []cluster.Node{
+		{Name: "node1", Containers: 2, CPUs: 4, Memory: 4096, UsedMemory: 1024, Labels: map[string]string{"zone": "a"}},
+		{Name: "node2", Containers: 1, CPUs: 4, Memory: 4096, UsedMemory: 3584, Labels: map[string]string{"zone": "b"}},
+		{Name: "node3", Containers: 3, CPUs: 4, Memory: 4096, UsedMemory: 0, Labels: map[string]string{"zone": "b"}},
+	}
+}
+
+func rejectionOf(d Decision, node string) string {
+	for _, r := range d.Rejections {
+		if r.Node == node {
+			return r.Reason
+		}
+	}
+	return ""
+}
+
+func TestScheduleSpread(t *testing.T) {
+	d, err := Schedule(Request{Name: "hello", Memory: 256}, testNodes(), nil)
+	if err != nil {
+		t.Fatalf("Should schedule the request, %s", err)
+	}
+	if d.Node != "node2" {
+		t.Errorf("Should pick the node with the least containers, got %s", d.Node)
+	}
+	if len(d.Rejections) != 2 {
+		t.Errorf("Should explain why the other nodes were not picked, got %+v", d.Rejections)
+	}
+
+	d, err = Schedule(Request{Name: "hello", Memory: 1024}, testNodes(), nil)
+	if err != nil {
+		t.Fatalf("Should schedule the request, %s", err)
+	}
+	if d.Node != "node1" {
+		t.Errorf("Should skip the node without enough memory, got %s", d.Node)
+	}
+	if !strings.Contains(rejectionOf(d, "node2"), "not enough memory") {
+		t.Errorf("Should reject node2 for the memory, got %q", rejectionOf(d, "node2"))
+	}
+
+	if _, err := Schedule(Request{Name: "hello", Memory: 8192}, testNodes(), nil); err == nil {
+		t.Errorf("Should fail if no node has enough memory")
+	}
+	if _, err := Schedule(Request{Name: "hello", CPUs: 8}, testNodes(), nil); err == nil {
+		t.Errorf("Should fail if no node has enough cpus")
+	}
+	if _, err := Schedule(Request{Name: "hello"}, nil, nil); err != ErrNoNodeAvailable {
+		t.Errorf("Should fail without nodes, got %v", err)
+	}
+}
+
+func TestScheduleConstraints(t *testing.T) {
+	d, err := Schedule(Request{Name: "hello", Filters: []string{"constraint:zone==b", "constraint:node!=node2"}}, testNodes(), nil)
+	if err != nil {
+		t.Fatalf("Should schedule the request, %s", err)
+	}
+	if d.Node != "node3" {
+		t.Errorf("Should pick the only node satisfies the constraints, got %s", d.Node)
+	}
+	if reason := rejectionOf(d, "node1"); reason != "does not satisfy constraint:zone==b" {
+		t.Errorf("Should reject node1 by the label constraint, got %q", reason)
+	}
+	if reason := rejectionOf(d, "node2"); reason != "does not satisfy constraint:node!=node2" {
+		t.Errorf("Should reject node2 by the node constraint, got %q", reason)
+	}
+
+	_, err = Schedule(Request{Name: "hello", Filters: []string{"constraint:zone==c"}}, testNodes(), nil)
+	if err == nil || !strings.Contains(err.Error(), "node1: does not satisfy constraint:zone==c") {
+		t.Errorf("Should fail with the explanation, got %v", err)
+	}
+
+	d, err = Schedule(Request{Name: "hello", Filters: []string{"constraint:zone==~c"}}, testNodes(), nil)
+	if err != nil {
+		t.Fatalf("Should ignore the soft constraint nobody satisfies, %s", err)
+	}
+	if d.Node != "node2" || len(d.Ignored) != 1 {
+		t.Errorf("Should report the ignored soft constraint, got %+v", d)
+	}
+
+	nodes := testNodes()
+	for i := range nodes {
+		nodes[i].Labels = nil
+	}
+	if _, err := Schedule(Request{Name: "hello", Filters: []string{"constraint:zone==c"}}, nodes, nil); err != nil {
+		t.Errorf("Should leave the label constraints to the cluster if no labels reported, %s", err)
+	}
+
+	if _, err := Schedule(Request{Name: "hello", Filters: []string{"constraint:zone"}}, testNodes(), nil); err == nil {
+		t.Errorf("Should fail with the invalid filter")
+	}
+}
+
+func TestScheduleAffinities(t *testing.T) {
+	pods := []Pod{
+		{Id: "c1", Name: "hello.web.web.v0-i1-d0", Node: "node2", Image: "hello:v1",
+			Labels: map[string]string{"cc.bdp.lain.deployd.pg_name": "hello.web.web"}},
+		{Id: "c2", Name: "redis", Node: "node3", Image: "redis:3"},
+	}
+	d, err := Schedule(Request{Name: "hello.web.web", Filters: []string{"affinity:cc.bdp.lain.deployd.pg_name!=~hello.web.web"}}, testNodes(), pods)
+	if err != nil {
+		t.Fatalf("Should schedule the request, %s", err)
+	}
+	if d.Node != "node1" {
+		t.Errorf("Should prefer the node without the same pod group, got %s", d.Node)
+	}
+	if reason := rejectionOf(d, "node2"); !strings.Contains(reason, "preferred affinity") {
+		t.Errorf("Should reject node2 by the soft anti affinity, got %q", reason)
+	}
+
+	d, err = Schedule(Request{Name: "hello", Filters: []string{"affinity:image==redis:*"}}, testNodes(), pods)
+	if err != nil || d.Node != "node3" {
+		t.Errorf("Should place with the image affinity, got %+v, %v", d, err)
+	}
+	d, err = Schedule(Request{Name: "hello", Filters: []string{"affinity:container==hello.web.web.v0-i1-d0"}}, testNodes(), pods)
+	if err != nil || d.Node != "node2" {
+		t.Errorf("Should place with the container affinity, got %+v, %v", d, err)
+	}
+}
@@ -0,0 +1,316 @@
+package engine
+
+import (
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/laincloud/deployd/storage"
+	"github.com/mijia/sweb/log"
+)
+
+type RecordKind string
+
+const (
+	RecordPodGroup    RecordKind = "podgroup"
+	RecordDependsSpec RecordKind = "depends_spec"
+)
+
+// Migration upgrades the raw json record of the kinds to the schema version, records written before the
+// schema versioning are on version 0.
+type Migration struct {
+	Version     int
+	Kinds       []RecordKind
+	Description string
+	Migrate     func(record map[string]interface{}) error
+}
+
+func (m Migration) appliesTo(kind RecordKind) bool {
+	for _, k := range m.Kinds {
+		if k == kind {
+			return true
+		}
+	}
+	return false
+}
+
+// migrations are ordered by the version, every format change of the stored records should come with one
+var migrations = []Migration{
+	{
+		Version:     1,
+		Kinds:       []RecordKind{RecordPodGroup},
+		Description: "pad the pod group PrevState to the number of instances",
+		Migrate:     migratePadPrevState,
+	},
+	{
+		Version:     2,
+		Kinds:       []RecordKind{RecordPodGroup, RecordDependsSpec},
+		Description: "move the healthcheck url in the annotation into the HealthConfig",
+		Migrate:     migrateHealthCheckAnnotation,
+	},
+}
+
+// SchemaVersion is the schema version of the records written by this deployd
+func SchemaVersion() int {
+	if len(migrations) == 0 {
+		return 0
+	}
+	return migrations[len(migrations)-1].Version
+}
+
+// storedPodGroup and storedDependsSpec are what actually written into the store, the embedded fields are
+// flattened so the records can still be read as PodGroupWithSpec and PodSpec.
+type storedPodGroup struct {
+	PodGroupWithSpec
+	SchemaVersion int
+}
+
+type storedDependsSpec struct {
+	PodSpec
+	SchemaVersion int
+}
+
+func newStoredPodGroup(pg PodGroupWithSpec) storedPodGroup {
+	return storedPodGroup{pg, SchemaVersion()}
+}
+
+func newStoredDependsSpec(spec PodSpec) storedDependsSpec {
+	return storedDependsSpec{spec, SchemaVersion()}
+}
+
+type schemaStamp struct {
+	SchemaVersion int
+}
+
+// migrateRecord runs all the migrations newer than the record's schema version, and returns the upgraded
+// record stamped with the current schema version, changed is false if the record is already up to date.
+func migrateRecord(kind RecordKind, raw string) (string, bool, error) {
+	var record map[string]interface{}
+	decoder := json.NewDecoder(strings.NewReader(raw))
+	decoder.UseNumber() // keep the numbers as they are, float64 rounds the large ones
+	if err := decoder.Decode(&record); err != nil {
+		return "", false, err
+	}
+	var stamp schemaStamp
+	if err := json.Unmarshal([]byte(raw), &stamp); err != nil {
+		return "", false, err
+	}
+	if stamp.SchemaVersion > SchemaVersion() {
+		return "", false, fmt.Errorf("Record schema version %d is newer than %d", stamp.SchemaVersion, SchemaVersion())
+	}
+	if stamp.SchemaVersion == SchemaVersion() {
+		return raw, false, nil
+	}
+	for _, m := range migrations {
+		if m.Version <= stamp.SchemaVersion || !m.appliesTo(kind) {
+			continue
+		}
+		if err := m.Migrate(record); err != nil {
+			return "", false, fmt.Errorf("Migration to schema version %d failed, %s", m.Version, err)
+		}
+	}
+	record["SchemaVersion"] = SchemaVersion()
+	data, err := json.Marshal(record)
+	if err != nil {
+		return "", false, err
+	}
+	return string(data), true, nil
+}
+
+// loadMigrated reads the record with its version, and writes the migrated record back if it was upgraded
+func loadMigrated(store storage.Store, kind RecordKind, key string, v interface{}) (uint64, error) {
+	var raw json.RawMessage
+	version, err := store.GetWithVersion(key, &raw)
+	if err != nil {
+		return 0, err
+	}
+	migrated, changed, err := migrateRecord(kind, string(raw))
+	if err != nil {
+		return 0, fmt.Errorf("Failed to migrate %s, %s", key, err)
+	}
+	if changed {
+		if version, err = store.SetIfVersion(key, storage.RawValue(migrated), version, true); err != nil {
+			return 0, fmt.Errorf("Failed to save the migrated %s, %s", key, err)
+		}
+		log.Infof("Migrated %s to schema version %d", key, SchemaVersion())
+	}
+	if err := json.Unmarshal([]byte(migrated), v); err != nil {
+		return 0, err
+	}
+	return version, nil
+}
+
+type SchemaRecord struct {
+	Key           string     `json:"key"`
+	Kind          RecordKind `json:"kind"`
+	SchemaVersion int        `json:"schema_version"`
+}
+
+type MigrationInfo struct {
+	Version     int          `json:"version"`
+	Kinds       []RecordKind `json:"kinds"`
+	Description string       `json:"description"`
+}
+
+type SchemaReport struct {
+	Current    int                        `json:"current"`
+	Migrations []MigrationInfo            `json:"migrations"`
+	Counts     map[RecordKind]map[int]int `json:"counts"`
+	Records    []SchemaRecord             `json:"records"`
+}
+
+// NewSchemaReport reports the schema version of every versioned record in the store
+func NewSchemaReport(store storage.Store) (*SchemaReport, error) {
+	report := &SchemaReport{
+		Current:    SchemaVersion(),
+		Migrations: make([]MigrationInfo, 0, len(migrations)),
+		Counts:     make(map[RecordKind]map[int]int),
+		Records:    make([]SchemaRecord, 0),
+	}
+	for _, m := range migrations {
+		report.Migrations = append(report.Migrations, MigrationInfo{m.Version, m.Kinds, m.Description})
+	}
+
+	pgKey := strings.Join([]string{kLainDeploydRootKey, kLainPodGroupKey}, "/")
+	namespaces, err := listKeys(store, pgKey)
+	if err != nil {
+		return nil, err
+	}
+	for _, namespace := range namespaces {
+		pgNames, err := listKeys(store, namespace)
+		if err != nil {
+			return nil, err
+		}
+		if err := report.add(store, RecordPodGroup, pgNames); err != nil {
+			return nil, err
+		}
+	}
+
+	specKey := strings.Join([]string{kLainDeploydRootKey, kLainDependencyKey, kLainSpecKey}, "/")
+	specNames, err := listKeys(store, specKey)
+	if err != nil {
+		return nil, err
+	}
+	if err := report.add(store, RecordDependsSpec, specNames); err != nil {
+		return nil, err
+	}
+	sort.Sort(bySchemaRecordKey(report.Records))
+	return report, nil
+}
+
+func (report *SchemaReport) add(store storage.Store, kind RecordKind, keys []string) error {
+	for _, key := range keys {
+		var stamp schemaStamp
+		if err := store.Get(key, &stamp); err != nil {
+			if err == storage.KMissingError {
+				continue
+			}
+			return err
+		}
+		report.Records = append(report.Records, SchemaRecord{key, kind, stamp.SchemaVersion})
+		if _, ok := report.Counts[kind]; !ok {
+			report.Counts[kind] = make(map[int]int)
+		}
+		report.Counts[kind][stamp.SchemaVersion]++
+	}
+	return nil
+}
+
+func (engine *OrcEngine) SchemaReport() (*SchemaReport, error) {
+	return NewSchemaReport(engine.store)
+}
+
+func listKeys(store storage.Store, prefix string) ([]string, error) {
+	keys, err := store.KeysByPrefix(prefix)
+	if err != nil && err != storage.KMissingError {
+		return nil, err
+	}
+	return keys, nil
+}
+
+type bySchemaRecordKey []SchemaRecord
+
+func (records bySchemaRecordKey) Len() int           { return len(records) }
+func (records bySchemaRecordKey) Swap(i, j int)      { records[i], records[j] = records[j], records[i] }
+func (records bySchemaRecordKey) Less(i, j int) bool { return records[i].Key < records[j].Key }
+
+// migratePadPrevState makes sure every instance has its prev state, which was patched up in
+// newPodGroupController for the records saved before the instances were scaled.
+func migratePadPrevState(record map[string]interface{}) error {
+	spec, ok := record["Spec"].(map[string]interface{})
+	if !ok {
+		return fmt.Errorf("pod group record has no Spec")
+	}
+	number, ok := spec["NumInstances"].(json.Number)
+	if !ok {
+		return fmt.Errorf("pod group record has no NumInstances")
+	}
+	numInstances, err := number.Int64()
+	if err != nil {
+		return fmt.Errorf("pod group record has a bad NumInstances, %s", err)
+	}
+	states, _ := record["PrevState"].([]interface{})
+	for len(states) < int(numInstances) {
+		states = append(states, map[string]interface{}{"NodeName": "", "IPs": []interface{}{""}})
+	}
+	record["PrevState"] = states
+	return nil
+}
+
+// migrateHealthCheckAnnotation turns the healthcheck url in the annotation, which was checked on the main port
+// of the first container when the containers were created, into the HealthConfig of the pod specs in the record.
+func migrateHealthCheckAnnotation(record map[string]interface{}) error {
+	spec, ok := record["Spec"].(map[string]interface{})
+	if !ok {
+		// the depends spec record is the pod spec itself
+		return migratePodHealthCheck(record)
+	}
+	if pod, ok := spec["Pod"].(map[string]interface{}); ok {
+		if err := migratePodHealthCheck(pod); err != nil {
+			return err
+		}
+	}
+	for _, key := range []string{"Canary", "BlueGreen"} {
+		if sub, ok := spec[key].(map[string]interface{}); ok {
+			if pod, ok := sub["Pod"].(map[string]interface{}); ok {
+				if err := migratePodHealthCheck(pod); err != nil {
+					return err
+				}
+			}
+		}
+	}
+	return nil
+}
+
+func migratePodHealthCheck(pod map[string]interface{}) error {
+	data, err := json.Marshal(pod)
+	if err != nil {
+		return err
+	}
+	var podSpec PodSpec
+	if err := json.Unmarshal(data, &podSpec); err != nil {
+		return err
+	}
+	if podSpec.HealthConfig.Cmd != "" || len(podSpec.Containers) == 0 {
+		return nil
+	}
+	var annotation map[string]interface{}
+	if err := json.Unmarshal([]byte(podSpec.Annotation), &annotation); err != nil {
+		return nil
+	}
+	url, ok := annotation["healthcheck"].(string)
+	if !ok {
+		return nil
+	}
+	port := podSpec.Containers[0].MainPort().Port
+	timeout := podSpec.HealthConfig.FetchOption().Timeout
+	health, _ := pod["HealthConfig"].(map[string]interface{})
+	if health == nil {
+		health = make(map[string]interface{})
+	}
+	health["cmd"] = fmt.Sprintf(CURL_TMPLT, strconv.Itoa(timeout), "http://localhost:"+strconv.Itoa(port)+url)
+	pod["HealthConfig"] = health
+	return nil
+}
@@ -0,0 +1,129 @@
+package engine
+
+import (
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"testing"
+
+	"github.com/laincloud/deployd/storage"
+	"github.com/laincloud/deployd/storage/memory"
+)
+
+func TestMigrationsOrdered(t *testing.T) {
+	last := 0
+	for _, m := range migrations {
+		if m.Version <= last {
+			t.Errorf("Should register the migrations in increasing versions, got %d after %d", m.Version, last)
+		}
+		last = m.Version
+	}
+	if SchemaVersion() != last {
+		t.Errorf("Should use the last migration version as the schema version, %d != %d", SchemaVersion(), last)
+	}
+}
+
+func TestMigratePadPrevState(t *testing.T) {
+	raw := `{"Spec":{"Name":"hello.proc.web","NumInstances":3},"PrevState":[{"NodeName":"node1","IPs":["10.0.0.1"]}]}`
+	migrated, changed, err := migrateRecord(RecordPodGroup, raw)
+	if err != nil || !changed {
+		t.Fatalf("Should migrate the version 0 record, changed=%v, %v", changed, err)
+	}
+	if _, changed, err := migrateRecord(RecordPodGroup, migrated); err != nil || changed {
+		t.Errorf("Should not migrate the record on current version again, changed=%v, %v", changed, err)
+	}
+	if _, _, err := migrateRecord(RecordPodGroup, `{"SchemaVersion":10000}`); err == nil {
+		t.Errorf("Should refuse the record from a newer deployd")
+	}
+	for _, bad := range []string{`{"Spec":{"Name":"hello.proc.web"}}`, `{"Spec":{"Name":"hello.proc.web","NumInstances":"3"}}`} {
+		if _, _, err := migrateRecord(RecordPodGroup, bad); err == nil {
+			t.Errorf("Should refuse the record without a number of instances, %s", bad)
+		}
+	}
+}
+
+func TestLoadMigrated(t *testing.T) {
+	store := memory.NewStore()
+	pgKey := kLainDeploydRootKey + "/" + kLainPodGroupKey + "/hello/hello.proc.web"
+	specKey := kLainDeploydRootKey + "/" + kLainDependencyKey + "/" + kLainSpecKey + "/hello.portal"
+	pgSpec := createPodGroupSpec("hello", "hello.proc.web", 2)
+	store.Set(pgKey, PodGroupWithSpec{Spec: pgSpec, PrevState: []PodPrevState{NewPodPrevState(1)}})
+	store.Set(specKey, createPodSpec("hello", "hello.portal"))
+
+	report, err := NewSchemaReport(store)
+	if err != nil {
+		t.Fatalf("Should be able to report the schemas, %s", err)
+	}
+	if len(report.Records) != 2 || report.Counts[RecordPodGroup][0] != 1 || report.Counts[RecordDependsSpec][0] != 1 {
+		t.Errorf("Should report both records on version 0, %+v", report)
+	}
+
+	var pg PodGroupWithSpec
+	version, err := loadMigrated(store, RecordPodGroup, pgKey, &pg)
+	if err != nil {
+		t.Fatalf("Should be able to load the migrated pod group, %s", err)
+	}
+	if len(pg.PrevState) != 2 || pg.Spec.Name != pgSpec.Name {
+		t.Errorf("Should pad the prev state to the instances, %+v", pg)
+	}
+	var spec PodSpec
+	if _, err := loadMigrated(store, RecordDependsSpec, specKey, &spec); err != nil || spec.Name != "hello.portal" {
+		t.Errorf("Should be able to load the migrated depends spec, %+v, %v", spec, err)
+	}
+
+	report, _ = NewSchemaReport(store)
+	for _, record := range report.Records {
+		if record.SchemaVersion != SchemaVersion() {
+			t.Errorf("Should write back the record on the current schema, %+v", record)
+		}
+	}
+
+	// the engine writes the stamped records which can still be read as they are
+	if _, err := store.SetIfVersion(pgKey, newStoredPodGroup(pg), version); err != nil {
+		t.Fatalf("Should be able to save the pod group on its version, %s", err)
+	}
+	var stored PodGroupWithSpec
+	if err := store.Get(pgKey, &stored); err != nil || stored.Spec.Name != pgSpec.Name {
+		t.Errorf("Should read the stamped record as PodGroupWithSpec, %+v, %v", stored, err)
+	}
+	if _, changed, _ := migrateRecord(RecordPodGroup, mustGetRaw(store, pgKey)); changed {
+		t.Errorf("Should stamp the saved record with the current schema")
+	}
+}
+
+func mustGetRaw(store storage.Store, key string) string {
+	value, _ := store.GetRaw(key)
+	return value
+}
+
+func TestMigrateHealthCheckAnnotation(t *testing.T) {
+	spec := createPodGroupSpec("hello", "hello.proc.web", 1)
+	spec.Pod.Annotation = `{"healthcheck":"/ping"}`
+	spec.Pod.Containers[0].MemoryLimit = 1<<53 + 1 // rounded by float64
+	raw, _ := json.Marshal(storedPodGroup{PodGroupWithSpec{Spec: spec}, 1})
+	migrated, changed, err := migrateRecord(RecordPodGroup, string(raw))
+	if err != nil || !changed {
+		t.Fatalf("Should migrate the version 1 record, changed=%v, %v", changed, err)
+	}
+	var pg PodGroupWithSpec
+	if err := json.Unmarshal([]byte(migrated), &pg); err != nil {
+		t.Fatalf("Should decode the migrated record, %s", err)
+	}
+	expected := fmt.Sprintf(CURL_TMPLT, strconv.Itoa(DefaultHealthTimeout), "http://localhost:5000/ping")
+	if pg.Spec.Pod.HealthConfig.Cmd != expected {
+		t.Errorf("Should move the healthcheck annotation into the HealthConfig, got %q", pg.Spec.Pod.HealthConfig.Cmd)
+	}
+	if pg.Spec.Pod.Containers[0].MemoryLimit != spec.Pod.Containers[0].MemoryLimit {
+		t.Errorf("Should keep the large numbers as they are, got %d", pg.Spec.Pod.Containers[0].MemoryLimit)
+	}
+
+	podSpec := createPodSpec("hello", "hello.portal")
+	podSpec.Annotation = `{"healthcheck":"/ping"}`
+	podSpec.HealthConfig.Cmd = "true"
+	raw, _ = json.Marshal(podSpec)
+	migrated, _, _ = migrateRecord(RecordDependsSpec, string(raw))
+	var depends PodSpec
+	if err := json.Unmarshal([]byte(migrated), &depends); err != nil || depends.HealthConfig.Cmd != "true" {
+		t.Errorf("Should keep the HealthConfig set by the spec, got %+v, %v", depends.HealthConfig, err)
+	}
+}
@@ -0,0 +1,221 @@
+package engine
+
+import (
+	"encoding/json"
+	"fmt"
+
+	"github.com/laincloud/deployd/cluster"
+	"github.com/laincloud/deployd/engine/scheduler"
+)
+
+type InstancePlacement struct {
+	InstanceNo int                   `json:"instance_no"`
+	Node       string                `json:"node"`
+	Existing   bool                  `json:"existing"`
+	Surged     bool                  `json:"surged"`
+	Filters    []string              `json:"filters,omitempty"`
+	Rejections []scheduler.Rejection `json:"rejections,omitempty"`
+	Ignored    []string              `json:"ignored,omitempty"`
+	Error      string                `json:"error,omitempty"`
+}
+
+// ScheduleSimulation tells how a pod group would be scheduled, Existing placements are the instances
+// which stay where they are, Surged ones are deployed before their old pods are removed by the update
+// strategy, and the PortCollisions are the stream ports taken by the other pod groups.
+type ScheduleSimulation struct {
+	Name            string              `json:"name"`
+	NumInstances    int                 `json:"num_instances"`
+	EnoughResources bool                `json:"enough_resources"`
+	Schedulable     bool                `json:"schedulable"`
+	Placements      []InstancePlacement `json:"placements"`
+	PortCollisions  []StreamProc        `json:"port_collisions"`
+}
+
+// SimulateNewPodGroup tells where the instances of a new pod group would land without deploying anything
+func (engine *OrcEngine) SimulateNewPodGroup(spec PodGroupSpec) (*ScheduleSimulation, error) {
+	engine.RLock()
+	defer engine.RUnlock()
+	if _, ok := engine.pgCtrls[spec.Name]; ok {
+		return nil, ErrPodGroupExists
+	}
+	return engine.simulate(spec, nil, false)
+}
+
+// SimulateRescheduleInstance tells where the new instances would land if the pod group is scaled
+func (engine *OrcEngine) SimulateRescheduleInstance(name string, numInstances int) (*ScheduleSimulation, error) {
+	engine.RLock()
+	defer engine.RUnlock()
+	pgCtrl, ok := engine.pgCtrls[name]
+	if !ok {
+		return nil, ErrPodGroupNotExists
+	}
+	current := pgCtrl.Inspect()
+	spec := current.Spec.Clone()
+	spec.NumInstances = numInstances
+	return engine.simulate(spec, &current, false)
+}
+
+// SimulateRescheduleSpec tells where the instances would land if the pod group is upgraded to the pod spec,
+// the instances are redeployed in batches by the update strategy of the pod group.
+func (engine *OrcEngine) SimulateRescheduleSpec(name string, podSpec PodSpec) (*ScheduleSimulation, error) {
+	engine.RLock()
+	defer engine.RUnlock()
+	pgCtrl, ok := engine.pgCtrls[name]
+	if !ok {
+		return nil, ErrPodGroupNotExists
+	}
+	current := pgCtrl.Inspect()
+	spec := current.Spec.Clone()
+	spec.Pod = spec.Pod.Merge(podSpec)
+	return engine.simulate(spec, &current, shouldReDeploy(current.Spec.Pod, spec.Pod))
+}
+
+func (engine *OrcEngine) simulate(spec PodGroupSpec, current *PodGroupWithSpec, reDeploy bool) (*ScheduleSimulation, error) {
+	nodes, err := engine.cluster.GetResources()
+	if err != nil {
+		return nil, err
+	}
+	pods, err := listScheduledPods(engine.cluster)
+	if err != nil {
+		return nil, err
+	}
+
+	fitSpec, ownPods := spec, []Pod(nil)
+	if current != nil {
+		fitSpec.Pod, ownPods = current.Spec.Pod, current.Pods
+	}
+	sim := &ScheduleSimulation{
+		Name:            spec.Name,
+		NumInstances:    spec.NumInstances,
+		EnoughResources: fitsResources(nodes, fitSpec, ownPods, spec.Pod),
+		Schedulable:     true,
+		Placements:      make([]InstancePlacement, 0, spec.NumInstances),
+		PortCollisions:  collidedStreamPorts(spec),
+	}
+
+	size, surge := 1, 0
+	if current != nil && reDeploy {
+		size, surge = spec.UpdateStrategy.Batch(!current.Spec.Pod.IsStateful() && !spec.Pod.IsStateful())
+	}
+	oldPod := func(i int) *Pod {
+		if current != nil && i < len(current.Pods) && current.Pods[i].NodeName() != "" {
+			return &current.Pods[i]
+		}
+		return nil
+	}
+	req := newScheduleRequest(spec.Pod, nil)
+	var oldMemory int64
+	if current != nil {
+		oldMemory = newScheduleRequest(current.Spec.Pod, nil).Memory
+	}
+	for i := 0; i < spec.NumInstances; i += size {
+		end := i + size
+		if end > spec.NumInstances {
+			end = spec.NumInstances
+		}
+		// the instances not surged in the batch are removed before any of them is deployed, see pgOperUpgradeBatch
+		for j := i + surge; j < end && reDeploy; j += 1 {
+			if old := oldPod(j); old != nil {
+				nodes, pods = releasePod(nodes, pods, *old, oldMemory)
+			}
+		}
+		for j := i; j < end; j += 1 {
+			placement := InstancePlacement{InstanceNo: j + 1}
+			old := oldPod(j)
+			if old != nil && !reDeploy {
+				placement.Node = old.NodeName()
+				placement.Existing = true
+				sim.Placements = append(sim.Placements, placement)
+				continue
+			}
+
+			req.Filters = deployFilters(spec.Pod)
+			placement.Surged = old != nil && j-i < surge
+			if old != nil && current.Spec.Pod.IsStateful() && spec.Pod.IsStateful() {
+				// stateful pods are upgraded in place, see deployUpgradedInstance
+				req.Filters = append(req.Filters, fmt.Sprintf("constraint:node==%s", old.NodeName()))
+			}
+			decision, err := scheduler.Schedule(req, nodes, pods)
+			if placement.Surged {
+				// the old pod is removed first if the new one cannot be deployed next to it
+				nodes, pods = releasePod(nodes, pods, *old, oldMemory)
+				if err != nil {
+					placement.Surged = false
+					decision, err = scheduler.Schedule(req, nodes, pods)
+				}
+			}
+			placement.Filters = req.Filters
+			placement.Node = decision.Node
+			placement.Rejections = decision.Rejections
+			placement.Ignored = decision.Ignored
+			if err != nil {
+				placement.Error = err.Error()
+				sim.Schedulable = false
+			} else {
+				nodes, pods = reservePod(nodes, pods, spec.Pod, decision.Node, req.Memory)
+			}
+			sim.Placements = append(sim.Placements, placement)
+		}
+	}
+	return sim, nil
+}
+
+// releasePod takes the containers of the pod away from the cluster snapshot
+func releasePod(nodes []cluster.Node, pods []scheduler.Pod, pod Pod, memory int64) ([]cluster.Node, []scheduler.Pod) {
+	ids := make(map[string]struct{}, len(pod.Containers))
+	for _, container := range pod.Containers {
+		ids[container.Id] = struct{}{}
+	}
+	left := make([]scheduler.Pod, 0, len(pods))
+	for _, p := range pods {
+		if _, ok := ids[p.Id]; !ok {
+			left = append(left, p)
+		}
+	}
+	for i := range nodes {
+		if nodes[i].Name == pod.NodeName() {
+			nodes[i].Containers -= int64(len(pod.Containers))
+			nodes[i].UsedMemory -= memory
+		}
+	}
+	return nodes, left
+}
+
+// reservePod puts the containers of the pod onto the node in the cluster snapshot, so that the following
+// instances are scheduled with the resources and the affinities taken by it.
+func reservePod(nodes []cluster.Node, pods []scheduler.Pod, spec PodSpec, node string, memory int64) ([]cluster.Node, []scheduler.Pod) {
+	containerLabel := ContainerLabel{Name: spec.Name, Namespace: spec.Namespace}
+	for i, cSpec := range spec.Containers {
+		pods = append(pods, scheduler.Pod{
+			Name:   fmt.Sprintf("%s-c%d", spec.Name, i),
+			Node:   node,
+			Image:  cSpec.Image,
+			Labels: containerLabel.Label2Maps(),
+		})
+	}
+	for i := range nodes {
+		if nodes[i].Name == node {
+			nodes[i].Containers += int64(len(spec.Containers))
+			nodes[i].UsedMemory += memory
+		}
+	}
+	return nodes, pods
+}
+
+// collidedStreamPorts are the stream ports in the annotation which are registered by the other pod groups
+func collidedStreamPorts(spec PodGroupSpec) []StreamProc {
+	collisions := make([]StreamProc, 0)
+	var sps StreamPorts
+	if pm == nil || json.Unmarshal([]byte(spec.Pod.Annotation), &sps) != nil || len(sps.Ports) == 0 {
+		return collisions
+	}
+	registered := pm.FetchAllStreamPortsInfo()
+	for _, sp := range sps.Ports {
+		for _, proc := range registered {
+			if proc.SrcPort == sp.SrcPort && proc.ProcName != spec.Name {
+				collisions = append(collisions, proc)
+			}
+		}
+	}
+	return collisions
+}
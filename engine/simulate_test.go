@@ -0,0 +1,65 @@
+package engine
+
+import (
+	"testing"
+)
+
+func TestSimulateNewPodGroup(t *testing.T) {
+	engine, _, _ := initFakeEngine(t, 3)
+	defer engine.Stop()
+	cstController = NewConstraintController()
+	cstController.SetConstraint(ConstraintSpec{Type: "node", Equal: false, Value: "node3"}, engine.store)
+	defer func() { cstController = NewConstraintController() }()
+
+	cSpec := NewContainerSpec("training/webapp")
+	cSpec.MemoryLimit = 1024 * 1024 * 1024
+	podSpec := NewPodSpec(cSpec)
+	podSpec.Name = "hello.proc.web.web"
+	podSpec.Namespace = "hello"
+	podSpec.Annotation = `{"ports":[{"srcport":9601,"dstport":9601,"proto":"tcp"}]}`
+	pgSpec := NewPodGroupSpec("hello.proc.web.web", "hello", podSpec, 3)
+
+	other := &StreamProc{StreamPort: StreamPort{SrcPort: 9601, DstPort: 9601, Proto: "tcp"}, NameSpace: "world", ProcName: "world.proc.web.web"}
+	if ok, _ := RegisterPorts(other); !ok {
+		t.Fatalf("Should be able to register the port 9601")
+	}
+	defer CancelPorts(other)
+
+	sim, err := engine.SimulateNewPodGroup(pgSpec)
+	if err != nil {
+		t.Fatalf("Should simulate the new pod group, %s", err)
+	}
+	if !sim.EnoughResources || !sim.Schedulable || len(sim.Placements) != 3 {
+		t.Fatalf("Should be able to place all the instances, got %+v", sim)
+	}
+	if sim.Placements[0].Node == sim.Placements[1].Node {
+		t.Errorf("Should spread the instances by the anti affinity, got %+v", sim.Placements)
+	}
+	for _, placement := range sim.Placements {
+		if placement.Node == "node3" {
+			t.Errorf("Should not place instance on the constrained node3, got %+v", placement)
+		}
+		rejected := false
+		for _, r := range placement.Rejections {
+			rejected = rejected || (r.Node == "node3" && r.Reason == "does not satisfy constraint:node!=node3")
+		}
+		if !rejected {
+			t.Errorf("Should explain node3 was rejected by the constraint, got %+v", placement.Rejections)
+		}
+	}
+	if len(sim.Placements[2].Ignored) != 1 {
+		t.Errorf("Should ignore the anti affinity for the third instance, got %+v", sim.Placements[2])
+	}
+	if len(sim.PortCollisions) != 1 || sim.PortCollisions[0].ProcName != "world.proc.web.web" {
+		t.Errorf("Should report the stream port collision, got %+v", sim.PortCollisions)
+	}
+
+	pgSpec.Pod.Containers[0].MemoryLimit = 20 * 1024 * 1024 * 1024
+	sim, err = engine.SimulateNewPodGroup(pgSpec)
+	if err != nil {
+		t.Fatalf("Should simulate the new pod group, %s", err)
+	}
+	if sim.EnoughResources || sim.Schedulable || sim.Placements[0].Error == "" {
+		t.Errorf("Should not be able to place the instances without enough memory, got %+v", sim)
+	}
+}
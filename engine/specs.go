@@ -2,6 +2,7 @@ package engine
 
 import (
 	"fmt"
+	"sort"
 	"strconv"
 	"time"
 
@@ -31,6 +32,8 @@ const (
 
 	MinPodKillTimeout = 10
 	MaxPodKillTimeout = 120
+
+	DefaultInitTimeout = 300
 )
 
 var (
@@ -44,6 +47,7 @@ type ImSpec struct {
 	Version   int
 	CreatedAt time.Time
 	UpdatedAt time.Time
+	UpdatedBy string `json:",omitempty"` // who requested the last change of the spec
 }
 
 type ContainerLabel struct {
@@ -174,6 +178,44 @@ func (hc HealthConfig) FetchOption() HealthCnfOptions {
 	}
 }
 
+const (
+	ProtocolTCP = "tcp"
+	ProtocolUDP = "udp"
+)
+
+// PortSpec is a port exposed by the container, the protocol is tcp if empty
+type PortSpec struct {
+	Name     string
+	Port     int
+	Protocol string
+}
+
+func (ps PortSpec) VerifyParams() bool {
+	return ps.Port > 0 && ps.Port <= 65535 &&
+		(ps.Protocol == "" || ps.Protocol == ProtocolTCP || ps.Protocol == ProtocolUDP)
+}
+
+// Key is the port key of docker, like 5000/tcp
+func (ps PortSpec) Key() string {
+	protocol := ps.Protocol
+	if protocol == "" {
+		protocol = ProtocolTCP
+	}
+	return fmt.Sprintf("%d/%s", ps.Port, protocol)
+}
+
+func equalPorts(a, b []PortSpec) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
 type ContainerSpec struct {
 	ImSpec
 	Image         string
@@ -188,10 +230,45 @@ type ContainerSpec struct {
 	Entrypoint    []string
 	CpuLimit      int
 	MemoryLimit   int64
-	Expose        int
+	Expose        int        // the main tcp port, kept for the specs without Ports
+	Ports         []PortSpec `json:",omitempty"`
 	LogConfig     adoc.LogConfig
 }
 
+// ExposedPorts returns all the ports exposed by the container, the Expose port comes first as the main port
+// if it is not declared in Ports.
+func (s ContainerSpec) ExposedPorts() []PortSpec {
+	ports := make([]PortSpec, 0, len(s.Ports)+1)
+	if s.Expose > 0 {
+		expose, declared := PortSpec{Port: s.Expose, Protocol: ProtocolTCP}, false
+		for _, p := range s.Ports {
+			declared = declared || p.Key() == expose.Key()
+		}
+		if !declared {
+			ports = append(ports, expose)
+		}
+	}
+	for _, p := range s.Ports {
+		if p.Protocol == "" {
+			p.Protocol = ProtocolTCP
+		}
+		ports = append(ports, p)
+	}
+	return ports
+}
+
+// MainPort returns the Expose port, or the first one of Ports if Expose is not set,
+// the port is 0 if the container exposes nothing.
+func (s ContainerSpec) MainPort() PortSpec {
+	if s.Expose > 0 {
+		return PortSpec{Port: s.Expose, Protocol: ProtocolTCP}
+	}
+	if ports := s.ExposedPorts(); len(ports) > 0 {
+		return ports[0]
+	}
+	return PortSpec{Protocol: ProtocolTCP}
+}
+
 func (s ContainerSpec) Clone() ContainerSpec {
 	newSpec := s
 	newSpec.Env = generics.Clone_StringSlice(s.Env)
@@ -199,6 +276,10 @@ func (s ContainerSpec) Clone() ContainerSpec {
 	newSpec.SystemVolumes = generics.Clone_StringSlice(s.SystemVolumes)
 	newSpec.Command = generics.Clone_StringSlice(s.Command)
 	newSpec.DnsSearch = generics.Clone_StringSlice(s.DnsSearch)
+	if s.Ports != nil {
+		newSpec.Ports = make([]PortSpec, len(s.Ports))
+		copy(newSpec.Ports, s.Ports)
+	}
 	if s.Entrypoint == nil {
 		newSpec.Entrypoint = nil
 	} else {
@@ -226,6 +307,13 @@ func (s ContainerSpec) VerifyParams() bool {
 			return false
 		}
 	}
+	names, keys := make(map[string]bool), make(map[string]bool)
+	for _, p := range s.Ports {
+		if !p.VerifyParams() || keys[p.Key()] || (p.Name != "" && names[p.Name]) {
+			return false
+		}
+		names[p.Name], keys[p.Key()] = true, true
+	}
 	return true
 }
 
@@ -242,6 +330,7 @@ func (s ContainerSpec) Equals(o ContainerSpec) bool {
 		s.CpuLimit == o.CpuLimit &&
 		s.MemoryLimit == o.MemoryLimit &&
 		s.Expose == o.Expose &&
+		equalPorts(s.Ports, o.Ports) &&
 		s.User == o.User &&
 		s.WorkingDir == o.WorkingDir &&
 		generics.Equal_StringSlice(s.Volumes, o.Volumes) &&
@@ -309,6 +398,9 @@ type PodSpec struct {
 	KillTimeout  int
 	PrevState    PodPrevState
 	HealthConfig HealthConfig
+
+	InitContainers []ContainerSpec `json:",omitempty"` // run to completion in order before the containers start
+	InitTimeout    int             `json:",omitempty"` // seconds for each init container to complete
 }
 
 func (s PodSpec) GetSetupTime() int {
@@ -329,6 +421,13 @@ func (s PodSpec) GetKillTimeout() int {
 	return s.KillTimeout
 }
 
+func (s PodSpec) GetInitTimeout() int {
+	if s.InitTimeout <= 0 {
+		return DefaultInitTimeout
+	}
+	return s.InitTimeout
+}
+
 func (s PodSpec) String() string {
 	return fmt.Sprintf("Pod[name=%s, version=%d, depends=%+v, stateful=%v, #containers=%d]",
 		s.Name, s.Version, s.Dependencies, s.Stateful, len(s.Containers))
@@ -343,6 +442,12 @@ func (s PodSpec) Clone() PodSpec {
 	for i := range s.Containers {
 		newSpec.Containers[i] = s.Containers[i].Clone()
 	}
+	if s.InitContainers != nil {
+		newSpec.InitContainers = make([]ContainerSpec, len(s.InitContainers))
+		for i := range s.InitContainers {
+			newSpec.InitContainers[i] = s.InitContainers[i].Clone()
+		}
+	}
 	newSpec.Dependencies = make([]Dependency, len(s.Dependencies))
 	for i := range s.Dependencies {
 		newSpec.Dependencies[i] = s.Dependencies[i].Clone()
@@ -362,7 +467,12 @@ func (s PodSpec) VerifyParams() bool {
 			return false
 		}
 	}
-	return true
+	for _, cSpec := range s.InitContainers {
+		if !cSpec.VerifyParams() {
+			return false
+		}
+	}
+	return s.InitTimeout >= 0
 }
 
 func (s PodSpec) IsHardStateful() bool {
@@ -394,6 +504,9 @@ func (s PodSpec) Equals(o PodSpec) bool {
 			return false
 		}
 	}
+	if !equalContainers(s.InitContainers, o.InitContainers) {
+		return false
+	}
 	if len(s.Dependencies) != len(o.Dependencies) {
 		return false
 	}
@@ -411,9 +524,22 @@ func (s PodSpec) Equals(o PodSpec) bool {
 		generics.Equal_StringStringMap(s.Labels, o.Labels) &&
 		s.KillTimeout == o.KillTimeout &&
 		s.SetupTime == o.SetupTime &&
+		s.InitTimeout == o.InitTimeout &&
 		s.HealthConfig.Equals(o.HealthConfig)
 }
 
+func equalContainers(a, b []ContainerSpec) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if !a[i].Equals(b[i]) {
+			return false
+		}
+	}
+	return true
+}
+
 func (s PodSpec) Merge(o PodSpec) PodSpec {
 	// deal with params keeping original
 	if len(s.Containers) > 0 {
@@ -440,9 +566,12 @@ func (s PodSpec) Merge(o PodSpec) PodSpec {
 	s.Stateful = o.Stateful
 	s.Version += 1
 	s.UpdatedAt = time.Now()
+	s.UpdatedBy = o.UpdatedBy
 	s.SetupTime = o.SetupTime
 	s.KillTimeout = o.KillTimeout
 	s.HealthConfig = o.HealthConfig
+	s.InitContainers = o.InitContainers
+	s.InitTimeout = o.InitTimeout
 	return s
 }
 
@@ -483,6 +612,235 @@ func (rp RestartPolicy) String() string {
 	}
 }
 
+// UpdateStrategy controls how the instances are upgraded when the pod spec is rescheduled, the zero value
+// upgrades the instances one by one and removes the old pod first. Stateful pods are never surged.
+type UpdateStrategy struct {
+	BatchSize      int // how many instances are upgraded together, the next batch waits for the last one to be healthy
+	MaxUnavailable int // how many instances in a batch can be removed before their new pods are deployed
+	MaxSurge       int // how many instances in a batch get their new pods deployed before the old pods are removed
+}
+
+func (us UpdateStrategy) VerifyParams() bool {
+	return us.BatchSize >= 0 && us.MaxUnavailable >= 0 && us.MaxSurge >= 0
+}
+
+// Batch returns how many instances are upgraded in a batch and how many of them are surged,
+// the batch size is limited by MaxSurge+MaxUnavailable.
+func (us UpdateStrategy) Batch(surgeable bool) (size int, surge int) {
+	size, maxSurge, maxUnavailable := us.BatchSize, us.MaxSurge, us.MaxUnavailable
+	if size <= 0 {
+		size = 1
+	}
+	if !surgeable {
+		maxSurge = 0
+	}
+	if maxSurge == 0 && maxUnavailable == 0 {
+		maxUnavailable = 1
+	}
+	if size > maxSurge+maxUnavailable {
+		size = maxSurge + maxUnavailable
+	}
+	surge = maxSurge
+	if surge > size {
+		surge = size
+	}
+	return size, surge
+}
+
+const (
+	FailureActionRollback = "rollback"
+	FailureActionPause    = "pause"
+	FailureActionContinue = "continue"
+)
+
+// FailurePolicy decides what to do when the upgraded instances fail during an upgrade, an upgraded instance fails
+// if it exits, gets OOM killed, gets restarted or is not healthy by the health deadline. The zero value rolls back
+// all the upgraded instances once any of them fails.
+type FailurePolicy struct {
+	HealthDeadline int    // seconds for the upgraded instances to become healthy, 0 waits 5 times of the setup time
+	MaxFailed      int    // how many upgraded instances can fail before the action is taken
+	Action         string // rollback, pause or continue, rollback if empty
+}
+
+func (fp FailurePolicy) VerifyParams() bool {
+	if fp.HealthDeadline < 0 || fp.MaxFailed < 0 {
+		return false
+	}
+	switch fp.Action {
+	case "", FailureActionRollback, FailureActionPause, FailureActionContinue:
+		return true
+	}
+	return false
+}
+
+// CanarySpec is the pod spec running on the first Instances of the pod group while the other instances
+// keep running the pod spec of the group, until the canary is promoted or aborted.
+type CanarySpec struct {
+	Instances int
+	Version   int
+	Pod       PodSpec
+}
+
+func (cs CanarySpec) Clone() CanarySpec {
+	newSpec := cs
+	newSpec.Pod = cs.Pod.Clone()
+	return newSpec
+}
+
+func (cs CanarySpec) Equals(o CanarySpec) bool {
+	return cs.Instances == o.Instances &&
+		cs.Version == o.Version &&
+		cs.Pod.Equals(o.Pod)
+}
+
+// BlueGreenSpec is the pod spec deployed as a complete new set of pods alongside the running pods of
+// the group, the group is switched to the new set explicitly and the old set is removed after RemoveDelay seconds.
+type BlueGreenSpec struct {
+	Version     int
+	Pod         PodSpec
+	RemoveDelay int
+}
+
+func (bs BlueGreenSpec) Clone() BlueGreenSpec {
+	newSpec := bs
+	newSpec.Pod = bs.Pod.Clone()
+	return newSpec
+}
+
+func (bs BlueGreenSpec) Equals(o BlueGreenSpec) bool {
+	return bs.Version == o.Version &&
+		bs.RemoveDelay == o.RemoveDelay &&
+		bs.Pod.Equals(o.Pod)
+}
+
+// JobSpec makes the pod group a job, the pods run to completion instead of being restarted. Parallelism pods
+// run at the same time until Completions pods exited with 0, the failed pods are run again after the backoff
+// until more than BackoffLimit pods failed. The containers of the finished job are removed after TTL seconds.
+type JobSpec struct {
+	Completions  int // how many pods should succeed
+	Parallelism  int // how many pods run at the same time, 1 if 0
+	BackoffLimit int // how many pods can fail before the job fails
+	Backoff      int // seconds before the failed pod is run again, doubled on each failure up to 10 minutes
+	TTL          int // seconds to keep the containers after the job finished, 0 keeps them until the job is removed
+}
+
+func (js JobSpec) VerifyParams() bool {
+	return js.Completions > 0 && js.Parallelism >= 0 && js.BackoffLimit >= 0 && js.Backoff >= 0 && js.TTL >= 0
+}
+
+// GetParallelism returns how many pods run at the same time, which is the number of the instances of the job
+func (js JobSpec) GetParallelism() int {
+	parallelism := js.Parallelism
+	if parallelism <= 0 {
+		parallelism = 1
+	}
+	if parallelism > js.Completions {
+		parallelism = js.Completions
+	}
+	return parallelism
+}
+
+// GetBackoff returns how long the failed pod waits before it is run again after the failures of the job
+func (js JobSpec) GetBackoff(failures int) time.Duration {
+	backoff := time.Duration(js.Backoff) * time.Second
+	for i := 1; i < failures && backoff < kJobMaxBackoff; i += 1 {
+		backoff *= 2
+	}
+	if backoff > kJobMaxBackoff {
+		backoff = kJobMaxBackoff
+	}
+	return backoff
+}
+
+// DaemonSpec makes the pod group a daemon, one instance runs on each node which has all the labels of
+// the NodeSelector, the instances are added and removed as the nodes join and leave the cluster.
+// MaxUnavailable nodes are updated at the same time in the rolling update, the new pod never runs next to
+// the old one on the same node.
+type DaemonSpec struct {
+	NodeSelector   map[string]string `json:",omitempty"` // all the nodes if empty
+	MaxUnavailable int               // 1 if 0
+	Nodes          []string          // the node of each instance by the instance number, kept by the engine
+}
+
+func (ds DaemonSpec) Clone() DaemonSpec {
+	newSpec := ds
+	newSpec.NodeSelector = make(map[string]string, len(ds.NodeSelector))
+	for key, value := range ds.NodeSelector {
+		newSpec.NodeSelector[key] = value
+	}
+	newSpec.Nodes = generics.Clone_StringSlice(ds.Nodes)
+	return newSpec
+}
+
+func (ds DaemonSpec) Equals(o DaemonSpec) bool {
+	if ds.MaxUnavailable != o.MaxUnavailable || len(ds.NodeSelector) != len(o.NodeSelector) {
+		return false
+	}
+	for key, value := range ds.NodeSelector {
+		if v, ok := o.NodeSelector[key]; !ok || v != value {
+			return false
+		}
+	}
+	return generics.Equal_StringSlice(ds.Nodes, o.Nodes)
+}
+
+func (ds DaemonSpec) VerifyParams() bool {
+	for key := range ds.NodeSelector {
+		if key == "" {
+			return false
+		}
+	}
+	return ds.MaxUnavailable >= 0
+}
+
+func (ds DaemonSpec) GetMaxUnavailable() int {
+	if ds.MaxUnavailable <= 0 {
+		return 1
+	}
+	return ds.MaxUnavailable
+}
+
+// NodeName returns the node of the instance, empty if the instance is beyond the nodes
+func (ds DaemonSpec) NodeName(instanceNo int) string {
+	if instanceNo < 1 || instanceNo > len(ds.Nodes) {
+		return ""
+	}
+	return ds.Nodes[instanceNo-1]
+}
+
+// PinPodSpec returns the pod spec of the instance constrained to its node
+func (ds DaemonSpec) PinPodSpec(instanceNo int, podSpec PodSpec) PodSpec {
+	return ds.nodePodSpec(ds.NodeName(instanceNo), podSpec)
+}
+
+// nodePodSpec returns the pod spec constrained to the node, and to the node selector which is left to
+// the cluster to check on the nodes without labels reported, the filters already in the pod spec are kept once.
+func (ds DaemonSpec) nodePodSpec(node string, podSpec PodSpec) PodSpec {
+	spec := podSpec.Clone()
+	filters := make([]string, 0, len(ds.NodeSelector)+1)
+	if node != "" {
+		filters = append(filters, fmt.Sprintf("constraint:node==%s", node))
+	}
+	keys := make([]string, 0, len(ds.NodeSelector))
+	for key := range ds.NodeSelector {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		filters = append(filters, fmt.Sprintf("constraint:%s==%s", key, ds.NodeSelector[key]))
+	}
+	existing := make(map[string]bool, len(spec.Filters))
+	for _, filter := range spec.Filters {
+		existing[filter] = true
+	}
+	for _, filter := range filters {
+		if !existing[filter] {
+			spec.Filters = append(spec.Filters, filter)
+		}
+	}
+	return spec
+}
+
 type PodGroupPrevState struct {
 	Nodes []string
 	// we think a instance only have one ip, as now a instance only have one container.
@@ -518,9 +876,16 @@ func (pgps PodGroupPrevState) Length() int {
 
 type PodGroupSpec struct {
 	ImSpec
-	Pod           PodSpec
-	NumInstances  int
-	RestartPolicy RestartPolicy
+	Pod            PodSpec
+	NumInstances   int
+	RestartPolicy  RestartPolicy
+	UpdateStrategy UpdateStrategy
+	FailurePolicy  FailurePolicy
+	Canary         *CanarySpec    `json:",omitempty"`
+	BlueGreen      *BlueGreenSpec `json:",omitempty"`
+	Job            *JobSpec       `json:",omitempty"`
+	Daemon         *DaemonSpec    `json:",omitempty"`
+	BurnedVersion  int            `json:",omitempty"` // version of the last aborted canary, never used again
 }
 
 func (spec PodGroupSpec) String() string {
@@ -531,22 +896,81 @@ func (spec PodGroupSpec) String() string {
 func (spec PodGroupSpec) Clone() PodGroupSpec {
 	newSpec := spec
 	newSpec.Pod = spec.Pod.Clone()
+	if spec.Canary != nil {
+		canary := spec.Canary.Clone()
+		newSpec.Canary = &canary
+	}
+	if spec.BlueGreen != nil {
+		blueGreen := spec.BlueGreen.Clone()
+		newSpec.BlueGreen = &blueGreen
+	}
+	if spec.Job != nil {
+		job := *spec.Job
+		newSpec.Job = &job
+	}
+	if spec.Daemon != nil {
+		daemon := spec.Daemon.Clone()
+		newSpec.Daemon = &daemon
+	}
 	return newSpec
 }
 
+// InstanceSpec returns the version and the pod spec which the instance should be running,
+// the first instances run the canary pod spec while a canary is in progress,
+// and the daemon instances are pinned to their nodes.
+func (spec PodGroupSpec) InstanceSpec(instanceNo int) (int, PodSpec) {
+	if spec.Canary != nil && instanceNo <= spec.Canary.Instances {
+		return spec.Canary.Version, spec.Canary.Pod
+	}
+	if spec.Daemon != nil {
+		return spec.Version, spec.Daemon.PinPodSpec(instanceNo, spec.Pod)
+	}
+	return spec.Version, spec.Pod
+}
+
+// nextVersion is the version for the next upgrade of the pod group, the version of an aborted canary is skipped
+// so the containers of the canary are never confused with the new ones.
+func (spec PodGroupSpec) nextVersion() int {
+	if spec.BurnedVersion > spec.Version {
+		return spec.BurnedVersion + 1
+	}
+	return spec.Version + 1
+}
+
 func (spec PodGroupSpec) Equals(o PodGroupSpec) bool {
+	if (spec.Canary == nil) != (o.Canary == nil) ||
+		(spec.Canary != nil && !spec.Canary.Equals(*o.Canary)) {
+		return false
+	}
+	if (spec.BlueGreen == nil) != (o.BlueGreen == nil) ||
+		(spec.BlueGreen != nil && !spec.BlueGreen.Equals(*o.BlueGreen)) {
+		return false
+	}
+	if (spec.Job == nil) != (o.Job == nil) || (spec.Job != nil && *spec.Job != *o.Job) {
+		return false
+	}
+	if (spec.Daemon == nil) != (o.Daemon == nil) || (spec.Daemon != nil && !spec.Daemon.Equals(*o.Daemon)) {
+		return false
+	}
 	return spec.Name == o.Name &&
 		spec.Namespace == o.Namespace &&
 		spec.Version == o.Version &&
+		spec.BurnedVersion == o.BurnedVersion &&
 		spec.Pod.Equals(o.Pod) &&
 		spec.NumInstances == o.NumInstances &&
-		spec.RestartPolicy == o.RestartPolicy
+		spec.RestartPolicy == o.RestartPolicy &&
+		spec.UpdateStrategy == o.UpdateStrategy &&
+		spec.FailurePolicy == o.FailurePolicy
 }
 
 func (spec PodGroupSpec) VerifyParams() bool {
 	verify := spec.Name != "" &&
 		spec.Namespace != "" &&
-		spec.NumInstances >= 0
+		spec.NumInstances >= 0 &&
+		spec.UpdateStrategy.VerifyParams() &&
+		spec.FailurePolicy.VerifyParams() &&
+		(spec.Job == nil || spec.Job.VerifyParams()) &&
+		(spec.Daemon == nil || (spec.Job == nil && spec.Daemon.VerifyParams()))
 	if !verify {
 		return false
 	}
@@ -1,8 +1,10 @@
 package main
 
 import (
+	"encoding/json"
 	"flag"
 	"fmt"
+	"io/ioutil"
 	"os"
 	"os/signal"
 	"runtime"
@@ -22,14 +24,27 @@ const (
 )
 
 func main() {
-	var webAddr, swarmAddr, etcdAddr, advertise string
+	if len(os.Args) > 1 {
+		switch os.Args[1] {
+		case "backup":
+			backup(os.Args[2:])
+			return
+		case "restore":
+			restore(os.Args[2:])
+			return
+		}
+	}
+
+	var webAddr, swarmAddr, dockerEngines, etcdAddr, etcdApi, advertise string
 	var isDebug, version bool
 	var refreshInterval, dependsGCTime, maxRestartTimes, restartInfoClearInterval int
 
 	flag.StringVar(&advertise, "advertise", "", "The address advertise to other peers, this will open HA mode")
 	flag.StringVar(&webAddr, "web", ":9000", "The address which lain-deployd is listenning on")
 	flag.StringVar(&swarmAddr, "swarm", "", "The tcp://<SWRAM_IP>:<SWARM_PORT> address that Swarm master is deployed")
+	flag.StringVar(&dockerEngines, "docker", "", "The docker engines to use directly instead of swarm, e.g. node1=tcp://192.168.77.21:2375,node2=tcp://192.168.77.22:2375")
 	flag.StringVar(&etcdAddr, "etcd", "", "The etcd cluster access points, e.g. http://127.0.0.1:4001")
+	flag.StringVar(&etcdApi, "etcdApi", "v2", "The etcd api version to use, v2 or v3")
 	flag.IntVar(&dependsGCTime, "dependsGCTime", 5, "The depends garbage collection time (minutes)")
 	flag.IntVar(&refreshInterval, "refreshInterval", 90, "The refresh interval time (seconds)")
 	flag.IntVar(&maxRestartTimes, "maxRestartTimes", 3, "The max restart times for pod")
@@ -43,8 +58,9 @@ func main() {
 		return
 	}
 
-	usage(swarmAddr != "", "Please provide the swarm master address!")
+	usage(swarmAddr != "" || dockerEngines != "", "Please provide the swarm master address or the docker engines!")
 	usage(etcdAddr != "", "Please provide the etcd access points address!")
+	usage(etcdApi == "v2" || etcdApi == "v3", "Please provide the etcd api version in v2 or v3!")
 
 	if isDebug {
 		log.EnableDebug()
@@ -55,16 +71,20 @@ func main() {
 	engine.RestartMaxCount = maxRestartTimes
 	engine.RestartInfoClearInterval = time.Duration(restartInfoClearInterval) * time.Minute
 
-	server := apiserver.New(swarmAddr, etcdAddr, isDebug)
+	server := apiserver.New(swarmAddr, dockerEngines, etcdAddr, etcdApi, isDebug)
 
-	engine.ConfigPortsManager(etcdAddr)
+	store, err := apiserver.NewStore(etcdApi, etcdAddr, isDebug)
+	if err != nil {
+		log.Fatal(err.Error())
+	}
+	engine.ConfigPortsManager(store)
 
 	if advertise == "" {
 		// no advertise, running without election
 		go server.ListenAndServe(webAddr)
 	} else {
 		// running with election, make deploy service HA
-		elec, err := elector.New(strings.Split(etcdAddr, ","), elector.LeaderKey, advertise)
+		elec, err := newElector(etcdApi, etcdAddr, advertise)
 		if err != nil {
 			log.Fatal(err.Error())
 		}
@@ -96,6 +116,96 @@ func main() {
 	waitSignal()
 }
 
+// backup dumps all the deployd data in etcd into the archive file, or stdout if no file given
+func backup(args []string) {
+	var etcdAddr, etcdApi, output string
+	var isDebug bool
+	flags := flag.NewFlagSet("backup", flag.ExitOnError)
+	flags.StringVar(&etcdAddr, "etcd", "", "The etcd cluster access points, e.g. http://127.0.0.1:4001")
+	flags.StringVar(&etcdApi, "etcdApi", "v2", "The etcd api version to use, v2 or v3")
+	flags.StringVar(&output, "o", "", "The archive file to write, default to stdout")
+	flags.BoolVar(&isDebug, "debug", false, "Debug mode switch")
+	flags.Parse(args)
+
+	subUsage(flags, etcdAddr != "", "Please provide the etcd access points address!")
+	if isDebug {
+		log.EnableDebug()
+	}
+
+	store, err := apiserver.NewStore(etcdApi, etcdAddr, isDebug)
+	if err != nil {
+		log.Fatal(err.Error())
+	}
+	archive, err := engine.NewBackup(store)
+	if err != nil {
+		log.Fatalf("Failed to backup the deployd data, %s", err)
+	}
+	data, err := json.MarshalIndent(archive, "", "  ")
+	if err != nil {
+		log.Fatal(err.Error())
+	}
+	data = append(data, '\n')
+	if output == "" {
+		os.Stdout.Write(data)
+		return
+	}
+	if err := ioutil.WriteFile(output, data, 0600); err != nil {
+		log.Fatalf("Failed to write the archive file, %s", err)
+	}
+	log.Infof("Backup %d keys into %s", len(archive.Entries), output)
+}
+
+// restore loads the archive file into an empty etcd, with dry-run only the keys to write are printed
+func restore(args []string) {
+	var etcdAddr, etcdApi, input string
+	var isDebug, dryRun bool
+	flags := flag.NewFlagSet("restore", flag.ExitOnError)
+	flags.StringVar(&etcdAddr, "etcd", "", "The etcd cluster access points, e.g. http://127.0.0.1:4001")
+	flags.StringVar(&etcdApi, "etcdApi", "v2", "The etcd api version to use, v2 or v3")
+	flags.StringVar(&input, "i", "", "The archive file to restore")
+	flags.BoolVar(&dryRun, "dry-run", false, "Only show the keys which would be written")
+	flags.BoolVar(&isDebug, "debug", false, "Debug mode switch")
+	flags.Parse(args)
+
+	subUsage(flags, etcdAddr != "", "Please provide the etcd access points address!")
+	subUsage(flags, input != "", "Please provide the archive file to restore!")
+	if isDebug {
+		log.EnableDebug()
+	}
+
+	data, err := ioutil.ReadFile(input)
+	if err != nil {
+		log.Fatalf("Failed to read the archive file, %s", err)
+	}
+	var archive engine.BackupArchive
+	if err := json.Unmarshal(data, &archive); err != nil {
+		log.Fatalf("Invalid archive file, %s", err)
+	}
+	store, err := apiserver.NewStore(etcdApi, etcdAddr, isDebug)
+	if err != nil {
+		log.Fatal(err.Error())
+	}
+	result, err := engine.RestoreBackup(store, &archive, dryRun)
+	if err != nil {
+		log.Fatalf("Failed to restore the backup, %s", err)
+	}
+	for _, key := range result.Keys {
+		fmt.Println(key)
+	}
+	if dryRun {
+		log.Infof("Dry run, %d keys would be restored", len(result.Keys))
+	} else {
+		log.Infof("Restored %d keys", len(result.Keys))
+	}
+}
+
+func newElector(etcdApi, etcdAddr, advertise string) (*elector.Elector, error) {
+	if etcdApi == "v3" {
+		return elector.NewV3(strings.Split(etcdAddr, ","), elector.LeaderKey, advertise)
+	}
+	return elector.New(strings.Split(etcdAddr, ","), elector.LeaderKey, advertise)
+}
+
 func waitSignal() {
 	ch := make(chan os.Signal)
 	signal.Notify(ch, syscall.SIGINT, syscall.SIGTERM)
@@ -112,6 +222,15 @@ func usage(condition bool, msg string) {
 	}
 }
 
+func subUsage(flags *flag.FlagSet, condition bool, msg string) {
+	if !condition {
+		fmt.Println("lain-deployd " + flags.Name() + ":")
+		fmt.Println("    " + msg)
+		flags.Usage()
+		os.Exit(1)
+	}
+}
+
 func init() {
 	runtime.GOMAXPROCS(runtime.NumCPU())
 }
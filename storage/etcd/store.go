@@ -9,6 +9,7 @@ import (
 
 	"github.com/coreos/etcd/client"
 	"github.com/laincloud/deployd/storage"
+	"github.com/mijia/sweb/log"
 	"golang.org/x/net/context"
 )
 
@@ -17,7 +18,8 @@ type EtcdStore struct {
 	ctx     context.Context
 
 	sync.RWMutex
-	keyHashes map[string]uint64
+	keyHashes   map[string]uint64
+	keyVersions map[string]uint64 // versions written by SetIfVersion
 }
 
 func (store *EtcdStore) GetRaw(key string) (string, error) {
@@ -48,24 +50,88 @@ func (store *EtcdStore) Get(key string, v interface{}) error {
 	return nil
 }
 
-func (store *EtcdStore) Watch(key string) chan string {
-	resp := make(chan string)
+func (store *EtcdStore) Watch(ctx context.Context, key string) <-chan storage.WatchEvent {
+	events := make(chan storage.WatchEvent)
 	errSleepTime := 10 * time.Second
+	afterIndex, indexErr := store.currentIndex(ctx, key)
 	go func() {
+		defer close(events)
+		send := func(event storage.WatchEvent) bool {
+			select {
+			case events <- event:
+				return true
+			case <-ctx.Done():
+				return false
+			}
+		}
+		if indexErr != nil && !send(storage.WatchEvent{Key: key, Err: indexErr}) {
+			return
+		}
 		for {
-			wather := store.keysApi.Watcher(key, &client.WatcherOptions{Recursive: true})
-			for {
-				if response, err := wather.Next(store.ctx); err == nil {
-					if response.Node == nil || response.Node.Dir {
-						continue
-					}
-					resp <- response.Node.Value
+			watcher := store.keysApi.Watcher(key, &client.WatcherOptions{AfterIndex: afterIndex, Recursive: true})
+			var err error
+			for err == nil {
+				var response *client.Response
+				if response, err = watcher.Next(ctx); err != nil {
+					break
+				}
+				if response.Node == nil || response.Node.Dir {
+					continue
+				}
+				afterIndex = response.Node.ModifiedIndex
+				event := storage.WatchEvent{
+					Key:      response.Node.Key,
+					Value:    response.Node.Value,
+					Action:   storage.WatchActionSet,
+					Revision: response.Node.ModifiedIndex,
+				}
+				switch response.Action {
+				case "delete", "compareAndDelete":
+					event.Action, event.Value = storage.WatchActionDelete, ""
+				case "expire":
+					event.Action, event.Value = storage.WatchActionExpire, ""
 				}
+				if !send(event) {
+					return
+				}
+			}
+			if ctx.Err() != nil {
+				return
+			}
+			if isErrorCode(err, client.ErrorCodeEventIndexCleared) {
+				// etcd v2 only keeps the last 1000 events, watch again from now on
+				if index, err := store.currentIndex(ctx, key); err == nil {
+					afterIndex = index
+				}
+				if !send(storage.WatchEvent{Key: key, Err: storage.KWatchCompactedError}) {
+					return
+				}
+				continue
+			}
+			log.Warnf("Watch key %s failed, %s", key, err)
+			if !send(storage.WatchEvent{Key: key, Err: err}) {
+				return
+			}
+			select {
+			case <-ctx.Done():
+				return
+			case <-time.After(errSleepTime):
 			}
-			time.Sleep(errSleepTime)
 		}
 	}()
-	return resp
+	return events
+}
+
+// currentIndex returns the current etcd index, the watcher starts after it
+func (store *EtcdStore) currentIndex(ctx context.Context, key string) (uint64, error) {
+	resp, err := store.keysApi.Get(ctx, key, nil)
+	if err != nil {
+		if cerr, ok := err.(client.Error); ok {
+			return cerr.Index, nil
+		}
+		return 0, err
+	}
+	return resp.Index, nil
 }
 
 func (store *EtcdStore) KeysByPrefix(prefix string) ([]string, error) {
@@ -97,7 +163,7 @@ func (store *EtcdStore) Set(key string, v interface{}, force ...bool) error {
 }
 
 func (store *EtcdStore) SetWithTTL(key string, v interface{}, ttlSec int, force ...bool) error {
-	if data, err := json.Marshal(v); err != nil {
+	if data, err := storage.Marshal(v); err != nil {
 		return err
 	} else {
 		h := fnv.New64a()
@@ -122,16 +188,226 @@ func (store *EtcdStore) SetWithTTL(key string, v interface{}, ttlSec int, force
 		_, err := store.keysApi.Set(store.ctx, key, string(data), setOpts)
 		if err == nil {
 			store.keyHashes[key] = dataHash
+			delete(store.keyVersions, key)
 		}
 		return err
 	}
 }
 
+func (store *EtcdStore) GetWithVersion(key string, v interface{}) (uint64, error) {
+	resp, err := store.keysApi.Get(store.ctx, key, &client.GetOptions{Quorum: true})
+	if err != nil {
+		if isErrorCode(err, client.ErrorCodeKeyNotFound) {
+			return 0, storage.KMissingError
+		}
+		return 0, err
+	}
+	if resp.Node == nil {
+		return 0, storage.KNilNodeError
+	}
+	if resp.Node.Dir {
+		return 0, storage.KDirNodeError
+	}
+	if err := json.Unmarshal([]byte(resp.Node.Value), v); err != nil {
+		return 0, err
+	}
+	return resp.Node.ModifiedIndex, nil
+}
+
+func (store *EtcdStore) SetIfAbsent(key string, v interface{}, ttlSec int) (uint64, error) {
+	data, err := storage.Marshal(v)
+	if err != nil {
+		return 0, err
+	}
+	store.Lock()
+	defer store.Unlock()
+	setOpts := &client.SetOptions{PrevExist: client.PrevNoExist}
+	if ttlSec > 0 {
+		setOpts.TTL = time.Duration(ttlSec) * time.Second
+	}
+	resp, err := store.keysApi.Set(store.ctx, key, string(data), setOpts)
+	if err != nil {
+		if isErrorCode(err, client.ErrorCodeNodeExist) {
+			return 0, storage.KKeyExistsError
+		}
+		return 0, err
+	}
+	store.keyHashes[key] = hashData(data)
+	return resp.Node.ModifiedIndex, nil
+}
+
+func (store *EtcdStore) SetIfVersion(key string, v interface{}, version uint64, force ...bool) (uint64, error) {
+	data, err := storage.Marshal(v)
+	if err != nil {
+		return 0, err
+	}
+	dataHash := hashData(data)
+	forceSave := false
+	if len(force) > 0 {
+		forceSave = force[0]
+	}
+
+	store.Lock()
+	defer store.Unlock()
+	if !forceSave && version > 0 && store.keyVersions[key] == version {
+		if lastHash, ok := store.keyHashes[key]; ok && lastHash == dataHash {
+			return version, nil
+		}
+	}
+	setOpts := &client.SetOptions{PrevIndex: version}
+	if version == 0 {
+		setOpts = &client.SetOptions{PrevExist: client.PrevNoExist}
+	}
+	resp, err := store.keysApi.Set(store.ctx, key, string(data), setOpts)
+	if err != nil {
+		if isErrorCode(err, client.ErrorCodeNodeExist, client.ErrorCodeTestFailed, client.ErrorCodeKeyNotFound) {
+			return 0, storage.KVersionError
+		}
+		return 0, err
+	}
+	store.keyHashes[key] = dataHash
+	store.keyVersions[key] = resp.Node.ModifiedIndex
+	return resp.Node.ModifiedIndex, nil
+}
+
+// Commit applies the transaction, but etcd v2 has no multi-key transaction, so it is NOT atomic: the conditions
+// are checked by compare-and-swap on the operations one by one, the applied ones are rolled back on a best-effort
+// basis if any of the later ones failed. Others may see the partial writes before the rollback, and the rollback
+// itself may fail. The keys rolled back keep the TTL left when they were read.
+func (store *EtcdStore) Commit(txn *storage.Txn) error {
+	values := make([]string, len(txn.Ops))
+	for i, op := range txn.Ops {
+		if op.Type == storage.TxnOpSet {
+			data, err := storage.Marshal(op.Value)
+			if err != nil {
+				return err
+			}
+			values[i] = string(data)
+		}
+	}
+
+	store.Lock()
+	defer store.Unlock()
+	// conditions on the keys which are not written by the transaction can only be checked before
+	conditions := make(map[string]uint64)
+	for _, cond := range txn.Conditions {
+		conditions[cond.Key] = cond.Version
+	}
+	for _, op := range txn.Ops {
+		delete(conditions, op.Key)
+	}
+	for key, version := range conditions {
+		if ok, err := store.checkVersion(key, version); err != nil {
+			return err
+		} else if !ok {
+			return storage.KTxnFailedError
+		}
+	}
+
+	type undo struct {
+		key  string
+		node *client.Node
+	}
+	undos := make([]undo, 0, len(txn.Ops))
+	rollback := func() {
+		for i := len(undos) - 1; i >= 0; i-- {
+			u := undos[i]
+			var err error
+			if u.node == nil {
+				_, err = store.keysApi.Delete(store.ctx, u.key, nil)
+			} else {
+				// the TTL is 0 for the keys without one
+				setOpts := &client.SetOptions{TTL: time.Duration(u.node.TTL) * time.Second}
+				_, err = store.keysApi.Set(store.ctx, u.key, u.node.Value, setOpts)
+			}
+			delete(store.keyHashes, u.key)
+			delete(store.keyVersions, u.key)
+			if err != nil {
+				log.Errorf("Failed to roll back the key %s of the transaction, %s", u.key, err)
+			}
+		}
+	}
+
+	versions := make(map[string]uint64)
+	for _, cond := range txn.Conditions {
+		versions[cond.Key] = cond.Version
+	}
+	for i, op := range txn.Ops {
+		prev, err := store.keysApi.Get(store.ctx, op.Key, &client.GetOptions{Quorum: true})
+		if err != nil && !isErrorCode(err, client.ErrorCodeKeyNotFound) {
+			rollback()
+			return err
+		}
+		var prevNode *client.Node
+		if err == nil {
+			prevNode = prev.Node
+		}
+		if version, ok := versions[op.Key]; ok {
+			if (version == 0 && prevNode != nil) || (version > 0 && (prevNode == nil || prevNode.ModifiedIndex != version)) {
+				rollback()
+				return storage.KTxnFailedError
+			}
+		}
+		var prevIndex uint64
+		if prevNode != nil {
+			prevIndex = prevNode.ModifiedIndex
+		}
+		switch op.Type {
+		case storage.TxnOpSet:
+			setOpts := &client.SetOptions{PrevIndex: prevIndex}
+			if prevNode == nil {
+				setOpts = &client.SetOptions{PrevExist: client.PrevNoExist}
+			}
+			if op.TTLSec > 0 {
+				setOpts.TTL = time.Duration(op.TTLSec) * time.Second
+			}
+			resp, err := store.keysApi.Set(store.ctx, op.Key, values[i], setOpts)
+			if err != nil {
+				rollback()
+				if isErrorCode(err, client.ErrorCodeNodeExist, client.ErrorCodeTestFailed) {
+					return storage.KTxnFailedError
+				}
+				return err
+			}
+			store.keyHashes[op.Key] = hashData([]byte(values[i]))
+			store.keyVersions[op.Key] = resp.Node.ModifiedIndex
+		case storage.TxnOpRemove:
+			if prevNode == nil {
+				continue
+			}
+			if _, err := store.keysApi.Delete(store.ctx, op.Key, &client.DeleteOptions{PrevIndex: prevIndex}); err != nil {
+				rollback()
+				if isErrorCode(err, client.ErrorCodeTestFailed, client.ErrorCodeKeyNotFound) {
+					return storage.KTxnFailedError
+				}
+				return err
+			}
+			delete(store.keyHashes, op.Key)
+			delete(store.keyVersions, op.Key)
+		}
+		undos = append(undos, undo{op.Key, prevNode})
+	}
+	return nil
+}
+
+// checkVersion tells if the key is at the version, version 0 means the key should not exist
+func (store *EtcdStore) checkVersion(key string, version uint64) (bool, error) {
+	resp, err := store.keysApi.Get(store.ctx, key, &client.GetOptions{Quorum: true})
+	if err != nil {
+		if isErrorCode(err, client.ErrorCodeKeyNotFound) {
+			return version == 0, nil
+		}
+		return false, err
+	}
+	return version > 0 && resp.Node != nil && resp.Node.ModifiedIndex == version, nil
+}
+
 func (store *EtcdStore) Remove(key string) error {
 	_, err := store.keysApi.Delete(store.ctx, key, nil)
 	if err == nil {
 		store.Lock()
 		delete(store.keyHashes, key)
+		delete(store.keyVersions, key)
 		store.Unlock()
 	}
 	return err
@@ -155,6 +431,23 @@ func (store *EtcdStore) deleteDir(key string, recursive bool) error {
 	return err
 }
 
+func hashData(data []byte) uint64 {
+	h := fnv.New64a()
+	h.Write(data)
+	return h.Sum64()
+}
+
+func isErrorCode(err error, codes ...int) bool {
+	if cerr, ok := err.(client.Error); ok {
+		for _, code := range codes {
+			if cerr.Code == code {
+				return true
+			}
+		}
+	}
+	return false
+}
+
 func NewStore(addr string, isDebug bool) (storage.Store, error) {
 	c, err := client.New(client.Config{
 		Endpoints: strings.Split(addr, ","),
@@ -166,9 +459,10 @@ func NewStore(addr string, isDebug bool) (storage.Store, error) {
 		client.EnablecURLDebug()
 	}
 	s := &EtcdStore{
-		keysApi:   client.NewKeysAPI(c),
-		ctx:       context.Background(),
-		keyHashes: make(map[string]uint64),
+		keysApi:     client.NewKeysAPI(c),
+		ctx:         context.Background(),
+		keyHashes:   make(map[string]uint64),
+		keyVersions: make(map[string]uint64),
 	}
 	return s, nil
 }
@@ -0,0 +1,451 @@
+package etcdv3
+
+import (
+	"encoding/json"
+	"hash/fnv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/coreos/etcd/clientv3"
+	"github.com/laincloud/deployd/storage"
+	"github.com/mijia/sweb/log"
+	"golang.org/x/net/context"
+)
+
+const (
+	kDialTimeout    = 5 * time.Second
+	kRequestTimeout = 10 * time.Second
+	kWatchRetryTime = 3 * time.Second
+)
+
+// EtcdStore implements the storage.Store with the etcd v3 api, v3 has a flat key space, so the
+// directories of v2 are simulated by the "/" separated key prefixes: a directory exists as long as
+// there are keys under it.
+type EtcdStore struct {
+	client *clientv3.Client
+	ctx    context.Context
+
+	sync.RWMutex
+	keyHashes   map[string]uint64
+	keyVersions map[string]uint64 // versions written by SetIfVersion
+}
+
+func (store *EtcdStore) GetRaw(key string) (string, error) {
+	ctx, cancel := context.WithTimeout(store.ctx, kRequestTimeout)
+	defer cancel()
+	resp, err := store.client.Get(ctx, key)
+	if err != nil {
+		return "", err
+	}
+	if len(resp.Kvs) > 0 {
+		return string(resp.Kvs[0].Value), nil
+	}
+	if isDir, err := store.isDir(ctx, key); err != nil {
+		return "", err
+	} else if isDir {
+		return "", storage.KDirNodeError
+	}
+	return "", storage.KMissingError
+}
+
+func (store *EtcdStore) Get(key string, v interface{}) error {
+	value, err := store.GetRaw(key)
+	if err != nil {
+		return err
+	}
+	if err := json.Unmarshal([]byte(value), v); err != nil {
+		return err
+	}
+	return nil
+}
+
+func (store *EtcdStore) Watch(ctx context.Context, key string) <-chan storage.WatchEvent {
+	events := make(chan storage.WatchEvent)
+	dirPrefix := dirKey(key)
+	var lastRev int64
+	getCtx, cancel := context.WithTimeout(ctx, kRequestTimeout)
+	resp, revErr := store.client.Get(getCtx, key, clientv3.WithCountOnly())
+	cancel()
+	if revErr == nil {
+		lastRev = resp.Header.Revision
+	}
+	go func() {
+		defer close(events)
+		send := func(event storage.WatchEvent) bool {
+			select {
+			case events <- event:
+				return true
+			case <-ctx.Done():
+				return false
+			}
+		}
+		if revErr != nil && !send(storage.WatchEvent{Key: key, Err: revErr}) {
+			return
+		}
+		for {
+			opts := []clientv3.OpOption{clientv3.WithPrefix()}
+			if lastRev > 0 {
+				opts = append(opts, clientv3.WithRev(lastRev+1))
+			}
+			var err error
+			wctx, cancel := context.WithCancel(ctx)
+			for wresp := range store.client.Watch(wctx, key, opts...) {
+				if err = wresp.Err(); err != nil {
+					if wresp.CompactRevision > 0 {
+						// watch again from the oldest revision we have
+						lastRev = wresp.CompactRevision - 1
+						err = storage.KWatchCompactedError
+					}
+					break
+				}
+				for _, ev := range wresp.Events {
+					lastRev = ev.Kv.ModRevision
+					evKey := string(ev.Kv.Key)
+					if evKey != key && !strings.HasPrefix(evKey, dirPrefix) {
+						continue
+					}
+					event := storage.WatchEvent{
+						Key:      evKey,
+						Value:    string(ev.Kv.Value),
+						Action:   storage.WatchActionSet,
+						Revision: uint64(ev.Kv.ModRevision),
+					}
+					if ev.Type == clientv3.EventTypeDelete {
+						event.Action, event.Value = storage.WatchActionDelete, ""
+					}
+					if !send(event) {
+						cancel()
+						return
+					}
+				}
+			}
+			cancel()
+			if ctx.Err() != nil {
+				return
+			}
+			if err != nil {
+				log.Warnf("Watch key %s failed, %s", key, err)
+				if !send(storage.WatchEvent{Key: key, Err: err}) {
+					return
+				}
+				if err == storage.KWatchCompactedError {
+					continue
+				}
+			}
+			select {
+			case <-ctx.Done():
+				return
+			case <-time.After(kWatchRetryTime):
+			}
+		}
+	}()
+	return events
+}
+
+func (store *EtcdStore) KeysByPrefix(prefix string) ([]string, error) {
+	// Prefix should corresponding to a directory name, and will return all the nodes inside the directory
+	keys := make([]string, 0)
+	prefix = strings.TrimSuffix(prefix, "/")
+	ctx, cancel := context.WithTimeout(store.ctx, kRequestTimeout)
+	defer cancel()
+	resp, err := store.client.Get(ctx, dirKey(prefix), clientv3.WithPrefix(), clientv3.WithKeysOnly())
+	if err != nil {
+		return keys, err
+	}
+	if len(resp.Kvs) == 0 {
+		if resp, err := store.client.Get(ctx, prefix, clientv3.WithCountOnly()); err != nil {
+			return keys, err
+		} else if resp.Count > 0 {
+			return keys, storage.KNonDirNodeError
+		}
+		return keys, storage.KMissingError
+	}
+	subKeys := make([]string, 0, len(resp.Kvs))
+	for _, kv := range resp.Kvs {
+		subKeys = append(subKeys, string(kv.Key))
+	}
+	return childKeys(prefix, subKeys), nil
+}
+
+func (store *EtcdStore) Set(key string, v interface{}, force ...bool) error {
+	return store.SetWithTTL(key, v, -1, force...)
+}
+
+func (store *EtcdStore) SetWithTTL(key string, v interface{}, ttlSec int, force ...bool) error {
+	if data, err := storage.Marshal(v); err != nil {
+		return err
+	} else {
+		dataHash := hashData(data)
+		forceSave := false
+		if len(force) > 0 {
+			forceSave = force[0]
+		}
+
+		store.Lock()
+		defer store.Unlock()
+		if !forceSave {
+			if lastHash, ok := store.keyHashes[key]; ok && lastHash == dataHash {
+				return nil
+			}
+		}
+		ctx, cancel := context.WithTimeout(store.ctx, kRequestTimeout)
+		defer cancel()
+		var opts []clientv3.OpOption
+		if ttlSec > 0 {
+			lease, err := store.client.Grant(ctx, int64(ttlSec))
+			if err != nil {
+				return err
+			}
+			opts = append(opts, clientv3.WithLease(lease.ID))
+		}
+		_, err := store.client.Put(ctx, key, string(data), opts...)
+		if err == nil {
+			store.keyHashes[key] = dataHash
+			delete(store.keyVersions, key)
+		}
+		return err
+	}
+}
+
+func (store *EtcdStore) GetWithVersion(key string, v interface{}) (uint64, error) {
+	ctx, cancel := context.WithTimeout(store.ctx, kRequestTimeout)
+	defer cancel()
+	resp, err := store.client.Get(ctx, key)
+	if err != nil {
+		return 0, err
+	}
+	if len(resp.Kvs) == 0 {
+		if isDir, err := store.isDir(ctx, key); err != nil {
+			return 0, err
+		} else if isDir {
+			return 0, storage.KDirNodeError
+		}
+		return 0, storage.KMissingError
+	}
+	if err := json.Unmarshal(resp.Kvs[0].Value, v); err != nil {
+		return 0, err
+	}
+	return uint64(resp.Kvs[0].ModRevision), nil
+}
+
+func (store *EtcdStore) SetIfAbsent(key string, v interface{}, ttlSec int) (uint64, error) {
+	data, err := storage.Marshal(v)
+	if err != nil {
+		return 0, err
+	}
+	store.Lock()
+	defer store.Unlock()
+	ctx, cancel := context.WithTimeout(store.ctx, kRequestTimeout)
+	defer cancel()
+	putOp, err := store.putOp(ctx, key, string(data), ttlSec)
+	if err != nil {
+		return 0, err
+	}
+	resp, err := store.client.Txn(ctx).If(versionCmp(key, 0)).Then(putOp).Commit()
+	if err != nil {
+		return 0, err
+	}
+	if !resp.Succeeded {
+		return 0, storage.KKeyExistsError
+	}
+	store.keyHashes[key] = hashData(data)
+	return uint64(resp.Header.Revision), nil
+}
+
+func (store *EtcdStore) SetIfVersion(key string, v interface{}, version uint64, force ...bool) (uint64, error) {
+	data, err := storage.Marshal(v)
+	if err != nil {
+		return 0, err
+	}
+	dataHash := hashData(data)
+	forceSave := false
+	if len(force) > 0 {
+		forceSave = force[0]
+	}
+
+	store.Lock()
+	defer store.Unlock()
+	if !forceSave && version > 0 && store.keyVersions[key] == version {
+		if lastHash, ok := store.keyHashes[key]; ok && lastHash == dataHash {
+			return version, nil
+		}
+	}
+	ctx, cancel := context.WithTimeout(store.ctx, kRequestTimeout)
+	defer cancel()
+	resp, err := store.client.Txn(ctx).If(versionCmp(key, version)).Then(clientv3.OpPut(key, string(data))).Commit()
+	if err != nil {
+		return 0, err
+	}
+	if !resp.Succeeded {
+		return 0, storage.KVersionError
+	}
+	store.keyHashes[key] = dataHash
+	store.keyVersions[key] = uint64(resp.Header.Revision)
+	return uint64(resp.Header.Revision), nil
+}
+
+func (store *EtcdStore) Commit(txn *storage.Txn) error {
+	store.Lock()
+	defer store.Unlock()
+	ctx, cancel := context.WithTimeout(store.ctx, kRequestTimeout)
+	defer cancel()
+	cmps := make([]clientv3.Cmp, 0, len(txn.Conditions))
+	for _, cond := range txn.Conditions {
+		cmps = append(cmps, versionCmp(cond.Key, cond.Version))
+	}
+	ops := make([]clientv3.Op, 0, len(txn.Ops))
+	hashes := make(map[string]uint64)
+	for _, op := range txn.Ops {
+		switch op.Type {
+		case storage.TxnOpSet:
+			data, err := storage.Marshal(op.Value)
+			if err != nil {
+				return err
+			}
+			putOp, err := store.putOp(ctx, op.Key, string(data), op.TTLSec)
+			if err != nil {
+				return err
+			}
+			ops = append(ops, putOp)
+			hashes[op.Key] = hashData(data)
+		case storage.TxnOpRemove:
+			ops = append(ops, clientv3.OpDelete(op.Key))
+		}
+	}
+	resp, err := store.client.Txn(ctx).If(cmps...).Then(ops...).Commit()
+	if err != nil {
+		return err
+	}
+	if !resp.Succeeded {
+		return storage.KTxnFailedError
+	}
+	for _, op := range txn.Ops {
+		delete(store.keyVersions, op.Key)
+		if hash, ok := hashes[op.Key]; ok {
+			store.keyHashes[op.Key] = hash
+		} else {
+			delete(store.keyHashes, op.Key)
+		}
+	}
+	return nil
+}
+
+// putOp makes the put operation with a lease if the ttl is given, must be called with the lock held
+func (store *EtcdStore) putOp(ctx context.Context, key, value string, ttlSec int) (clientv3.Op, error) {
+	if ttlSec > 0 {
+		lease, err := store.client.Grant(ctx, int64(ttlSec))
+		if err != nil {
+			return clientv3.Op{}, err
+		}
+		return clientv3.OpPut(key, value, clientv3.WithLease(lease.ID)), nil
+	}
+	return clientv3.OpPut(key, value), nil
+}
+
+func (store *EtcdStore) Remove(key string) error {
+	ctx, cancel := context.WithTimeout(store.ctx, kRequestTimeout)
+	defer cancel()
+	resp, err := store.client.Delete(ctx, key)
+	if err != nil {
+		return err
+	}
+	store.Lock()
+	delete(store.keyHashes, key)
+	delete(store.keyVersions, key)
+	store.Unlock()
+	if resp.Deleted == 0 {
+		if isDir, err := store.isDir(ctx, key); err != nil {
+			return err
+		} else if isDir {
+			return storage.KDirNodeError
+		}
+		return storage.KMissingError
+	}
+	return nil
+}
+
+func (store *EtcdStore) RemoveDir(key string) error {
+	ctx, cancel := context.WithTimeout(store.ctx, kRequestTimeout)
+	defer cancel()
+	dir := dirKey(strings.TrimSuffix(key, "/"))
+	if _, err := store.client.Delete(ctx, dir, clientv3.WithPrefix()); err != nil {
+		return err
+	}
+	store.Lock()
+	defer store.Unlock()
+	for k := range store.keyHashes {
+		if strings.HasPrefix(k, dir) {
+			delete(store.keyHashes, k)
+			delete(store.keyVersions, k)
+		}
+	}
+	return nil
+}
+
+func (store *EtcdStore) TryRemoveDir(key string) {
+	// There are no directory nodes in etcd v3, an empty directory is already gone
+}
+
+func (store *EtcdStore) isDir(ctx context.Context, key string) (bool, error) {
+	resp, err := store.client.Get(ctx, dirKey(key), clientv3.WithPrefix(), clientv3.WithCountOnly())
+	if err != nil {
+		return false, err
+	}
+	return resp.Count > 0, nil
+}
+
+// versionCmp compares the mod revision of the key, the key should not exist if the version is 0
+func versionCmp(key string, version uint64) clientv3.Cmp {
+	if version == 0 {
+		return clientv3.Compare(clientv3.CreateRevision(key), "=", 0)
+	}
+	return clientv3.Compare(clientv3.ModRevision(key), "=", int64(version))
+}
+
+func hashData(data []byte) uint64 {
+	h := fnv.New64a()
+	h.Write(data)
+	return h.Sum64()
+}
+
+func dirKey(key string) string {
+	return key + "/"
+}
+
+// childKeys returns the direct children of the directory from all the keys under it,
+// e.g. /a/b/c and /a/d will give /a/b and /a/d for the directory /a.
+func childKeys(dir string, subKeys []string) []string {
+	keys := make([]string, 0)
+	seen := make(map[string]bool)
+	dir = dirKey(dir)
+	for _, key := range subKeys {
+		if !strings.HasPrefix(key, dir) {
+			continue
+		}
+		name := strings.SplitN(strings.TrimPrefix(key, dir), "/", 2)[0]
+		if name == "" || seen[name] {
+			continue
+		}
+		seen[name] = true
+		keys = append(keys, dir+name)
+	}
+	return keys
+}
+
+func NewStore(addr string, isDebug bool) (storage.Store, error) {
+	c, err := clientv3.New(clientv3.Config{
+		Endpoints:   strings.Split(addr, ","),
+		DialTimeout: kDialTimeout,
+	})
+	if err != nil {
+		return nil, err
+	}
+	s := &EtcdStore{
+		client:      c,
+		ctx:         context.Background(),
+		keyHashes:   make(map[string]uint64),
+		keyVersions: make(map[string]uint64),
+	}
+	return s, nil
+}
@@ -0,0 +1,187 @@
+package etcdv3
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/laincloud/deployd/storage"
+	"golang.org/x/net/context"
+)
+
+type testValue struct {
+	Name string
+}
+
+func newTestStore(t *testing.T) (storage.Store, string) {
+	store, err := NewStore("http://127.0.0.1:2379", false)
+	if err != nil {
+		t.Fatalf("Cannot create the etcd v3 store, %s", err)
+	}
+	root := fmt.Sprintf("/lain/deployd/test/%d", time.Now().UnixNano())
+	return store, root
+}
+
+func TestChildKeys(t *testing.T) {
+	keys := childKeys("/lain/deployd/pod_groups", []string{
+		"/lain/deployd/pod_groups/hello/hello.web.web",
+		"/lain/deployd/pod_groups/hello/hello.worker.foo",
+		"/lain/deployd/pod_groups/world",
+		"/lain/deployd/pod_groups/world/world.web.web",
+		"/lain/deployd/pod_groups_backup/hello",
+	})
+	if len(keys) != 2 || keys[0] != "/lain/deployd/pod_groups/hello" || keys[1] != "/lain/deployd/pod_groups/world" {
+		t.Errorf("Should only get the direct children, but got %v", keys)
+	}
+}
+
+func TestGetSet(t *testing.T) {
+	store, root := newTestStore(t)
+	defer store.RemoveDir(root)
+	if err := store.Set(root+"/hello/hello.web.web", testValue{"web"}); err != nil {
+		t.Fatalf("Should be able to set the key, %s", err)
+	}
+	var v testValue
+	if err := store.Get(root+"/hello/hello.web.web", &v); err != nil || v.Name != "web" {
+		t.Errorf("Should get the same value back, v=%+v, err=%v", v, err)
+	}
+	if err := store.Get(root+"/hello/hello.web.foo", &v); err != storage.KMissingError {
+		t.Errorf("Should get the missing error, but got %v", err)
+	}
+	if err := store.Get(root+"/hello", &v); err != storage.KDirNodeError {
+		t.Errorf("Should get the dir node error, but got %v", err)
+	}
+	if err := store.Remove(root + "/hello"); err != storage.KDirNodeError {
+		t.Errorf("Should not be able to remove a directory as a key, but got %v", err)
+	}
+}
+
+func TestKeysByPrefix(t *testing.T) {
+	store, root := newTestStore(t)
+	defer store.RemoveDir(root)
+	store.Set(root+"/hello/hello.web.web", testValue{"web"})
+	store.Set(root+"/hello/hello.worker.foo", testValue{"foo"})
+	store.Set(root+"/world/world.web.web", testValue{"web"})
+
+	if keys, err := store.KeysByPrefix(root); err != nil || len(keys) != 2 {
+		t.Errorf("Should get the 2 namespaces, keys=%v, err=%v", keys, err)
+	}
+	if _, err := store.KeysByPrefix(root + "/hello/hello.web.web"); err != storage.KNonDirNodeError {
+		t.Errorf("Should get the non-directory error, but got %v", err)
+	}
+	if err := store.RemoveDir(root + "/hello"); err != nil {
+		t.Errorf("Should be able to remove the directory recursively, %s", err)
+	}
+	if _, err := store.KeysByPrefix(root + "/hello"); err != storage.KMissingError {
+		t.Errorf("Should get the missing error after the directory removed, but got %v", err)
+	}
+}
+
+func TestSetWithTTL(t *testing.T) {
+	store, root := newTestStore(t)
+	defer store.RemoveDir(root)
+	if err := store.SetWithTTL(root+"/operating", struct{}{}, 1, true); err != nil {
+		t.Fatalf("Should be able to set the key with ttl, %s", err)
+	}
+	if _, err := store.GetRaw(root + "/operating"); err != nil {
+		t.Errorf("Should get the key before expired, %s", err)
+	}
+	time.Sleep(2500 * time.Millisecond)
+	if _, err := store.GetRaw(root + "/operating"); err != storage.KMissingError {
+		t.Errorf("Should get the missing error after the lease expired, but got %v", err)
+	}
+}
+
+func TestWatch(t *testing.T) {
+	store, root := newTestStore(t)
+	defer store.RemoveDir(root)
+	ctx, cancel := context.WithCancel(context.Background())
+	ch := store.Watch(ctx, root+"/config")
+	store.Set(root+"/config/resources", testValue{"resources"})
+	store.Set(root+"/configx", testValue{"other"})
+	store.Set(root+"/config/guardswitch", testValue{"guard"})
+	store.Remove(root + "/config/resources")
+
+	expects := []storage.WatchEvent{
+		{Key: root + "/config/resources", Value: `{"Name":"resources"}`, Action: storage.WatchActionSet},
+		{Key: root + "/config/guardswitch", Value: `{"Name":"guard"}`, Action: storage.WatchActionSet},
+		{Key: root + "/config/resources", Action: storage.WatchActionDelete},
+	}
+	for _, expect := range expects {
+		select {
+		case event := <-ch:
+			if event.Key != expect.Key || event.Value != expect.Value || event.Action != expect.Action || event.Revision == 0 {
+				t.Errorf("Should get the watched event %+v, but got %+v", expect, event)
+			}
+		case <-time.After(time.Second):
+			t.Fatalf("Should get the watched event %+v, but timeout", expect)
+		}
+	}
+
+	cancel()
+	select {
+	case event, ok := <-ch:
+		if ok {
+			t.Errorf("Should not get any more event, but got %+v", event)
+		}
+	case <-time.After(time.Second):
+		t.Errorf("The channel should be closed after the context canceled")
+	}
+}
+
+func TestCompareAndSwap(t *testing.T) {
+	store, root := newTestStore(t)
+	defer store.RemoveDir(root)
+	version, err := store.SetIfAbsent(root+"/ports/9001", testValue{"hello"}, 0)
+	if err != nil || version == 0 {
+		t.Fatalf("Should be able to set the absent key, version=%d, err=%v", version, err)
+	}
+	if _, err := store.SetIfAbsent(root+"/ports/9001", testValue{"world"}, 0); err != storage.KKeyExistsError {
+		t.Errorf("Should get the key exists error, but got %v", err)
+	}
+
+	var v testValue
+	if current, err := store.GetWithVersion(root+"/ports/9001", &v); err != nil || current != version || v.Name != "hello" {
+		t.Errorf("Should get the value with version %d, but got %d, %+v, err=%v", version, current, v, err)
+	}
+	newVersion, err := store.SetIfVersion(root+"/ports/9001", testValue{"world"}, version)
+	if err != nil || newVersion <= version {
+		t.Fatalf("Should be able to set the key at the version, version=%d, err=%v", newVersion, err)
+	}
+	if _, err := store.SetIfVersion(root+"/ports/9001", testValue{"foo"}, version); err != storage.KVersionError {
+		t.Errorf("Should get the version error with the stale version, but got %v", err)
+	}
+	if _, err := store.SetIfVersion(root+"/ports/9002", testValue{"foo"}, 0); err != nil {
+		t.Errorf("Should be able to set the absent key with version 0, %s", err)
+	}
+	if same, err := store.SetIfVersion(root+"/ports/9001", testValue{"world"}, newVersion); err != nil || same != newVersion {
+		t.Errorf("The same value without force should be skipped, version=%d, err=%v", same, err)
+	}
+}
+
+func TestCommit(t *testing.T) {
+	store, root := newTestStore(t)
+	defer store.RemoveDir(root)
+	version, _ := store.SetIfAbsent(root+"/ports/9001", testValue{"hello"}, 0)
+
+	txn := storage.NewTxn().IfAbsent(root+"/ports/9002").IfAbsent(root+"/ports/9001").
+		Set(root+"/ports/9002", testValue{"world"}).
+		Set(root+"/ports/9001", testValue{"world"})
+	if err := store.Commit(txn); err != storage.KTxnFailedError {
+		t.Errorf("Should get the txn failed error, but got %v", err)
+	}
+	if _, err := store.GetRaw(root + "/ports/9002"); err != storage.KMissingError {
+		t.Errorf("Nothing should be written by the failed txn, but got %v", err)
+	}
+
+	txn = storage.NewTxn().IfVersion(root+"/ports/9001", version).
+		Set(root+"/ports/9002", testValue{"world"}).
+		Remove(root + "/ports/9001").
+		Remove(root + "/ports/9003")
+	if err := store.Commit(txn); err != nil {
+		t.Fatalf("Should be able to commit the txn, %s", err)
+	}
+	if keys, _ := store.KeysByPrefix(root + "/ports"); len(keys) != 1 || keys[0] != root+"/ports/9002" {
+		t.Errorf("All the operations should be applied, but got %v", keys)
+	}
+}
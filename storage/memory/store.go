@@ -0,0 +1,444 @@
+package memory
+
+import (
+	"encoding/json"
+	"hash/fnv"
+	"path"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/laincloud/deployd/storage"
+	"golang.org/x/net/context"
+)
+
+// node is a single entry in the key space, it mimics the etcd v2 node, which is either
+// a directory or a leaf with value.
+type node struct {
+	dir     bool
+	value   string
+	version uint64
+	timer   *time.Timer
+}
+
+type watcher struct {
+	prefix string
+	ctx    context.Context
+	ch     chan storage.WatchEvent
+
+	sync.Mutex
+	queue  []storage.WatchEvent
+	notify chan struct{}
+}
+
+func (w *watcher) push(event storage.WatchEvent) {
+	w.Lock()
+	w.queue = append(w.queue, event)
+	w.Unlock()
+	select {
+	case w.notify <- struct{}{}:
+	default:
+	}
+}
+
+// pump delivers the queued events in order, so a slow reader would never block the writers
+func (w *watcher) pump() {
+	defer close(w.ch)
+	for {
+		select {
+		case <-w.ctx.Done():
+			return
+		case <-w.notify:
+		}
+		w.Lock()
+		events := w.queue
+		w.queue = nil
+		w.Unlock()
+		for _, event := range events {
+			select {
+			case w.ch <- event:
+			case <-w.ctx.Done():
+				return
+			}
+		}
+	}
+}
+
+// MemoryStore keeps all the data in process, with the same directory semantics as the etcd v2 store.
+// It is used for the tests and single node runs which have no etcd cluster around.
+type MemoryStore struct {
+	sync.RWMutex
+	nodes     map[string]*node
+	keyHashes map[string]uint64
+	watchers  []*watcher
+	index     uint64
+}
+
+func (store *MemoryStore) GetRaw(key string) (string, error) {
+	key = cleanKey(key)
+	store.RLock()
+	defer store.RUnlock()
+	n, ok := store.nodes[key]
+	if !ok {
+		return "", storage.KMissingError
+	}
+	if n.dir {
+		return "", storage.KDirNodeError
+	}
+	return n.value, nil
+}
+
+func (store *MemoryStore) Get(key string, v interface{}) error {
+	value, err := store.GetRaw(key)
+	if err != nil {
+		return err
+	}
+	if err := json.Unmarshal([]byte(value), v); err != nil {
+		return err
+	}
+	return nil
+}
+
+func (store *MemoryStore) Watch(ctx context.Context, key string) <-chan storage.WatchEvent {
+	w := &watcher{
+		prefix: cleanKey(key),
+		ctx:    ctx,
+		ch:     make(chan storage.WatchEvent),
+		notify: make(chan struct{}, 1),
+	}
+	go w.pump()
+	store.Lock()
+	store.watchers = append(store.watchers, w)
+	store.Unlock()
+	go func() {
+		<-ctx.Done()
+		store.Lock()
+		defer store.Unlock()
+		for i, watcher := range store.watchers {
+			if watcher == w {
+				store.watchers = append(store.watchers[:i], store.watchers[i+1:]...)
+				break
+			}
+		}
+	}()
+	return w.ch
+}
+
+func (store *MemoryStore) KeysByPrefix(prefix string) ([]string, error) {
+	// Prefix should corresponding to a directory name, and will return all the nodes inside the directory
+	prefix = cleanKey(prefix)
+	keys := make([]string, 0)
+	store.RLock()
+	defer store.RUnlock()
+	n, ok := store.nodes[prefix]
+	if !ok {
+		return keys, storage.KMissingError
+	}
+	if !n.dir {
+		return keys, storage.KNonDirNodeError
+	}
+	keys = store.children(prefix)
+	return keys, nil
+}
+
+func (store *MemoryStore) Set(key string, v interface{}, force ...bool) error {
+	return store.SetWithTTL(key, v, -1, force...)
+}
+
+func (store *MemoryStore) SetWithTTL(key string, v interface{}, ttlSec int, force ...bool) error {
+	data, err := storage.Marshal(v)
+	if err != nil {
+		return err
+	}
+	key = cleanKey(key)
+	dataHash := hashData(data)
+	forceSave := false
+	if len(force) > 0 {
+		forceSave = force[0]
+	}
+
+	store.Lock()
+	defer store.Unlock()
+	if !forceSave {
+		if lastHash, ok := store.keyHashes[key]; ok && lastHash == dataHash {
+			return nil
+		}
+	}
+	_, err = store.setNode(key, string(data), ttlSec)
+	return err
+}
+
+func (store *MemoryStore) GetWithVersion(key string, v interface{}) (uint64, error) {
+	key = cleanKey(key)
+	store.RLock()
+	n, ok := store.nodes[key]
+	store.RUnlock()
+	if !ok {
+		return 0, storage.KMissingError
+	}
+	if n.dir {
+		return 0, storage.KDirNodeError
+	}
+	if err := json.Unmarshal([]byte(n.value), v); err != nil {
+		return 0, err
+	}
+	return n.version, nil
+}
+
+func (store *MemoryStore) SetIfAbsent(key string, v interface{}, ttlSec int) (uint64, error) {
+	data, err := storage.Marshal(v)
+	if err != nil {
+		return 0, err
+	}
+	key = cleanKey(key)
+	store.Lock()
+	defer store.Unlock()
+	if _, ok := store.nodes[key]; ok {
+		return 0, storage.KKeyExistsError
+	}
+	return store.setNode(key, string(data), ttlSec)
+}
+
+func (store *MemoryStore) SetIfVersion(key string, v interface{}, version uint64, force ...bool) (uint64, error) {
+	data, err := storage.Marshal(v)
+	if err != nil {
+		return 0, err
+	}
+	key = cleanKey(key)
+	dataHash := hashData(data)
+	forceSave := false
+	if len(force) > 0 {
+		forceSave = force[0]
+	}
+
+	store.Lock()
+	defer store.Unlock()
+	if !store.versionMatch(key, version) {
+		return 0, storage.KVersionError
+	}
+	if !forceSave && version > 0 {
+		if lastHash, ok := store.keyHashes[key]; ok && lastHash == dataHash {
+			return version, nil
+		}
+	}
+	return store.setNode(key, string(data), -1)
+}
+
+func (store *MemoryStore) Commit(txn *storage.Txn) error {
+	values := make([]string, len(txn.Ops))
+	for i, op := range txn.Ops {
+		if op.Type == storage.TxnOpSet {
+			data, err := storage.Marshal(op.Value)
+			if err != nil {
+				return err
+			}
+			values[i] = string(data)
+		}
+	}
+
+	store.Lock()
+	defer store.Unlock()
+	for _, cond := range txn.Conditions {
+		if !store.versionMatch(cleanKey(cond.Key), cond.Version) {
+			return storage.KTxnFailedError
+		}
+	}
+	// check all the operations before applying any of them
+	for _, op := range txn.Ops {
+		key := cleanKey(op.Key)
+		if n, ok := store.nodes[key]; ok && n.dir {
+			return storage.KDirNodeError
+		}
+		for dir := path.Dir(key); dir != "/"; dir = path.Dir(dir) {
+			if n, ok := store.nodes[dir]; ok && !n.dir {
+				return storage.KNonDirNodeError
+			}
+		}
+	}
+	for i, op := range txn.Ops {
+		key := cleanKey(op.Key)
+		switch op.Type {
+		case storage.TxnOpSet:
+			store.setNode(key, values[i], op.TTLSec)
+		case storage.TxnOpRemove:
+			if n, ok := store.nodes[key]; ok {
+				store.removeNode(key, n, storage.WatchActionDelete)
+			}
+		}
+	}
+	return nil
+}
+
+// versionMatch checks the version of the key, must be called with the lock held
+func (store *MemoryStore) versionMatch(key string, version uint64) bool {
+	n, ok := store.nodes[key]
+	if version == 0 {
+		return !ok
+	}
+	return ok && !n.dir && n.version == version
+}
+
+// setNode writes the leaf node and returns its new version, must be called with the lock held
+func (store *MemoryStore) setNode(key string, value string, ttlSec int) (uint64, error) {
+	if n, ok := store.nodes[key]; ok && n.dir {
+		return 0, storage.KDirNodeError
+	}
+	if err := store.mkdirs(path.Dir(key)); err != nil {
+		return 0, err
+	}
+	if n, ok := store.nodes[key]; ok && n.timer != nil {
+		n.timer.Stop()
+	}
+	store.index++
+	n := &node{value: value, version: store.index}
+	if ttlSec > 0 {
+		n.timer = time.AfterFunc(time.Duration(ttlSec)*time.Second, func() {
+			store.expire(key, n)
+		})
+	}
+	store.nodes[key] = n
+	store.keyHashes[key] = hashData([]byte(value))
+	store.notify(storage.WatchEvent{Key: key, Value: value, Action: storage.WatchActionSet, Revision: n.version})
+	return n.version, nil
+}
+
+func (store *MemoryStore) Remove(key string) error {
+	key = cleanKey(key)
+	store.Lock()
+	defer store.Unlock()
+	n, ok := store.nodes[key]
+	if !ok {
+		return storage.KMissingError
+	}
+	if n.dir {
+		return storage.KDirNodeError
+	}
+	store.removeNode(key, n, storage.WatchActionDelete)
+	return nil
+}
+
+func (store *MemoryStore) RemoveDir(key string) error {
+	return store.deleteDir(key, true)
+}
+
+func (store *MemoryStore) TryRemoveDir(key string) {
+	store.deleteDir(key, false)
+}
+
+func (store *MemoryStore) deleteDir(key string, recursive bool) error {
+	key = cleanKey(key)
+	store.Lock()
+	defer store.Unlock()
+	n, ok := store.nodes[key]
+	if !ok {
+		return storage.KMissingError
+	}
+	if !n.dir {
+		return storage.KNonDirNodeError
+	}
+	if !recursive && len(store.children(key)) > 0 {
+		// etcd refuses to delete a non-empty directory without the recursive flag
+		return storage.KDirNodeError
+	}
+	store.deleteTree(key)
+	return nil
+}
+
+// deleteTree removes the directory and everything inside, must be called with the lock held
+func (store *MemoryStore) deleteTree(key string) {
+	for _, child := range store.children(key) {
+		if store.nodes[child].dir {
+			store.deleteTree(child)
+		} else {
+			store.removeNode(child, store.nodes[child], storage.WatchActionDelete)
+		}
+	}
+	if key != "/" {
+		delete(store.nodes, key)
+	}
+}
+
+// removeNode removes a leaf node, must be called with the lock held
+func (store *MemoryStore) removeNode(key string, n *node, action storage.WatchAction) {
+	if n.timer != nil {
+		n.timer.Stop()
+	}
+	delete(store.nodes, key)
+	delete(store.keyHashes, key)
+	store.index++
+	store.notify(storage.WatchEvent{Key: key, Action: action, Revision: store.index})
+}
+
+func (store *MemoryStore) expire(key string, n *node) {
+	store.Lock()
+	defer store.Unlock()
+	// the node may have been overwritten or removed before the timer fired
+	if current, ok := store.nodes[key]; ok && current == n {
+		store.removeNode(key, n, storage.WatchActionExpire)
+	}
+}
+
+// mkdirs creates all the directories along the key, must be called with the lock held
+func (store *MemoryStore) mkdirs(key string) error {
+	if n, ok := store.nodes[key]; ok {
+		if !n.dir {
+			return storage.KNonDirNodeError
+		}
+		return nil
+	}
+	if key != "/" {
+		if err := store.mkdirs(path.Dir(key)); err != nil {
+			return err
+		}
+	}
+	store.nodes[key] = &node{dir: true}
+	return nil
+}
+
+// children returns the direct children keys of the directory, must be called with the lock held
+func (store *MemoryStore) children(dir string) []string {
+	prefix := dir + "/"
+	if dir == "/" {
+		prefix = dir
+	}
+	keys := make([]string, 0)
+	for key := range store.nodes {
+		if key == dir || !strings.HasPrefix(key, prefix) {
+			continue
+		}
+		if !strings.Contains(strings.TrimPrefix(key, prefix), "/") {
+			keys = append(keys, key)
+		}
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// notify sends the event to all the recursive watchers, must be called with the lock held
+func (store *MemoryStore) notify(event storage.WatchEvent) {
+	for _, w := range store.watchers {
+		if event.Key == w.prefix || strings.HasPrefix(event.Key, w.prefix+"/") || w.prefix == "/" {
+			w.push(event)
+		}
+	}
+}
+
+func hashData(data []byte) uint64 {
+	h := fnv.New64a()
+	h.Write(data)
+	return h.Sum64()
+}
+
+func cleanKey(key string) string {
+	return path.Clean("/" + key)
+}
+
+func NewStore() storage.Store {
+	s := &MemoryStore{
+		nodes:     make(map[string]*node),
+		keyHashes: make(map[string]uint64),
+	}
+	s.nodes["/"] = &node{dir: true}
+	return s
+}
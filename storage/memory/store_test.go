@@ -0,0 +1,207 @@
+package memory
+
+import (
+	"testing"
+	"time"
+
+	"github.com/laincloud/deployd/storage"
+	"golang.org/x/net/context"
+)
+
+type testValue struct {
+	Name string
+}
+
+func TestGetSet(t *testing.T) {
+	store := NewStore()
+	if err := store.Set("/lain/deployd/pod_groups/hello/hello.web.web", testValue{"web"}); err != nil {
+		t.Fatalf("Should be able to set the key, %s", err)
+	}
+	var v testValue
+	if err := store.Get("/lain/deployd/pod_groups/hello/hello.web.web", &v); err != nil {
+		t.Fatalf("Should be able to get the key back, %s", err)
+	}
+	if v.Name != "web" {
+		t.Errorf("Should get the same value back, but got %+v", v)
+	}
+	if raw, err := store.GetRaw("/lain/deployd/pod_groups/hello/hello.web.web"); err != nil || raw != `{"Name":"web"}` {
+		t.Errorf("Should get the raw json back, raw=%q, err=%v", raw, err)
+	}
+	if err := store.Get("/lain/deployd/pod_groups/hello/hello.web.foo", &v); err != storage.KMissingError {
+		t.Errorf("Should get the missing error, but got %v", err)
+	}
+	if err := store.Get("/lain/deployd/pod_groups/hello", &v); err != storage.KDirNodeError {
+		t.Errorf("Should get the dir node error, but got %v", err)
+	}
+	if err := store.Set("/lain/deployd/pod_groups/hello/hello.web.web/1", testValue{"web"}); err != storage.KNonDirNodeError {
+		t.Errorf("Should not be able to set key under a non-directory node, but got %v", err)
+	}
+	if err := store.Set("/lain/deployd/pod_groups/hello", testValue{"web"}); err != storage.KDirNodeError {
+		t.Errorf("Should not be able to overwrite a directory node, but got %v", err)
+	}
+}
+
+func TestKeysByPrefix(t *testing.T) {
+	store := NewStore()
+	store.Set("/lain/deployd/pod_groups/hello/hello.web.web", testValue{"web"})
+	store.Set("/lain/deployd/pod_groups/hello/hello.worker.foo", testValue{"foo"})
+	store.Set("/lain/deployd/pod_groups/world/world.web.web", testValue{"web"})
+
+	keys, err := store.KeysByPrefix("/lain/deployd/pod_groups")
+	if err != nil {
+		t.Fatalf("Should be able to list the directory, %s", err)
+	}
+	if len(keys) != 2 || keys[0] != "/lain/deployd/pod_groups/hello" || keys[1] != "/lain/deployd/pod_groups/world" {
+		t.Errorf("Should only get the direct children, but got %v", keys)
+	}
+	keys, err = store.KeysByPrefix("/lain/deployd/pod_groups/hello")
+	if err != nil || len(keys) != 2 {
+		t.Errorf("Should get 2 pod groups in namespace hello, keys=%v, err=%v", keys, err)
+	}
+	if _, err := store.KeysByPrefix("/lain/deployd/pod_groups/hello/hello.web.web"); err != storage.KNonDirNodeError {
+		t.Errorf("Should get the non-directory error, but got %v", err)
+	}
+	if _, err := store.KeysByPrefix("/lain/deployd/depends"); err != storage.KMissingError {
+		t.Errorf("Should get the missing error, but got %v", err)
+	}
+
+	store.Remove("/lain/deployd/pod_groups/world/world.web.web")
+	if keys, err := store.KeysByPrefix("/lain/deployd/pod_groups/world"); err != nil || len(keys) != 0 {
+		t.Errorf("The directory should be kept after the last key removed, keys=%v, err=%v", keys, err)
+	}
+	store.TryRemoveDir("/lain/deployd/pod_groups/world")
+	if _, err := store.KeysByPrefix("/lain/deployd/pod_groups/world"); err != storage.KMissingError {
+		t.Errorf("The empty directory should be removed, but got %v", err)
+	}
+	store.TryRemoveDir("/lain/deployd/pod_groups/hello")
+	if keys, _ := store.KeysByPrefix("/lain/deployd/pod_groups/hello"); len(keys) != 2 {
+		t.Errorf("The non-empty directory should not be removed without recursive, keys=%v", keys)
+	}
+	if err := store.RemoveDir("/lain/deployd/pod_groups"); err != nil {
+		t.Errorf("Should be able to remove the directory recursively, %s", err)
+	}
+	if _, err := store.GetRaw("/lain/deployd/pod_groups/hello/hello.web.web"); err != storage.KMissingError {
+		t.Errorf("Keys inside the removed directory should be missing, but got %v", err)
+	}
+}
+
+func TestSetWithTTL(t *testing.T) {
+	store := NewStore()
+	if err := store.SetWithTTL("/lain/deployd/operating/hello.web.web", struct{}{}, 1, true); err != nil {
+		t.Fatalf("Should be able to set the key with ttl, %s", err)
+	}
+	if _, err := store.GetRaw("/lain/deployd/operating/hello.web.web"); err != nil {
+		t.Errorf("Should get the key before expired, %s", err)
+	}
+	time.Sleep(1500 * time.Millisecond)
+	if _, err := store.GetRaw("/lain/deployd/operating/hello.web.web"); err != storage.KMissingError {
+		t.Errorf("Should get the missing error after expired, but got %v", err)
+	}
+
+	store.SetWithTTL("/lain/deployd/operating/hello.web.foo", struct{}{}, 1, true)
+	store.Set("/lain/deployd/operating/hello.web.foo", struct{}{}, true)
+	time.Sleep(1500 * time.Millisecond)
+	if _, err := store.GetRaw("/lain/deployd/operating/hello.web.foo"); err != nil {
+		t.Errorf("Overwritten key should not be expired by the old ttl, %s", err)
+	}
+}
+
+func TestWatch(t *testing.T) {
+	store := NewStore()
+	ctx, cancel := context.WithCancel(context.Background())
+	ch := store.Watch(ctx, "/lain/config")
+	store.Set("/lain/config/resources", testValue{"resources"})
+	store.Set("/lain/deployd/engine/config", testValue{"engine"})
+	store.Set("/lain/config/guardswitch", testValue{"guard"})
+	store.Set("/lain/config/guardswitch", testValue{"guard"}) // same value without force would be skipped
+	store.Remove("/lain/config/resources")
+	store.SetWithTTL("/lain/config/operating", struct{}{}, 1)
+
+	expects := []storage.WatchEvent{
+		{Key: "/lain/config/resources", Value: `{"Name":"resources"}`, Action: storage.WatchActionSet},
+		{Key: "/lain/config/guardswitch", Value: `{"Name":"guard"}`, Action: storage.WatchActionSet},
+		{Key: "/lain/config/resources", Action: storage.WatchActionDelete},
+		{Key: "/lain/config/operating", Value: "{}", Action: storage.WatchActionSet},
+		{Key: "/lain/config/operating", Action: storage.WatchActionExpire},
+	}
+	var lastRevision uint64
+	for _, expect := range expects {
+		select {
+		case event := <-ch:
+			if event.Key != expect.Key || event.Value != expect.Value || event.Action != expect.Action || event.Err != nil {
+				t.Errorf("Should get the watched event %+v, but got %+v", expect, event)
+			}
+			if event.Revision <= lastRevision {
+				t.Errorf("Revision of the events should be increasing, but got %d after %d", event.Revision, lastRevision)
+			}
+			lastRevision = event.Revision
+		case <-time.After(2 * time.Second):
+			t.Fatalf("Should get the watched event %+v, but timeout", expect)
+		}
+	}
+
+	cancel()
+	select {
+	case event, ok := <-ch:
+		if ok {
+			t.Errorf("Should not get any more event, but got %+v", event)
+		}
+	case <-time.After(time.Second):
+		t.Errorf("The channel should be closed after the context canceled")
+	}
+}
+
+func TestCompareAndSwap(t *testing.T) {
+	store := NewStore()
+	version, err := store.SetIfAbsent("/lain/deployd/stream/ports/9001", testValue{"hello"}, 0)
+	if err != nil || version == 0 {
+		t.Fatalf("Should be able to set the absent key, version=%d, err=%v", version, err)
+	}
+	if _, err := store.SetIfAbsent("/lain/deployd/stream/ports/9001", testValue{"world"}, 0); err != storage.KKeyExistsError {
+		t.Errorf("Should get the key exists error, but got %v", err)
+	}
+
+	var v testValue
+	if current, err := store.GetWithVersion("/lain/deployd/stream/ports/9001", &v); err != nil || current != version || v.Name != "hello" {
+		t.Errorf("Should get the value with version %d, but got %d, %+v, err=%v", version, current, v, err)
+	}
+	newVersion, err := store.SetIfVersion("/lain/deployd/stream/ports/9001", testValue{"world"}, version)
+	if err != nil || newVersion <= version {
+		t.Fatalf("Should be able to set the key at the version, version=%d, err=%v", newVersion, err)
+	}
+	if _, err := store.SetIfVersion("/lain/deployd/stream/ports/9001", testValue{"foo"}, version); err != storage.KVersionError {
+		t.Errorf("Should get the version error with the stale version, but got %v", err)
+	}
+	if _, err := store.SetIfVersion("/lain/deployd/stream/ports/9002", testValue{"foo"}, 0); err != nil {
+		t.Errorf("Should be able to set the absent key with version 0, %s", err)
+	}
+	if same, err := store.SetIfVersion("/lain/deployd/stream/ports/9001", testValue{"world"}, newVersion); err != nil || same != newVersion {
+		t.Errorf("The same value without force should be skipped, version=%d, err=%v", same, err)
+	}
+}
+
+func TestCommit(t *testing.T) {
+	store := NewStore()
+	version, _ := store.SetIfAbsent("/lain/deployd/stream/ports/9001", testValue{"hello"}, 0)
+
+	txn := storage.NewTxn().IfAbsent("/lain/deployd/stream/ports/9002").IfAbsent("/lain/deployd/stream/ports/9001").
+		Set("/lain/deployd/stream/ports/9002", testValue{"world"}).
+		Set("/lain/deployd/stream/ports/9001", testValue{"world"})
+	if err := store.Commit(txn); err != storage.KTxnFailedError {
+		t.Errorf("Should get the txn failed error, but got %v", err)
+	}
+	if _, err := store.GetRaw("/lain/deployd/stream/ports/9002"); err != storage.KMissingError {
+		t.Errorf("Nothing should be written by the failed txn, but got %v", err)
+	}
+
+	txn = storage.NewTxn().IfVersion("/lain/deployd/stream/ports/9001", version).
+		Set("/lain/deployd/stream/ports/9002", testValue{"world"}).
+		Remove("/lain/deployd/stream/ports/9001").
+		Remove("/lain/deployd/stream/ports/9003")
+	if err := store.Commit(txn); err != nil {
+		t.Fatalf("Should be able to commit the txn, %s", err)
+	}
+	if keys, _ := store.KeysByPrefix("/lain/deployd/stream/ports"); len(keys) != 1 || keys[0] != "/lain/deployd/stream/ports/9002" {
+		t.Errorf("All the operations should be applied, but got %v", keys)
+	}
+}
@@ -1,7 +1,10 @@
 package storage
 
 import (
+	"encoding/json"
 	"errors"
+
+	"golang.org/x/net/context"
 )
 
 var (
@@ -9,6 +12,11 @@ var (
 	KNilNodeError    = errors.New("Etcd Store returns a nil node")
 	KDirNodeError    = errors.New("Etcd Store returns this is a directory node")
 	KNonDirNodeError = errors.New("Etcd Store returns this is a non-directory node")
+	KKeyExistsError  = errors.New("Key already exists")
+	KVersionError    = errors.New("Key version does not match")
+	KTxnFailedError  = errors.New("Transaction conditions are not satisfied")
+
+	KWatchCompactedError = errors.New("Watched revision has been compacted")
 )
 
 type Store interface {
@@ -16,9 +24,34 @@ type Store interface {
 	GetRaw(key string) (string, error)
 	Set(key string, v interface{}, force ...bool) error
 	SetWithTTL(key string, v interface{}, ttlSec int, force ...bool) error
-	Watch(key string) chan string
+	// Watch watches the key and all the keys under it, the changes after Watch returned will be delivered in
+	// order and the watcher resumes from the last revision after reconnected. The channel is closed after the
+	// context is done.
+	Watch(ctx context.Context, key string) <-chan WatchEvent
 	KeysByPrefix(prefix string) ([]string, error)
 	Remove(key string) error
 	TryRemoveDir(key string)
 	RemoveDir(key string) error
+
+	// GetWithVersion returns the version of the key as well, which changes on every write of the key
+	GetWithVersion(key string, v interface{}) (uint64, error)
+	// SetIfAbsent writes the key only if it does not exist, returns KKeyExistsError otherwise
+	SetIfAbsent(key string, v interface{}, ttlSec int) (uint64, error)
+	// SetIfVersion writes the key only if it is still at the version, version 0 means the key should not exist,
+	// returns KVersionError otherwise
+	SetIfVersion(key string, v interface{}, version uint64, force ...bool) (uint64, error)
+	// Commit writes all the operations of the transaction atomically if the conditions hold,
+	// except on etcd v2 which only rolls back the partial writes on a best-effort basis
+	Commit(txn *Txn) error
+}
+
+// RawValue is written into the store as it is without the json encoding, e.g. the values restored from a backup
+type RawValue string
+
+// Marshal encodes the value to be written into the store
+func Marshal(v interface{}) ([]byte, error) {
+	if raw, ok := v.(RawValue); ok {
+		return []byte(raw), nil
+	}
+	return json.Marshal(v)
 }
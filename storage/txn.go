@@ -0,0 +1,59 @@
+package storage
+
+type TxnOpType int
+
+const (
+	TxnOpSet TxnOpType = iota
+	TxnOpRemove
+)
+
+// TxnCondition requires the key at the version, version 0 means the key should not exist
+type TxnCondition struct {
+	Key     string
+	Version uint64
+}
+
+type TxnOp struct {
+	Type   TxnOpType
+	Key    string
+	Value  interface{}
+	TTLSec int
+}
+
+// Txn is a batch of writes which will be committed by Store.Commit all together only if all the
+// conditions are satisfied, otherwise nothing will be written and KTxnFailedError returned.
+type Txn struct {
+	Conditions []TxnCondition
+	Ops        []TxnOp
+}
+
+func NewTxn() *Txn {
+	return &Txn{
+		Conditions: make([]TxnCondition, 0),
+		Ops:        make([]TxnOp, 0),
+	}
+}
+
+func (txn *Txn) IfAbsent(key string) *Txn {
+	return txn.IfVersion(key, 0)
+}
+
+func (txn *Txn) IfVersion(key string, version uint64) *Txn {
+	txn.Conditions = append(txn.Conditions, TxnCondition{Key: key, Version: version})
+	return txn
+}
+
+func (txn *Txn) Set(key string, v interface{}) *Txn {
+	return txn.SetWithTTL(key, v, -1)
+}
+
+func (txn *Txn) SetWithTTL(key string, v interface{}, ttlSec int) *Txn {
+	txn.Ops = append(txn.Ops, TxnOp{Type: TxnOpSet, Key: key, Value: v, TTLSec: ttlSec})
+	return txn
+}
+
+// Remove removes the key in the transaction, it is fine if the key does not exist
+func (txn *Txn) Remove(key string) *Txn {
+	txn.Ops = append(txn.Ops, TxnOp{Type: TxnOpRemove, Key: key})
+	return txn
+}
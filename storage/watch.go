@@ -0,0 +1,19 @@
+package storage
+
+type WatchAction string
+
+const (
+	WatchActionSet    WatchAction = "set"
+	WatchActionDelete WatchAction = "delete"
+	WatchActionExpire WatchAction = "expire"
+)
+
+// WatchEvent is a change of a key under the watched one, or an error of the watcher if Err is not nil.
+// KWatchCompactedError means some changes may be missed, the watcher should read the keys again.
+type WatchEvent struct {
+	Key      string
+	Value    string
+	Action   WatchAction
+	Revision uint64
+	Err      error
+}
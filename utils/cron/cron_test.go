@@ -0,0 +1,56 @@
+package cron
+
+import (
+	"testing"
+	"time"
+)
+
+func TestParse(t *testing.T) {
+	valid := []string{"* * * * *", "*/5 0-6,22 1,15 jan-mar mon-fri", "0 0 * * 7", "@daily", "30 2/4 * * *"}
+	for _, expr := range valid {
+		if _, err := Parse(expr); err != nil {
+			t.Errorf("Should parse %q, %s", expr, err)
+		}
+	}
+	invalid := []string{"", "* * * *", "60 * * * *", "* 24 * * *", "* * 0 * *", "5-1 * * * *", "*/0 * * * *", "* * * foo *"}
+	for _, expr := range invalid {
+		if _, err := Parse(expr); err == nil {
+			t.Errorf("Should not parse %q", expr)
+		}
+	}
+}
+
+func TestNext(t *testing.T) {
+	shanghai, err := time.LoadLocation("Asia/Shanghai")
+	if err != nil {
+		t.Fatalf("Should load the location, %s", err)
+	}
+	from := time.Date(2017, 6, 1, 10, 7, 30, 0, time.UTC) // a thursday
+	cases := []struct {
+		expr string
+		from time.Time
+		next time.Time
+	}{
+		{"* * * * *", from, time.Date(2017, 6, 1, 10, 8, 0, 0, time.UTC)},
+		{"*/15 * * * *", from, time.Date(2017, 6, 1, 10, 15, 0, 0, time.UTC)},
+		{"0 3 * * *", from, time.Date(2017, 6, 2, 3, 0, 0, 0, time.UTC)},
+		{"0 0 * * mon", from, time.Date(2017, 6, 5, 0, 0, 0, 0, time.UTC)},
+		{"0 0 1 * *", from, time.Date(2017, 7, 1, 0, 0, 0, 0, time.UTC)},
+		{"0 0 13 * fri", from, time.Date(2017, 6, 2, 0, 0, 0, 0, time.UTC)},
+		{"0 0 29 2 *", from, time.Date(2020, 2, 29, 0, 0, 0, 0, time.UTC)},
+		{"@hourly", time.Date(2017, 12, 31, 23, 0, 0, 0, time.UTC), time.Date(2018, 1, 1, 0, 0, 0, 0, time.UTC)},
+		{"0 2 * * *", from.In(shanghai), time.Date(2017, 6, 2, 2, 0, 0, 0, shanghai)},
+	}
+	for _, c := range cases {
+		s, err := Parse(c.expr)
+		if err != nil {
+			t.Fatalf("Should parse %q, %s", c.expr, err)
+		}
+		if next := s.Next(c.from); !next.Equal(c.next) {
+			t.Errorf("Should run %q next at %s, got %s", c.expr, c.next, next)
+		}
+	}
+	if s, _ := Parse("0 0 31 2 *"); !s.Next(from).IsZero() {
+		t.Errorf("Should not find the next time of the impossible date")
+	}
+}
@@ -1,6 +1,7 @@
 package elector
 
 import (
+	"github.com/coreos/etcd/clientv3"
 	"github.com/docker/libkv"
 	"github.com/docker/libkv/store"
 	etcdLibkv "github.com/docker/libkv/store/etcd"
@@ -15,7 +16,8 @@ const (
 )
 
 type Elector struct {
-	store  store.Store
+	store  store.Store      // etcd v2 by libkv
+	client *clientv3.Client // etcd v3
 	key    string
 	value  string
 	ttl    time.Duration
@@ -48,8 +50,13 @@ func New(etcds []string, key string, value string) (*Elector, error) {
 func (e *Elector) Run(stop chan struct{}) chan string {
 	stopWatchCh, leaderCh := make(chan struct{}), make(chan string)
 
-	go e.elect(stopWatchCh, stop)
-	go e.watch(leaderCh, stopWatchCh)
+	if e.client != nil {
+		go e.electV3(stopWatchCh, stop)
+		go e.watchV3(leaderCh, stopWatchCh)
+	} else {
+		go e.elect(stopWatchCh, stop)
+		go e.watch(leaderCh, stopWatchCh)
+	}
 
 	return leaderCh
 }
@@ -0,0 +1,145 @@
+package elector
+
+import (
+	"strings"
+	"time"
+
+	"github.com/coreos/etcd/clientv3"
+	"github.com/coreos/etcd/clientv3/concurrency"
+	"github.com/mijia/sweb/log"
+	"golang.org/x/net/context"
+)
+
+// NewV3 creates an elector on the etcd v3 api, the candidates campaign under the key as a prefix
+// and the one with the earliest created revision is the leader.
+func NewV3(etcds []string, key string, value string) (*Elector, error) {
+	c, err := clientv3.New(clientv3.Config{
+		Endpoints:   etcds,
+		DialTimeout: 5 * time.Second,
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &Elector{
+		client: c,
+		key:    key,
+		value:  value,
+		leader: false,
+		ttl:    defaultLockTTL,
+	}, nil
+}
+
+func (e *Elector) watchV3(leaderCh chan string, stop chan struct{}) {
+	defer close(leaderCh)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go func() {
+		<-stop
+		cancel()
+	}()
+
+	var (
+		current string = ""
+		lastRev int64
+	)
+	prefix := strings.TrimSuffix(e.key, "/") + "/"
+	for {
+		if resp, err := e.client.Get(ctx, prefix, clientv3.WithPrefix()); err != nil {
+			log.Warnf("Fail to get leader key[%s], %s, try again", e.key, err.Error())
+			select {
+			case <-stop:
+				return
+			case <-time.After(time.Second):
+			}
+			continue
+		} else {
+			lastRev = resp.Header.Revision
+			var leaderRev int64
+			value := ""
+			for _, kv := range resp.Kvs {
+				if leaderRev == 0 || kv.CreateRevision < leaderRev {
+					leaderRev, value = kv.CreateRevision, string(kv.Value)
+				}
+			}
+			log.Debugf("Get watch event, leader value changed to %s", value)
+			if current != value && value != "" {
+				current = value
+				leaderCh <- value
+			}
+		}
+
+		// wait for any changes of the candidates, then read the leader again
+		wctx, wcancel := context.WithCancel(ctx)
+		wch := e.client.Watch(wctx, prefix, clientv3.WithPrefix(), clientv3.WithRev(lastRev+1))
+		<-wch
+		wcancel()
+		select {
+		case <-stop: // real stop
+			return
+		default:
+		}
+	}
+}
+
+func (e *Elector) electV3(stopWatchCh chan struct{}, stop chan struct{}) {
+	defer close(stopWatchCh)
+	for {
+		e.leader = false
+		session, err := concurrency.NewSession(e.client, concurrency.WithTTL(int(e.ttl/time.Second)))
+		if err != nil {
+			log.Errorf("Fail to create election session, %s", err.Error())
+			select {
+			case <-stop:
+				return
+			case <-time.After(time.Second * 3):
+			}
+			continue
+		}
+
+		ctx, cancel := context.WithCancel(context.Background())
+		go func() {
+			select {
+			case <-stop:
+			case <-session.Done():
+			case <-ctx.Done():
+			}
+			cancel()
+		}()
+
+		log.Debug("Try to campaign for becoming a leader")
+		// follower will block here waiting for the earlier candidates gone
+		election := concurrency.NewElection(session, strings.TrimSuffix(e.key, "/"))
+		if err := election.Campaign(ctx, e.value); err != nil {
+			cancel()
+			session.Close()
+			select {
+			case <-stop:
+				log.Debug("Get a stop-signal, stop election routine")
+				return
+			default:
+			}
+			log.Errorf("Fail to campaign %s:%s", e.key, err.Error())
+			time.Sleep(time.Second * 3) // sleep for a while to try again
+			continue
+		}
+
+		log.Debug("Becomming a leader")
+		// leader will block here until it stoped or the session lost
+		e.leader = true
+		select {
+		case <-stop:
+			// stop election
+			log.Debug("Get a stop-signal, stop election routine")
+			if err := election.Resign(context.Background()); err != nil {
+				log.Errorf("Fail to give up the leader identity, %s", err.Error())
+			}
+			cancel()
+			session.Close()
+			return
+		case <-session.Done():
+			// lost the lease, try to elect again
+			cancel()
+		}
+	}
+}
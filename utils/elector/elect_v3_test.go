@@ -0,0 +1,48 @@
+package elector
+
+import (
+	"testing"
+	"time"
+)
+
+func TestRunElectionV3(t *testing.T) {
+	key := LeaderKey + "_v3_test"
+	e1, err := NewV3([]string{"http://127.0.0.1:2379"}, key, "127.0.0.1:2376")
+	if err != nil {
+		t.Fatalf("Cannot create the v3 elector, %s", err)
+	}
+	e2, err := NewV3([]string{"http://127.0.0.1:2379"}, key, "127.0.0.1:2377")
+	if err != nil {
+		t.Fatalf("Cannot create the v3 elector, %s", err)
+	}
+
+	stop1, stop2 := make(chan struct{}), make(chan struct{})
+	defer close(stop2)
+	ch1 := e1.Run(stop1)
+	if leader := waitLeader(t, ch1); leader != "127.0.0.1:2376" || !e1.IsLeader() {
+		t.Fatalf("The first candidate should be the leader, but got %s", leader)
+	}
+	ch2 := e2.Run(stop2)
+	if leader := waitLeader(t, ch2); leader != "127.0.0.1:2376" || e2.IsLeader() {
+		t.Errorf("The second candidate should follow the first one, but got %s", leader)
+	}
+
+	close(stop1)
+	if leader := waitLeader(t, ch2); leader != "127.0.0.1:2377" {
+		t.Errorf("The second candidate should take over the leadership, but got %s", leader)
+	}
+	time.Sleep(100 * time.Millisecond)
+	if !e2.IsLeader() {
+		t.Errorf("The second candidate should be the leader")
+	}
+}
+
+func waitLeader(t *testing.T, ch chan string) string {
+	select {
+	case leader := <-ch:
+		return leader
+	case <-time.After(5 * time.Second):
+		t.Fatalf("Should get the leader, but timeout")
+	}
+	return ""
+}